@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sync"
+)
+
+// Ways a room can be joined
+const (
+	accessPublic   = "public"   // anyone can join
+	accessPassword = "password" // joining needs the room's password
+	accessInvite   = "invite"   // joining needs an invite token; hidden from the room listing
+)
+
+// roomAccess controls who may join a room. It is read by HTTP handlers before
+// the client reaches the room goroutine, so it has its own lock.
+type roomAccess struct {
+	mu       sync.Mutex
+	mode     string
+	password [sha256.Size]byte
+	invites  map[string]bool
+	banned   map[string]bool
+}
+
+// Create the access rules of a room; password is only used by password rooms
+func newRoomAccess(mode, password string) (*roomAccess, error) {
+	a := &roomAccess{mode: mode, invites: make(map[string]bool)}
+	switch mode {
+	case "", accessPublic:
+		a.mode = accessPublic
+	case accessPassword:
+		if password == "" {
+			return nil, errors.New("a password room needs a password")
+		}
+		a.password = sha256.Sum256([]byte(password))
+	case accessInvite:
+	default:
+		return nil, errors.New("access must be public, password or invite")
+	}
+	return a, nil
+}
+
+// Report whether a client presenting the password or invite token may join
+func (a *roomAccess) admits(password, invite string) bool {
+	switch a.mode {
+	case accessPassword:
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(sum[:], a.password[:]) == 1
+	case accessInvite:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.invites[invite]
+	}
+	return true
+}
+
+// Issue an invite token, valid as long as the room is open
+func (a *roomAccess) invite() string {
+	token := newSessionID()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.invites[token] = true
+	return token
+}
+
+// Keep a user out of the room while it is open
+func (a *roomAccess) ban(username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.banned == nil {
+		a.banned = make(map[string]bool)
+	}
+	a.banned[username] = true
+}
+
+// Let a banned user back in
+func (a *roomAccess) unban(username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.banned, username)
+}
+
+// Report whether the user is banned from the room
+func (a *roomAccess) isBanned(username string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.banned[username]
+}
+
+// Report whether the room shows up in the room listing
+func (a *roomAccess) listed() bool {
+	return a.mode != accessInvite
+}
+
+// Save the room's access rules, so it keeps them once closed; invite tokens
+// aren't saved, as they only last while the room is open. Runs before the room starts.
+func (r *Room) saveAccess() {
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	var hash []byte
+	if r.access.mode == accessPassword {
+		hash = r.access.password[:]
+	}
+	if err := store.SaveAccess(ctx, r.name, r.access.mode, hash); err != nil {
+		r.logger().Error("Storage error", "err", err)
+	}
+}
+
+// Load the access rules saved for a room, public if it has none
+func loadAccess(ctx context.Context, room string) (*roomAccess, error) {
+	a := &roomAccess{mode: accessPublic, invites: make(map[string]bool)}
+	if store == nil {
+		return a, nil
+	}
+	mode, hash, err := store.LoadAccess(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case accessPassword:
+		if len(hash) != len(a.password) {
+			return nil, errors.New("saved password hash is malformed")
+		}
+		a.mode = mode
+		copy(a.password[:], hash)
+	case accessInvite:
+		a.mode = mode
+	}
+	return a, nil
+}
+
+// Get the access rules of a room: the open room's, else those saved for it
+func (h *Hub) accessOf(ctx context.Context, name string) (*roomAccess, error) {
+	if room, ok := h.lookup(name); ok {
+		return room.access, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return loadAccess(ctx, name)
+}
+
+// Load the room's saved access rules, before its goroutine starts
+func (r *Room) restoreAccess() {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	a, err := loadAccess(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	r.access = a
+}
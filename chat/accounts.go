@@ -0,0 +1,313 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"chat-app/internal/env"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Require registered accounts with passwords, from ACCOUNTS; needs STORAGE_DSN
+// to keep them and JWT_SECRET to sign their sessions. Without accounts anyone
+// may chat as any username the room hasn't taken.
+var accounts bool
+
+// account is a registered user
+type account struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	Avatar      string `json:"avatar,omitempty"` // URL of the user's picture
+	Created     int64  `json:"created"`          // unix milliseconds
+
+	passwordHash []byte
+}
+
+// profileUpdate changes an account; fields left out are kept
+type profileUpdate struct {
+	DisplayName *string `json:"display_name"`
+	Avatar      *string `json:"avatar"`
+	Password    *string `json:"password"`
+}
+
+const (
+	minPasswordLength  = 8
+	maxPasswordLength  = 72 // bcrypt ignores the rest
+	maxDisplayName     = 64
+	maxAvatarURLLength = 512
+)
+
+// Cookie keeping a browser's session token, sent along with its WebSocket upgrades
+const sessionCookie = "chat_session"
+
+var errAccountExists = errors.New("username is taken")
+
+// Turn accounts on from ACCOUNTS; call once the store and JWT secret are set up
+func configureAccounts() {
+	accounts = env.Bool("ACCOUNTS", false)
+	if accounts && (store == nil || jwtSecret == nil) {
+		fatal("ACCOUNTS needs STORAGE_DSN and JWT_SECRET")
+	}
+}
+
+// Check and apply a profile update
+func (a *account) update(u profileUpdate) error {
+	if u.DisplayName != nil {
+		if len(*u.DisplayName) > maxDisplayName || cleanText(*u.DisplayName) != *u.DisplayName {
+			return errors.New("the display name must be at most 64 bytes of text without control characters")
+		}
+		a.DisplayName = *u.DisplayName
+	}
+	if u.Avatar != nil {
+		if *u.Avatar != "" {
+			avatar, err := url.Parse(*u.Avatar)
+			if err != nil || len(*u.Avatar) > maxAvatarURLLength || (avatar.Scheme != "https" && avatar.Scheme != "http") || avatar.Host == "" {
+				return errors.New("the avatar must be an http or https URL of at most 512 bytes")
+			}
+		}
+		a.Avatar = *u.Avatar
+	}
+	if u.Password != nil {
+		return a.setPassword(*u.Password)
+	}
+	return nil
+}
+
+// Hash and set a new password
+func (a *account) setPassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return errors.New("the password must be 8 to 72 bytes long")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.passwordHash = hash
+	return nil
+}
+
+// Look up the account a request's session token belongs to, nil if the token is
+// missing, invalid or its account is gone
+func accountFromRequest(r *http.Request) (*account, error) {
+	username, err := verifyToken(tokenFromRequest(r))
+	if err != nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	return store.Account(ctx, username)
+}
+
+// Answer with a new session token for the user, also set as the session cookie
+func writeSession(w http.ResponseWriter, r *http.Request, username string, status int) {
+	token, err := issueToken(username)
+	if err != nil {
+		http.Error(w, "Could not issue token", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// Keep a session token in the browser's session cookie
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(tokenTTL / time.Second),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HTTP handler registering an account from
+// {"username": "...", "password": "...", "display_name": "..."} and logging it in
+func serveRegister(w http.ResponseWriter, r *http.Request) {
+	if !accounts {
+		http.NotFound(w, r)
+		return
+	}
+	var body struct {
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !validUsername(body.Username) {
+		http.Error(w, usernameError, http.StatusBadRequest)
+		return
+	}
+	a := &account{Username: body.Username, Created: time.Now().UnixMilli()}
+	if err := a.update(profileUpdate{DisplayName: &body.DisplayName, Password: &body.Password}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	switch err := store.CreateAccount(ctx, a); {
+	case errors.Is(err, errAccountExists):
+		http.Error(w, "Username is taken", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	writeSession(w, r, a.Username, http.StatusCreated)
+}
+
+// Log in to an account from {"username": "...", "password": "..."}
+func loginAccount(w http.ResponseWriter, r *http.Request, username, password string) {
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	a, err := store.Account(ctx, username)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if a == nil || bcrypt.CompareHashAndPassword(a.passwordHash, []byte(password)) != nil {
+		http.Error(w, "Wrong username or password", http.StatusUnauthorized)
+		return
+	}
+	writeSession(w, r, a.Username, http.StatusOK)
+}
+
+// HTTP handler clearing the session cookie
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler showing the logged in account with GET and changing it with a
+// profile update such as {"display_name": "...", "avatar": "https://..."} with PATCH
+func serveMe(w http.ResponseWriter, r *http.Request) {
+	if !accounts {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := accountFromRequest(r)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		var u profileUpdate
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&u); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := a.update(u); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		defer cancel()
+		if err := store.UpdateAccount(ctx, a); err != nil {
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// HTTP handler showing a user's public profile
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	if !accounts {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	a, err := store.Account(ctx, r.PathValue("username"))
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// Restore the room's owner and moderators; accounts keep roles across restarts
+// since their usernames can't be claimed by someone else. Without accounts only
+// the owner is kept, so whoever is first back into an idle room doesn't take it
+// over. Runs before the room starts.
+func (r *Room) restoreRoles() {
+	if !accounts {
+		r.restoreOwner()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	roles, err := store.Roles(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	owner := ""
+	for username, role := range roles {
+		switch role {
+		case roleOwner:
+			owner = username
+		case roleModerator:
+			r.moderators[username] = true
+		}
+	}
+	if owner != "" {
+		r.owner = owner
+	} else if r.owner != "" {
+		r.saveRole(r.owner, roleOwner)
+	}
+}
+
+// Restore the owner saved with the room, saving its creator if it has none
+func (r *Room) restoreOwner() {
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	owner, err := store.LoadOwner(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	if owner != "" {
+		r.owner = owner
+	} else if r.owner != "" {
+		if err := store.SaveOwner(ctx, r.name, r.owner); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+}
+
+// Keep a user's role in the room when accounts are on; roleMember forgets it
+func (r *Room) saveRole(username string, role int) {
+	if !accounts {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := store.SaveRole(ctx, r.name, username, role); err != nil {
+		r.logger().Error("Storage error", "err", err)
+	}
+}
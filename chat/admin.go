@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Token required by admin endpoints, from ADMIN_TOKEN; admin endpoints are disabled without it
+var adminToken string
+
+// Check the request carries the admin bearer token, writing an error response if not
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Report whether the request carries the admin bearer token
+func isAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Set while the server is in maintenance, refusing new connections
+var maintenance atomic.Bool
+
+// connectionInfo describes a live connection in the admin API
+type connectionInfo struct {
+	ID           uint64    `json:"id"`
+	Username     string    `json:"username"`
+	Email        string    `json:"email,omitempty"`
+	Room         string    `json:"room"`
+	IP           string    `json:"ip"`
+	Transport    string    `json:"transport"` // websocket or sse
+	PresenceOnly bool      `json:"presence_only,omitempty"`
+	JoinedAt     time.Time `json:"joined_at"`
+}
+
+// List every connection of every room, by room then connection ID
+func (h *Hub) connections() []connectionInfo {
+	var infos []connectionInfo
+	for _, room := range h.list() {
+		result := make(chan []connectionInfo, 1)
+		if !room.do(func() {
+			var local []connectionInfo
+			for c := range room.clients {
+				transport := "websocket"
+				if c.conn == nil {
+					transport = "sse"
+				}
+				local = append(local, connectionInfo{
+					ID: c.connID, Username: c.username, Email: c.email, Room: room.name, IP: c.ip,
+					Transport: transport, PresenceOnly: c.presenceOnly, JoinedAt: c.joinedAt,
+				})
+			}
+			result <- local
+		}) {
+			continue
+		}
+		local := <-result
+		slices.SortFunc(local, func(a, b connectionInfo) int { return cmp.Compare(a.ID, b.ID) })
+		infos = append(infos, local...)
+	}
+	return infos
+}
+
+// Close the connection with the given ID in every room it is in, reporting
+// whether it was found
+func (h *Hub) disconnect(id uint64, reason string) bool {
+	closeReason := "disconnected by an administrator"
+	if reason != "" {
+		closeReason += ": " + reason
+	}
+	disconnected := false
+	for _, room := range h.list() {
+		found := make(chan bool, 1)
+		ran := room.do(func() {
+			for c := range room.clients {
+				if c.connID == id {
+					c.closeCode, c.closeReason = websocket.ClosePolicyViolation, closeReason
+					room.leave(c)
+					room.audit("", auditDisconnect, c.username, reason, fmt.Sprintf("connection %d", id))
+					found <- true
+					return
+				}
+			}
+			found <- false
+		})
+		if ran && <-found {
+			disconnected = true
+		}
+	}
+	return disconnected
+}
+
+// HTTP handler listing the live connections; admin only
+func (h *Hub) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.connections())
+}
+
+// HTTP handler force-disconnecting a connection by ID; admin only
+func (h *Hub) serveDisconnect(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	if !h.disconnect(id, r.URL.Query().Get("reason")) {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler sending a {"body": "..."} system announcement to every room; admin only
+func (h *Hub) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Body == "" {
+		http.Error(w, "Expected a JSON body with a body", http.StatusBadRequest)
+		return
+	}
+	for _, room := range h.list() {
+		room.do(func() { room.deliver(systemMessage(req.Body)) })
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler reporting or, given {"enabled": true}, switching maintenance mode,
+// which refuses new connections but keeps the open ones; admin only
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		maintenance.Store(req.Enabled)
+		slog.Info("Maintenance mode changed", "enabled", req.Enabled)
+		audit(auditEntry{Action: auditMaintenance, Detail: strconv.FormatBool(req.Enabled)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": maintenance.Load()})
+}
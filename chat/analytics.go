@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	"chat-app/internal/env"
+)
+
+// AnalyticsEvent is the metadata recorded for a sampled message; Body is only
+// set with ANALYTICS_INCLUDE_BODY
+type AnalyticsEvent struct {
+	MessageID string    `json:"message_id"`
+	Room      string    `json:"room"`
+	Sender    string    `json:"sender"`
+	Length    int       `json:"length"`
+	Time      time.Time `json:"ts"`
+	Body      string    `json:"body,omitempty"`
+}
+
+// AnalyticsSink receives sampled message events. Emit is called on the room
+// goroutine, so a sink has to be quick and safe for concurrent use.
+type AnalyticsSink interface {
+	Emit(event AnalyticsEvent)
+}
+
+// Sink installed by SetAnalyticsSink, nil to write events to ANALYTICS_FILE or stdout
+var analyticsSink AnalyticsSink
+
+// SetAnalyticsSink sends the sampled messages to sink instead of writing them
+// as JSON lines, sampling ANALYTICS_SAMPLE_RATE of them as before; call it
+// before the hub serves connections
+func SetAnalyticsSink(sink AnalyticsSink) {
+	analyticsSink = sink
+	if analytics != nil {
+		analytics.sink = sink
+	}
+}
+
+// analyticsSampler forwards a fixed fraction of messages to a sink
+type analyticsSampler struct {
+	rate        float64
+	includeBody bool
+	sink        AnalyticsSink
+}
+
+// Report whether a message belongs to the sample; the same ID always gives the same answer
+func (s *analyticsSampler) sampled(messageID string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(messageID))
+	return float64(h.Sum64())/math.MaxUint64 < s.rate
+}
+
+// Emit a message's metadata if it is sampled; safe to call on a nil sampler
+func (s *analyticsSampler) record(messageID, room, sender string, body []byte) {
+	if s == nil || !s.sampled(messageID) {
+		return
+	}
+	event := AnalyticsEvent{
+		MessageID: messageID,
+		Room:      room,
+		Sender:    sender,
+		Length:    len(body),
+		Time:      time.Now(),
+	}
+	if s.includeBody {
+		event.Body = string(body)
+	}
+	s.sink.Emit(event)
+}
+
+// writerSink writes events as JSON lines from a background goroutine
+type writerSink struct {
+	events chan AnalyticsEvent
+}
+
+// Create a sink writing to w, dropping events if the writer falls behind
+func newWriterSink(w io.Writer) *writerSink {
+	s := &writerSink{events: make(chan AnalyticsEvent, 1024)}
+	go func() {
+		enc := json.NewEncoder(w)
+		for event := range s.events {
+			if err := enc.Encode(event); err != nil {
+				slog.Error("Analytics write error", "err", err)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *writerSink) Emit(event AnalyticsEvent) {
+	select {
+	case s.events <- event:
+	default:
+	}
+}
+
+// Set up message sampling from the environment, returning nil when disabled
+func newAnalyticsFromEnv() *analyticsSampler {
+	rate := env.Float("ANALYTICS_SAMPLE_RATE", 0)
+	if rate <= 0 {
+		return nil
+	}
+	sampler := &analyticsSampler{
+		rate:        rate,
+		includeBody: env.Bool("ANALYTICS_INCLUDE_BODY", false),
+		sink:        analyticsSink,
+	}
+	if sampler.sink != nil {
+		return sampler
+	}
+	var out io.Writer = os.Stdout
+	if path := os.Getenv("ANALYTICS_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			fatal("Analytics file error", "err", err)
+		}
+		out = f
+	}
+	sampler.sink = newWriterSink(out)
+	return sampler
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// collectSink keeps the events it receives
+type collectSink struct {
+	events []AnalyticsEvent
+}
+
+func (s *collectSink) Emit(event AnalyticsEvent) {
+	s.events = append(s.events, event)
+}
+
+func TestAnalyticsSamplesConfiguredFraction(t *testing.T) {
+	const messages = 10000
+	for _, rate := range []float64{0.1, 0.5} {
+		sink := &collectSink{}
+		s := &analyticsSampler{rate: rate, sink: sink}
+		for i := range messages {
+			s.record(strconv.Itoa(i), "lobby", "alice", []byte("hello"))
+		}
+		got := float64(len(sink.events)) / messages
+		if math.Abs(got-rate) > 0.02 {
+			t.Errorf("rate %g: sampled %g of the messages", rate, got)
+		}
+		for _, event := range sink.events {
+			if event.Body != "" {
+				t.Fatalf("rate %g: event has a body without includeBody", rate)
+			}
+		}
+	}
+}
+
+func TestAnalyticsSamplingIsDeterministic(t *testing.T) {
+	// Replaying the same messages samples the same ones again
+	first, replay := &collectSink{}, &collectSink{}
+	for _, sink := range []*collectSink{first, replay} {
+		s := &analyticsSampler{rate: 0.3, sink: sink}
+		for i := range 1000 {
+			s.record(strconv.Itoa(i), "lobby", "alice", nil)
+		}
+	}
+	if len(first.events) != len(replay.events) {
+		t.Fatalf("sampled %d then %d of the same messages", len(first.events), len(replay.events))
+	}
+	for i := range first.events {
+		if first.events[i].MessageID != replay.events[i].MessageID {
+			t.Fatalf("sampled %s then %s", first.events[i].MessageID, replay.events[i].MessageID)
+		}
+	}
+}
+
+func TestSetAnalyticsSinkReplacesTheWriter(t *testing.T) {
+	t.Setenv("ANALYTICS_SAMPLE_RATE", "1")
+	setFor(t, &analyticsSink, nil)
+	setFor(t, &analytics, nil)
+
+	// Installed before configuring, the sampler is built around it
+	before := &collectSink{}
+	SetAnalyticsSink(before)
+	setFor(t, &analytics, newAnalyticsFromEnv())
+	analytics.record("1", "lobby", "alice", []byte("hi"))
+	if len(before.events) != 1 {
+		t.Fatalf("the sink installed before configuring got %d events, want 1", len(before.events))
+	}
+
+	// Installed after, it replaces the sampler's sink
+	after := &collectSink{}
+	SetAnalyticsSink(after)
+	analytics.record("2", "lobby", "alice", []byte("hi"))
+	if len(after.events) != 1 || len(before.events) != 1 {
+		t.Errorf("events went to %d and %d, want the later sink only", len(before.events), len(after.events))
+	}
+}
@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// roomInfo describes a room in the REST API
+type roomInfo struct {
+	Name    string   `json:"name"`
+	Members int      `json:"members"`
+	Access  string   `json:"access"`
+	Pinned  []uint64 `json:"pinned"` // IDs of the pinned messages, in the order they were pinned
+	roomMeta
+}
+
+// Describe a room, reporting false if it has stopped
+func (r *Room) info() (roomInfo, bool) {
+	infos := make(chan roomInfo, 1)
+	if !r.do(func() {
+		infos <- roomInfo{Name: r.name, Members: len(r.members()), Access: r.access.mode, Pinned: r.pins(), roomMeta: r.meta}
+	}) {
+		return roomInfo{}, false
+	}
+	return <-infos, true
+}
+
+// HTTP handler listing the rooms with their member counts, except invite-only ones
+func (h *Hub) serveRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := []roomInfo{}
+	for _, room := range h.list() {
+		if !room.access.listed() {
+			continue
+		}
+		if info, ok := room.info(); ok {
+			rooms = append(rooms, info)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// HTTP handler creating an empty room from
+// {"name": "...", "access": "public|password|invite", "password": "..."}; admin only
+func (h *Hub) serveCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Name     string `json:"name"`
+		Access   string `json:"access"`
+		Password string `json:"password"`
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil || json.Unmarshal(body, &req) != nil || req.Name == "" {
+		http.Error(w, `Expected {"name": "..."}`, http.StatusBadRequest)
+		return
+	}
+	// The room's node creates it, so the body is put back for forwarding
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if shards.forward(w, r, req.Name) {
+		return
+	}
+	access, err := newRoomAccess(req.Access, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room, created := h.create(req.Name, access)
+	if !created {
+		http.Error(w, "Room already exists", http.StatusConflict)
+		return
+	}
+	info, _ := room.info()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// HTTP handler closing a room and disconnecting its members; admin only
+func (h *Hub) serveDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !h.remove(r.PathValue("name"), websocket.CloseNormalClosure, "room deleted") {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	audit(auditEntry{Room: r.PathValue("name"), Action: auditDeleteRoom, Reason: r.URL.Query().Get("reason")})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler issuing an invite token to an invite-only room; admin only
+func (h *Hub) serveInvite(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name := r.PathValue("name")
+	room, exists := h.lookup(name)
+	if !exists {
+		// Invites only last while the room is open, so a closed invite-only room is reopened
+		access, err := h.accessOf(r.Context(), name)
+		if err != nil {
+			slog.Error("Storage error", "room", name, "err", err)
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		if access.mode == accessInvite {
+			room = h.room(name, "")
+		}
+		if room == nil {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+	}
+	if room.access.mode != accessInvite {
+		http.Error(w, "Room is not invite-only", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"invite": room.access.invite()})
+}
+
+// Check a request to read a room's messages as joining the room would be: with
+// JWT_SECRET it needs the token of a user the room hasn't banned, and a private
+// room's password or invite, whether the room is open or not. Reports false
+// once the request was refused.
+func (h *Hub) authorizeRead(w http.ResponseWriter, r *http.Request, name string) bool {
+	username := ""
+	if jwtSecret != nil {
+		claims, err := verifyClaims(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		username = claims.Subject
+	}
+	access, err := h.accessOf(r.Context(), name)
+	if err != nil {
+		slog.Error("Storage error", "room", name, "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return false
+	}
+	query := r.URL.Query()
+	if access.isBanned(username) || !access.admits(query.Get("password"), query.Get("invite")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Page sizes of the message search API
+const (
+	searchLimit    = 50
+	maxSearchLimit = 200
+)
+
+// HTTP handler searching a room's stored messages, newest first. ?q= filters by
+// body text, and ?before= continues from the next_before of the previous page.
+func (h *Hub) serveMessages(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Message history needs STORAGE_DSN", http.StatusNotImplemented)
+		return
+	}
+	name := r.PathValue("name")
+	query := r.URL.Query()
+	if !h.authorizeRead(w, r, name) {
+		return
+	}
+	before, limit := uint64(0), searchLimit
+	var err error
+	if v := query.Get("before"); v != "" {
+		if before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxSearchLimit)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	messages, err := store.Search(ctx, name, query.Get("q"), before, limit)
+	if err != nil {
+		slog.Error("Storage error", "room", name, "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	page := struct {
+		Messages   []*Message `json:"messages"`
+		NextBefore uint64     `json:"next_before,omitempty"` // set when there may be older matches
+	}{Messages: messages}
+	if page.Messages == nil {
+		page.Messages = []*Message{}
+	}
+	if len(messages) == limit {
+		page.NextBefore = messages[len(messages)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
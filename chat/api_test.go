@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Get a room's stored messages over the API, returning the status and the bodies
+func getMessages(t *testing.T, srv *httptest.Server, room string, query url.Values, token string) (int, []string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/rooms/"+room+"/messages?"+query.Encode(), nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page struct{ Messages []*Message }
+	json.NewDecoder(resp.Body).Decode(&page)
+	var bodies []string
+	for _, m := range page.Messages {
+		bodies = append(bodies, m.Body)
+	}
+	return resp.StatusCode, bodies
+}
+
+// Start a hub over a fresh store with the message API routed
+func newAPIServer(t *testing.T) (*Hub, *httptest.Server) {
+	useTestStore(t)
+	hub, srv, mux := newTestServer(t)
+	mux.HandleFunc("GET /api/rooms/{name}/messages", hub.serveMessages)
+	return hub, srv
+}
+
+func TestMessagesOfClosedPasswordRoomStayProtected(t *testing.T) {
+	hub, srv := newAPIServer(t)
+	access, _ := newRoomAccess(accessPassword, "hunter2")
+	hub.create("vault", access)
+	store.Save(context.Background(), &Message{Room: "vault", ID: 1, Sender: "alice", Body: "the code is 1234", TS: time.Now().UnixMilli()})
+	hub.remove("vault", websocket.CloseNormalClosure, "closed")
+	if _, open := hub.lookup("vault"); open {
+		t.Fatal("the room is still open")
+	}
+
+	if status, bodies := getMessages(t, srv, "vault", nil, ""); status != http.StatusForbidden || len(bodies) > 0 {
+		t.Errorf("without the password: %d %q, want 403", status, bodies)
+	}
+	if status, _ := getMessages(t, srv, "vault", url.Values{"password": {"wrong"}}, ""); status != http.StatusForbidden {
+		t.Errorf("with a wrong password: %d, want 403", status)
+	}
+	if status, bodies := getMessages(t, srv, "vault", url.Values{"password": {"hunter2"}}, ""); status != http.StatusOK || len(bodies) != 1 {
+		t.Errorf("with the password: %d %q, want the message", status, bodies)
+	}
+
+	// Joining doesn't reopen it as a public room either
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, url.Values{"room": {"vault"}, "username": {"mallory"}}), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("joining without the password: %v, want 403", err)
+	}
+}
+
+func TestMessagesOfClosedInviteRoomStayProtected(t *testing.T) {
+	hub, srv := newAPIServer(t)
+	access, _ := newRoomAccess(accessInvite, "")
+	hub.create("secret", access)
+	invite := access.invite()
+	hub.remove("secret", websocket.CloseNormalClosure, "closed")
+
+	if status, _ := getMessages(t, srv, "secret", url.Values{"invite": {invite}}, ""); status != http.StatusForbidden {
+		t.Errorf("with an invite of the closed room: %d, want 403", status)
+	}
+}
+
+func TestMessagesNeedTokenWithJWT(t *testing.T) {
+	_, srv := newAPIServer(t)
+	setFor(t, &jwtSecret, []byte("secret"))
+	store.Save(context.Background(), &Message{Room: "lobby", ID: 1, Sender: "alice", Body: "hi", TS: time.Now().UnixMilli()})
+
+	if status, _ := getMessages(t, srv, "lobby", nil, ""); status != http.StatusUnauthorized {
+		t.Errorf("without a token: %d, want 401", status)
+	}
+	if status, _ := getMessages(t, srv, "lobby", nil, "forged"); status != http.StatusUnauthorized {
+		t.Errorf("with an invalid token: %d, want 401", status)
+	}
+	token, _ := issueToken("bob")
+	if status, bodies := getMessages(t, srv, "lobby", nil, token); status != http.StatusOK || len(bodies) != 1 {
+		t.Errorf("with a token: %d %q, want the message", status, bodies)
+	}
+}
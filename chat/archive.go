@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Archiver stores a room's remaining history somewhere durable, when the room
+// closes for being idle and when the hub shuts down
+type Archiver interface {
+	Archive(ctx context.Context, room string, history []ArchivedMessage) error
+}
+
+// ArchivedMessage is a chat message of a room's history handed to the archiver.
+// With coalescing on, one can hold several consecutive messages, IDs ID through LastID.
+type ArchivedMessage struct {
+	ID        uint64              `json:"id"`
+	LastID    uint64              `json:"last_id,omitempty"`
+	Sender    string              `json:"sender"`
+	Body      string              `json:"body"`
+	Data      []byte              `json:"data,omitempty"` // binary payload, base64 in JSON
+	Time      time.Time           `json:"ts"`
+	ParentID  uint64              `json:"parent_id,omitempty"` // the message replied to, when it is a thread's reply
+	Reactions map[string][]string `json:"reactions,omitempty"` // who reacted with each emoji
+}
+
+// fileArchiver appends history to a file as JSON lines
+type fileArchiver struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (a *fileArchiver) Archive(ctx context.Context, room string, history []ArchivedMessage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, entry := range history {
+		if err := enc.Encode(archivedEntry{Room: room, ArchivedMessage: entry}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedEntry is an archived message tagged with its room
+type archivedEntry struct {
+	Room string `json:"room"`
+	ArchivedMessage
+}
+
+// httpArchiver posts each room's history as a JSON document
+type httpArchiver struct {
+	url string
+}
+
+func (a *httpArchiver) Archive(ctx context.Context, room string, history []ArchivedMessage) error {
+	body, err := json.Marshal(map[string]any{"room": room, "history": history})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("archiver responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Pick the archiver installed by SetArchiver, or one from ARCHIVE_FILE or
+// ARCHIVE_URL, returning nil when there is none
+func newArchiverFromEnv() Archiver {
+	if customArchiver != nil {
+		return customArchiver
+	}
+	if path := os.Getenv("ARCHIVE_FILE"); path != "" {
+		return &fileArchiver{path: path}
+	}
+	if url := os.Getenv("ARCHIVE_URL"); url != "" {
+		return &httpArchiver{url: url}
+	}
+	return nil
+}
+
+// Archiver for room history, nil when neither ARCHIVE_FILE nor ARCHIVE_URL is set
+var archiver Archiver
+
+// Archiver installed by SetArchiver, taking over from ARCHIVE_FILE and ARCHIVE_URL
+var customArchiver Archiver
+
+// SetArchiver archives room history with a instead of ARCHIVE_FILE or
+// ARCHIVE_URL; call it before the hub serves connections
+func SetArchiver(a Archiver) {
+	customArchiver = a
+	archiver = a
+}
+
+// Time allowed to archive a room closed for being idle
+const archiveTimeout = 10 * time.Second
+
+// Flush every room's buffered history to the archiver, giving up when ctx is done
+func archiveRooms(ctx context.Context, hub *Hub) {
+	for _, room := range hub.list() {
+		history, err := room.snapshot(ctx)
+		if err != nil {
+			room.logger().Error("Archive error", "err", err)
+			return
+		}
+		if len(history) == 0 {
+			continue
+		}
+		if err := archiver.Archive(ctx, room.name, history); err != nil {
+			room.logger().Error("Archive error", "err", err)
+		}
+	}
+}
+
+// Copy the room's history from its goroutine
+func (r *Room) snapshot(ctx context.Context) ([]ArchivedMessage, error) {
+	result := make(chan []ArchivedMessage, 1)
+	select {
+	case r.control <- func() { result <- r.archivable() }:
+	case <-r.done:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case history := <-result:
+		return history, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Copy the history to archive, none for ephemeral or end-to-end encrypted rooms;
+// runs on the room goroutine
+func (r *Room) archivable() []ArchivedMessage {
+	if r.meta.Ephemeral || r.meta.E2E {
+		return nil
+	}
+	history := make([]ArchivedMessage, len(r.history))
+	for i, e := range r.history {
+		history[i] = e.archived()
+	}
+	return history
+}
+
+// historyEntry is a chat message kept in a room's recent history. With coalescing
+// on, one entry can hold several consecutive messages, IDs ID through LastID.
+type historyEntry struct {
+	ID        uint64
+	LastID    uint64
+	Sender    string
+	Body      string
+	Data      []byte // binary payload, or the ciphertext of an end-to-end encrypted message
+	Time      time.Time
+	ParentID  uint64              // the message replied to, when the entry is a thread's reply
+	Reactions map[string][]string // who reacted with each emoji
+	last      time.Time           // when the latest message was merged in
+	expires   time.Time           // when the message disappears, unless zero
+	encrypted bool                // Data is the ciphertext of an end-to-end encrypted message
+	keyID     string
+}
+
+// Turn the entry back into a chat message for replaying
+func (e *historyEntry) message() *Message {
+	m := &Message{Type: typeChat, ID: e.ID, Sender: e.Sender, Body: e.Body, Data: e.Data, TS: e.Time.UnixMilli(), ParentID: e.ParentID, Reactions: e.reactionCounts()}
+	if !e.expires.IsZero() {
+		m.ExpiresAt = e.expires.UnixMilli()
+	}
+	if e.encrypted {
+		m.Type, m.Body, m.KeyID = typeEncrypted, "", e.keyID
+	}
+	return m
+}
+
+// Copy the entry for the archiver
+func (e *historyEntry) archived() ArchivedMessage {
+	return ArchivedMessage{ID: e.ID, LastID: e.LastID, Sender: e.Sender, Body: e.Body, Data: e.Data, Time: e.Time, ParentID: e.ParentID, Reactions: maps.Clone(e.Reactions)}
+}
+
+// Report whether the entry holds the message with the given ID
+func (e *historyEntry) contains(id uint64) bool {
+	return id == e.ID || (e.ID < id && id <= e.LastID)
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestShutdownArchivesHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	setFor[Archiver](t, &archiver, &fileArchiver{path: path})
+	hub, srv, _ := newTestServer(t)
+	alice := join(t, srv, "archived", "alice")
+	for _, body := range []string{"first", "second"} {
+		alice.say(body)
+		alice.expect(typeAck)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	hub.Shutdown(ctx)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var bodies []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var entry archivedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Room != "archived" || entry.Sender != "alice" {
+			t.Errorf("archived %+v, want alice's message in archived", entry)
+		}
+		bodies = append(bodies, entry.Body)
+	}
+	if want := []string{"first", "second"}; !slices.Equal(bodies, want) {
+		t.Errorf("archived %q, want %q", bodies, want)
+	}
+}
+
+// recordingArchiver keeps the history it is given, by room
+type recordingArchiver struct {
+	mu       sync.Mutex
+	archived map[string][]ArchivedMessage
+}
+
+func (a *recordingArchiver) Archive(ctx context.Context, room string, history []ArchivedMessage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.archived[room] = append(a.archived[room], history...)
+	return nil
+}
+
+func TestSetArchiverTakesOverArchiving(t *testing.T) {
+	setFor(t, &archiver, nil)
+	setFor(t, &customArchiver, nil)
+	a := &recordingArchiver{archived: make(map[string][]ArchivedMessage)}
+	SetArchiver(a)
+	hub, srv, _ := newTestServer(t)
+	alice := join(t, srv, "custom", "alice")
+	alice.say("kept")
+	alice.expect(typeAck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	hub.Shutdown(ctx)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	got := a.archived["custom"]
+	if len(got) != 1 || got[0].Sender != "alice" || got[0].Body != "kept" {
+		t.Errorf("archived %+v, want alice's message", got)
+	}
+	if picked := newArchiverFromEnv(); picked != a {
+		t.Errorf("configuring again picked %v, want the installed archiver", picked)
+	}
+}
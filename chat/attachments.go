@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"chat-app/internal/env"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Attachment describes an uploaded file shared in a room
+type Attachment struct {
+	URL         string `json:"url"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// AttachmentStore keeps uploaded files and tells where they can be downloaded
+type AttachmentStore interface {
+	// Put stores data under key, returning its download URL
+	Put(ctx context.Context, key, contentType string, data []byte) (string, error)
+}
+
+// localAttachments keeps uploads in a directory, served by the chat server itself
+type localAttachments struct {
+	dir string
+}
+
+func (s *localAttachments) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	if err := os.WriteFile(filepath.Join(s.dir, key), data, 0o644); err != nil {
+		return "", err
+	}
+	return "/attachments/" + url.PathEscape(key), nil
+}
+
+// Serve the stored files. Uploads are untrusted, so browsers are kept from running them.
+func (s *localAttachments) handler() http.Handler {
+	files := http.StripPrefix("/attachments/", http.FileServer(http.Dir(s.dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; sandbox")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// s3Attachments keeps uploads in an S3-compatible bucket
+type s3Attachments struct {
+	client    *minio.Client
+	bucket    string
+	publicURL string // base URL objects are downloaded from
+}
+
+func (s *s3Attachments) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(s.publicURL, "/") + "/" + url.PathEscape(key), nil
+}
+
+// Pick the attachment storage from ATTACHMENT_DIR or ATTACHMENT_S3_BUCKET, returning
+// nil when uploads are disabled
+func newAttachmentsFromEnv() AttachmentStore {
+	if dir := os.Getenv("ATTACHMENT_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			fatal("Attachment storage error", "err", err)
+		}
+		return &localAttachments{dir: dir}
+	}
+	bucket := os.Getenv("ATTACHMENT_S3_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	endpoint := os.Getenv("ATTACHMENT_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	secure := !env.Bool("ATTACHMENT_S3_INSECURE", false)
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("ATTACHMENT_S3_ACCESS_KEY"), os.Getenv("ATTACHMENT_S3_SECRET_KEY"), ""),
+		Secure: secure,
+		Region: os.Getenv("ATTACHMENT_S3_REGION"),
+	})
+	if err != nil {
+		fatal("Attachment storage error", "err", err)
+	}
+	publicURL := os.Getenv("ATTACHMENT_S3_PUBLIC_URL")
+	if publicURL == "" {
+		scheme := "https"
+		if !secure {
+			scheme = "http"
+		}
+		publicURL = fmt.Sprintf("%s://%s/%s", scheme, endpoint, bucket)
+	}
+	return &s3Attachments{client: client, bucket: bucket, publicURL: publicURL}
+}
+
+// Storage for uploads, nil when attachments are disabled
+var attachments AttachmentStore
+
+// Largest file that can be uploaded, from ATTACHMENT_MAX_SIZE
+var maxAttachmentSize int64 = 10 << 20
+
+// Time allowed to store an upload
+const attachmentTimeout = 30 * time.Second
+
+// HTTP handler for uploading a file to a room as the multipart field "file". The
+// uploader must be in the room; everyone there gets an attachment message.
+func (h *Hub) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if attachments == nil {
+		http.NotFound(w, r)
+		return
+	}
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	room, exists := h.lookup(r.PathValue("name"))
+	if !exists || !room.mayPost(username) {
+		http.Error(w, "Only members of the room who may post can upload to it", http.StatusForbidden)
+		return
+	}
+
+	// Leave room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+64*1024)
+	name, data, err := readUpload(r)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.Is(err, errAttachmentTooBig) || errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("Attachments are limited to %d bytes", maxAttachmentSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	ctx, cancel := context.WithTimeout(r.Context(), attachmentTimeout)
+	defer cancel()
+	link, err := attachments.Put(ctx, newSessionID()+"-"+name, contentType, data)
+	if err != nil {
+		slog.Error("Attachment error", "room", r.PathValue("name"), "err", err)
+		http.Error(w, "Couldn't store the attachment", http.StatusInternalServerError)
+		return
+	}
+	if strings.HasPrefix(link, "/") {
+		// Served by this server, under the scheme and host the uploader sees
+		link = absoluteURL(r, link)
+	}
+	attachment := &Attachment{URL: link, Name: name, ContentType: contentType, Size: int64(len(data))}
+	m := newMessage(typeAttachment, "")
+	m.Sender = username
+	m.Attachment = attachment
+	if !room.do(func() {
+		room.deliver(m)
+		bridges.relay(room.name, m)
+	}) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+var errAttachmentTooBig = errors.New("attachment too big")
+
+// Read the "file" part of a multipart upload, returning its cleaned up file name
+func readUpload(r *http.Request) (string, []byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", nil, errors.New(`expected a multipart "file" field`)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(part, maxAttachmentSize+1))
+		if err != nil {
+			return "", nil, err
+		}
+		if int64(len(data)) > maxAttachmentSize {
+			return "", nil, errAttachmentTooBig
+		}
+		name := path.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+		if name == "." || name == "/" {
+			name = "file"
+		}
+		return name, data, nil
+	}
+}
+
+// Report whether the user has a connection in the room and may post to it
+func (r *Room) mayPost(username string) bool {
+	result := make(chan bool, 1)
+	if !r.do(func() { result <- r.connections[username] > 0 && !r.muted[username] && !r.readOnly(username) }) {
+		return false
+	}
+	return <-result
+}
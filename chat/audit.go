@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded for a connection attempt
+const (
+	connSuccess         = "success"
+	connBadRequest      = "bad_request"
+	connBadUsername     = "bad_username"
+	connBanned          = "banned"
+	connRoomFull        = "room_full"
+	connRateLimited     = "rate_limited"
+	connAuthFailed      = "auth_failed"
+	connUpgradeFailed   = "upgrade_failed"
+	connChallengeFailed = "challenge_failed"
+	connForbidden       = "forbidden"
+	connMaintenance     = "maintenance"
+)
+
+// connAttempt is one audited connection attempt
+type connAttempt struct {
+	Time     time.Time `json:"ts"`
+	IP       string    `json:"ip"`
+	Room     string    `json:"room"`
+	Username string    `json:"username"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// connAuditLog writes connection attempts as JSON lines
+type connAuditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Audit log of connection attempts, nil when CONN_AUDIT_FILE isn't set
+var connAudit *connAuditLog
+
+// Open the connection audit log from CONN_AUDIT_FILE ("-" for stdout)
+func newConnAuditFromEnv() *connAuditLog {
+	path := os.Getenv("CONN_AUDIT_FILE")
+	if path == "" {
+		return nil
+	}
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			fatal("Connection audit file error", "err", err)
+		}
+		out = f
+	}
+	return &connAuditLog{enc: json.NewEncoder(out)}
+}
+
+// Record the outcome of a connection attempt; safe to call on a nil log
+func (a *connAuditLog) record(r *http.Request, username, outcome, detail string) {
+	if a == nil {
+		return
+	}
+	a.write(connAttempt{IP: remoteIP(r), Room: r.URL.Query().Get("room"), Username: username, Outcome: outcome, Detail: detail})
+}
+
+// Record the outcome of a client's attempt to join its room once its connection
+// was accepted, as when the room turns it away for being full; safe to call on a nil log
+func (a *connAuditLog) recordClient(c *Client, outcome, detail string) {
+	if a == nil {
+		return
+	}
+	a.write(connAttempt{IP: c.ip, Room: c.room.name, Username: c.username, Outcome: outcome, Detail: detail})
+}
+
+// Write an attempt, stamped with the current time
+func (a *connAuditLog) write(attempt connAttempt) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	attempt.Time = time.Now()
+	if err := a.enc.Encode(attempt); err != nil {
+		slog.Error("Connection audit error", "err", err)
+	}
+}
+
+// Get the IP address a request came from: the client's behind another node of
+// the cluster or a trusted proxy, else the peer's
+func remoteIP(r *http.Request) string {
+	if fromCluster(r) {
+		return r.Header.Get(clientIPHeader)
+	}
+	if viaTrustedProxy(r) {
+		if ip := forwardedIP(r); ip != "" {
+			return ip
+		}
+	}
+	return peerIP(r)
+}
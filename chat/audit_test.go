@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Read the attempts written to a connection audit log
+func auditedAttempts(t *testing.T, logs *syncBuffer) []connAttempt {
+	t.Helper()
+	var attempts []connAttempt
+	for scanner := bufio.NewScanner(strings.NewReader(logs.String())); scanner.Scan(); {
+		var attempt connAttempt
+		if err := json.Unmarshal(scanner.Bytes(), &attempt); err != nil {
+			t.Fatal(err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts
+}
+
+// Try joining the room over plain HTTP, returning the status it was refused with
+func refusedStatus(t *testing.T, srv string, query url.Values) int {
+	t.Helper()
+	resp, err := http.Get(srv + "/ws?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConnectionAuditRecordsEachRejection(t *testing.T) {
+	logs := &syncBuffer{}
+	setFor(t, &connAudit, &connAuditLog{enc: json.NewEncoder(logs)})
+	_, srv, _ := newTestServer(t)
+
+	alice := join(t, srv, "audited", "alice")
+	capacity := 1
+	alice.send(&Message{Type: typeRoomUpdate, Meta: &roomUpdate{Capacity: &capacity}})
+	alice.expect(typeRoomUpdate)
+	bob := dial(t, srv, url.Values{"room": {"audited"}, "username": {"bob"}})
+	if m := bob.expect(typeError); m.Code != errCodeRoomFull {
+		t.Errorf("bob was refused with %+v, want room_full", m)
+	}
+	bob.expectClosed()
+
+	for _, query := range []url.Values{
+		{"room": {"audited"}},
+		{"room": {"audited"}, "username": {"carol"}, "last_seen_id": {"x"}},
+	} {
+		if status := refusedStatus(t, srv.URL, query); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query.Encode(), status)
+		}
+	}
+	limits := newConnLimiter(1)
+	limits.acquire("127.0.0.1")
+	setFor(t, &connLimits, limits)
+	if status := refusedStatus(t, srv.URL, url.Values{"room": {"other"}, "username": {"dave"}}); status != http.StatusTooManyRequests {
+		t.Errorf("over the connection limit: status %d, want 429", status)
+	}
+	setFor(t, &jwtSecret, []byte("secret"))
+	if status := refusedStatus(t, srv.URL, url.Values{"room": {"other"}, "username": {"erin"}}); status != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", status)
+	}
+
+	attempts := auditedAttempts(t, logs)
+	var outcomes []string
+	for _, attempt := range attempts {
+		outcomes = append(outcomes, attempt.Outcome)
+		if attempt.IP != "127.0.0.1" || attempt.Time.IsZero() {
+			t.Errorf("attempt %+v lacks its address or time", attempt)
+		}
+	}
+	want := []string{connSuccess, connRoomFull, connBadUsername, connBadRequest, connRateLimited, connAuthFailed}
+	if !slices.Equal(outcomes, want) {
+		t.Fatalf("audited %q, want %q", outcomes, want)
+	}
+	if full := attempts[1]; full.Room != "audited" || full.Username != "bob" {
+		t.Errorf("room full attempt = %+v, want bob's for audited", full)
+	}
+}
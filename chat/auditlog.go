@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Actions kept in the audit log
+const (
+	auditKick        = "kick"
+	auditBan         = "ban"
+	auditUnban       = "unban"
+	auditMute        = "mute"
+	auditUnmute      = "unmute"
+	auditMod         = "mod"
+	auditUnmod       = "unmod"
+	auditDisconnect  = "disconnect"  // an administrator closed a connection
+	auditDeleteRoom  = "delete_room" // an administrator deleted a room
+	auditRoomUpdate  = "room_update" // the room's metadata changed, with the new metadata as Detail
+	auditFilter      = "filter"
+	auditQuarantine  = "quarantine"
+	auditNumbering   = "numbering"
+	auditMaintenance = "maintenance"
+	auditServerBan   = "server_ban" // an administrator banned a username or IP from the server, with its kind as Detail
+	auditServerUnban = "server_unban"
+)
+
+// Page sizes of the audit log API
+const (
+	auditLimit    = 100
+	maxAuditLimit = 1000
+)
+
+// Audit entries kept when there's no store, the oldest dropped beyond this
+const auditMemoryMax = 10000
+
+// auditEntry is one administrative or moderation action
+type auditEntry struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"ts"`
+	Room   string    `json:"room,omitempty"`
+	Actor  string    `json:"actor"` // the user who acted, empty for the admin token
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"` // the user acted on, if any
+	Reason string    `json:"reason,omitempty"`
+	Detail string    `json:"detail,omitempty"` // what changed, such as a setting's new value
+}
+
+// auditQuery selects audit entries; empty fields match everything
+type auditQuery struct {
+	Room, Actor, Target, Action string
+	Before                      uint64 // only entries with smaller IDs, when not 0
+	Limit                       int
+}
+
+// Report whether an entry is selected by the query, apart from its paging
+func (q auditQuery) matches(e auditEntry) bool {
+	return (q.Room == "" || e.Room == q.Room) && (q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Target == "" || e.Target == q.Target) && (q.Action == "" || e.Action == q.Action) &&
+		(q.Before == 0 || e.ID < q.Before)
+}
+
+// memoryAudit keeps the audit log in memory when there's no store
+type memoryAudit struct {
+	mu      sync.Mutex
+	lastID  uint64
+	entries []auditEntry // oldest first
+}
+
+var auditEntries = &memoryAudit{}
+
+// Add an action to the audit log, in the store if there is one; entries are
+// never changed or removed, other than memory dropping the oldest
+func audit(e auditEntry) {
+	e.Time = time.Now()
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.Audit(ctx, &e); err != nil {
+			slog.Error("Storage error", "err", err)
+		}
+		return
+	}
+	a := auditEntries
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastID++
+	e.ID = a.lastID
+	a.entries = append(a.entries, e)
+	if len(a.entries) > auditMemoryMax {
+		a.entries = a.entries[len(a.entries)-auditMemoryMax:]
+	}
+}
+
+// Get the entries selected by the query, newest first
+func auditLog(q auditQuery) ([]auditEntry, error) {
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		return store.AuditLog(ctx, q)
+	}
+	a := auditEntries
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var found []auditEntry
+	for i := len(a.entries) - 1; i >= 0 && len(found) < q.Limit; i-- {
+		if q.matches(a.entries[i]) {
+			found = append(found, a.entries[i])
+		}
+	}
+	return found, nil
+}
+
+// Add an action taken in the room to the audit log; runs on the room goroutine
+func (r *Room) audit(actor, action, target, reason, detail string) {
+	audit(auditEntry{Room: r.name, Actor: actor, Action: action, Target: target, Reason: reason, Detail: detail})
+}
+
+// HTTP handler listing the audit log for admins, newest first, as
+// {"entries":[...],"next_before":12}. ?room=, ?actor=, ?target= and ?action=
+// filter it, and ?before= continues from the next_before of the previous page.
+func serveAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	q := auditQuery{
+		Room:   query.Get("room"),
+		Actor:  query.Get("actor"),
+		Target: query.Get("target"),
+		Action: query.Get("action"),
+		Limit:  auditLimit,
+	}
+	if before := query.Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		q.Before = id
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = min(n, maxAuditLimit)
+	}
+	entries, err := auditLog(q)
+	if err != nil {
+		slog.Error("Storage error", "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	page := struct {
+		Entries    []auditEntry `json:"entries"`
+		NextBefore uint64       `json:"next_before,omitempty"` // ID to continue from, when there may be more
+	}{Entries: entries}
+	if page.Entries == nil {
+		page.Entries = []auditEntry{}
+	}
+	if len(entries) == q.Limit {
+		page.NextBefore = entries[len(entries)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
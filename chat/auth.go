@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key signing chat tokens, from JWT_SECRET; connections aren't authenticated without it
+var jwtSecret []byte
+
+// How long an issued token stays valid
+const tokenTTL = 24 * time.Hour
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// tokenClaims are the claims of a chat token. The subject is the username; the
+// name and email are set when an identity provider verified them.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// Issue a signed token for a username
+func issueToken(username string) (string, error) {
+	return signToken(username, "", "")
+}
+
+// Issue a signed token for a username with the name and email it was verified with
+func signToken(username, name, email string) (string, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+		},
+		Name:  name,
+		Email: email,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+// Verify a token, returning the username it was issued for
+func verifyToken(token string) (string, error) {
+	claims, err := verifyClaims(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// Verify a token, returning all its claims
+func verifyClaims(token string) (*tokenClaims, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// Get the token from the Authorization header, the token query parameter since
+// browsers can't set headers on WebSocket requests, or the session cookie
+func tokenFromRequest(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// HTTP handler issuing a token for the account in a {"username": "...",
+// "password": "..."} body. Without accounts there is no credential to check, so
+// there is no login either: tokens come from an identity provider, or from
+// whoever else holds JWT_SECRET.
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	if jwtSecret == nil || !accounts {
+		http.NotFound(w, r)
+		return
+	}
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	loginAccount(w, r, body.Username, body.Password)
+}
@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoginWithoutAccountsIssuesNoToken(t *testing.T) {
+	setFor(t, &jwtSecret, []byte("secret"))
+	setFor(t, &accounts, false)
+	w := postJSON(serveLogin, "/login", `{"username":"admin"}`)
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "token") {
+		t.Errorf("login without accounts answered %d %q, want a 404 without a token", w.Code, w.Body)
+	}
+}
+
+// Post a JSON body to a handler
+func postJSON(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return w
+}
+
+func TestLoginChecksTheAccountPassword(t *testing.T) {
+	useTestStore(t)
+	setFor(t, &jwtSecret, []byte("secret"))
+	setFor(t, &accounts, true)
+	if w := postJSON(serveRegister, "/register", `{"username":"bob","password":"correct horse"}`); w.Code != http.StatusCreated && w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+
+	if w := postJSON(serveLogin, "/login", `{"username":"bob","password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", w.Code)
+	}
+	if w := postJSON(serveLogin, "/login", `{"username":"nobody","password":"correct horse"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("no such account: %d, want 401", w.Code)
+	}
+	w := postJSON(serveLogin, "/login", `{"username":"bob","password":"correct horse"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("right password: %d %s", w.Code, w.Body)
+	}
+	var body struct{ Token string }
+	json.NewDecoder(w.Body).Decode(&body)
+	if username, err := verifyToken(body.Token); err != nil || username != "bob" {
+		t.Errorf("token is for %q (%v), want bob", username, err)
+	}
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backplane relays room events between server instances so clients connected to
+// different instances share the same rooms
+type Backplane interface {
+	// Publish an event that was delivered to this instance's clients
+	Publish(ctx context.Context, room string, m *Message) error
+	// Subscribe calls deliver with events other instances publish to the room
+	Subscribe(room string, deliver func(*Message)) (unsubscribe func())
+	// NextID allocates the room's next message ID, unique across instances
+	NextID(ctx context.Context, room string) (uint64, error)
+	// Ping checks that the backplane can be reached
+	Ping(ctx context.Context) error
+}
+
+// relayedMessage is a message on the backplane tagged with the instance that sent it
+type relayedMessage struct {
+	Node    string   `json:"node"`
+	Message *Message `json:"message"`
+}
+
+// redisBackplane relays events over Redis pub/sub, one channel per room
+type redisBackplane struct {
+	client *redis.Client
+	node   string
+}
+
+func (b *redisBackplane) channel(room string) string {
+	return "chat:room:" + room
+}
+
+func (b *redisBackplane) Publish(ctx context.Context, room string, m *Message) error {
+	data, err := json.Marshal(relayedMessage{Node: b.node, Message: m})
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel(room), data).Err()
+}
+
+func (b *redisBackplane) Subscribe(room string, deliver func(*Message)) func() {
+	sub := b.client.Subscribe(context.Background(), b.channel(room))
+	go func() {
+		for msg := range sub.Channel() {
+			var relayed relayedMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &relayed); err != nil {
+				slog.Error("Backplane decode error", "room", room, "err", err)
+				continue
+			}
+			// Our own events were already delivered locally
+			if relayed.Node != b.node && relayed.Message != nil {
+				deliver(relayed.Message)
+			}
+		}
+	}()
+	return func() { sub.Close() }
+}
+
+func (b *redisBackplane) NextID(ctx context.Context, room string) (uint64, error) {
+	id, err := b.client.Incr(ctx, "chat:seq:"+room).Result()
+	return uint64(id), err
+}
+
+func (b *redisBackplane) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// Set up the backplane selected by BACKPLANE, returning nil for a single instance
+func newBackplaneFromEnv() Backplane {
+	switch kind := os.Getenv("BACKPLANE"); kind {
+	case "":
+		return nil
+	case "redis":
+		client := redisClientFromEnv()
+		if client == nil {
+			fatal("BACKPLANE=redis requires REDIS_URL")
+		}
+		return &redisBackplane{client: client, node: nodeID}
+	default:
+		fatal("Unknown BACKPLANE", "backplane", kind)
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What to do with a client whose send buffer is full, from SLOW_CLIENT_POLICY
+const (
+	slowDisconnect = "disconnect"  // close the connection so the client reconnects and catches up
+	slowDropOldest = "drop-oldest" // discard the oldest queued frame to make room
+)
+
+// Send buffering, from SEND_BUFFER, WRITE_TIMEOUT and SLOW_CLIENT_POLICY
+var (
+	sendBufferSize = 256
+	writeTimeout   = 10 * time.Second // how long a single frame may take to write
+	slowPolicy     = slowDisconnect
+)
+
+// Check SLOW_CLIENT_POLICY, falling back to disconnecting slow clients
+func slowPolicyFromEnv(policy string) string {
+	switch policy {
+	case "":
+		return slowDisconnect
+	case slowDisconnect, slowDropOldest:
+		return policy
+	}
+	slog.Warn("Unknown SLOW_CLIENT_POLICY, disconnecting slow clients", "policy", policy)
+	return slowDisconnect
+}
+
+// Queue a frame for a client, reporting false if the client is too slow to keep
+// and should leave the room. The client is warned with a connection_slow event
+// once its buffer is three quarters full. Runs on the room goroutine, or on the
+// fanout goroutine given the client's share of a big room while the room
+// goroutine waits for it, so one goroutine at a time uses the client's slow state.
+func (r *Room) offer(client *Client, f frame) bool {
+	queued := len(client.send)
+	if queued < cap(client.send)/2 {
+		client.slow = false
+	} else if !client.slow && queued >= cap(client.send)*3/4 {
+		client.slow = true
+		warning := newMessage(typeSlow, "Your connection is falling behind, messages may be lost")
+		if slowPolicy == slowDisconnect {
+			warning.Body = "Your connection is falling behind and will be closed if it doesn't catch up"
+		}
+		warning.Room = r.name
+		if w, ok := encodeFor(client, framesOf(warning)); ok {
+			select {
+			case client.send <- w:
+			default:
+			}
+		}
+	}
+	for {
+		select {
+		case client.send <- f:
+			return true
+		default:
+		}
+		sendBufferDrops.Inc()
+		if slowPolicy == slowDisconnect {
+			client.closeCode, client.closeReason = websocket.CloseTryAgainLater, "connection too slow"
+			return false
+		}
+		// Make room, unless the write pump got there first
+		select {
+		case <-client.send:
+		default:
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Most users one user may block
+const maxBlocks = 1000
+
+var errTooManyBlocks = errors.New("you can block at most 1000 users")
+
+// blockList keeps who each user blocked, loaded from the store the first time
+// the user is looked up; without a store, blocks last until the server restarts
+type blockList struct {
+	mu       sync.RWMutex
+	blocked  map[string]map[string]bool // blocked usernames by blocker
+	blockers map[string]map[string]bool // the reverse: blockers by blocked username, of the users loaded
+}
+
+var blocks = &blockList{blocked: make(map[string]map[string]bool), blockers: make(map[string]map[string]bool)}
+
+// Get the users someone blocked, loading them from the store if needed
+func (b *blockList) of(username string) (map[string]bool, error) {
+	b.mu.RLock()
+	blocked, ok := b.blocked[username]
+	b.mu.RUnlock()
+	if ok {
+		return blocked, nil
+	}
+	blocked = make(map[string]bool)
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		names, err := store.Blocks(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			blocked[name] = true
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if loaded, ok := b.blocked[username]; ok {
+		return loaded, nil
+	}
+	b.blocked[username] = blocked
+	for name := range blocked {
+		b.addBlocker(name, username)
+	}
+	return blocked, nil
+}
+
+// Record in the reverse index that blocker blocked username; the caller holds b.mu
+func (b *blockList) addBlocker(username, blocker string) {
+	if b.blockers[username] == nil {
+		b.blockers[username] = make(map[string]bool)
+	}
+	b.blockers[username][blocker] = true
+}
+
+// Get who blocked sender among the users loaded, nil when nobody did, which is
+// checked once per broadcast rather than once per recipient. Users are loaded
+// as they join rooms.
+func (b *blockList) blockersOf(sender string) map[string]bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.blockers[sender]) == 0 {
+		return nil
+	}
+	return maps.Clone(b.blockers[sender])
+}
+
+// Report whether blocker blocked sender; a store error counts as not blocked
+func (b *blockList) has(blocker, sender string) bool {
+	if blocker == sender {
+		return false
+	}
+	blocked, err := b.of(blocker)
+	if err != nil {
+		slog.Error("Storage error", "username", blocker, "err", err)
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return blocked[sender]
+}
+
+// List the users someone blocked, sorted
+func (b *blockList) list(username string) ([]string, error) {
+	blocked, err := b.of(username)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	names := make([]string, 0, len(blocked))
+	for name := range blocked {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// Block or unblock a user for someone, saving the change
+func (b *blockList) set(username, target string, block bool) error {
+	blocked, err := b.of(username)
+	if err != nil {
+		return err
+	}
+	b.mu.RLock()
+	count, already := len(blocked), blocked[target]
+	b.mu.RUnlock()
+	switch {
+	case already == block:
+		return nil
+	case block && count >= maxBlocks:
+		return errTooManyBlocks
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SaveBlock(ctx, username, target, block); err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if block {
+		blocked[target] = true
+		b.addBlocker(target, username)
+	} else {
+		delete(blocked, target)
+		if delete(b.blockers[target], username); len(b.blockers[target]) == 0 {
+			delete(b.blockers, target)
+		}
+	}
+	return nil
+}
+
+// Report whether a message from a user someone blocked should be kept from
+// their connections: what the user says, types, reacts with or uploads
+func blockable(m *Message) bool {
+	switch m.Type {
+	case typeChat, typeDM, typeAttachment, typeMention, typeTyping, typeStopped, typeReactionAdd, typeReactionRemove, typePollCreate, typeLinkPreview:
+		return m.Sender != ""
+	}
+	return false
+}
+
+// Report whether the client's user blocked the sender of a blockable message
+func (c *Client) blocks(m *Message) bool {
+	return blockable(m) && blocks.has(c.username, m.Sender)
+}
+
+// Run "/block <username>" or "/unblock <username>"
+func runBlock(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Error("Usage: " + cmd.Name + " <username>")
+		return
+	}
+	target, block := cmd.Args[0], cmd.Name == "/block"
+	switch {
+	case !validUsername(target):
+		cmd.Error(usernameError)
+		return
+	case target == cmd.Username():
+		cmd.Error("You can't block yourself")
+		return
+	}
+	switch err := blocks.set(cmd.Username(), target, block); {
+	case errors.Is(err, errTooManyBlocks):
+		cmd.Error("Can't block " + target + ": " + err.Error())
+		return
+	case err != nil:
+		slog.Error("Storage error", "username", cmd.Username(), "err", err)
+		cmd.Error("Couldn't change your blocked users")
+		return
+	}
+	if block {
+		cmd.Reply("Blocked " + target + ": you won't see their messages or get their direct messages")
+	} else {
+		cmd.Reply("Unblocked " + target)
+	}
+}
+
+// Run "/blocks", listing the users the sender blocked
+func runBlocks(cmd *Command) {
+	names, err := blocks.list(cmd.Username())
+	if err != nil {
+		slog.Error("Storage error", "username", cmd.Username(), "err", err)
+		cmd.Error("Couldn't load your blocked users")
+		return
+	}
+	if len(names) == 0 {
+		cmd.Reply("You haven't blocked anyone")
+		return
+	}
+	cmd.Reply("Blocked: " + strings.Join(names, ", "))
+}
+
+// HTTP handler listing the users the requesting user blocked as ["bob"]; the
+// user comes from the token with JWT_SECRET, else from ?username=
+func serveBlocks(w http.ResponseWriter, r *http.Request) {
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	names, err := blocks.list(username)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// HTTP handler blocking the user named in the path with PUT, or unblocking them with DELETE
+func serveBlock(w http.ResponseWriter, r *http.Request) {
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	target := r.PathValue("username")
+	switch {
+	case !validUsername(target):
+		http.Error(w, usernameError, http.StatusBadRequest)
+		return
+	case target == username:
+		http.Error(w, "You can't block yourself", http.StatusBadRequest)
+		return
+	}
+	switch err := blocks.set(username, target, r.Method == http.MethodPut); {
+	case errors.Is(err, errTooManyBlocks):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
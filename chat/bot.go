@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Bot names by token, from BOT_TOKENS such as "ci=s3cret,deploy=other"
+var botTokens map[string]string
+
+// Parse BOT_TOKENS, skipping malformed entries
+func botTokensFromEnv(value string) map[string]string {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(entry, "=")
+		if !ok || !validUsername(name) || token == "" {
+			slog.Warn("Ignoring malformed BOT_TOKENS entry", "bot", name)
+			continue
+		}
+		tokens[token] = name
+	}
+	return tokens
+}
+
+// Find the bot a request's bearer token belongs to
+func botFromRequest(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for known, name := range botTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// HTTP handler posting a {"body": "..."} message to a room as the bot that owns the
+// bearer token, without a WebSocket; "ttl" makes it disappear after that many
+// seconds. Answers with the message, including its ID.
+func (h *Hub) servePost(w http.ResponseWriter, r *http.Request) {
+	if len(botTokens) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	bot, ok := botFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Body string `json:"body"`
+		TTL  int    `json:"ttl"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(readLimit))
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, "Message too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Body == "" {
+		http.Error(w, "A message needs a body", http.StatusBadRequest)
+		return
+	}
+	if err := validTTL(req.TTL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room, exists := h.lookup(r.PathValue("name"))
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	// Bots post in the clear, which end-to-end encrypted rooms refuse
+	if room.encrypted() {
+		http.Error(w, "The room is end-to-end encrypted", http.StatusForbidden)
+		return
+	}
+	m := newMessage(typeChat, req.Body)
+	if refusal := sanitize(m); refusal != nil {
+		http.Error(w, refusal.Body, http.StatusRequestEntityTooLarge)
+		return
+	}
+	m.Sender = bot
+	m.Bot = true
+	m.TTL = req.TTL
+	published := make(chan bool, 1)
+	if !room.do(func() { published <- room.publish(m) }) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if !<-published {
+		http.Error(w, "The bot is muted in this room", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(m.encode())
+}
@@ -0,0 +1,229 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// How long a bridge waits to connect again after its connection drops, doubled
+// after every failed attempt
+const (
+	bridgeBackoff    = time.Second
+	maxBridgeBackoff = 5 * time.Minute
+)
+
+// Room messages waiting to be mirrored to a bridge's channel; more are dropped
+const bridgeQueueSize = 256
+
+// bridgeNetwork is a connection to a channel on another chat network
+type bridgeNetwork interface {
+	// run joins the channel and relays both ways, sending the room's messages from
+	// b.outgoing and handing the channel's to b.receive, until the connection
+	// fails or ctx is done
+	run(ctx context.Context, b *roomBridge) error
+}
+
+// roomBridge mirrors a room to a channel on another network, both ways
+type roomBridge struct {
+	room     string
+	target   string // the configured URL, without its password
+	network  bridgeNetwork
+	outgoing chan *Message
+	hub      *Hub
+}
+
+// bridgeSet holds the bridges configured in BRIDGES, by room
+type bridgeSet struct {
+	rooms  map[string][]*roomBridge
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Configured bridges, nil without BRIDGES
+var bridges *bridgeSet
+
+// Parse BRIDGES, comma separated room=URL entries such as
+// "lobby=ircs://chatbridge@irc.libera.chat/#chat-app,dev=matrix://matrix.org/#dev:matrix.org";
+// exits if an entry is invalid
+func newBridgesFromEnv() *bridgeSet {
+	value := os.Getenv("BRIDGES")
+	if value == "" {
+		return nil
+	}
+	s := &bridgeSet{rooms: make(map[string][]*roomBridge)}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		room, target, ok := strings.Cut(entry, "=")
+		if room = strings.TrimSpace(room); !ok || room == "" {
+			fatal("Invalid BRIDGES entry, expected room=URL", "entry", entry)
+		}
+		b, err := newRoomBridge(room, target)
+		if err != nil {
+			fatal("Invalid BRIDGES entry", "room", room, "err", err)
+		}
+		s.rooms[room] = append(s.rooms[room], b)
+	}
+	if len(s.rooms) == 0 {
+		return nil
+	}
+	return s
+}
+
+// Set up the bridge of a room to an irc://, ircs://, matrix:// or matrix+http:// URL
+func newRoomBridge(room, target string) (*roomBridge, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	b := &roomBridge{room: room, target: u.Redacted(), outgoing: make(chan *Message, bridgeQueueSize)}
+	switch u.Scheme {
+	case "irc", "ircs":
+		b.network, err = newIRCBridge(u)
+	case "matrix", "matrix+http":
+		b.network, err = newMatrixBridge(u)
+	default:
+		err = fmt.Errorf("unknown bridge scheme %q, expected irc, ircs, matrix or matrix+http", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Connect every bridge, reconnecting dropped ones until stop. With CLUSTER_NODES,
+// each node only bridges the rooms it owns.
+func (s *bridgeSet) start(h *Hub) {
+	if s == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for room, list := range s.rooms {
+		if shards != nil && shards.owner(room) != shards.self {
+			continue
+		}
+		for _, b := range list {
+			b.hub = h
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				b.run(ctx)
+			}()
+		}
+	}
+}
+
+// Disconnect every bridge and wait until they're gone
+func (s *bridgeSet) stop() {
+	if s == nil || s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Queue a message of the room for its bridges, other than the one it came in
+// through; dropped for bridges too far behind
+func (s *bridgeSet) relay(room string, m *Message) {
+	if s == nil {
+		return
+	}
+	for _, b := range s.rooms[room] {
+		if b == m.bridge || b.hub == nil {
+			continue
+		}
+		copied := *m
+		select {
+		case b.outgoing <- &copied:
+		default:
+			slog.Warn("Bridge queue full, dropping message", "room", room, "bridge", b.target)
+		}
+	}
+}
+
+// Keep the bridge connected until ctx is done, waiting longer after every failure
+func (b *roomBridge) run(ctx context.Context) {
+	backoff := bridgeBackoff
+	for {
+		started := time.Now()
+		err := b.network.run(ctx, b)
+		if ctx.Err() != nil {
+			return
+		}
+		// A connection that lasted a while was healthy, so start waiting afresh
+		if time.Since(started) > maxBridgeBackoff {
+			backoff = bridgeBackoff
+		}
+		slog.Warn("Bridge disconnected", "room", b.room, "bridge", b.target, "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBridgeBackoff)
+	}
+}
+
+// Publish a message from the bridged channel to the room, from a bridged user
+// named as bridgedName makes them; dropped if that user is banned from the room
+// or server
+func (b *roomBridge) receive(sender, body string, action bool) {
+	m := newMessage(typeChat, body)
+	m.Sender, m.Action, m.bridge = sender, action, b
+	if refusal := sanitize(m); refusal != nil || m.Body == "" {
+		return
+	}
+	room := b.hub.room(b.room, "")
+	if room == nil {
+		return
+	}
+	room.do(func() {
+		if room.access.isBanned(m.Sender) || serverBanned(m.Sender) {
+			return
+		}
+		room.publish(m)
+	})
+}
+
+// Name a user of another network in the room: an IRC nick gets an @irc suffix
+// and a Matrix user keeps its @user:server ID, cut to the longest username
+func bridgedName(name, suffix string) string {
+	name = cleanText(strings.TrimSpace(name))
+	for len(name)+len(suffix) > maxUsernameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name + suffix
+}
+
+// Report whether a username is one bridges give to users of other networks,
+// which local users can't take while bridges are configured
+func isBridgedName(username string) bool {
+	return bridges != nil && (strings.HasSuffix(username, ircSuffix) || strings.HasPrefix(username, "@"))
+}
+
+// Describe a room message in plain text for a network without this server's
+// envelope: "<alice> hi", "* alice waves", or a file's name and link; empty for
+// messages that have no such form
+func bridgeText(m *Message) string {
+	switch {
+	case m.Type == typeAttachment && m.Attachment != nil:
+		return fmt.Sprintf("* %s shared %s: %s", m.Sender, m.Attachment.Name, m.Attachment.URL)
+	case m.Type != typeChat:
+		return ""
+	case m.Data != nil:
+		return fmt.Sprintf("* %s sent a binary message, %d bytes", m.Sender, len(m.Data))
+	case m.Action:
+		return "* " + m.Sender + " " + m.Body
+	}
+	return "<" + m.Sender + "> " + m.Body
+}
@@ -0,0 +1,256 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long a Matrix sync waits for new events before returning empty
+const matrixSyncTimeout = 30 * time.Second
+
+// Largest homeserver response read
+const matrixMaxResponse = 16 << 20
+
+// Times a request is retried when the homeserver says it's rate limited
+const matrixRetries = 3
+
+// Transaction IDs of the events bridges send, unique for the process
+var matrixTxnIDs atomic.Uint64
+
+// matrixBridge follows a Matrix room through the client-server API, with the
+// access token of a user the homeserver has for the bridge
+type matrixBridge struct {
+	homeserver string // base URL, such as https://matrix.org
+	room       string // room ID or alias joined
+	token      string
+	client     *http.Client
+}
+
+// Set up a Matrix bridge from a URL such as matrix://matrix.org/!roomid:matrix.org,
+// or matrix://matrix.org/#alias:matrix.org for a room alias; matrix+http:// talks
+// to the homeserver without TLS. The access token comes from MATRIX_TOKEN.
+func newMatrixBridge(u *url.URL) (*matrixBridge, error) {
+	token := os.Getenv("MATRIX_TOKEN")
+	if token == "" {
+		return nil, errors.New("Matrix bridges need the bridge user's access token in MATRIX_TOKEN")
+	}
+	if u.Host == "" {
+		return nil, errors.New("a Matrix bridge needs a homeserver")
+	}
+	room := strings.TrimPrefix(u.Path, "/")
+	if u.Fragment != "" {
+		room = "#" + u.Fragment
+	}
+	if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") || !strings.Contains(room, ":") {
+		return nil, errors.New("a Matrix bridge needs a room ID or alias, as in matrix://matrix.org/#room:matrix.org")
+	}
+	scheme := "https"
+	if u.Scheme == "matrix+http" {
+		scheme = "http"
+	}
+	return &matrixBridge{
+		homeserver: scheme + "://" + u.Host,
+		room:       room,
+		token:      token,
+		client:     &http.Client{Timeout: matrixSyncTimeout + writeTimeout},
+	}, nil
+}
+
+// matrixError is an error response of the homeserver
+type matrixError struct {
+	status     int
+	Code       string `json:"errcode"`
+	Message    string `json:"error"`
+	RetryAfter int64  `json:"retry_after_ms"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix: %d %s: %s", e.status, e.Code, e.Message)
+}
+
+// Call the client-server API, decoding the response into result; requests the
+// homeserver rate limits are retried after the wait it asks for
+func (x *matrixBridge) call(ctx context.Context, method, path string, query url.Values, body, result any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	target := x.homeserver + "/_matrix/client/v3" + path
+	if query != nil {
+		target += "?" + query.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+x.token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := x.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, matrixMaxResponse))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode < 300 {
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(data, result)
+		}
+		e := &matrixError{status: resp.StatusCode}
+		json.Unmarshal(data, e)
+		if e.status != http.StatusTooManyRequests || attempt == matrixRetries {
+			return e
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(max(e.RetryAfter, 1000)) * time.Millisecond):
+		}
+	}
+}
+
+// matrixSync is the part of a /sync response a bridge reads
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// matrixEvent is a room event, of which bridges relay m.room.message
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType   string `json:"msgtype"`
+		Body      string `json:"body"`
+		URL       string `json:"url"` // mxc:// URL of a file
+		RelatesTo *struct {
+			RelType string `json:"rel_type"`
+		} `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+func (x *matrixBridge) run(ctx context.Context, b *roomBridge) error {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := x.call(ctx, http.MethodGet, "/account/whoami", nil, nil, &whoami); err != nil {
+		return err
+	}
+	var joined struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := x.call(ctx, http.MethodPost, "/join/"+url.PathEscape(x.room), nil, struct{}{}, &joined); err != nil {
+		return err
+	}
+	filter, _ := json.Marshal(map[string]any{
+		"room":         map[string]any{"rooms": []string{joined.RoomID}, "timeline": map[string]any{"types": []string{"m.room.message"}, "limit": 50}, "state": map[string]any{"types": []string{}}, "ephemeral": map[string]any{"types": []string{}}, "account_data": map[string]any{"types": []string{}}},
+		"presence":     map[string]any{"types": []string{}},
+		"account_data": map[string]any{"types": []string{}},
+	})
+
+	// Send the room's messages while the sync below follows the Matrix room
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-b.outgoing:
+				if err := x.send(ctx, joined.RoomID, m); err != nil {
+					failed <- err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	// The first sync only marks where the room is, so its history isn't relayed again
+	since := ""
+	for {
+		query := url.Values{"filter": {string(filter)}}
+		if since != "" {
+			query.Set("since", since)
+			query.Set("timeout", strconv.FormatInt(matrixSyncTimeout.Milliseconds(), 10))
+		}
+		var sync matrixSync
+		if err := x.call(ctx, http.MethodGet, "/sync", query, nil, &sync); err != nil {
+			select {
+			case err = <-failed:
+			default:
+			}
+			return err
+		}
+		if since != "" {
+			for _, event := range sync.Rooms.Join[joined.RoomID].Timeline.Events {
+				if event.Type == "m.room.message" && event.Sender != whoami.UserID {
+					x.receive(b, event)
+				}
+			}
+		}
+		since = sync.NextBatch
+	}
+}
+
+// Hand a Matrix message to the room: text and notices as chat, emotes as /me
+// messages and files as their name and link. Edits are skipped, since the room
+// already has the message.
+func (x *matrixBridge) receive(b *roomBridge, event matrixEvent) {
+	c := event.Content
+	if c.RelatesTo != nil && c.RelatesTo.RelType == "m.replace" {
+		return
+	}
+	switch c.MsgType {
+	case "m.text", "m.notice":
+		b.receive(bridgedName(event.Sender, ""), c.Body, false)
+	case "m.emote":
+		b.receive(bridgedName(event.Sender, ""), c.Body, true)
+	case "m.image", "m.file", "m.audio", "m.video":
+		body := "shared " + c.Body
+		if link, ok := strings.CutPrefix(c.URL, "mxc://"); ok {
+			body += ": " + x.homeserver + "/_matrix/media/v3/download/" + link
+		}
+		b.receive(bridgedName(event.Sender, ""), body, true)
+	}
+}
+
+// Post a room message to the Matrix room
+func (x *matrixBridge) send(ctx context.Context, roomID string, m *Message) error {
+	text := bridgeText(m)
+	if text == "" {
+		return nil
+	}
+	content := map[string]string{"msgtype": "m.text", "body": text}
+	txn := fmt.Sprintf("chat-app-%d-%d", time.Now().UnixMilli(), matrixTxnIDs.Add(1))
+	path := "/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + txn
+	return x.call(ctx, http.MethodPut, path, nil, content, nil)
+}
@@ -0,0 +1,107 @@
+package chat
+
+// States of a call between two members of a room
+const (
+	callRinging = "ringing" // offered, waiting for the callee to answer
+	callActive  = "active"  // answered; the peers are connected or connecting
+)
+
+// call is a voice or video call the room relays signaling for. The media flows
+// peer to peer, so the room only tracks who is calling whom.
+type call struct {
+	caller, callee string
+	state          string
+}
+
+// The other party of a call
+func (c *call) peer(username string) string {
+	if username == c.caller {
+		return c.callee
+	}
+	return c.caller
+}
+
+// Relay a signaling message from a client to the user named in m.To, checking
+// it against the calls between them; runs on the room goroutine
+func (r *Room) signal(c *Client, m *Message) {
+	if m.To == "" || m.To == c.username {
+		r.sendTo(c, errorMessage("A call message needs another member of the room in to"))
+		return
+	}
+	current := r.calls[c.username]
+	if current != nil && current.peer(c.username) != m.To {
+		current = nil
+	}
+	switch m.Type {
+	case typeCallOffer:
+		if r.calls[c.username] != nil {
+			r.sendTo(c, errorMessage("You are already in a call"))
+			return
+		}
+		if r.connections[m.To] == 0 {
+			r.sendTo(c, errorMessage(m.To+" is not in this room"))
+			return
+		}
+		if r.calls[m.To] != nil {
+			busy := newMessage(typeCallBusy, "")
+			busy.Sender = m.To
+			r.sendTo(c, busy)
+			return
+		}
+		current = &call{caller: c.username, callee: m.To, state: callRinging}
+		r.calls[c.username], r.calls[m.To] = current, current
+	case typeCallAnswer:
+		if current == nil || current.callee != c.username || current.state != callRinging {
+			r.sendTo(c, errorMessage("No call from "+m.To+" to answer"))
+			return
+		}
+		current.state = callActive
+	case typeCallDecline:
+		if current == nil || current.callee != c.username || current.state != callRinging {
+			r.sendTo(c, errorMessage("No call from "+m.To+" to decline"))
+			return
+		}
+		r.endCall(current)
+	case typeCallEnd:
+		if current == nil {
+			r.sendTo(c, errorMessage("No call with "+m.To+" to end"))
+			return
+		}
+		r.endCall(current)
+	case typeICECandidate:
+		if current == nil {
+			r.sendTo(c, errorMessage("No call with "+m.To))
+			return
+		}
+	}
+	relayed := newMessage(m.Type, m.Body)
+	relayed.Sender, relayed.To, relayed.Signal = c.username, m.To, m.Signal
+	r.sendToUser(m.To, relayed)
+}
+
+// Forget a call; runs on the room goroutine
+func (r *Room) endCall(c *call) {
+	delete(r.calls, c.caller)
+	delete(r.calls, c.callee)
+}
+
+// End the call of a user who left the room, telling the other party; runs on the room goroutine
+func (r *Room) hangUp(username string) {
+	current := r.calls[username]
+	if current == nil {
+		return
+	}
+	r.endCall(current)
+	end := newMessage(typeCallEnd, "disconnected")
+	end.Sender, end.To = username, current.peer(username)
+	r.sendToUser(end.To, end)
+}
+
+// Send a message to every chatting connection of a user in the room; runs on the room goroutine
+func (r *Room) sendToUser(username string, m *Message) {
+	for client := range r.clients {
+		if client.username == username && !client.presenceOnly {
+			r.sendTo(client, m)
+		}
+	}
+}
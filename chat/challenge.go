@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"os"
+	"time"
+
+	"chat-app/internal/env"
+
+	"github.com/gorilla/websocket"
+)
+
+// Challenge types a new connection may have to answer before joining its room
+const (
+	challengeEcho = "echo" // send back the server's nonce
+	challengePoW  = "pow"  // find a suffix giving sha256(nonce+suffix) enough leading zero bits
+)
+
+// challengeConfig describes the challenge new connections must pass
+type challengeConfig struct {
+	kind       string
+	difficulty int // leading zero bits required by proof of work
+	timeout    time.Duration
+}
+
+// Challenge settings from CHALLENGE, CHALLENGE_DIFFICULTY and CHALLENGE_TIMEOUT; no challenge when kind is empty
+var challenge challengeConfig
+
+var errChallengeFailed = errors.New("challenge failed")
+
+// Read the challenge settings from the environment
+func challengeFromEnv() challengeConfig {
+	kind := os.Getenv("CHALLENGE")
+	if kind != "" && kind != challengeEcho && kind != challengePoW {
+		slog.Warn("Unknown CHALLENGE, not challenging connections", "challenge", kind)
+		kind = ""
+	}
+	return challengeConfig{
+		kind:       kind,
+		difficulty: env.Int("CHALLENGE_DIFFICULTY", 16),
+		timeout:    env.Duration("CHALLENGE_TIMEOUT", 10*time.Second),
+	}
+}
+
+// Challenge a freshly upgraded connection; must run before its pumps start
+func (cfg challengeConfig) run(conn *websocket.Conn) error {
+	if cfg.kind == "" {
+		return nil
+	}
+	// The body is "echo <nonce>" or "pow <nonce> <difficulty>", answered by a
+	// challenge message whose body is the nonce or the proof of work suffix
+	nonce := newSessionID()
+	prompt := "echo " + nonce
+	if cfg.kind == challengePoW {
+		prompt = fmt.Sprintf("pow %s %d", nonce, cfg.difficulty)
+	}
+	conn.SetWriteDeadline(time.Now().Add(cfg.timeout))
+	packed := conn.Subprotocol() == protocolMsgpack
+	question := singleFrame(newMessage(typeChallenge, prompt), packed)
+	if err := conn.WriteMessage(question.messageType, question.data); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(cfg.timeout))
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Time{})
+
+	answer, err := decodeFrame(messageType, data, packed)
+	if err != nil {
+		return err
+	}
+	if cfg.kind == challengeEcho && answer.Body == nonce {
+		return nil
+	}
+	if cfg.kind == challengePoW && leadingZeroBits(sha256.Sum256([]byte(nonce+answer.Body))) >= cfg.difficulty {
+		return nil
+	}
+	return errChallengeFailed
+}
+
+// Count the leading zero bits of a hash
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
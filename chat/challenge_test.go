@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connect to a room that challenges new connections, returning the challenge's prompt
+func dialChallenged(t *testing.T, srv *httptest.Server, username string) (*testConn, []string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, url.Values{"room": {"guarded"}, "username": {username}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testConn{Conn: conn, t: t}
+	m := c.next()
+	if m.Type != typeChallenge {
+		t.Fatalf("first message = %+v, want a challenge", m)
+	}
+	return c, strings.Fields(m.Body)
+}
+
+// Find a proof of work suffix for a nonce
+func solve(nonce string, difficulty int) string {
+	for i := 0; ; i++ {
+		suffix := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(nonce+suffix))) >= difficulty {
+			return suffix
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		config challengeConfig
+		answer func(prompt []string) string
+		pass   bool
+	}{
+		{"echo", challengeConfig{kind: challengeEcho, timeout: time.Second}, func(p []string) string { return p[1] }, true},
+		{"wrong echo", challengeConfig{kind: challengeEcho, timeout: time.Second}, func(p []string) string { return "guess" }, false},
+		{"pow", challengeConfig{kind: challengePoW, difficulty: 8, timeout: time.Second}, func(p []string) string {
+			difficulty, _ := strconv.Atoi(p[2])
+			return solve(p[1], difficulty)
+		}, true},
+		{"wrong pow", challengeConfig{kind: challengePoW, difficulty: 24, timeout: time.Second}, func(p []string) string { return "0" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFor(t, &challenge, tt.config)
+			_, srv, _ := newTestServer(t)
+			c, prompt := dialChallenged(t, srv, "bot")
+			c.send(&Message{Type: typeChallenge, Body: tt.answer(prompt)})
+			if tt.pass {
+				if m := c.expect(typeMembers); len(m.Members) != 1 || m.Members[0] != "bot" {
+					t.Errorf("members = %q, want the client registered", m.Members)
+				}
+				return
+			}
+			err := c.expectClosed()
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("connection ended with %v, want a policy violation close", err)
+			}
+		})
+	}
+}
+
+func TestChallengeTimesOut(t *testing.T) {
+	setFor(t, &challenge, challengeConfig{kind: challengeEcho, timeout: 100 * time.Millisecond})
+	_, srv, _ := newTestServer(t)
+	c, _ := dialChallenged(t, srv, "bot")
+	c.expectClosed()
+}
+
+func TestChallengeAnswerIsReadLimited(t *testing.T) {
+	setFor(t, &challenge, challengeConfig{kind: challengeEcho, timeout: time.Second})
+	_, srv, _ := newTestServer(t)
+	c, _ := dialChallenged(t, srv, "bot")
+	c.say(strings.Repeat("a", readLimit+1))
+	if err := c.expectClosed(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("connection ended with %v, want a message too big close", err)
+	}
+}
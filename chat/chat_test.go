@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a test waits for a message before failing
+const testTimeout = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	os.Setenv("LOG_LEVEL", "error")
+	ConfigureFromEnv()
+	os.Exit(m.Run())
+}
+
+// Start a hub behind a test server routing /ws to it; more routes can be added to mux
+func newTestServer(t testing.TB) (*Hub, *httptest.Server, *http.ServeMux) {
+	t.Helper()
+	hub := NewHub(time.Minute)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.joinRoom)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		hub.stopAll(websocket.CloseGoingAway, "test over")
+		srv.Close()
+	})
+	return hub, srv, mux
+}
+
+// Store messages in a fresh SQLite database for the length of a test
+func useTestStore(t testing.TB) Store {
+	t.Helper()
+	s, err := openStore("sqlite://" + filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	setFor[Store](t, &store, s)
+	return s
+}
+
+// testConn is a WebSocket connection to a test server
+type testConn struct {
+	*websocket.Conn
+	t testing.TB
+}
+
+// Join a room over a WebSocket with the given query parameters, failing the test if refused
+func dial(t testing.TB, srv *httptest.Server, query url.Values) *testConn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, query), nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", query.Encode(), err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, t: t}
+}
+
+// Join a room as a user
+func join(t testing.TB, srv *httptest.Server, room, username string) *testConn {
+	t.Helper()
+	c := dial(t, srv, url.Values{"room": {room}, "username": {username}})
+	c.expect(typeMembers)
+	return c
+}
+
+// URL of a test server's WebSocket endpoint
+func wsURL(srv *httptest.Server, query url.Values) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?" + query.Encode()
+}
+
+// Read the next message, failing the test if none comes in time
+func (c *testConn) next() *Message {
+	c.t.Helper()
+	m, err := c.read(testTimeout)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return m
+}
+
+// Read the next message within d
+func (c *testConn) read(d time.Duration) (*Message, error) {
+	c.SetReadDeadline(time.Now().Add(d))
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		c.t.Fatalf("decode %s: %v", data, err)
+	}
+	return &m, nil
+}
+
+// Skip messages until one of the given type, failing the test if none comes in time
+func (c *testConn) expect(typ string) *Message {
+	c.t.Helper()
+	for {
+		if m := c.next(); m.Type == typ {
+			return m
+		}
+	}
+}
+
+// Read the messages received until none comes for d
+func (c *testConn) drain(d time.Duration) []*Message {
+	var got []*Message
+	for {
+		m, err := c.read(d)
+		if err != nil {
+			return got
+		}
+		got = append(got, m)
+	}
+}
+
+// Send a message, failing the test if it can't be written
+func (c *testConn) send(m *Message) {
+	c.t.Helper()
+	if err := c.WriteJSON(m); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// Send a chat message
+func (c *testConn) say(body string) {
+	c.t.Helper()
+	c.send(&Message{Type: typeChat, Body: body})
+}
+
+// Wait for the server to close the connection, failing the test if it doesn't,
+// and return the error reading ended with
+func (c *testConn) expectClosed() error {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.t.Fatal("the connection wasn't closed")
+		}
+		return err
+	}
+}
+
+// Set a configuration variable for the length of a test
+func setFor[T any](t testing.TB, v *T, value T) {
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
@@ -0,0 +1,506 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chat-app/internal/env"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Longest username accepted when joining
+const maxUsernameLength = 32
+
+var usernameError = fmt.Sprintf("Username is required and must be at most %d bytes of text without control characters", maxUsernameLength)
+
+// Report whether a username can be used to chat
+func validUsername(username string) bool {
+	return username != "" && len(username) <= maxUsernameLength && cleanText(username) == username
+}
+
+var errMessageTooBig = errors.New("message decompresses beyond the size limit")
+
+// Client represents a single chatting user
+type Client struct {
+	conn     *websocket.Conn // nil for clients connected over server-sent events
+	socket   *socket         // the WebSocket shared with the other rooms joined over it, nil for other transports
+	room     *Room
+	send     chan frame
+	username string
+	// Profile of the user's account, shown with their messages
+	displayName string
+	avatar      string
+	email       string // verified by an identity provider, if the user signed in with one
+	limiter     *tokenBucket
+	ip          string
+	connID      uint64 // tags the connection's log lines
+	// throttling is set while messages are being dropped, so the throttle event
+	// is sent once per burst; only used by whoever reads the client's messages
+	throttling bool
+	typingAt   time.Time // when typing_start was last relayed, zero when not typing; used like throttling
+	// presenceOnly clients receive join/leave/member events but no chat
+	presenceOnly bool
+	sessionID    string
+	replaces     string // session ID of a live connection this one takes over from, if any
+	lastSeen     uint64 // ID of the last message seen before reconnecting, 0 for a fresh join
+	binary       bool   // negotiated a protocol that accepts binary frames
+	msgpack      bool   // negotiated chat-msgpack, so its frames both ways are MessagePack
+	joinedAt     time.Time
+	lastMessage  time.Time // only used by the room goroutine
+	slow         bool      // warned that its send buffer is filling up; only used by the room goroutine and its fanout
+	// Close frame writePump sends once the room closes send, a normal closure by default;
+	// the reason goes in a leave event instead while the WebSocket is in other rooms
+	closeCode   int
+	closeReason string
+	refusal     *Message // error event for a client refused joining, sent before the close frame
+	// waiting is set while the client is in line for a full room, which it hasn't joined yet
+	waiting atomic.Bool
+	// shadowBanned clients' messages are only echoed back to them
+	shadowBanned atomic.Bool
+}
+
+// Act on a message from the client in a span continuing the trace it was sent with
+func (c *Client) receive(m *Message) {
+	_, span := tracer.Start(messageContext(m), "chat.receive",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("chat.type", m.Type), attribute.String("chat.room", c.room.name), attribute.String("chat.username", c.username)),
+	)
+	defer span.End()
+	setTrace(m, span)
+	c.handle(m)
+}
+
+// Act on a message from the client
+func (c *Client) handle(m *Message) {
+	if c.waiting.Load() {
+		c.replyWith(codedError(errCodeRoomFull, "You're still in line to join the room"))
+		return
+	}
+	if c.shadowBanned.Load() {
+		switch m.Type {
+		// Others would see these, so they're dropped without telling the sender
+		case typeTyping, typeStopped, typeReactionAdd, typeReactionRemove, typePinned, typeUnpinned,
+			typePollCreate, typePollVote, typeStatus, typeRoomUpdate, typeKeyExchange,
+			typeCallOffer, typeCallAnswer, typeICECandidate, typeCallDecline, typeCallEnd:
+			return
+		}
+	}
+	switch m.Type {
+	case typeChat:
+		c.sendChat(m)
+	case typeEncrypted:
+		c.sendEncrypted(m)
+	case typeKeyExchange:
+		if !c.throttled() {
+			c.room.do(func() { c.room.exchangeKeys(c, m) })
+		}
+	case typeDM:
+		c.sendDirect(m)
+	case typeTyping, typeStopped:
+		c.sendTyping(m.Type)
+	case typeEdit, typeDelete:
+		if !c.throttled() {
+			c.room.do(func() { c.room.modifyMessage(c, m) })
+		}
+	case typeRead:
+		c.room.do(func() { c.room.markRead(c, m.ID) })
+	case typeRoomUpdate:
+		if m.Meta == nil {
+			c.replyError("A room update needs a meta object")
+			break
+		}
+		c.room.do(func() {
+			if _, err := c.room.updateMeta(c.username, m.Meta); err != nil {
+				c.room.sendTo(c, errorMessage("Can't update the room: "+err.Error()))
+			}
+		})
+	case typeUnread:
+		if !c.throttled() {
+			c.sendUnread()
+		}
+	case typeThread:
+		if !c.throttled() {
+			c.room.do(func() { c.room.sendThread(c, m.ID) })
+		}
+	case typePinned, typeUnpinned:
+		if !c.throttled() {
+			c.room.do(func() { c.room.pin(c, m) })
+		}
+	case typeReactionAdd, typeReactionRemove:
+		if !c.throttled() {
+			c.room.do(func() { c.room.react(c, m) })
+		}
+	case typePollCreate:
+		if !c.throttled() {
+			c.room.do(func() { c.room.createPoll(c, m) })
+		}
+	case typePollVote:
+		if !c.throttled() {
+			c.room.do(func() { c.room.vote(c, m) })
+		}
+	case typeStatus:
+		if !c.throttled() {
+			c.setStatus(m)
+		}
+	case typeActivity:
+		// Reading it was enough to count as activity
+	case typeSubscribe, typeUnsubscribe:
+		c.replyError("Only WebSocket connections can join more rooms; open another connection instead")
+	case typeCallOffer, typeCallAnswer, typeICECandidate, typeCallDecline, typeCallEnd:
+		// Not throttled, as setting up a call takes a burst of ICE candidates
+		c.room.do(func() { c.room.signal(c, m) })
+	default:
+		c.replyError("Unknown message type " + m.Type)
+	}
+}
+
+// Leave the room once the client's connection has ended, keeping its session for resuming
+func (c *Client) disconnect() {
+	connLimits.release(c.ip)
+	c.leave()
+	c.keepSession()
+}
+
+// Leave the client's room; the room closes send once it has
+func (c *Client) leave() {
+	if !c.presenceOnly {
+		users.remove(c)
+	}
+	select {
+	case c.room.unregister <- c:
+	case <-c.room.done:
+	}
+}
+
+// Keep the session of a client that left for resuming
+func (c *Client) keepSession() {
+	if !c.presenceOnly {
+		sessions.put(&session{id: c.sessionID, username: c.username, room: c.room.name})
+	}
+}
+
+// Broadcast a chat message from this client, unless it is a command
+func (c *Client) sendChat(m *Message) {
+	body := m.Body
+	if m.Data == nil {
+		if c.handleCommand(body) {
+			return
+		}
+		if escaped, ok := strings.CutPrefix(body, "//"); ok {
+			body = "/" + escaped
+		}
+	}
+	if err := validTTL(m.TTL); err != nil {
+		c.replyError("Can't send the message: " + err.Error())
+		return
+	}
+	message := &Message{Type: typeChat, Body: body, Data: m.Data, ParentID: m.ParentID, TTL: m.TTL, ref: m.Ref, span: m.span}
+	if m.SendAt > time.Now().UnixMilli() {
+		// Scheduled messages are stored until they're due
+		if c.room.encrypted() {
+			c.replyWith(codedError(errCodeE2E, "Messages can't be scheduled in an end-to-end encrypted room"))
+			return
+		}
+		message.SendAt = m.SendAt
+		c.scheduleChat(message)
+		return
+	}
+	c.post(message)
+}
+
+// Broadcast a chat message as this client, unless it is over the rate limit
+func (c *Client) post(m *Message) {
+	if c.throttled() {
+		return
+	}
+	c.typingAt = time.Time{} // sending ends typing, clients drop the indicator on the chat message
+	m.Sender, m.from = c.username, c
+	m.DisplayName, m.Avatar = c.displayName, c.avatar
+	select {
+	case c.room.broadcast <- m:
+	case <-c.room.done:
+	}
+}
+
+// Report whether an error only means the connection was closed by either side
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, websocket.ErrCloseSent) ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// WebSocket handler, reporting whether the client was started
+func (h *Hub) serveWs(roomName string, client *Client, w http.ResponseWriter, r *http.Request) bool {
+	_, span := tracer.Start(traceFormat.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), "chat.upgrade",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("chat.room", roomName), attribute.String("chat.username", client.username)),
+	)
+	defer span.End()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		client.logger().Warn("Upgrade error", "err", err)
+		upgradeFailures.Inc()
+		connAudit.record(r, client.username, connUpgradeFailed, err.Error())
+		return false
+	}
+	// Limit reads before anything is read, the challenge's answer included
+	conn.SetReadLimit(int64(readLimit))
+	if err := challenge.run(conn); err != nil {
+		connAudit.record(r, client.username, connChallengeFailed, err.Error())
+		closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "challenge failed")
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		conn.Close()
+		return false
+	}
+	client.conn = conn
+	client.send = make(chan frame, sendBufferSize)
+	client.msgpack = conn.Subprotocol() == protocolMsgpack
+	client.binary = client.msgpack || conn.Subprotocol() == protocolBinary
+	client.joinedAt = time.Now()
+	client.limiter = newTokenBucket(messageRate, messageBurst)
+	s := newSocket(h, conn, client)
+	if !h.register(roomName, client) {
+		code, reason := client.closeCode, client.closeReason
+		if code == 0 {
+			code, reason = websocket.CloseGoingAway, "server shutting down"
+		}
+		if client.refusal != nil {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			refusal := singleFrame(client.refusal, client.msgpack)
+			conn.WriteMessage(refusal.messageType, refusal.data)
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		conn.Close()
+		return false
+	}
+	s.add(client)
+	connAudit.record(r, client.username, connSuccess, "")
+	pumps.Add(1)
+	go s.writePump()
+	go s.readPump()
+	return true
+}
+
+// Add a client to its room, creating the room if needed; false once the hub is stopped
+func (h *Hub) register(roomName string, client *Client) bool {
+	// A room can close between looking it up and registering, then the hub makes a new one
+	for registered := false; !registered; {
+		client.room = h.room(roomName, client.username)
+		if client.room == nil {
+			return false
+		}
+		// Joining settles the username, so wait for the room's answer
+		joined := make(chan bool, 1)
+		if client.room.do(func() { joined <- client.room.join(client) }) {
+			if !<-joined {
+				return false
+			}
+			registered = true
+		}
+	}
+	// Clients in line are added once admitted
+	if !client.presenceOnly && !client.waiting.Load() {
+		users.add(client)
+	}
+	return true
+}
+
+// WebSocket upgrader
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return origins.allows(r) },
+	Subprotocols:    []string{protocolMsgpack, protocolBinary, protocolJSON, protocolText},
+}
+
+// Running writePumps, waited for when shutting down
+var pumps sync.WaitGroup
+
+// Sessions of recently disconnected clients that may be resumed
+var sessions *sessionStore
+
+// Room membership, shared across instances when backed by Redis
+var presence PresenceStore
+
+// Persistent message storage, nil when STORAGE_DSN isn't set
+var store Store
+
+// Relay between server instances, nil when running a single instance
+var backplane Backplane
+
+// Sampler for the analytics event stream, nil when disabled
+var analytics *analyticsSampler
+
+// Query parameters understood by joinRoom and serveEvents
+var joinParams = map[string]bool{"room": true, "username": true, "presence": true, "session": true, "token": true, "last_seen_id": true, "password": true, "invite": true}
+
+// Disconnect clients that send nothing for idleTimeout, warning them idleWarning before;
+// from IDLE_TIMEOUT and IDLE_WARNING, disabled when the timeout is zero
+var (
+	idleTimeout time.Duration
+	idleWarning time.Duration
+)
+
+// Check IDLE_WARNING against the idle timeout: at most half of it, so clients
+// with a short timeout are warned halfway through rather than as they connect
+func idleWarningFromEnv(timeout time.Duration) time.Duration {
+	return min(env.Duration("IDLE_WARNING", 30*time.Second), timeout/2)
+}
+
+// Reject unknown query parameters instead of ignoring them, from STRICT_QUERY
+var strictQuery bool
+
+// Concurrent connections allowed per IP, from MAX_CONNECTIONS_PER_IP
+var connLimits = newConnLimiter(0)
+
+// List the query parameters that aren't in known, sorted
+func unknownParams(query url.Values, known map[string]bool) []string {
+	var unknown []string
+	for key := range query {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// HTTP handler to join a room over a WebSocket
+func (h *Hub) joinRoom(w http.ResponseWriter, r *http.Request) {
+	h.admit(w, r, h.serveWs)
+}
+
+// Check a request to join a room and build its client, then hand it to serve,
+// which reports whether the client was started
+func (h *Hub) admit(w http.ResponseWriter, r *http.Request, serve func(roomName string, client *Client, w http.ResponseWriter, r *http.Request) bool) {
+	if strictQuery {
+		if unknown := unknownParams(r.URL.Query(), joinParams); len(unknown) > 0 {
+			message := "Unknown query parameters: " + strings.Join(unknown, ", ")
+			connAudit.record(r, r.URL.Query().Get("username"), connBadRequest, message)
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+	}
+	roomName := r.URL.Query().Get("room")
+	username := r.URL.Query().Get("username") // Get the username from the query parameters
+	if bannedIPs.contains(remoteIP(r)) {
+		connAudit.record(r, username, connBanned, "banned address")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if maintenance.Load() {
+		connAudit.record(r, username, connMaintenance, "")
+		http.Error(w, "The server is down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	client := &Client{
+		ip:           remoteIP(r),
+		connID:       connIDs.Add(1),
+		username:     username,
+		presenceOnly: r.URL.Query().Get("presence") == "true",
+		sessionID:    newSessionID(),
+	}
+	if id := r.URL.Query().Get("last_seen_id"); id != "" {
+		lastSeen, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			connAudit.record(r, username, connBadRequest, "invalid last_seen_id")
+			http.Error(w, "Invalid last_seen_id", http.StatusBadRequest)
+			return
+		}
+		client.lastSeen = lastSeen
+	}
+	// With authentication on, the identity comes from the verified token only
+	if jwtSecret != nil {
+		claims, err := verifyClaims(tokenFromRequest(r))
+		if err != nil {
+			connAudit.record(r, username, connAuthFailed, err.Error())
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		client.username, client.displayName, client.email = claims.Subject, claims.Name, claims.Email
+		if accounts {
+			ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+			a, err := store.Account(ctx, claims.Subject)
+			cancel()
+			if err != nil || a == nil {
+				connAudit.record(r, username, connAuthFailed, "no such account")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			client.displayName, client.avatar = cmp.Or(a.DisplayName, client.displayName), a.Avatar
+		}
+	}
+	// Resume a previous session of the same user, keeping its session ID, or take over
+	// from a connection that hasn't noticed it's gone yet
+	if id := r.URL.Query().Get("session"); id != "" {
+		if sess, ok := sessions.take(id); ok && sess.room == roomName && (jwtSecret == nil || sess.username == client.username) {
+			client.username = sess.username
+			client.sessionID = sess.id
+		} else {
+			client.replaces = id
+		}
+	}
+	if !validUsername(client.username) {
+		connAudit.record(r, client.username, connBadUsername, "")
+		http.Error(w, usernameError, http.StatusBadRequest)
+		return
+	}
+	if isBridgedName(client.username) {
+		connAudit.record(r, client.username, connBadUsername, "bridged name")
+		http.Error(w, "Usernames ending in "+ircSuffix+" or starting with @ belong to bridged users", http.StatusBadRequest)
+		return
+	}
+	if b, banned := serverBans.match(client.username, client.ip); banned {
+		if !b.Shadow {
+			connAudit.record(r, client.username, connBanned, "server ban")
+			http.Error(w, "You are banned from this server", http.StatusForbidden)
+			return
+		}
+		client.shadowBanned.Store(true)
+	}
+
+	// A closed room keeps its access rules, so they're checked before it reopens
+	access, err := h.accessOf(r.Context(), roomName)
+	if err != nil {
+		client.logger().Error("Storage error", "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if access.isBanned(client.username) {
+		connAudit.record(r, client.username, connBanned, "")
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return
+	}
+	if !access.admits(r.URL.Query().Get("password"), r.URL.Query().Get("invite")) {
+		connAudit.record(r, client.username, connForbidden, access.mode)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !connLimits.acquire(client.ip) {
+		connAudit.record(r, client.username, connRateLimited, "too many connections")
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	// Serve the connection with the username, creating the room if needed
+	if !serve(roomName, client, w, r) {
+		connLimits.release(client.ip)
+	}
+}
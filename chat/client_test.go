@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a buffer log lines can be written to from several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Capture warnings and errors logged during a test
+func captureLogs(t *testing.T) *syncBuffer {
+	logs := &syncBuffer{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return logs
+}
+
+// Wait for every writePump to stop
+func waitPumps(t *testing.T) {
+	t.Helper()
+	stopped := make(chan struct{})
+	go func() {
+		pumps.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("writePumps didn't stop")
+	}
+}
+
+func TestTeardownDuringBroadcastLogsNoWriteError(t *testing.T) {
+	logs := captureLogs(t)
+	setFor(t, &messageRate, 1000.0)
+	setFor(t, &messageBurst, 1000.0)
+	hub, srv, _ := newTestServer(t)
+	var conns []*testConn
+	for i := range 10 {
+		conns = append(conns, join(t, srv, "teardown", fmt.Sprintf("user%d", i)))
+	}
+	// Keep every writePump busy, then unregister them all at once
+	for i := range 200 {
+		conns[i%len(conns)].say(fmt.Sprintf("message %d", i))
+	}
+	time.Sleep(10 * time.Millisecond)
+	hub.stopAll(websocket.CloseGoingAway, "test over")
+	for _, c := range conns {
+		c.expectClosed()
+	}
+	waitPumps(t)
+
+	if strings.Contains(logs.String(), "Write error") {
+		t.Errorf("teardown logged a write error:\n%s", logs)
+	}
+}
+
+func TestStrictQueryRejectsUnknownParams(t *testing.T) {
+	setFor(t, &strictQuery, true)
+	_, srv, _ := newTestServer(t)
+	query := url.Values{"room": {"strict"}, "username": {"alice"}, "colour": {"red"}, "nick": {"al"}}
+	resp, err := http.Get(srv.URL + "/ws?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+	if want := "Unknown query parameters: colour, nick"; !strings.Contains(string(body), want) {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestLenientQueryIgnoresUnknownParams(t *testing.T) {
+	setFor(t, &strictQuery, false)
+	_, srv, _ := newTestServer(t)
+	c := dial(t, srv, url.Values{"room": {"lenient"}, "username": {"alice"}, "colour": {"red"}})
+	c.expect(typeMembers)
+}
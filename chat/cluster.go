@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Points each node gets on the hash ring, to spread rooms evenly
+const ringReplicas = 128
+
+// Headers on requests one node forwards to another
+const (
+	clusterHeader  = "X-Chat-Cluster"   // the cluster secret, proving the request came from a node
+	clientIPHeader = "X-Chat-Client-IP" // the address the forwarding node saw
+)
+
+// cluster gives each room to one node, found by consistent hashing of its name,
+// and proxies requests for rooms this node doesn't own to their owner. Nodes
+// keep their rooms to themselves, so unlike a backplane nothing is broadcast
+// between them.
+type cluster struct {
+	self    string
+	secret  string
+	ring    []ringPoint // sorted by hash
+	proxies map[string]*httputil.ReverseProxy
+}
+
+type ringPoint struct {
+	hash uint32
+	node string
+}
+
+// Nodes sharing rooms, nil unless CLUSTER_NODES is set
+var shards *cluster
+
+// Hash a room or node name onto the ring; names differing in a character or two,
+// like node URLs, still land far apart
+func ringHash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Set up sharding from CLUSTER_NODES, the base URLs of every node such as
+// "http://chat-1:8080,http://chat-2:8080", and CLUSTER_SELF, this node's URL among them
+func newClusterFromEnv() *cluster {
+	var nodes []string
+	for _, node := range strings.Split(os.Getenv("CLUSTER_NODES"), ",") {
+		if node = strings.TrimRight(strings.TrimSpace(node), "/"); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	if backplane != nil {
+		fatal("CLUSTER_NODES and BACKPLANE are alternatives; set only one")
+	}
+	secret := os.Getenv("CLUSTER_SECRET")
+	if secret == "" {
+		fatal("CLUSTER_NODES requires CLUSTER_SECRET")
+	}
+	self := strings.TrimRight(os.Getenv("CLUSTER_SELF"), "/")
+	if !slices.Contains(nodes, self) {
+		fatal("CLUSTER_SELF must be one of CLUSTER_NODES", "self", self)
+	}
+	c := &cluster{self: self, secret: secret, proxies: make(map[string]*httputil.ReverseProxy)}
+	for _, node := range nodes {
+		for i := range ringReplicas {
+			c.ring = append(c.ring, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+		if node != self {
+			target, err := url.Parse(node)
+			if err != nil {
+				fatal("Invalid node in CLUSTER_NODES", "node", node, "err", err)
+			}
+			c.proxies[node] = c.proxy(target)
+		}
+	}
+	slices.SortFunc(c.ring, func(a, b ringPoint) int { return int(int64(a.hash) - int64(b.hash)) })
+	slog.Info("Sharding rooms across the cluster", "nodes", len(nodes), "self", self)
+	return c
+}
+
+// Build the proxy to another node; it passes WebSocket upgrades and event streams through
+func (c *cluster) proxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// Keep the browser's host so the owner's origin check sees the same request
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header.Set(clusterHeader, c.secret)
+			pr.Out.Header.Set(clientIPHeader, remoteIP(pr.In))
+		},
+		FlushInterval: -1, // flush event streams as they are written
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Could not reach the room's node", "node", target.String(), "err", err)
+			http.Error(w, "The room's server is unavailable", http.StatusBadGateway)
+		},
+	}
+}
+
+// Find the node owning a room
+func (c *cluster) owner(room string) string {
+	hash := ringHash(room)
+	i, _ := slices.BinarySearchFunc(c.ring, hash, func(p ringPoint, h uint32) int { return int(int64(p.hash) - int64(h)) })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].node
+}
+
+// Report whether a request was forwarded by another node of the cluster
+func fromCluster(r *http.Request) bool {
+	token := r.Header.Get(clusterHeader)
+	return shards != nil && r.Header.Get(clientIPHeader) != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(shards.secret)) == 1
+}
+
+// Proxy the request to the node owning the room, reporting whether it was; requests
+// another node forwarded are served here so nodes that disagree don't bounce them
+func (c *cluster) forward(w http.ResponseWriter, r *http.Request, room string) bool {
+	if c == nil || fromCluster(r) {
+		return false
+	}
+	owner := c.owner(room)
+	if owner == c.self {
+		return false
+	}
+	c.proxies[owner].ServeHTTP(w, r)
+	return true
+}
+
+// Wrap a handler of a room's requests to run on the room's node, naming the room
+// by a path value or, when param starts with "?", a query parameter
+func sharded(param string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var room string
+		if query, ok := strings.CutPrefix(param, "?"); ok {
+			room = r.URL.Query().Get(query)
+		} else {
+			room = r.PathValue(param)
+		}
+		if !shards.forward(w, r, room) {
+			next(w, r)
+		}
+	}
+}
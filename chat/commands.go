@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Command is a slash command sent by a client, such as "/nick bob"
+type Command struct {
+	Name   string   // the command itself, e.g. "/nick"
+	Args   []string // the words after the name
+	client *Client
+}
+
+// Username returns the name of the user who sent the command
+func (cmd *Command) Username() string { return cmd.client.username }
+
+// Room returns the name of the room the command was sent in
+func (cmd *Command) Room() string { return cmd.client.room.name }
+
+// Reply sends a notice to the sender only
+func (cmd *Command) Reply(text string) { cmd.client.reply(text) }
+
+// Error sends an error to the sender only
+func (cmd *Command) Error(text string) { cmd.client.replyError(text) }
+
+// Say posts a chat message to the room as the sender, within their rate limit
+func (cmd *Command) Say(text string) { cmd.client.post(&Message{Type: typeChat, Body: text}) }
+
+// CommandFunc handles a slash command; it runs on the sender's connection, so it
+// doesn't receive their next message until it returns
+type CommandFunc func(cmd *Command)
+
+type registeredCommand struct {
+	usage string
+	run   CommandFunc
+}
+
+// Slash commands by name, registered before serving
+var commands = make(map[string]registeredCommand)
+
+// RegisterCommand adds a slash command, replacing any command with the same name.
+// The usage line is listed by /help, e.g. "/roll [sides] - roll a die". Call it
+// before serving connections.
+func RegisterCommand(name, usage string, run CommandFunc) {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	commands[name] = registeredCommand{usage: usage, run: run}
+}
+
+// The built-in commands
+func init() {
+	RegisterCommand("/help", "/help - list the commands", runHelp)
+	RegisterCommand("/me", "/me <action> - say what you're doing", runMe)
+	RegisterCommand("/nick", "/nick <name> - change your username", runNick)
+	RegisterCommand("/list", "/list - list the rooms and their members", runList)
+	RegisterCommand("/status", "/status online|away|busy [text] - set your status", func(cmd *Command) {
+		if len(cmd.Args) == 0 {
+			cmd.Error("Usage: /status online|away|busy [text]")
+			return
+		}
+		cmd.client.setStatus(&Message{Status: cmd.Args[0], Body: strings.Join(cmd.Args[1:], " ")})
+	})
+	RegisterCommand("/block", "/block <username> - hide a user's messages and refuse their direct messages", runBlock)
+	RegisterCommand("/unblock", "/unblock <username> - stop blocking a user", runBlock)
+	RegisterCommand("/blocks", "/blocks - list the users you blocked", runBlocks)
+	RegisterCommand("/scheduled", "/scheduled - list your scheduled messages", runScheduled)
+	RegisterCommand("/unschedule", "/unschedule <id> - cancel a scheduled message", runUnschedule)
+	RegisterCommand("/quota", "/quota [clear] - show how many messages you can still send, or clear the count sent this window", func(cmd *Command) {
+		switch strings.Join(cmd.Args, " ") {
+		case "":
+		case "clear":
+			cmd.client.limiter.clear()
+		default:
+			cmd.Error("Usage: /quota [clear]")
+			return
+		}
+		cmd.Reply(cmd.client.limiter.status().String())
+	})
+	RegisterCommand("/numbering", "/numbering on|off|reset - number the room's messages (owner only)", onRoom((*Room).setNumbering))
+	RegisterCommand("/report", "/report <messageId> [reason] - report a message to the admins", onRoom((*Room).fileReport))
+	RegisterCommand("/filter", "/filter [<name> on|off|<setting>] - list or change the message filters (owner only)", onRoom((*Room).setFilter))
+	RegisterCommand("/slowmode", "/slowmode <interval>|off - let members post once per interval (moderators)", onRoom((*Room).setSlowMode))
+	RegisterCommand("/quarantine", "/quarantine <window> <interval>|off - slow down new members (owner only)", onRoom((*Room).setQuarantine))
+	moderation := map[string]string{
+		"/kick":   "disconnect a user (moderators)",
+		"/ban":    "disconnect a user and keep them out (moderators)",
+		"/unban":  "let a banned user back in (moderators)",
+		"/mute":   "drop a user's messages (moderators)",
+		"/unmute": "stop dropping a user's messages (moderators)",
+		"/mod":    "make a user a moderator (owner only)",
+		"/unmod":  "take a user's moderator role away (owner only)",
+	}
+	for name, help := range moderation {
+		RegisterCommand(name, name+" <username> [reason] - "+help, func(cmd *Command) {
+			cmd.client.room.do(func() { cmd.client.room.moderate(cmd.client, cmd.Name, cmd.Args) })
+		})
+	}
+}
+
+// Adapt a room method run on the room goroutine to a command handler
+func onRoom(fn func(r *Room, c *Client, args []string)) CommandFunc {
+	return func(cmd *Command) {
+		c := cmd.client
+		c.room.do(func() { fn(c.room, c, cmd.Args) })
+	}
+}
+
+// Handle a slash command sent by a client, reporting whether the text was one.
+// Text starting with "//" isn't a command but a message starting with "/".
+func (c *Client) handleCommand(text string) bool {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return false
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return false
+	}
+	command, ok := commands[fields[0]]
+	if !ok {
+		c.replyError(fmt.Sprintf("Unknown command %s, see /help; start with // to send a message beginning with /", fields[0]))
+		return true
+	}
+	command.run(&Command{Name: fields[0], Args: fields[1:], client: c})
+	return true
+}
+
+func runHelp(cmd *Command) {
+	usages := make([]string, 0, len(commands))
+	for _, command := range commands {
+		usages = append(usages, command.usage)
+	}
+	slices.Sort(usages)
+	cmd.Reply("Commands:\n" + strings.Join(usages, "\n"))
+}
+
+func runMe(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Error("Usage: /me <action>")
+		return
+	}
+	cmd.client.post(&Message{Type: typeChat, Body: strings.Join(cmd.Args, " "), Action: true})
+}
+
+func runList(cmd *Command) {
+	var lines []string
+	for _, room := range cmd.client.room.hub.list() {
+		if !room.access.listed() && room != cmd.client.room {
+			continue
+		}
+		if info, ok := room.info(); ok {
+			lines = append(lines, fmt.Sprintf("%s (%d)", info.Name, info.Members))
+		}
+	}
+	cmd.Reply("Rooms: " + strings.Join(lines, ", "))
+}
+
+// Rename the sender in their room. Without authentication usernames aren't
+// verified anyway; with it they're the token's and can't change.
+func runNick(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Error("Usage: /nick <name>")
+		return
+	}
+	if jwtSecret != nil {
+		cmd.Error("Usernames come from your login here and can't be changed")
+		return
+	}
+	c := cmd.client
+	// Wait for the rename, as this connection's other goroutines read its username
+	done := make(chan struct{})
+	if c.room.do(func() { c.room.rename(c, cmd.Args[0]); close(done) }) {
+		<-done
+	}
+}
+
+// Change a client's username, announcing it like the old name leaving and the
+// new one joining; runs on the room goroutine
+func (r *Room) rename(c *Client, name string) {
+	switch {
+	case !validUsername(name):
+		r.sendTo(c, errorMessage(usernameError))
+		return
+	case name == c.username:
+		return
+	case r.connections[name] > 0:
+		r.sendTo(c, errorMessage("username "+name+" is taken"))
+		return
+	case r.muted[c.username]:
+		r.sendTo(c, errorMessage("Muted users can't change their username"))
+		return
+	case r.access.isBanned(name) || serverBanned(name):
+		r.sendTo(c, errorMessage("username "+name+" is banned from this room"))
+		return
+	}
+	old := c.username
+	users.remove(c)
+	r.updatePresence(presence.Unregister, c)
+	if r.connections[old]--; r.connections[old] <= 0 {
+		delete(r.connections, old)
+	}
+	c.username = name
+	users.add(c)
+	r.updatePresence(presence.Register, c)
+	r.connections[name]++
+	// The session event tells the client its new name
+	session := newMessage(typeSession, c.sessionID)
+	session.To = name
+	r.sendTo(c, session)
+	r.deliver(systemMessage(fmt.Sprintf("%s is now known as %s", old, name)))
+	if r.connections[old] == 0 {
+		r.deliver(r.presenceEvent(typeLeave, old))
+	}
+	r.deliver(r.presenceEvent(typeJoin, name))
+}
+
+// Send a notice to this client only
+func (c *Client) reply(text string) {
+	c.replyWith(systemMessage(text))
+}
+
+// Send an error to this client only
+func (c *Client) replyError(text string) {
+	c.replyWith(errorMessage(text))
+}
+
+// Send a message to this client only
+func (c *Client) replyWith(m *Message) {
+	c.room.do(func() { c.room.sendTo(c, m) })
+}
+
+// Turn message numbering on or off, or restart it; runs on the room goroutine
+func (r *Room) setNumbering(c *Client, args []string) {
+	if c.username != r.owner {
+		r.sendTo(c, errorMessage("Only the room owner can change message numbering"))
+		return
+	}
+	if len(args) != 1 {
+		r.sendTo(c, errorMessage("Usage: /numbering on|off|reset"))
+		return
+	}
+	switch args[0] {
+	case "on":
+		r.numbering = true
+	case "off":
+		r.numbering = false
+	case "reset":
+		r.displayNum = 0
+	default:
+		r.sendTo(c, errorMessage("Usage: /numbering on|off|reset"))
+		return
+	}
+	r.audit(c.username, auditNumbering, "", "", args[0])
+	r.deliver(systemMessage(fmt.Sprintf("%s set message numbering %s", c.username, args[0])))
+}
@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// When the process started, for the uptime in debug stats
+var startedAt = time.Now()
+
+// debugStats is the runtime state reported by GET /admin/debug, to watch a
+// server's goroutines and memory under load
+type debugStats struct {
+	Goroutines    int     `json:"goroutines"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`  // bytes of live and not yet collected objects
+	HeapInuse     uint64  `json:"heap_inuse_bytes"`  // bytes of the heap's spans in use
+	HeapObjects   uint64  `json:"heap_objects"`      // live and not yet collected objects
+	Sys           uint64  `json:"sys_bytes"`         // bytes obtained from the OS
+	GCCycles      uint32  `json:"gc_cycles"`         // completed since the process started
+	LastGCPause   float64 `json:"last_gc_pause_ms"`  // stop-the-world pause of the latest cycle
+	TotalGCPause  float64 `json:"total_gc_pause_ms"` // of every cycle since the process started
+	CPUs          int     `json:"cpus"`              // GOMAXPROCS
+	Rooms         int     `json:"rooms"`             // open on this instance
+	Connections   int     `json:"connections"`       // room memberships of this instance's clients
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// Gather the runtime state of the process and the hub
+func (h *Hub) debugStats() debugStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := debugStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		GCCycles:      mem.NumGC,
+		TotalGCPause:  float64(mem.PauseTotalNs) / float64(time.Millisecond),
+		CPUs:          runtime.GOMAXPROCS(0),
+		Rooms:         len(h.list()),
+		Connections:   len(h.connections()),
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+	}
+	if mem.NumGC > 0 {
+		stats.LastGCPause = float64(mem.PauseNs[(mem.NumGC+255)%256]) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// HTTP handler reporting the goroutine, heap and GC stats of the process with
+// the hub's rooms and connections; admin only
+func (h *Hub) serveDebug(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.debugStats())
+}
+
+// HTTP handler writing one of the runtime's profiles, such as goroutine or
+// heap, for go tool pprof, or as text with ?debug=1 (or 2 for goroutine stacks);
+// admin only. net/http/pprof isn't imported, as it would publish its handlers on
+// the default mux without the admin token.
+func serveDebugProfile(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	profile := pprof.Lookup(r.PathValue("profile"))
+	if profile == nil {
+		http.Error(w, "Unknown profile", http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+profile.Name()+`"`)
+	}
+	profile.WriteTo(w, debug)
+}
@@ -0,0 +1,92 @@
+package chat
+
+import "fmt"
+
+// Longest key ID of an encrypted message or key exchange, in bytes
+const maxKeyIDLength = 64
+
+// Report whether the room is end-to-end encrypted; safe to call from any goroutine
+func (r *Room) encrypted() bool {
+	result := make(chan bool, 1)
+	if !r.do(func() { result <- r.meta.E2E }) {
+		return false
+	}
+	return <-result
+}
+
+// Check the ciphertext and key ID of an encrypted message or key exchange
+func checkEncrypted(m *Message) error {
+	if len(m.Data) == 0 {
+		return fmt.Errorf("a %s message needs its ciphertext in data", m.Type)
+	}
+	if len(m.KeyID) > maxKeyIDLength {
+		return fmt.Errorf("key IDs are limited to %d bytes", maxKeyIDLength)
+	}
+	return nil
+}
+
+// Broadcast an end-to-end encrypted message from this client. The server only
+// passes the ciphertext on, so it is sent like a chat message without commands,
+// filters or link previews.
+func (c *Client) sendEncrypted(m *Message) {
+	if err := checkEncrypted(m); err != nil {
+		c.replyError("Can't send the message: " + err.Error())
+		return
+	}
+	if err := validTTL(m.TTL); err != nil {
+		c.replyError("Can't send the message: " + err.Error())
+		return
+	}
+	c.post(&Message{Type: typeEncrypted, Data: m.Data, KeyID: m.KeyID, ParentID: m.ParentID, TTL: m.TTL, ref: m.Ref, span: m.span})
+}
+
+// Refuse a message that doesn't match the room's encryption: plaintext chat in
+// an end-to-end encrypted room, or ciphertext in a room that isn't. Reports
+// whether it was refused; runs on the room goroutine.
+func (r *Room) refuseEncryption(m *Message) bool {
+	var refusal *Message
+	switch {
+	case r.meta.E2E && m.Type == typeChat:
+		refusal = codedError(errCodeE2E, "This room is end-to-end encrypted, so messages have to be sent as encrypted")
+	case !r.meta.E2E && m.Type == typeEncrypted:
+		refusal = errorMessage("This room isn't end-to-end encrypted; its owner can turn encryption on with room_update")
+	default:
+		return false
+	}
+	if m.from != nil {
+		r.sendTo(m.from, refusal)
+	}
+	return true
+}
+
+// Pass key material from a client on to the member named in m.To, or to every
+// member without one, such as a public key to encrypt the room's key for. The
+// server never keeps it. Runs on the room goroutine.
+func (r *Room) exchangeKeys(c *Client, m *Message) {
+	if err := checkEncrypted(m); err != nil {
+		r.sendTo(c, errorMessage("Can't exchange keys: "+err.Error()))
+		return
+	}
+	relayed := newMessage(typeKeyExchange, "")
+	relayed.Sender, relayed.To, relayed.Data, relayed.KeyID = c.username, m.To, m.Data, m.KeyID
+	if m.To == "" {
+		r.deliver(relayed)
+		return
+	}
+	if m.To == c.username || r.connections[m.To] == 0 {
+		r.sendTo(c, errorMessage(m.To+" is not in this room"))
+		return
+	}
+	r.sendToUser(m.To, relayed)
+}
+
+// Describe turning end-to-end encryption on or off for the room
+func e2eNotice(by string, on bool) string {
+	if by == "" {
+		by = "An administrator"
+	}
+	if on {
+		return by + " turned on end-to-end encryption: only encrypted messages can be sent, and none are stored"
+	}
+	return by + " turned off end-to-end encryption"
+}
@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	errNoMessage = errors.New("no such message in this room")
+	errMerged    = errors.New("that message was merged with others in the history and can't be changed")
+)
+
+// Edit or delete one of the room's messages for a client, then tell the room.
+// Only the sender or a moderator may change a message; runs on the room goroutine.
+func (r *Room) modifyMessage(c *Client, m *Message) {
+	if m.Type == typeEdit && r.meta.E2E {
+		r.sendTo(c, codedError(errCodeE2E, "Messages in an end-to-end encrypted room can't be edited, delete it and send it again"))
+		return
+	}
+	if m.Type == typeEdit && m.Body == "" {
+		r.sendTo(c, errorMessage("An edit needs the new body"))
+		return
+	}
+	sender, err := r.messageSender(m.ID)
+	if err != nil {
+		r.sendTo(c, errorMessage(fmt.Sprintf("Can't change message %d: %v", m.ID, err)))
+		return
+	}
+	if sender != c.username && r.role(c.username) < roleModerator {
+		r.sendTo(c, errorMessage("You can only change your own messages"))
+		return
+	}
+	if err := r.applyChange(m.Type, m.ID, m.Body); err != nil {
+		r.sendTo(c, errorMessage(fmt.Sprintf("Can't change message %d: %v", m.ID, err)))
+		return
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if m.Type == typeEdit {
+			err = store.Update(ctx, r.name, m.ID, m.Body)
+		} else {
+			err = store.Delete(ctx, r.name, m.ID)
+		}
+		if err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	change := newMessage(m.Type, m.Body)
+	change.ID = m.ID
+	change.Sender = c.username
+	r.deliver(change)
+	if m.Type == typeDelete {
+		r.unpinDeleted(c.username, m.ID)
+	}
+}
+
+// Find who sent a message, from the history or else the store
+func (r *Room) messageSender(id uint64) (string, error) {
+	for _, entry := range r.history {
+		if entry.contains(id) {
+			return entry.Sender, nil
+		}
+	}
+	if store == nil {
+		return "", errNoMessage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	m, err := store.Get(ctx, r.name, id)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return "", errNoMessage
+	}
+	if m == nil {
+		return "", errNoMessage
+	}
+	return m.Sender, nil
+}
+
+// Apply an edit or deletion to the in-memory history, which may no longer hold the message
+func (r *Room) applyChange(typ string, id uint64, body string) error {
+	i := slices.IndexFunc(r.history, func(e historyEntry) bool { return e.contains(id) })
+	if i < 0 {
+		return nil
+	}
+	if r.history[i].LastID != 0 {
+		return errMerged
+	}
+	if typ == typeEdit {
+		r.history[i].Body = body
+	} else {
+		r.history = slices.Delete(r.history, i, i+1)
+	}
+	return nil
+}
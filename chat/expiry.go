@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Longest time a disappearing message may live, in seconds
+const maxMessageTTL = 7 * 24 * 60 * 60
+
+// How often the hub deletes stored messages past their expiry that no room
+// timed, such as those sent before a restart. Rooms expire their own messages
+// on time, so the sweep leaves them this long to do so.
+const expirySweep = time.Minute
+
+// expiring is one of the room's messages waiting to disappear
+type expiring struct {
+	id uint64
+	at time.Time
+}
+
+// Check the TTL a sender asked for on a chat message
+func validTTL(ttl int) error {
+	if ttl < 0 || ttl > maxMessageTTL {
+		return fmt.Errorf("a message's ttl is between 0 and %d seconds", maxMessageTTL)
+	}
+	return nil
+}
+
+// Work out when a message published now disappears: after the shorter of the
+// TTL its sender asked for and the room's, or never when neither has one; runs
+// on the room goroutine
+func (r *Room) expiryOf(m *Message, now time.Time) time.Time {
+	ttl := r.meta.MessageTTL
+	if m.TTL > 0 && (ttl == 0 || m.TTL < ttl) {
+		ttl = m.TTL
+	}
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(ttl) * time.Second)
+}
+
+// Describe turning disappearing messages on or off for the room
+func messageTTLNotice(by string, seconds int) string {
+	if by == "" {
+		by = "An administrator"
+	}
+	if seconds == 0 {
+		return by + " turned off disappearing messages"
+	}
+	return fmt.Sprintf("%s turned on disappearing messages: new messages disappear after %s", by, time.Duration(seconds)*time.Second)
+}
+
+// Keep a message to expire at the given time, arming the room's timer when it
+// is the soonest; runs on the room goroutine
+func (r *Room) scheduleExpiry(id uint64, at time.Time) {
+	i, _ := slices.BinarySearchFunc(r.expiring, at, func(e expiring, at time.Time) int { return e.at.Compare(at) })
+	r.expiring = slices.Insert(r.expiring, i, expiring{id: id, at: at})
+	if i == 0 {
+		r.armExpiry()
+	}
+}
+
+// Arm the room's timer for its soonest expiring message; runs on the room goroutine
+func (r *Room) armExpiry() {
+	if r.expiryTimer != nil {
+		r.expiryTimer.Stop()
+		r.expiryTimer = nil
+	}
+	if len(r.expiring) == 0 || r.stopped {
+		return
+	}
+	r.expiryTimer = time.AfterFunc(time.Until(r.expiring[0].at), func() { r.do(r.expireDue) })
+}
+
+// Stop the expiry timer as the room stops; messages still stored are left to
+// the hub's sweep
+func (r *Room) stopExpiry() {
+	if r.expiryTimer != nil {
+		r.expiryTimer.Stop()
+	}
+}
+
+// Remove the messages whose time has come; runs on the room goroutine
+func (r *Room) expireDue() {
+	now := time.Now()
+	var due []uint64
+	for len(r.expiring) > 0 && !r.expiring[0].at.After(now) {
+		due = append(due, r.expiring[0].id)
+		r.expiring = r.expiring[1:]
+	}
+	r.expire(due, true)
+	r.armExpiry()
+}
+
+// Remove expired messages from the history, and the store unless they're gone
+// from it already, and tell the room; runs on the room goroutine
+func (r *Room) expire(ids []uint64, fromStore bool) {
+	for _, id := range ids {
+		r.applyChange(typeDelete, id, "")
+		if fromStore && r.stored() {
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			err := store.Delete(ctx, r.name, id)
+			cancel()
+			if err != nil {
+				r.logger().Error("Storage error", "err", err)
+			}
+		}
+		event := newMessage(typeMessageExpired, "")
+		event.ID = id
+		r.deliver(event)
+		r.unpinDeleted("", id)
+	}
+}
+
+// Periodically delete stored messages past their expiry, until the hub stops
+func (h *Hub) expirer() {
+	ticker := time.NewTicker(expirySweep)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		closed := h.closed
+		h.mu.Unlock()
+		if closed {
+			return
+		}
+		h.sweepExpired(time.Now().Add(-expirySweep))
+	}
+}
+
+// Delete the stored messages that expired before the given time, telling the
+// open rooms they were in
+func (h *Hub) sweepExpired(before time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), pruneTimeout)
+	defer cancel()
+	expired, err := store.Expire(ctx, before)
+	if err != nil {
+		slog.Error("Storage error", "err", err)
+		return
+	}
+	for _, room := range h.list() {
+		if ids := expired[room.name]; len(ids) > 0 {
+			room.do(func() {
+				room.expiring = slices.DeleteFunc(room.expiring, func(e expiring) bool { return slices.Contains(ids, e.id) })
+				room.expire(ids, false)
+			})
+		}
+	}
+}
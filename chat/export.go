@@ -0,0 +1,249 @@
+package chat
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Messages read from the store at a time while exporting, so exports of any
+// size are streamed without holding the database for long
+const exportPage = 500
+
+// exportWriter writes exported messages as NDJSON, or as JSON arrays in a zip
+type exportWriter struct {
+	w     io.Writer
+	zip   *zip.Writer // nil for NDJSON
+	first bool        // no message written in the current zip entry yet
+}
+
+// Start an export download named name (without extension) in the format asked
+// for by ?format=, ndjson by default; reports false after answering a bad format
+func newExportWriter(w http.ResponseWriter, r *http.Request, name string) (*exportWriter, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ndjson"`, name))
+		return &exportWriter{w: w}, true
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+		return &exportWriter{zip: zip.NewWriter(w)}, true
+	default:
+		http.Error(w, `Unknown format, expected "ndjson" or "zip"`, http.StatusBadRequest)
+		return nil, false
+	}
+}
+
+// Start a file of the zip holding a JSON array of messages; the messages are
+// written straight to the response with NDJSON
+func (e *exportWriter) file(name string) error {
+	if e.zip == nil {
+		return nil
+	}
+	if err := e.close(); err != nil {
+		return err
+	}
+	w, err := e.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	e.w, e.first = w, true
+	_, err = io.WriteString(w, "[")
+	return err
+}
+
+// Add a JSON document to a zip as a file of its own; left out of NDJSON
+func (e *exportWriter) document(name string, v any) error {
+	if e.zip == nil {
+		return nil
+	}
+	if err := e.close(); err != nil {
+		return err
+	}
+	w, err := e.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	e.w = nil
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Write a message: a line of NDJSON or an element of the zip file's array
+func (e *exportWriter) message(m *Message) error {
+	data := m.encode()
+	if e.zip != nil {
+		separator := ",\n"
+		if e.first {
+			separator, e.first = "\n", false
+		}
+		data = append([]byte(separator), data...)
+	} else {
+		data = append(data, '\n')
+	}
+	_, err := e.w.Write(data)
+	return err
+}
+
+// End the zip file being written, if any
+func (e *exportWriter) close() error {
+	if e.zip == nil || e.w == nil {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "\n]\n")
+	e.w = nil
+	return err
+}
+
+// Finish the download
+func (e *exportWriter) finish() error {
+	if e.zip == nil {
+		return nil
+	}
+	if err := e.close(); err != nil {
+		return err
+	}
+	return e.zip.Close()
+}
+
+// HTTP handler downloading a room's stored messages, oldest first, as NDJSON or
+// with ?format=zip as messages.json in a zip; for admins, and with JWT_SECRET
+// for the room's owner while the room is open
+func (h *Hub) serveRoomExport(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Exports need STORAGE_DSN", http.StatusNotImplemented)
+		return
+	}
+	name := r.PathValue("name")
+	if !isAdmin(r) {
+		if jwtSecret == nil {
+			requireAdmin(w, r)
+			return
+		}
+		username, err := verifyToken(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		room, open := h.lookup(name)
+		if !open || room.ownerName() != username {
+			http.Error(w, "Only the room owner can export the room", http.StatusForbidden)
+			return
+		}
+	}
+	export, ok := newExportWriter(w, r, name)
+	if !ok {
+		return
+	}
+	err := export.file("messages.json")
+	for after := uint64(0); err == nil; {
+		var page []*Message
+		page, err = pageOf(r.Context(), func(ctx context.Context) ([]*Message, error) {
+			return store.Since(ctx, name, after, exportPage)
+		})
+		for _, m := range page {
+			if err = export.message(m); err != nil {
+				break
+			}
+		}
+		if len(page) < exportPage {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+	finishExport(export, err, "room", name)
+}
+
+// HTTP handler downloading every stored message the user sent, by room then
+// oldest first, as NDJSON or with ?format=zip as messages.json in a zip, along
+// with account.json when accounts are on. Needs JWT_SECRET, whose token says who
+// the user is; admins name any user with ?username=.
+func (h *Hub) serveUserExport(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Exports need STORAGE_DSN", http.StatusNotImplemented)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if !isAdmin(r) || username == "" {
+		if jwtSecret == nil {
+			http.NotFound(w, r)
+			return
+		}
+		verified, err := verifyToken(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		username = verified
+	}
+	var a *account
+	if accounts {
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		defer cancel()
+		var err error
+		if a, err = store.Account(ctx, username); err != nil {
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+	}
+	export, ok := newExportWriter(w, r, username)
+	if !ok {
+		return
+	}
+	var err error
+	if a != nil {
+		err = export.document("account.json", a)
+	}
+	if err == nil {
+		err = export.file("messages.json")
+	}
+	for afterRoom, afterID := "", uint64(0); err == nil; {
+		var page []*Message
+		page, err = pageOf(r.Context(), func(ctx context.Context) ([]*Message, error) {
+			return store.BySender(ctx, username, afterRoom, afterID, exportPage)
+		})
+		for _, m := range page {
+			if err = export.message(m); err != nil {
+				break
+			}
+		}
+		if len(page) < exportPage {
+			break
+		}
+		last := page[len(page)-1]
+		afterRoom, afterID = last.Room, last.ID
+	}
+	finishExport(export, err, "username", username)
+}
+
+// Get the username of the room's owner, empty if it has none or has stopped
+func (r *Room) ownerName() string {
+	owners := make(chan string, 1)
+	if !r.do(func() { owners <- r.owner }) {
+		return ""
+	}
+	return <-owners
+}
+
+// Read a page of an export within the store timeout
+func pageOf(ctx context.Context, read func(context.Context) ([]*Message, error)) ([]*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return read(ctx)
+}
+
+// Complete an export; once streaming has started an error can only cut the
+// download short, so it is logged
+func finishExport(export *exportWriter, err error, key, value string) {
+	if err == nil {
+		err = export.finish()
+	}
+	if err != nil {
+		slog.Error("Export error", key, value, "err", err)
+	}
+}
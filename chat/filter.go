@@ -0,0 +1,272 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"chat-app/internal/env"
+)
+
+// FilterFunc checks a chat message on the room goroutine before the room
+// broadcasts it. It may rewrite m.Body; a non-empty warning is sent to the
+// sender as a warning event, and drop discards the message.
+type FilterFunc func(m *Message) (warning string, drop bool)
+
+type registeredFilter struct {
+	usage string
+	new   func(setting string) (FilterFunc, error)
+}
+
+// Message filters by name, and their names in the order rooms run them
+var (
+	filters     = make(map[string]registeredFilter)
+	filterOrder []string
+)
+
+// RegisterFilter adds a message filter that rooms run after the ones registered
+// before it, replacing any filter with the same name. Each room that turns the
+// filter on calls newFilter for its own instance, passing the room's setting
+// such as "5", or "" for the server default. The usage line is listed by /filter.
+// Call it before serving connections.
+func RegisterFilter(name, usage string, newFilter func(setting string) (FilterFunc, error)) {
+	if _, exists := filters[name]; !exists {
+		filterOrder = append(filterOrder, name)
+	}
+	filters[name] = registeredFilter{usage: usage, new: newFilter}
+}
+
+// The built-in filters
+func init() {
+	RegisterFilter("profanity", "profanity - mask words from PROFANITY_WORDLIST", newProfanityFilter)
+	RegisterFilter("spam", "spam [window] - drop a sender's repeated message within the window", newSpamFilter)
+	RegisterFilter("links", "links [count] - drop messages with more links than count", newLinkFilter)
+}
+
+// Filters turned on in new rooms, from FILTERS
+var defaultFilters []string
+
+// Defaults of the built-in filters' settings
+var (
+	profanity  *regexp.Regexp // matches any word of the list, nil without one
+	spamWindow = 30 * time.Second
+	maxLinks   = 3
+)
+
+// Read the filters turned on by default and the built-in filters' settings
+func configureFilters() {
+	defaultFilters = nil
+	for _, name := range strings.Split(os.Getenv("FILTERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := filters[name]; !ok {
+			slog.Warn("Ignoring unknown filter in FILTERS", "filter", name)
+			continue
+		}
+		defaultFilters = append(defaultFilters, name)
+	}
+	spamWindow = env.Duration("SPAM_WINDOW", spamWindow)
+	maxLinks = env.Int("MAX_LINKS", maxLinks)
+	if path := os.Getenv("PROFANITY_WORDLIST"); path != "" {
+		pattern, err := loadWordlist(path)
+		if err != nil {
+			fatal("Could not load PROFANITY_WORDLIST", "err", err)
+		}
+		profanity = pattern
+	}
+}
+
+// Compile a file of words, one per line, into a case-insensitive pattern
+// matching any of them as a whole word
+func loadWordlist(path string) (*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+}
+
+func newProfanityFilter(setting string) (FilterFunc, error) {
+	if setting != "" {
+		return nil, errors.New("the profanity filter takes no setting")
+	}
+	return func(m *Message) (string, bool) {
+		if profanity == nil || !profanity.MatchString(m.Body) {
+			return "", false
+		}
+		m.Body = profanity.ReplaceAllStringFunc(m.Body, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+		return "Some words in your message were masked", false
+	}, nil
+}
+
+func newSpamFilter(setting string) (FilterFunc, error) {
+	window := spamWindow
+	if setting != "" {
+		d, err := time.ParseDuration(setting)
+		if err != nil || d <= 0 {
+			return nil, errors.New("the spam window must be a duration such as 30s")
+		}
+		window = d
+	}
+	type sent struct {
+		body string
+		at   time.Time
+	}
+	last := make(map[string]sent) // each sender's latest message
+	return func(m *Message) (string, bool) {
+		now := time.Now()
+		body := strings.ToLower(strings.TrimSpace(m.Body))
+		if prev, ok := last[m.Sender]; ok && prev.body == body && now.Sub(prev.at) < window {
+			return fmt.Sprintf("Repeated message dropped; wait %s before sending it again", window), true
+		}
+		if len(last) >= 1000 {
+			for sender, prev := range last {
+				if now.Sub(prev.at) >= window {
+					delete(last, sender)
+				}
+			}
+		}
+		last[m.Sender] = sent{body: body, at: now}
+		return "", false
+	}, nil
+}
+
+// Matches a link, with or without its scheme
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+func newLinkFilter(setting string) (FilterFunc, error) {
+	limit := maxLinks
+	if setting != "" {
+		n, err := strconv.Atoi(setting)
+		if err != nil || n < 0 {
+			return nil, errors.New("the link limit must be a count such as 3")
+		}
+		limit = n
+	}
+	return func(m *Message) (string, bool) {
+		if len(linkPattern.FindAllStringIndex(m.Body, limit+1)) > limit {
+			return fmt.Sprintf("Messages may contain at most %d links", limit), true
+		}
+		return "", false
+	}, nil
+}
+
+// roomFilter is a filter turned on in a room
+type roomFilter struct {
+	setting string
+	run     FilterFunc
+}
+
+// Turn on the default filters in a new room
+func (r *Room) applyDefaultFilters() {
+	for _, name := range defaultFilters {
+		run, err := filters[name].new("")
+		if err != nil {
+			r.logger().Warn("Could not turn on filter", "filter", name, "err", err)
+			continue
+		}
+		r.filters[name] = roomFilter{run: run}
+	}
+}
+
+// Run the room's filters over a chat message, reporting whether it may be
+// broadcast; runs on the room goroutine
+func (r *Room) filter(m *Message) bool {
+	if len(r.filters) == 0 || m.Data != nil {
+		return true
+	}
+	for _, name := range filterOrder {
+		f, on := r.filters[name]
+		if !on {
+			continue
+		}
+		warning, drop := f.run(m)
+		if warning != "" && m.from != nil {
+			notice := newMessage(typeWarning, warning)
+			notice.Code = name
+			r.sendTo(m.from, notice)
+		}
+		if drop {
+			messagesFiltered.WithLabelValues(name).Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// List the room's filters, or turn one on or off; runs on the room goroutine
+func (r *Room) setFilter(c *Client, args []string) {
+	const usage = "Usage: /filter [<name> on|off|<setting>]"
+	if len(args) == 0 {
+		lines := []string{"Filters:"}
+		for _, name := range filterOrder {
+			state := "off"
+			if f, on := r.filters[name]; on {
+				state = "on"
+				if f.setting != "" {
+					state += " (" + f.setting + ")"
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", filters[name].usage, state))
+		}
+		r.sendTo(c, systemMessage(strings.Join(lines, "\n")))
+		return
+	}
+	if c.username != r.owner {
+		r.sendTo(c, errorMessage("Only the room owner can change filters"))
+		return
+	}
+	if len(args) != 2 {
+		r.sendTo(c, errorMessage(usage))
+		return
+	}
+	name, value := args[0], args[1]
+	registered, ok := filters[name]
+	if !ok {
+		r.sendTo(c, errorMessage(fmt.Sprintf("Unknown filter %s; the filters are %s", name, strings.Join(slices.Sorted(slices.Values(filterOrder)), ", "))))
+		return
+	}
+	switch value {
+	case "off":
+		delete(r.filters, name)
+	default:
+		setting := value
+		if value == "on" {
+			setting = ""
+		}
+		run, err := registered.new(setting)
+		if err != nil {
+			r.sendTo(c, errorMessage(err.Error()))
+			return
+		}
+		r.filters[name] = roomFilter{setting: setting, run: run}
+	}
+	r.audit(c.username, auditFilter, "", "", name+" "+value)
+	r.deliver(systemMessage(fmt.Sprintf("%s turned the %s filter %s", c.username, name, value)))
+}
@@ -0,0 +1,264 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-app/chat/chatpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer serves the hub over gRPC, for backend services and other clients
+// that would rather not speak the WebSocket protocol
+type grpcServer struct {
+	chatpb.UnimplementedChatServer
+	hub *Hub
+}
+
+// NewGRPCServer creates a gRPC server with the Chat service of the hub
+func (h *Hub) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	chatpb.RegisterChatServer(server, &grpcServer{hub: h})
+	return server
+}
+
+// List the rooms with their member counts, except invite-only ones, as GET /api/rooms does
+func (s *grpcServer) ListRooms(ctx context.Context, req *chatpb.ListRoomsRequest) (*chatpb.ListRoomsResponse, error) {
+	resp := &chatpb.ListRoomsResponse{}
+	for _, room := range s.hub.list() {
+		if !room.access.listed() {
+			continue
+		}
+		if info, ok := room.info(); ok {
+			resp.Rooms = append(resp.Rooms, &chatpb.Room{
+				Name:        info.Name,
+				Members:     int32(info.Members),
+				Access:      info.Access,
+				Topic:       info.Topic,
+				Description: info.Description,
+				Capacity:    int32(info.Capacity),
+			})
+		}
+	}
+	return resp, nil
+}
+
+// Join a room with the stream's first message, then relay messages both ways
+// until either side ends the stream. Joining goes through the same checks as
+// /ws, by handing admit the request a WebSocket client would have sent.
+func (s *grpcServer) JoinRoom(stream chatpb.Chat_JoinRoomServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	join := first.GetJoin()
+	if join == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be a join")
+	}
+	// Streams aren't proxied between nodes, so clients connect to the room's own
+	if shards != nil {
+		if owner := shards.owner(join.Room); owner != shards.self {
+			return status.Errorf(codes.FailedPrecondition, "room %s is served by %s", join.Room, owner)
+		}
+	}
+	r, err := joinRequest(stream, join)
+	if err != nil {
+		return err
+	}
+	w := &grpcRefusal{header: make(http.Header)}
+	var streamErr error
+	s.hub.admit(w, r, func(roomName string, client *Client, w http.ResponseWriter, r *http.Request) bool {
+		var started bool
+		started, streamErr = s.hub.serveGRPC(roomName, client, w, r, stream)
+		return started
+	})
+	if w.status != 0 {
+		return status.Error(grpcCode(w.status), strings.TrimSpace(w.body.String()))
+	}
+	return streamErr
+}
+
+// Build the /ws request equivalent to a join
+func joinRequest(stream chatpb.Chat_JoinRoomServer, join *chatpb.Join) (*http.Request, error) {
+	query := url.Values{"room": {join.Room}, "username": {join.Username}}
+	for key, value := range map[string]string{"password": join.Password, "invite": join.Invite, "session": join.Session} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if join.LastSeenId != 0 {
+		query.Set("last_seen_id", strconv.FormatUint(join.LastSeenId, 10))
+	}
+	if join.PresenceOnly {
+		query.Set("presence", "true")
+	}
+	r, err := http.NewRequestWithContext(stream.Context(), http.MethodGet, "/ws?"+query.Encode(), nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The token comes from the join or, as gRPC clients usually send it, the metadata
+	if join.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+join.Token)
+	} else if md, ok := metadata.FromIncomingContext(stream.Context()); ok && len(md.Get("authorization")) > 0 {
+		r.Header.Set("Authorization", md.Get("authorization")[0])
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r, nil
+}
+
+// Relay the room's messages to the stream and the stream's messages to the room,
+// reporting whether the client was started and how the stream ended
+func (h *Hub) serveGRPC(roomName string, client *Client, w http.ResponseWriter, r *http.Request, stream chatpb.Chat_JoinRoomServer) (bool, error) {
+	// The bot challenge is only spoken over WebSockets, so it can't be skipped with gRPC
+	if challenge.kind != "" {
+		connAudit.record(r, client.username, connChallengeFailed, "gRPC streams can't answer the challenge")
+		http.Error(w, "This server requires a WebSocket", http.StatusForbidden)
+		return false, nil
+	}
+	client.send = make(chan frame, sendBufferSize)
+	client.binary = true // protobuf carries binary payloads as they are
+	client.joinedAt = time.Now()
+	client.limiter = newTokenBucket(messageRate, messageBurst)
+	if !h.register(roomName, client) {
+		if client.closeReason != "" {
+			http.Error(w, client.closeReason, http.StatusConflict)
+		} else {
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		}
+		return false, nil
+	}
+	connAudit.record(r, client.username, connSuccess, "")
+	pumps.Add(1)
+	defer pumps.Done()
+	go client.recvGRPC(stream)
+
+	for {
+		select {
+		case f, ok := <-client.send:
+			if !ok {
+				// The room closed the stream, like a WebSocket close frame
+				if client.closeReason == "" {
+					return true, nil
+				}
+				return true, status.Error(codes.Aborted, client.closeReason)
+			}
+			m, err := decodeMessage(f.data)
+			if err != nil {
+				client.logger().Error("Decode error", "err", err)
+				continue
+			}
+			if err := stream.Send(toProto(m, f.data)); err != nil {
+				return true, err
+			}
+		case <-stream.Context().Done():
+			return true, nil
+		}
+	}
+}
+
+// Read the client's messages from the stream until it ends, then leave the room,
+// as readPump does for WebSockets
+func (c *Client) recvGRPC(stream chatpb.Chat_JoinRoomServer) {
+	defer c.disconnect()
+	for {
+		cm, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF && status.Code(err) != codes.Canceled {
+				c.logger().Warn("Read error", "err", err)
+			}
+			return
+		}
+		m, err := fromProto(cm.GetMessage())
+		if err != nil {
+			c.replyWith(codedError(errCodeInvalid, "Invalid message: "+err.Error()))
+			continue
+		}
+		if refusal := sanitize(m); refusal != nil {
+			c.replyWith(refusal)
+			continue
+		}
+		c.receive(m)
+	}
+}
+
+// Convert a message for the stream, keeping its JSON encoding for the other fields
+func toProto(m *Message, encoded []byte) *chatpb.Message {
+	return &chatpb.Message{
+		Type:    m.Type,
+		Id:      m.ID,
+		Room:    m.Room,
+		Sender:  m.Sender,
+		To:      m.To,
+		Body:    m.Body,
+		Data:    m.Data,
+		Ts:      m.TS,
+		Members: m.Members,
+		Replay:  m.Replay,
+		Ref:     m.Ref,
+		Code:    m.Code,
+		Json:    string(encoded),
+	}
+}
+
+// Convert a message from the stream, decoding its JSON envelope if it has one;
+// a message without a type is a chat message, like a plain text frame
+func fromProto(pm *chatpb.Message) (*Message, error) {
+	if pm == nil {
+		return nil, errors.New("expected a message")
+	}
+	if pm.Json != "" {
+		return decodeMessage([]byte(pm.Json))
+	}
+	m := &Message{Type: pm.Type, ID: pm.Id, To: pm.To, Body: pm.Body, Data: pm.Data, Ref: pm.Ref}
+	if m.Type == "" {
+		m.Type = typeChat
+	}
+	return m, nil
+}
+
+// grpcRefusal records the HTTP error admit answers a refused join with
+type grpcRefusal struct {
+	header http.Header
+	status int
+	body   strings.Builder
+}
+
+func (w *grpcRefusal) Header() http.Header { return w.header }
+
+func (w *grpcRefusal) Write(data []byte) (int, error) { return w.body.Write(data) }
+
+func (w *grpcRefusal) WriteHeader(status int) { w.status = status }
+
+// Map the HTTP status of a refused join to a gRPC code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Time allowed for each dependency to answer a health check
+const healthTimeout = 2 * time.Second
+
+// healthReport describes the instance for /healthz and /readyz
+type healthReport struct {
+	Status      string            `json:"status"`           // ok, or unavailable when not ready
+	Checks      map[string]string `json:"checks,omitempty"` // "ok" or the error of each dependency in use
+	Maintenance bool              `json:"maintenance,omitempty"`
+	Goroutines  int               `json:"goroutines"`
+	Connections int               `json:"connections"`
+	Rooms       int               `json:"rooms"`
+}
+
+// Check the store and backplane and count what the instance is serving,
+// reporting whether it is ready for new connections
+func (h *Hub) health(ctx context.Context) (healthReport, bool) {
+	report := healthReport{
+		Checks:      map[string]string{},
+		Maintenance: maintenance.Load(),
+		Goroutines:  runtime.NumGoroutine(),
+		Connections: connLimits.total(),
+		Rooms:       h.count(),
+	}
+	ready := !report.Maintenance && !h.stopped()
+	check := func(name string, ping func(context.Context) error) {
+		ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+		if err := ping(ctx); err != nil {
+			report.Checks[name] = err.Error()
+			ready = false
+			return
+		}
+		report.Checks[name] = "ok"
+	}
+	if store != nil {
+		check("storage", store.Ping)
+	}
+	if backplane != nil {
+		check("backplane", backplane.Ping)
+	}
+	report.Status = "ok"
+	if !ready {
+		report.Status = "unavailable"
+	}
+	return report, ready
+}
+
+// HTTP handler for liveness probes: answers 200 with the health report while
+// the process can serve requests at all, even if its dependencies are down
+func (h *Hub) serveHealth(w http.ResponseWriter, r *http.Request) {
+	report, _ := h.health(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// HTTP handler for readiness probes: answers 503 while the store or backplane
+// can't be reached, in maintenance or once shutting down, so load balancers
+// stop sending new connections here
+func (h *Hub) serveReady(w http.ResponseWriter, r *http.Request) {
+	report, ready := h.health(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
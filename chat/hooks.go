@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"regexp"
+	"sync"
+)
+
+// afterHookQueue is how many messages may wait for the hooks after broadcast;
+// more are dropped
+const afterHookQueue = 1024
+
+// Hook is a step of a room's message pipeline, given every chat and encrypted
+// message a room publishes, including those of bots, bridges and schedules.
+// The context carries the message's trace span.
+type Hook func(ctx context.Context, m *Message) error
+
+// ErrDrop, returned by a hook run before broadcast, drops the message without
+// telling its sender
+var ErrDrop = errors.New("message dropped by a hook")
+
+// hooks are the steps added to a hub's message pipeline
+type hooks struct {
+	before []Hook         // run on the room goroutine before broadcast, in order
+	after  []Hook         // run on the hub's hook goroutine once the room has the message
+	queue  chan afterHook // messages waiting for the after hooks, nil without any
+	closed sync.Once
+}
+
+// afterHook is a broadcast message waiting for the hooks after broadcast
+type afterHook struct {
+	ctx  context.Context
+	room *Room
+	m    Message
+}
+
+// Use adds hooks run on each message before it is broadcast, in the order they
+// were added. A hook may change the message, such as its Body; an error drops
+// it, telling the sender the error's text unless it is ErrDrop. The hooks run on
+// the room's goroutine, which waits for them, so they have to be quick. Add
+// hooks before the hub serves connections.
+func (h *Hub) Use(hook ...Hook) {
+	h.hooks.before = append(h.hooks.before, hook...)
+}
+
+// UseAfter adds hooks run on each message once it has been broadcast, with its
+// ID set. They run in order on one goroutine of the hub, which takes the
+// messages of every room in the order they were broadcast, get a copy of the
+// message and can't change what was sent; errors are logged. Messages broadcast
+// while 1024 are still waiting for the hooks skip them and are counted in
+// chat_hook_drops_total. Add hooks before the hub serves connections.
+func (h *Hub) UseAfter(hook ...Hook) {
+	h.hooks.after = append(h.hooks.after, hook...)
+	if h.hooks.queue == nil {
+		h.hooks.queue = make(chan afterHook, afterHookQueue)
+		go h.hooks.work()
+	}
+}
+
+// Run the hooks before broadcast, refusing the message to its sender if one
+// fails; reports whether the message goes on. Runs on the room goroutine.
+func (r *Room) runHooks(ctx context.Context, m *Message) bool {
+	if r.hub == nil {
+		return true
+	}
+	for _, hook := range r.hub.hooks.before {
+		err := hook(ctx, m)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrDrop) && m.from != nil {
+			r.sendTo(m.from, codedError(errCodeForbidden, err.Error()))
+		}
+		return false
+	}
+	return true
+}
+
+// Queue a copy of the message for the hooks after broadcast, dropping it if the
+// queue is full; runs on the room goroutine
+func (r *Room) runAfterHooks(ctx context.Context, m *Message) {
+	if r.hub == nil || len(r.hub.hooks.after) == 0 {
+		return
+	}
+	select {
+	case r.hub.hooks.queue <- afterHook{ctx: ctx, room: r, m: *m}:
+	default:
+		hookDrops.Inc()
+	}
+}
+
+// Run the hooks after broadcast on each queued message in turn, until the queue is closed
+func (hs *hooks) work() {
+	for job := range hs.queue {
+		for _, hook := range hs.after {
+			if err := hook(job.ctx, &job.m); err != nil {
+				job.room.logger().Error("Hook error", "id", job.m.ID, "err", err)
+			}
+		}
+	}
+}
+
+// Let the hook goroutine finish the queued messages and end; the rooms have stopped
+func (hs *hooks) close() {
+	if hs.queue != nil {
+		hs.closed.Do(func() { close(hs.queue) })
+	}
+}
+
+// LogMessages is a hook for UseAfter logging every message's room, sender, ID
+// and size to the logger, or the default one when nil
+func LogMessages(logger *slog.Logger) Hook {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(ctx context.Context, m *Message) error {
+		logger.InfoContext(ctx, "Message", "room", m.Room, "username", m.Sender, "id", m.ID, "type", m.Type, "bytes", len(m.payload()))
+		return nil
+	}
+}
+
+// RefuseMatching is a hook for Use refusing chat messages whose body matches
+// the pattern, answering their sender with reason
+func RefuseMatching(pattern *regexp.Regexp, reason string) Hook {
+	return func(ctx context.Context, m *Message) error {
+		if m.Type == typeChat && pattern.MatchString(m.Body) {
+			return errors.New(reason)
+		}
+		return nil
+	}
+}
+
+// MeasureMessages is a hook for UseAfter counting messages and their sizes in
+// the chat_hook_message_bytes histogram, by type
+func MeasureMessages() Hook {
+	return func(ctx context.Context, m *Message) error {
+		hookMessageBytes.WithLabelValues(m.Type).Observe(float64(len(m.payload())))
+		return nil
+	}
+}
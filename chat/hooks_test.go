@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAfterHooksRunInOrderAndDropWhenBehind(t *testing.T) {
+	hub := &Hub{}
+	t.Cleanup(hub.hooks.close)
+	release, done := make(chan struct{}), make(chan struct{})
+	var seen []uint64
+	want := 0
+	hub.UseAfter(func(ctx context.Context, m *Message) error {
+		<-release
+		seen = append(seen, m.ID)
+		if len(seen) == want {
+			close(done)
+		}
+		return nil
+	})
+	room := newRoom("hooked")
+	room.hub = hub
+
+	// The hook is held up, so the queue fills and the rest are dropped
+	const sent = afterHookQueue + 10
+	before := testutil.ToFloat64(hookDrops)
+	for id := range uint64(sent) {
+		room.runAfterHooks(context.Background(), &Message{Type: typeChat, ID: id})
+	}
+	dropped := int(testutil.ToFloat64(hookDrops) - before)
+	if dropped < 9 || dropped > 10 {
+		t.Fatalf("dropped %d messages, want the 9 or 10 beyond the queue", dropped)
+	}
+
+	want = sent - dropped
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("hook saw %d messages, want %d", len(seen), want)
+	}
+	if !slices.IsSorted(seen) || seen[0] != 0 {
+		t.Errorf("hook saw the messages out of order: %v", seen)
+	}
+}
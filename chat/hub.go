@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hub owns the rooms, creating them on demand and closing them once they've been empty for a while
+type Hub struct {
+	mu          sync.Mutex
+	rooms       map[string]*Room
+	idleTimeout time.Duration // close rooms empty for this long, never when zero
+	closed      bool          // no rooms are created after stopAll
+	hooks       hooks         // added to every room's message pipeline with Use and UseAfter
+}
+
+// NewHub creates a hub that closes rooms after they've been empty for idleTimeout,
+// prunes messages past their rooms' retention, sends scheduled messages and
+// connects the configured bridges
+func NewHub(idleTimeout time.Duration) *Hub {
+	h := &Hub{rooms: make(map[string]*Room), idleTimeout: idleTimeout}
+	if retentionInterval > 0 {
+		go h.janitor()
+	}
+	go h.scheduler()
+	if store != nil {
+		go h.expirer()
+	}
+	if awayAfter > 0 {
+		go h.awayWatcher()
+	}
+	bridges.start(h)
+	return h
+}
+
+// Get a room, creating and starting it if it doesn't exist yet; nil once the hub is stopped
+func (h *Hub) room(name, creator string) *Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if room, ok := h.rooms[name]; ok {
+		return room
+	}
+	if h.closed {
+		return nil
+	}
+	return h.start(name, creator, nil)
+}
+
+// Create and start a room with the given access rules unless it already exists
+// or the hub is stopped, reporting whether it was created
+func (h *Hub) create(name string, access *roomAccess) (*Room, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.rooms[name]; ok || h.closed {
+		return nil, false
+	}
+	return h.start(name, "", access), true
+}
+
+// Start a new room, public unless access is given; the caller holds h.mu
+func (h *Hub) start(name, creator string, access *roomAccess) *Room {
+	room := newRoom(name)
+	room.hub = h
+	if access != nil {
+		room.access = access
+		room.saveAccess()
+	} else {
+		room.restoreAccess()
+	}
+	room.owner = creator
+	room.applyDefaultFilters()
+	room.restoreSeq()
+	room.restoreMeta()
+	room.restoreRoles()
+	room.restorePins()
+	room.restorePolls()
+	if backplane != nil {
+		room.unsubscribe = backplane.Subscribe(name, func(m *Message) {
+			room.do(func() { room.receiveRemote(m) })
+		})
+	}
+	h.rooms[name] = room
+	go room.run()
+	return room
+}
+
+// Find an existing room
+func (h *Hub) lookup(name string) (*Room, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	return room, ok
+}
+
+// Report whether the hub was stopped for shutting down
+func (h *Hub) stopped() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// Count the open rooms
+func (h *Hub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms)
+}
+
+// List the rooms sorted by name
+func (h *Hub) list() []*Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	return rooms
+}
+
+// Close a room if it is still empty, archiving its history
+func (h *Hub) closeIfIdle(r *Room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[r.name] != r {
+		return
+	}
+	// Only the room goroutine knows whether the room is still empty
+	type result struct {
+		closed  bool
+		history []ArchivedMessage
+	}
+	results := make(chan result, 1)
+	ok := r.do(func() {
+		if len(r.clients) > 0 {
+			results <- result{}
+			return
+		}
+		r.stopped = true
+		r.stopPolls()
+		results <- result{closed: true, history: r.archivable()}
+	})
+	if !ok {
+		return
+	}
+	res := <-results
+	if !res.closed {
+		return
+	}
+	delete(h.rooms, r.name)
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
+	if archiver != nil && len(res.history) > 0 {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+			defer cancel()
+			if err := archiver.Archive(ctx, r.name, res.history); err != nil {
+				r.logger().Error("Archive error", "err", err)
+			}
+		}()
+	}
+}
+
+// Stop a room and close its connections, reporting whether it existed
+func (h *Hub) remove(name string, code int, reason string) bool {
+	h.mu.Lock()
+	room, ok := h.rooms[name]
+	delete(h.rooms, name)
+	h.mu.Unlock()
+	if ok {
+		room.stop(code, reason)
+	}
+	return ok
+}
+
+// Stop every room, closing their connections, and refuse to create new ones
+func (h *Hub) stopAll(code int, reason string) {
+	h.mu.Lock()
+	h.closed = true
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	h.rooms = make(map[string]*Room)
+	h.mu.Unlock()
+	for _, room := range rooms {
+		room.stop(code, reason)
+	}
+	h.hooks.close()
+}
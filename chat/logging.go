@@ -0,0 +1,54 @@
+package chat
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"chat-app/internal/env"
+)
+
+// Set up the default logger from LOG_LEVEL (debug, info, warn or error) and
+// LOG_FORMAT (text or json); the standard log package writes through it too
+func configureLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(env.String("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// Log a configuration error and exit
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Source of connection IDs, which tell apart log lines of a user's connections
+var connIDs atomic.Uint64
+
+// Logger tagged with the room
+func (r *Room) logger() *slog.Logger {
+	return slog.With("room", r.name)
+}
+
+// Logger tagged with the client's room, username, address and connection ID
+func (c *Client) logger() *slog.Logger {
+	l := slog.With("username", c.username, "ip", c.ip, "conn", c.connID)
+	if c.room != nil {
+		l = l.With("room", c.room.name)
+	}
+	return l
+}
+
+// Logger tagged with the user and connection of a WebSocket, in whichever rooms
+func (s *socket) logger() *slog.Logger {
+	c := s.identity
+	return slog.With("username", c.username, "ip", c.ip, "conn", c.connID)
+}
@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"slices"
+	"strings"
+)
+
+// Most users one message can notify, so a message can't ping a whole server
+const maxMentions = 10
+
+// Find the distinct usernames mentioned as @username in a message body
+func mentions(body string) []string {
+	var names []string
+	for _, word := range strings.Fields(body) {
+		name, ok := strings.CutPrefix(word, "@")
+		if !ok {
+			continue
+		}
+		name = strings.TrimRight(name, ".,;:!?)'\"")
+		if validUsername(name) && !slices.Contains(names, name) {
+			names = append(names, name)
+			if len(names) == maxMentions {
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Send a mention event to every connection of the users a chat message mentions,
+// in this room or, for public rooms, any other, queueing it for those offline and
+// pushing it to those offline or away; runs on the room goroutine
+func (r *Room) notifyMentions(m *Message) {
+	for _, name := range mentions(m.Body) {
+		if name == m.Sender {
+			continue
+		}
+		mention := newMessage(typeMention, m.Body)
+		mention.ID, mention.Room, mention.Sender, mention.To = m.ID, r.name, m.Sender, name
+		targets := perConnection(users.lookup(name), r)
+		if len(targets) == 0 && r.access.mode == accessPublic {
+			queueOffline(name, mention)
+		}
+		// Only push what the user could see: public rooms, or one they're in
+		if r.access.mode == accessPublic || slices.ContainsFunc(targets, func(c *Client) bool { return c.room == r }) {
+			if !blocks.has(name, m.Sender) {
+				pushes.notify(name, mention)
+			}
+		}
+		for _, target := range targets {
+			if target.room == r {
+				r.sendTo(target, mention)
+			} else if r.access.mode == accessPublic {
+				// Another room's goroutine may be waiting on this one, so don't block on it
+				go target.deliver(mention)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"chat-app/internal/msgpack"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Message types of the WebSocket protocol
+const (
+	typeChat           = "chat"              // a user's message to the room
+	typeJoin           = "user_joined"       // a user joined the room, with the updated members
+	typeLeave          = "user_left"         // a user left the room, with the updated members
+	typeMembers        = "members"           // the room's current members, sent on joining
+	typeSystem         = "system"            // an informational notice from the server
+	typeError          = "error"             // something the client sent was refused
+	typeSession        = "session"           // the session ID to resume with after reconnecting
+	typeChallenge      = "challenge"         // a challenge to answer before joining
+	typeDM             = "dm"                // a private message to the user named in To
+	typeThrottle       = "throttle"          // the client is sending too fast and its message was dropped
+	typeTyping         = "typing_start"      // the sender started typing; repeated while they keep typing
+	typeStopped        = "typing_stop"       // the sender stopped typing without sending
+	typeAck            = "ack"               // the sender's chat message was broadcast with the given ID
+	typeAttachment     = "attachment"        // the sender uploaded a file to the room
+	typeMention        = "mention"           // a chat message in Room mentioned the user named in To
+	typeEdit           = "edit"              // the message with ID now has Body; sent by clients too
+	typeDelete         = "delete"            // the message with ID was deleted; sent by clients too
+	typeSlow           = "connection_slow"   // the client's send buffer is filling up
+	typeReactionAdd    = "reaction_add"      // Sender reacted to the message with ID; sent by clients too
+	typeReactionRemove = "reaction_remove"   // Sender took their reaction back; sent by clients too
+	typeRead           = "read"              // Sender has read the room up to ID; sent by clients too
+	typeUnread         = "unread"            // unread counts per room, asked for by a client's own unread message
+	typeWarning        = "warning"           // a filter masked or dropped the client's message; Code names the filter
+	typeRoomUpdate     = "room_update"       // the room's Meta changed; sent by owners with the fields to change
+	typeCallOffer      = "call_offer"        // Sender calls To with a WebRTC offer in Signal; sent by clients too
+	typeCallAnswer     = "call_answer"       // the callee accepted with a WebRTC answer in Signal; sent by clients too
+	typeICECandidate   = "ice_candidate"     // an ICE candidate in Signal for the call with To; sent by clients too
+	typeCallDecline    = "call_decline"      // the callee turned the call down; sent by clients too
+	typeCallEnd        = "call_end"          // either party hung up or left the room; sent by clients too
+	typeCallBusy       = "call_busy"         // the user called, as Sender, is already in a call
+	typeTruncated      = "history_truncated" // retention removed older messages from the room's history
+	typeThread         = "thread"            // the Replies to the message with ID; asked for by clients with the ID
+	typePinned         = "message_pinned"    // a moderator pinned the message with ID, leaving the room's Pinned; sent by clients too
+	typeUnpinned       = "message_unpinned"  // a moderator unpinned the message with ID; sent by clients too
+	typeScheduled      = "scheduled"         // the sender's chat message with SendAt was queued as scheduled message ID
+	typePollCreate     = "poll_create"       // Sender started the Poll with ID; sent by clients with the Poll
+	typePollVote       = "poll_vote"         // sent by clients to vote for Option in the poll with ID
+	typePollResults    = "poll_results"      // the current tally of the Poll with ID, final once Closed
+	typeLinkPreview    = "link_preview"      // the Preview of the first link in the chat message with ID, from its Sender
+	typeStatus         = "status_set"        // Sender's Status is now online, away or busy, with Body as its text; sent by clients too
+	typeActivity       = "activity"          // sent by clients to say their user is still there without saying anything
+	typeMessageExpired = "message_expired"   // the disappearing message with ID reached its expiry and is gone
+	typeEncrypted      = "encrypted"         // an end-to-end encrypted message, its ciphertext in Data opaque to the server; sent by clients too
+	typeKeyExchange    = "key_exchange"      // key material in Data from Sender for To, or every member without one; sent by clients too
+	typeSubscribe      = "join"              // sent by clients to join Room over their connection too, with ID as the last message seen there and Body as the session
+	typeUnsubscribe    = "leave"             // the connection left Room, with Body saying why unless asked to; sent by clients too
+)
+
+// Message is the JSON envelope of everything sent over the WebSocket, e.g.
+// {"type":"chat","room":"x","sender":"bob","body":"hi","ts":1700000000000}
+type Message struct {
+	Type        string          `json:"type"`
+	ID          uint64          `json:"id,omitempty"`
+	Room        string          `json:"room,omitempty"`
+	Sender      string          `json:"sender,omitempty"`
+	To          string          `json:"to,omitempty"` // recipient of a direct message
+	Body        string          `json:"body,omitempty"`
+	Data        []byte          `json:"data,omitempty"`   // binary payload, base64 in JSON
+	Number      int             `json:"number,omitempty"` // room-local display number
+	Members     []string        `json:"members,omitempty"`
+	TS          int64           `json:"ts,omitempty"`     // unix milliseconds
+	Replay      bool            `json:"replay,omitempty"` // sent again from history to a joining client
+	Ref         string          `json:"ref,omitempty"`    // client-chosen reference, echoed in the ack
+	Attachment  *Attachment     `json:"attachment,omitempty"`
+	Emoji       string          `json:"emoji,omitempty"`        // the reaction added or removed
+	Reactions   map[string]int  `json:"reactions,omitempty"`    // how many users reacted with each emoji
+	Unread      map[string]int  `json:"unread,omitempty"`       // unread messages per room
+	Bot         bool            `json:"bot,omitempty"`          // posted through the API with a bot token
+	Action      bool            `json:"action,omitempty"`       // a /me message, shown as "* Sender Body"
+	Code        string          `json:"code,omitempty"`         // machine-readable reason of an error
+	Meta        *roomUpdate     `json:"meta,omitempty"`         // the room's topic, description and capacity
+	Offline     bool            `json:"offline,omitempty"`      // queued while the recipient was away
+	Signal      json.RawMessage `json:"signal,omitempty"`       // WebRTC session description or ICE candidate, passed through as is
+	Trace       string          `json:"trace,omitempty"`        // W3C traceparent of the span the message was published in
+	DisplayName string          `json:"display_name,omitempty"` // the sender's account profile
+	Avatar      string          `json:"avatar,omitempty"`
+	ParentID    uint64          `json:"parent_id,omitempty"` // the message replied to, the root of its thread
+	Replies     []*Message      `json:"replies,omitempty"`   // a thread's replies, oldest first
+	Pinned      []uint64        `json:"pinned,omitempty"`    // IDs of the room's pinned messages, in the order they were pinned
+	SendAt      int64           `json:"send_at,omitempty"`   // unix milliseconds a chat message is scheduled for
+	Poll        *Poll           `json:"poll,omitempty"`
+	Option      *int            `json:"option,omitempty"` // index of the poll option voted for
+	Preview     *LinkPreview    `json:"preview,omitempty"`
+	Status      string          `json:"status,omitempty"`      // online, away or busy
+	Statuses    statusList      `json:"statuses,omitempty"`    // members who aren't plainly online, in rosters
+	RetryAfter  int64           `json:"retry_after,omitempty"` // milliseconds until a slowed sender may post again
+	TTL         int             `json:"ttl,omitempty"`         // seconds a chat message lives before disappearing; sent by clients
+	ExpiresAt   int64           `json:"expires_at,omitempty"`  // unix milliseconds a disappearing message expires at
+	KeyID       string          `json:"key_id,omitempty"`      // which of the members' keys encrypted Data, as they name it
+	Password    string          `json:"password,omitempty"`    // sent by clients joining a password-protected room
+	Invite      string          `json:"invite,omitempty"`      // sent by clients joining an invite-only room
+
+	from   *Client           // the client that sent the message, if any
+	ref    string            // the sender's Ref, kept out of the broadcast
+	span   trace.SpanContext // the span the message was received or published in, if traced
+	bridge *roomBridge       // the bridge the message came in through, not relayed back to it
+}
+
+// Create a message of the given type stamped with the current time
+func newMessage(typ, body string) *Message {
+	return &Message{Type: typ, Body: body, TS: time.Now().UnixMilli()}
+}
+
+// Create an informational message for a client
+func systemMessage(body string) *Message {
+	return newMessage(typeSystem, body)
+}
+
+// Create an error message for a client
+func errorMessage(body string) *Message {
+	return newMessage(typeError, body)
+}
+
+// Encode the message as JSON
+func (m *Message) encode() []byte {
+	data, err := json.Marshal(m)
+	if err != nil {
+		slog.Error("Encode error", "type", m.Type, "err", err)
+	}
+	return data
+}
+
+// Encode the message as MessagePack, laid out as its JSON
+func (m *Message) pack() []byte {
+	data, err := msgpack.Marshal(m)
+	if err != nil {
+		slog.Error("Encode error", "type", m.Type, "err", err)
+	}
+	return data
+}
+
+// Decode a message from a client. Frames that aren't JSON objects are taken as
+// the body of a chat message, so plain text clients keep working.
+func decodeMessage(data []byte) (*Message, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return &Message{Type: typeChat, Body: string(data)}, nil
+	}
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Report whether the message is a presence event, which presence-only clients receive
+func (m *Message) isPresence() bool {
+	switch m.Type {
+	case typeJoin, typeLeave, typeMembers, typeTyping, typeStopped, typeStatus:
+		return true
+	}
+	return false
+}
+
+// Get the message's content, binary or text
+func (m *Message) payload() []byte {
+	if m.Data != nil {
+		return m.Data
+	}
+	return []byte(m.Body)
+}
@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"chat-app/internal/msgpack"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages with the kinds of field the envelope has
+func sampleMessages() []*Message {
+	topic, capacity := "launch", 20
+	option := 1
+	return []*Message{
+		newMessage(typeChat, "hello, room"),
+		{Type: typeChat, ID: 1 << 40, Room: "lobby", Sender: "alice", Body: "héllo 👋", Number: 12, TS: 1700000000000, Ref: "r1", Action: true},
+		{Type: typeChat, Sender: "alice", Data: []byte{0, 1, 2, 0xff}},
+		{Type: typeJoin, Sender: "bob", Members: []string{"alice", "bob"}, Statuses: statusList{"bob": {Status: "away", Text: "lunch"}}},
+		{Type: typeReactionAdd, ID: 3, Emoji: "🎉", Reactions: map[string]int{"🎉": 2, "👍": 1}},
+		{Type: typeRoomUpdate, Meta: &roomUpdate{Topic: &topic, Capacity: &capacity}},
+		{Type: typeCallOffer, To: "bob", Signal: json.RawMessage(`{"sdp":"v=0","type":"offer"}`)},
+		{Type: typePollResults, ID: 9, Poll: &Poll{Question: "Lunch?", Options: []string{"yes", "no"}, Counts: []int{2, 0}, Voters: [][]string{{"alice", "bob"}, nil}}},
+		{Type: typePollVote, ID: 9, Option: &option},
+		{Type: typeThread, ID: 4, Replies: []*Message{{Type: typeChat, ID: 5, ParentID: 4, Body: "first"}, {Type: typeChat, ID: 6, ParentID: 4, Body: "second"}}},
+		{Type: typeChat, Attachment: &Attachment{URL: "/files/a.png", Name: "a.png", ContentType: "image/png", Size: 1024}, Preview: &LinkPreview{URL: "https://example.com", Title: "Example"}},
+	}
+}
+
+func TestPackedMessagesDecodeAsTheirJSON(t *testing.T) {
+	for _, m := range sampleMessages() {
+		var fromJSON, fromPack Message
+		if err := json.Unmarshal(m.encode(), &fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		if err := msgpack.Unmarshal(m.pack(), &fromPack); err != nil {
+			t.Fatalf("unpack %s: %v", m.encode(), err)
+		}
+		if !reflect.DeepEqual(fromPack, fromJSON) {
+			t.Errorf("%s unpacked as %+v, want %+v", m.encode(), fromPack, fromJSON)
+		}
+	}
+}
+
+func TestMessagesDecodeTheSameFromEitherFrame(t *testing.T) {
+	for _, m := range sampleMessages() {
+		fromJSON, err := decodeFrame(websocket.TextMessage, m.encode(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromPack, err := decodeFrame(websocket.BinaryMessage, m.pack(), true)
+		if err != nil {
+			t.Fatalf("decode %s: %v", m.encode(), err)
+		}
+		if !reflect.DeepEqual(fromPack, fromJSON) {
+			t.Errorf("%s decoded as %+v from MessagePack, want %+v", m.encode(), fromPack, fromJSON)
+		}
+	}
+}
+
+// Encode and decode a typical chat message as JSON and as MessagePack
+func BenchmarkEnvelope(b *testing.B) {
+	m := &Message{Type: typeChat, ID: 123456, Room: "lobby", Sender: "alice", Body: "Is anyone around for lunch today?", Number: 42, TS: 1700000000000, DisplayName: "Alice"}
+	b.Run("json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var got Message
+			if err := json.Unmarshal(m.encode(), &got); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(len(m.encode())), "frame-B")
+	})
+	b.Run("msgpack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var got Message
+			if err := msgpack.Unmarshal(m.pack(), &got); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(len(m.pack())), "frame-B")
+	})
+}
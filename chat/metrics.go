@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Server metrics, served on /metrics
+var (
+	clientsConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_clients_connected",
+		Help: "Clients currently registered in a room.",
+	})
+	messagesBroadcast = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_broadcast_total",
+		Help: "Chat messages broadcast to rooms.",
+	})
+	sendBufferDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_send_buffer_drops_total",
+		Help: "Clients disconnected because their send buffer was full.",
+	})
+	sessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_sessions_active",
+		Help: "Sessions of disconnected clients kept for resuming.",
+	})
+	sessionsEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_sessions_evicted_total",
+		Help: "Resumable sessions dropped before being resumed, by reason: capacity or ttl.",
+	}, []string{"reason"})
+	upgradeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_upgrade_failures_total",
+		Help: "WebSocket upgrades that failed.",
+	})
+	messagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_messages_filtered_total",
+		Help: "Chat messages dropped by a filter, by filter.",
+	}, []string{"filter"})
+	pushNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_push_notifications_total",
+		Help: "Push notifications by result: sent, failed or expired.",
+	}, []string{"result"})
+	hookDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_hook_drops_total",
+		Help: "Messages that skipped the hooks after broadcast because too many were waiting.",
+	})
+	hookMessageBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_hook_message_bytes",
+		Help:    "Sizes of the messages the MeasureMessages hook saw, by type.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 7),
+	}, []string{"type"})
+)
+
+// Export the number of open rooms of the hub
+func registerHubMetrics(hub *Hub) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_rooms_active",
+		Help: "Rooms currently open.",
+	}, func() float64 { return float64(hub.count()) })
+}
@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Roles of a room's users, from least to most privileged
+const (
+	roleMember = iota
+	roleModerator
+	roleOwner
+)
+
+// Get a user's role in the room; runs on the room goroutine
+func (r *Room) role(username string) int {
+	switch {
+	case username == r.owner:
+		return roleOwner
+	case r.moderators[username]:
+		return roleModerator
+	}
+	return roleMember
+}
+
+// Run a moderation command such as "/kick bob" or "/kick bob spamming links" from a
+// client, keeping it in the audit log; runs on the room goroutine.
+// Moderators may act on members and the owner on everyone; only the owner appoints moderators.
+func (r *Room) moderate(c *Client, command string, args []string) {
+	if len(args) == 0 {
+		r.sendTo(c, errorMessage("Usage: "+command+" <username> [reason]"))
+		return
+	}
+	target, reason := args[0], strings.Join(args[1:], " ")
+	actor := r.role(c.username)
+	switch {
+	case (command == "/mod" || command == "/unmod") && actor != roleOwner:
+		r.sendTo(c, errorMessage("Only the room owner can appoint moderators"))
+		return
+	case actor == roleMember:
+		r.sendTo(c, errorMessage("Only moderators can use "+command))
+		return
+	case r.role(target) >= actor:
+		r.sendTo(c, errorMessage("You can't use "+command+" on "+target))
+		return
+	}
+	because := ""
+	if reason != "" {
+		because = ": " + reason
+	}
+	var action, logged string
+	switch command {
+	case "/kick":
+		r.kick(target, "kicked by "+c.username+because)
+		action, logged = "kicked", auditKick
+	case "/ban":
+		r.access.ban(target)
+		r.kick(target, "banned by "+c.username+because)
+		action, logged = "banned", auditBan
+	case "/unban":
+		r.access.unban(target)
+		action, logged = "unbanned", auditUnban
+	case "/mute":
+		r.muted[target] = true
+		action, logged = "muted", auditMute
+	case "/unmute":
+		delete(r.muted, target)
+		action, logged = "unmuted", auditUnmute
+	case "/mod":
+		r.moderators[target] = true
+		r.saveRole(target, roleModerator)
+		action, logged = "made a moderator", auditMod
+	case "/unmod":
+		delete(r.moderators, target)
+		r.saveRole(target, roleMember)
+		action, logged = "removed as moderator", auditUnmod
+	}
+	r.audit(c.username, logged, target, reason, "")
+	r.deliver(systemMessage(fmt.Sprintf("%s was %s by %s%s", target, action, c.username, because)))
+}
+
+// Disconnect every connection of a user from the room
+func (r *Room) kick(username, reason string) {
+	for client := range r.clients {
+		if client.username == username {
+			client.closeCode, client.closeReason = websocket.ClosePolicyViolation, reason
+			r.leave(client)
+		}
+	}
+}
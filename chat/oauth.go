@@ -0,0 +1,320 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// oauthProvider signs users in with an external identity provider
+type oauthProvider struct {
+	name     string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier // nil for GitHub, which doesn't speak OpenID Connect
+}
+
+// identity is who a provider says a user is
+type identity struct {
+	subject  string // the provider's ID for the user, which never changes
+	username string // the name the user goes by there, a starting point for theirs here
+	name     string
+	email    string // only set once the provider verified it
+	avatar   string
+}
+
+// Identity providers by name, from OAUTH_ variables; none when empty
+var oauthProviders = map[string]*oauthProvider{}
+
+// Cookie keeping the state and PKCE verifier of a sign-in in progress
+const oauthCookie = "chat_oauth"
+
+// Time allowed for exchanging a code and fetching the identity
+const oauthTimeout = 10 * time.Second
+
+// Set up the identity providers whose client IDs are set. Their callbacks are
+// OAUTH_REDIRECT_URL, the server's public URL, followed by /auth/{provider}/callback.
+func configureOAuth() {
+	base := strings.TrimSuffix(os.Getenv("OAUTH_REDIRECT_URL"), "/")
+	add := func(name string, config *oauth2.Config, verifier *oidc.IDTokenVerifier) {
+		if base == "" || jwtSecret == nil {
+			fatal("Signing in with " + name + " needs OAUTH_REDIRECT_URL and JWT_SECRET")
+		}
+		config.RedirectURL = base + "/auth/" + name + "/callback"
+		oauthProviders[name] = &oauthProvider{name: name, config: config, verifier: verifier}
+	}
+	if id := os.Getenv("OAUTH_GITHUB_CLIENT_ID"); id != "" {
+		add("github", &oauth2.Config{
+			ClientID:     id,
+			ClientSecret: os.Getenv("OAUTH_GITHUB_CLIENT_SECRET"),
+			Endpoint:     github.Endpoint,
+			Scopes:       []string{"read:user", "user:email"},
+		}, nil)
+	}
+	if id := os.Getenv("OAUTH_GOOGLE_CLIENT_ID"); id != "" {
+		addOIDC(add, "google", "https://accounts.google.com", id, os.Getenv("OAUTH_GOOGLE_CLIENT_SECRET"))
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		addOIDC(add, "oidc", issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"))
+	}
+}
+
+// Discover an OpenID Connect provider and set it up
+func addOIDC(add func(string, *oauth2.Config, *oidc.IDTokenVerifier), name, issuer, clientID, clientSecret string) {
+	ctx, cancel := context.WithTimeout(context.Background(), oauthTimeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		fatal("Identity provider error", "provider", name, "err", err)
+	}
+	add(name, &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}, provider.Verifier(&oidc.Config{ClientID: clientID}))
+}
+
+// HTTP handler listing the identity providers users can sign in with
+func serveProviders(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range oauthProviders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// HTTP handler sending the browser to sign in with a provider
+func serveOAuthStart(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oauthProviders[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	state := hex.EncodeToString(nonce)
+	verifier := oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookie,
+		Value:    state + "." + verifier,
+		Path:     "/auth/",
+		MaxAge:   int(10 * time.Minute / time.Second),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// HTTP handler the provider sends the browser back to. It sets the session
+// cookie to a chat token for the verified identity and returns to the chat.
+func serveOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oauthProviders[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie(oauthCookie)
+	if err != nil {
+		http.Error(w, "Sign-in expired, try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthCookie, Path: "/auth/", MaxAge: -1})
+	state, verifier, _ := strings.Cut(cookie.Value, ".")
+	if subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, "Sign-in state mismatch, try again", http.StatusBadRequest)
+		return
+	}
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		http.Error(w, "Sign-in refused: "+reason, http.StatusUnauthorized)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), oauthTimeout)
+	defer cancel()
+	token, err := provider.config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	id, err := provider.identify(ctx, token)
+	if err != nil {
+		http.Error(w, "Sign-in failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	username, err := provider.username(ctx, id)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	chatToken, err := signToken(username, id.name, id.email)
+	if err != nil {
+		http.Error(w, "Could not issue token", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, chatToken)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// HTTP handler describing the session cookie's identity, so pages signed in
+// through a provider know their username; 401 without a valid session
+func serveSession(w http.ResponseWriter, r *http.Request) {
+	if jwtSecret == nil {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	claims, err := verifyClaims(cookie.Value)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"username": claims.Subject, "name": claims.Name, "email": claims.Email})
+}
+
+// Get the user's identity from the provider's token
+func (p *oauthProvider) identify(ctx context.Context, token *oauth2.Token) (identity, error) {
+	if p.verifier == nil {
+		return githubIdentity(ctx, p.config.Client(ctx, token))
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return identity{}, errors.New("no ID token")
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return identity{}, err
+	}
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+		Picture           string `json:"picture"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return identity{}, err
+	}
+	id := identity{subject: idToken.Subject, name: claims.Name, avatar: claims.Picture, username: claims.PreferredUsername}
+	if claims.EmailVerified {
+		id.email = claims.Email
+		if id.username == "" {
+			id.username, _, _ = strings.Cut(claims.Email, "@")
+		}
+	}
+	return id, nil
+}
+
+// Get the user's identity from the GitHub API
+func githubIdentity(ctx context.Context, client *http.Client) (identity, error) {
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return identity{}, err
+	}
+	id := identity{subject: strconv.FormatInt(user.ID, 10), username: user.Login, name: user.Name, avatar: user.AvatarURL}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return identity{}, err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			id.email = e.Email
+		}
+	}
+	return id, nil
+}
+
+// Fetch and decode a JSON document
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Pick the username of an identity. With accounts on, the identity keeps the
+// account it first signed in with, created then under a free username.
+func (p *oauthProvider) username(ctx context.Context, id identity) (string, error) {
+	base := providerUsername(p.name, id)
+	if !accounts {
+		return base, nil
+	}
+	if username, err := store.Identity(ctx, p.name, id.subject); err != nil || username != "" {
+		return username, err
+	}
+	a := &account{DisplayName: truncate(cleanText(id.name), maxDisplayName), Avatar: id.avatar, Created: time.Now().UnixMilli()}
+	for n := 1; ; n++ {
+		a.Username = base
+		if n > 1 {
+			suffix := "-" + strconv.Itoa(n)
+			a.Username = truncate(base, maxUsernameLength-len(suffix)) + suffix
+		}
+		err := store.CreateAccount(ctx, a)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errAccountExists) {
+			return "", err
+		}
+	}
+	return a.Username, store.LinkIdentity(ctx, p.name, id.subject, a.Username)
+}
+
+// Make a valid username from the name the user goes by at the provider
+func providerUsername(provider string, id identity) string {
+	username := truncate(cleanText(id.username), maxUsernameLength)
+	if !validUsername(username) {
+		username = truncate(provider+"-"+id.subject, maxUsernameLength)
+	}
+	return username
+}
+
+// Cut a string to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
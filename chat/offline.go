@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Direct messages and mentions are queued for users who aren't connected, up to
+// offlineMax per user (off when 0) for offlineTTL, from OFFLINE_QUEUE_MAX and OFFLINE_QUEUE_TTL
+var (
+	offlineMax = 100
+	offlineTTL = 7 * 24 * time.Hour
+)
+
+// memoryQueue keeps offline messages in memory when there's no store
+type memoryQueue struct {
+	mu       sync.Mutex
+	messages map[string][]*Message
+}
+
+var offlineMessages = &memoryQueue{messages: make(map[string][]*Message)}
+
+func (q *memoryQueue) push(username string, m *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := append(q.messages[username], m)
+	q.messages[username] = queued[max(0, len(queued)-offlineMax):]
+}
+
+func (q *memoryQueue) take(username string) []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := q.messages[username]
+	delete(q.messages, username)
+	return queued
+}
+
+// Queue a message for a user who isn't connected, reporting whether it was
+func queueOffline(username string, m *Message) bool {
+	if offlineMax <= 0 {
+		return false
+	}
+	queued := *m
+	queued.Offline = true
+	if store == nil {
+		offlineMessages.push(username, &queued)
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := store.Enqueue(ctx, username, &queued, offlineMax, time.Now().Add(-offlineTTL)); err != nil {
+		slog.Error("Storage error", "username", username, "err", err)
+		return false
+	}
+	return true
+}
+
+// Send a joining client the messages queued while its user was away, oldest
+// first; runs on the room goroutine
+func (r *Room) deliverOffline(client *Client) {
+	var queued []*Message
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		var err error
+		if queued, err = store.Dequeue(ctx, client.username, time.Now().Add(-offlineTTL)); err != nil {
+			r.logger().Error("Storage error", "err", err)
+			return
+		}
+	} else {
+		expired := time.Now().Add(-offlineTTL).UnixMilli()
+		for _, m := range offlineMessages.take(client.username) {
+			if m.TS >= expired {
+				queued = append(queued, m)
+			}
+		}
+	}
+	for _, m := range queued {
+		r.sendTo(client, m)
+	}
+}
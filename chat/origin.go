@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// originPolicy decides which browser origins may open WebSockets and call the API
+type originPolicy struct {
+	any     bool            // allow every origin
+	allowed map[string]bool // origins such as "https://example.com", besides the server's own
+}
+
+// Read the allowed origins from ALLOWED_ORIGINS, a comma separated list or "*".
+// Without it only pages served by this server itself are allowed.
+func originPolicyFromEnv() *originPolicy {
+	p := &originPolicy{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+		case "*":
+			p.any = true
+		default:
+			p.allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	return p
+}
+
+// Report whether the request's origin is allowed. Requests without an Origin
+// header don't come from a browser page and are always allowed.
+func (p *originPolicy) allows(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any || p.allowed[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, requestHost(r))
+}
+
+// Wrap a handler to refuse disallowed origins with 403 and answer CORS
+// requests from allowed ones
+func (p *originPolicy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.allows(r) {
+			slog.Warn("Rejected origin", "origin", origin, "method", r.Method, "path", r.URL.Path, "ip", remoteIP(r))
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Origins allowed to connect, from ALLOWED_ORIGINS
+var origins = &originPolicy{}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Most messages a room may have pinned at once, from MAX_PINS
+var maxPins = 25
+
+// Pin or unpin one of the room's messages for a moderator, then tell the room
+// the new list of pins; runs on the room goroutine
+func (r *Room) pin(c *Client, m *Message) {
+	if r.role(c.username) < roleModerator {
+		r.sendTo(c, errorMessage("Only moderators can pin messages"))
+		return
+	}
+	pinned := m.Type == typePinned
+	i := slices.Index(r.pinned, m.ID)
+	switch {
+	case pinned && i >= 0, !pinned && i < 0:
+		return
+	case pinned && len(r.pinned) >= maxPins:
+		r.sendTo(c, errorMessage(fmt.Sprintf("A room can have at most %d pinned messages; unpin one first", maxPins)))
+		return
+	}
+	if pinned {
+		if _, err := r.messageSender(m.ID); err != nil {
+			r.sendTo(c, errorMessage(fmt.Sprintf("Can't pin message %d: %v", m.ID, err)))
+			return
+		}
+	}
+	r.setPin(c.username, m.ID, pinned)
+}
+
+// Add or remove a pin, saving it and telling the room; runs on the room goroutine
+func (r *Room) setPin(by string, id uint64, pinned bool) {
+	if pinned {
+		r.pinned = append(r.pinned, id)
+	} else {
+		r.pinned = slices.DeleteFunc(r.pinned, func(p uint64) bool { return p == id })
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SavePin(ctx, r.name, id, pinned); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	event := newMessage(typeUnpinned, "")
+	if pinned {
+		event.Type = typePinned
+	}
+	event.ID = id
+	event.Sender = by
+	event.Pinned = r.pins()
+	r.deliver(event)
+}
+
+// Drop the pin of a deleted message; runs on the room goroutine
+func (r *Room) unpinDeleted(by string, id uint64) {
+	if slices.Contains(r.pinned, id) {
+		r.setPin(by, id, false)
+	}
+}
+
+// Copy the IDs of the room's pinned messages, in the order they were pinned,
+// never nil so an empty list still shows in events; runs on the room goroutine
+func (r *Room) pins() []uint64 {
+	return append([]uint64{}, r.pinned...)
+}
+
+// Load the room's pinned messages, before its goroutine starts
+func (r *Room) restorePins() {
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	pinned, err := store.Pins(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	r.pinned = pinned
+}
+
+// HTTP handler describing a room with its metadata and pinned messages; takes
+// password or invite for private rooms
+func (h *Hub) serveRoom(w http.ResponseWriter, r *http.Request) {
+	room, exists := h.lookup(r.PathValue("name"))
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if !room.access.admits(query.Get("password"), query.Get("invite")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	info, ok := room.info()
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Limits of polls
+const (
+	maxPollQuestion   = 300
+	maxPollOption     = 100
+	minPollOptions    = 2
+	maxPollOptions    = 10
+	defaultPollLength = 24 * time.Hour
+	maxPollLength     = 30 * 24 * time.Hour
+)
+
+// Poll is a question the room votes on, e.g. {"question":"Lunch?","options":["pizza","sushi"]}.
+// Events carry the tally; anonymous polls leave out who voted for what.
+type Poll struct {
+	Question  string     `json:"question"`
+	Options   []string   `json:"options"`
+	Anonymous bool       `json:"anonymous,omitempty"`
+	ClosesAt  int64      `json:"closes_at,omitempty"` // unix milliseconds; a day after creation when left out
+	Closed    bool       `json:"closed,omitempty"`
+	Counts    []int      `json:"counts,omitempty"` // votes per option
+	Voters    [][]string `json:"voters,omitempty"` // who voted for each option, unless anonymous
+}
+
+// poll is an open or recently closed poll of a room
+type poll struct {
+	id     uint64
+	sender string
+	Poll
+	votes map[string]int // option index by voter
+	timer *time.Timer    // closes the poll at ClosesAt
+}
+
+// Check a new poll and clean up its text
+func (p *Poll) validate(now time.Time) error {
+	p.Question = cleanText(p.Question)
+	if p.Question == "" || len(p.Question) > maxPollQuestion {
+		return fmt.Errorf("a poll needs a question of at most %d bytes", maxPollQuestion)
+	}
+	if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+		return fmt.Errorf("a poll needs %d to %d options", minPollOptions, maxPollOptions)
+	}
+	for i, option := range p.Options {
+		p.Options[i] = cleanText(option)
+		if p.Options[i] == "" || len(p.Options[i]) > maxPollOption {
+			return fmt.Errorf("poll options must be 1 to %d bytes", maxPollOption)
+		}
+	}
+	if p.ClosesAt == 0 {
+		p.ClosesAt = now.Add(defaultPollLength).UnixMilli()
+	}
+	if closes := time.UnixMilli(p.ClosesAt); !closes.After(now) || closes.After(now.Add(maxPollLength)) {
+		return fmt.Errorf("a poll must close within %s", maxPollLength)
+	}
+	p.Closed, p.Counts, p.Voters = false, nil, nil
+	return nil
+}
+
+// Describe the poll with its current tally
+func (p *poll) tally() *Poll {
+	t := p.Poll
+	t.Counts = make([]int, len(p.Options))
+	if !p.Anonymous {
+		t.Voters = make([][]string, len(p.Options))
+		for i := range t.Voters {
+			t.Voters[i] = []string{}
+		}
+	}
+	for voter, option := range p.votes {
+		t.Counts[option]++
+		if !p.Anonymous {
+			t.Voters[option] = append(t.Voters[option], voter)
+		}
+	}
+	for _, voters := range t.Voters {
+		slices.Sort(voters)
+	}
+	return &t
+}
+
+// Create an event about the poll with its current tally
+func (p *poll) event(typ string) *Message {
+	m := newMessage(typ, "")
+	m.ID, m.Sender, m.Poll = p.id, p.sender, p.tally()
+	return m
+}
+
+// Start a poll from a client's poll_create and tell the room; the poll takes
+// the next message ID, so it sits among the room's messages. Runs on the room goroutine.
+func (r *Room) createPoll(c *Client, m *Message) {
+	if r.muted[c.username] || r.refuseReadOnly(c) {
+		return
+	}
+	// Polls are kept in the clear
+	if r.meta.E2E {
+		r.sendTo(c, codedError(errCodeE2E, "Polls can't be started in an end-to-end encrypted room"))
+		return
+	}
+	if m.Poll == nil {
+		r.sendTo(c, errorMessage("A poll needs a poll object with a question and options"))
+		return
+	}
+	now := time.Now()
+	if err := m.Poll.validate(now); err != nil {
+		r.sendTo(c, errorMessage("Can't create the poll: "+err.Error()))
+		return
+	}
+	p := &poll{id: r.nextID(), sender: c.username, Poll: *m.Poll, votes: make(map[string]int)}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SavePoll(ctx, r.name, p.id, p.sender, &p.Poll); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	r.openPoll(p, now)
+	r.deliver(p.event(typePollCreate))
+}
+
+// Keep an open poll and arm its closing timer; runs on the room goroutine
+func (r *Room) openPoll(p *poll, now time.Time) {
+	r.polls[p.id] = p
+	p.timer = time.AfterFunc(time.UnixMilli(p.ClosesAt).Sub(now), func() {
+		r.do(func() { r.closePoll(p) })
+	})
+}
+
+// Record a client's vote, replacing their earlier one, and tell the room the
+// new tally; runs on the room goroutine
+func (r *Room) vote(c *Client, m *Message) {
+	if r.muted[c.username] || r.refuseReadOnly(c) {
+		return
+	}
+	p, ok := r.polls[m.ID]
+	switch {
+	case !ok || p.Closed:
+		r.sendTo(c, errorMessage(fmt.Sprintf("Can't vote in poll %d: %v", m.ID, errNoPoll)))
+		return
+	case m.Option == nil || *m.Option < 0 || *m.Option >= len(p.Options):
+		r.sendTo(c, errorMessage(fmt.Sprintf("A vote needs an option from 0 to %d", len(p.Options)-1)))
+		return
+	}
+	if previous, voted := p.votes[c.username]; voted && previous == *m.Option {
+		return
+	}
+	p.votes[c.username] = *m.Option
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SaveVote(ctx, r.name, p.id, c.username, *m.Option); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	r.deliver(p.event(typePollResults))
+}
+
+var errNoPoll = errors.New("no such open poll in this room")
+
+// Close a poll at its closing time and tell the room the final tally; runs on
+// the room goroutine
+func (r *Room) closePoll(p *poll) {
+	if p.Closed {
+		return
+	}
+	p.Closed = true
+	delete(r.polls, p.id)
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.ClosePoll(ctx, r.name, p.id); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	r.deliver(p.event(typePollResults))
+}
+
+// Send a joining client the room's open polls with their tally; runs on the room goroutine
+func (r *Room) sendPolls(client *Client) {
+	ids := make([]uint64, 0, len(r.polls))
+	for id := range r.polls {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		event := r.polls[id].event(typePollResults)
+		event.Replay = true
+		r.sendTo(client, event)
+	}
+}
+
+// Load the room's open polls and their votes, closing those whose time passed
+// while the room was closed; runs before the room starts
+func (r *Room) restorePolls() {
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	stored, err := store.OpenPolls(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	now := time.Now()
+	for _, p := range stored {
+		// The timer of a poll already past its time fires right away, once the room runs
+		r.openPoll(p, now)
+	}
+}
+
+// Stop the timers of the room's open polls as the room stops; they are
+// restored with the room. Runs on the room goroutine.
+func (r *Room) stopPolls() {
+	for _, p := range r.polls {
+		p.timer.Stop()
+	}
+}
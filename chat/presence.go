@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PresenceStore tracks which users are in each room, possibly across instances
+type PresenceStore interface {
+	Register(ctx context.Context, room, username string) error
+	Unregister(ctx context.Context, room, username string) error
+	List(ctx context.Context, room string) ([]string, error)
+}
+
+// Timeout for a single presence store call made from a room goroutine
+const presenceTimeout = 2 * time.Second
+
+// memoryPresence keeps presence for this instance only
+type memoryPresence struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]int // room -> username -> connection count
+}
+
+func newMemoryPresence() *memoryPresence {
+	return &memoryPresence{rooms: make(map[string]map[string]int)}
+}
+
+func (p *memoryPresence) Register(ctx context.Context, room, username string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rooms[room] == nil {
+		p.rooms[room] = make(map[string]int)
+	}
+	p.rooms[room][username]++
+	return nil
+}
+
+func (p *memoryPresence) Unregister(ctx context.Context, room, username string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	members, ok := p.rooms[room]
+	if !ok {
+		return nil
+	}
+	if members[username]--; members[username] <= 0 {
+		delete(members, username)
+	}
+	if len(members) == 0 {
+		delete(p.rooms, room)
+	}
+	return nil
+}
+
+func (p *memoryPresence) List(ctx context.Context, room string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var names []string
+	for name := range p.rooms[room] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// redisPresence shares presence between instances through a Redis hash per room.
+// Each field is "node|username" so one node doesn't remove another's connections.
+// Each node also refreshes a heartbeat key, and the entries of a node whose
+// heartbeat expired are swept when listing, so a crashed node's members go away.
+type redisPresence struct {
+	client *redis.Client
+	node   string
+}
+
+// How long a node's presence entries outlive its last heartbeat
+const presenceTTL = 30 * time.Second
+
+// Time allowed on startup to clear the entries a node left before restarting
+const presenceClearTimeout = 10 * time.Second
+
+func (p *redisPresence) key(room string) string {
+	return "chat:presence:" + room
+}
+
+func (p *redisPresence) nodeKey(node string) string {
+	return "chat:presence:node:" + node
+}
+
+// Mark this node as alive for another presenceTTL
+func (p *redisPresence) beat(ctx context.Context) error {
+	return p.client.Set(ctx, p.nodeKey(p.node), time.Now().UnixMilli(), presenceTTL).Err()
+}
+
+// Refresh the heartbeat every third of presenceTTL, so one failed beat doesn't
+// make other nodes drop this one's members
+func (p *redisPresence) heartbeat() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+		if err := p.beat(ctx); err != nil {
+			slog.Warn("Presence heartbeat error", "err", err)
+		}
+		cancel()
+		time.Sleep(presenceTTL / 3)
+	}
+}
+
+// Drop the entries this node left in every room before it restarted, as
+// its heartbeat could still be alive and none of those connections are
+func (p *redisPresence) clear(ctx context.Context) error {
+	prefix := p.node + "|"
+	iter := p.client.ScanType(ctx, 0, p.key("*"), 100, "hash").Iterator()
+	for iter.Next(ctx) {
+		fields, err := p.client.HKeys(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+		var mine []string
+		for _, field := range fields {
+			if strings.HasPrefix(field, prefix) {
+				mine = append(mine, field)
+			}
+		}
+		if len(mine) > 0 {
+			if err := p.client.HDel(ctx, iter.Val(), mine...).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Err()
+}
+
+func (p *redisPresence) Register(ctx context.Context, room, username string) error {
+	return p.client.HIncrBy(ctx, p.key(room), p.node+"|"+username, 1).Err()
+}
+
+func (p *redisPresence) Unregister(ctx context.Context, room, username string) error {
+	field := p.node + "|" + username
+	count, err := p.client.HIncrBy(ctx, p.key(room), field, -1).Result()
+	if err != nil {
+		return err
+	}
+	if count <= 0 {
+		return p.client.HDel(ctx, p.key(room), field).Err()
+	}
+	return nil
+}
+
+func (p *redisPresence) List(ctx context.Context, room string) ([]string, error) {
+	fields, err := p.client.HKeys(ctx, p.key(room)).Result()
+	if err != nil {
+		return nil, err
+	}
+	alive, err := p.aliveNodes(ctx, fields)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names, stale []string
+	for _, field := range fields {
+		node, name, _ := strings.Cut(field, "|")
+		if !alive[node] {
+			stale = append(stale, field)
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(stale) > 0 {
+		if err := p.client.HDel(ctx, p.key(room), stale...).Err(); err != nil {
+			slog.Warn("Presence sweep error", "room", room, "err", err)
+		}
+	}
+	return names, nil
+}
+
+// Find which nodes of a room's presence fields still have a heartbeat; this node
+// always counts, as its own entries are kept up to date
+func (p *redisPresence) aliveNodes(ctx context.Context, fields []string) (map[string]bool, error) {
+	alive := map[string]bool{p.node: true}
+	var nodes, keys []string
+	for _, field := range fields {
+		node, _, _ := strings.Cut(field, "|")
+		if _, ok := alive[node]; !ok {
+			alive[node] = false
+			nodes = append(nodes, node)
+			keys = append(keys, p.nodeKey(node))
+		}
+	}
+	if len(keys) == 0 {
+		return alive, nil
+	}
+	beats, err := p.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, beat := range beats {
+		alive[nodes[i]] = beat != nil
+	}
+	return alive, nil
+}
+
+// Use Redis for presence when REDIS_URL is set, otherwise keep it in memory
+func newPresenceFromEnv() PresenceStore {
+	client := redisClientFromEnv()
+	if client == nil {
+		return newMemoryPresence()
+	}
+	p := &redisPresence{client: client, node: nodeID}
+	ctx, cancel := context.WithTimeout(context.Background(), presenceClearTimeout)
+	defer cancel()
+	if err := p.clear(ctx); err != nil {
+		slog.Warn("Presence clear error", "err", err)
+	}
+	go p.heartbeat()
+	return p
+}
+
+// Name of this instance among the others sharing Redis, from NODE_ID or the hostname
+var nodeID = nodeIDFromEnv()
+
+func nodeIDFromEnv() string {
+	if node := os.Getenv("NODE_ID"); node != "" {
+		return node
+	}
+	node, _ := os.Hostname()
+	return node
+}
+
+var (
+	redisOnce   sync.Once
+	redisClient *redis.Client
+)
+
+// Get the Redis client for REDIS_URL, shared by everything using Redis; nil when unset
+func redisClientFromEnv() *redis.Client {
+	redisOnce.Do(func() {
+		redisURL := os.Getenv("REDIS_URL")
+		if redisURL == "" {
+			return
+		}
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			fatal("Invalid REDIS_URL", "err", err)
+		}
+		redisClient = redis.NewClient(opts)
+	})
+	return redisClient
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Start two nodes sharing presence through one Redis
+func newRedisNodes(t *testing.T) (*miniredis.Miniredis, *redisPresence, *redisPresence) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	a, b := &redisPresence{client: client, node: "node-a"}, &redisPresence{client: client, node: "node-b"}
+	ctx := context.Background()
+	for _, p := range []*redisPresence{a, b} {
+		if err := p.beat(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mr, a, b
+}
+
+func TestRedisPresenceListsMembersOfEveryNode(t *testing.T) {
+	_, a, b := newRedisNodes(t)
+	ctx := context.Background()
+	a.Register(ctx, "lobby", "alice")
+	b.Register(ctx, "lobby", "bob")
+	b.Register(ctx, "lobby", "alice") // a second device on the other node
+	b.Register(ctx, "elsewhere", "carol")
+
+	for _, p := range []*redisPresence{a, b} {
+		names, err := p.List(ctx, "lobby")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"alice", "bob"}; !slices.Equal(names, want) {
+			t.Errorf("%s lists %q, want %q", p.node, names, want)
+		}
+	}
+
+	a.Unregister(ctx, "lobby", "alice")
+	names, _ := b.List(ctx, "lobby")
+	if want := []string{"alice", "bob"}; !slices.Equal(names, want) {
+		t.Errorf("after alice left node-a: %q, want %q", names, want)
+	}
+	b.Unregister(ctx, "lobby", "alice")
+	names, _ = a.List(ctx, "lobby")
+	if want := []string{"bob"}; !slices.Equal(names, want) {
+		t.Errorf("after alice left both: %q, want %q", names, want)
+	}
+}
+
+func TestRedisPresenceSweepsSilentNodes(t *testing.T) {
+	mr, a, b := newRedisNodes(t)
+	ctx := context.Background()
+	a.Register(ctx, "lobby", "alice")
+	b.Register(ctx, "lobby", "bob")
+
+	// node-b stops, so only node-a keeps beating
+	mr.FastForward(presenceTTL / 2)
+	a.beat(ctx)
+	mr.FastForward(presenceTTL / 2)
+	names, err := a.List(ctx, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice"}; !slices.Equal(names, want) {
+		t.Errorf("lists %q, want %q without the silent node's members", names, want)
+	}
+	if mr.HGet(a.key("lobby"), "node-b|bob") != "" {
+		t.Error("the silent node's entry wasn't removed")
+	}
+}
+
+func TestRedisPresenceClearsEntriesOfARestartedNode(t *testing.T) {
+	mr, a, b := newRedisNodes(t)
+	ctx := context.Background()
+	a.Register(ctx, "lobby", "alice")
+	a.Register(ctx, "elsewhere", "alice")
+	b.Register(ctx, "lobby", "bob")
+
+	// node-a restarts within its heartbeat's TTL
+	restarted := &redisPresence{client: a.client, node: "node-a"}
+	if err := restarted.clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	names, err := b.List(ctx, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bob"}; !slices.Equal(names, want) {
+		t.Errorf("lists %q, want %q without the connections lost in the restart", names, want)
+	}
+	if mr.Exists(a.key("elsewhere")) {
+		t.Error("the restarted node's only entry in a room wasn't removed")
+	}
+}
+
+func TestRoomMembersIncludeOtherNodes(t *testing.T) {
+	_, a, b := newRedisNodes(t)
+	setFor[PresenceStore](t, &presence, a)
+	_, srv, _ := newTestServer(t)
+	b.Register(context.Background(), "shared", "bob")
+
+	alice := dial(t, srv, url.Values{"room": {"shared"}, "username": {"alice"}})
+	if m := alice.expect(typeMembers); !slices.Equal(m.Members, []string{"alice", "bob"}) {
+		t.Errorf("members = %q, want alice from this node and bob from the other", m.Members)
+	}
+}
@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPresenceOnlyClientReceivesNoChat(t *testing.T) {
+	_, srv, _ := newTestServer(t)
+	watcher := dial(t, srv, url.Values{"room": {"sidebar"}, "username": {"watcher"}, "presence": {"true"}})
+	watcher.expect(typeMembers)
+
+	alice := join(t, srv, "sidebar", "alice")
+	if m := watcher.expect(typeJoin); m.Sender != "alice" {
+		t.Errorf("join event = %+v, want alice's", m)
+	}
+	alice.send(&Message{Type: typeTyping})
+	alice.say("hello")
+	alice.expect(typeAck)
+
+	var typing bool
+	for _, m := range watcher.drain(200 * time.Millisecond) {
+		switch m.Type {
+		case typeChat:
+			t.Errorf("presence-only client got chat %q", m.Body)
+		case typeTyping:
+			typing = true
+		}
+	}
+	if !typing {
+		t.Error("presence-only client didn't get the typing event")
+	}
+}
+
+func TestPresenceOnlyJoinGetsNoHistory(t *testing.T) {
+	_, srv, _ := newTestServer(t)
+	alice := join(t, srv, "sidebar", "alice")
+	alice.say("secret history")
+	alice.expect(typeAck)
+	alice.send(&Message{Type: typePollCreate, Poll: &Poll{Question: "Lunch?", Options: []string{"yes", "no"}}})
+	alice.expect(typePollCreate)
+
+	watcher := dial(t, srv, url.Values{"room": {"sidebar"}, "username": {"watcher"}, "presence": {"true"}})
+	for _, m := range watcher.drain(200 * time.Millisecond) {
+		if !m.isPresence() {
+			t.Errorf("presence-only client got %s %q (replay %t)", m.Type, m.Body, m.Replay)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"chat-app/internal/env"
+	"golang.org/x/net/html"
+)
+
+// Link preview settings
+const (
+	previewQueueSize = 256
+	previewWorkers   = 4
+	previewMaxBody   = 512 * 1024 // bytes of a page read looking for its metadata
+	previewRedirects = 3
+	previewCacheSize = 1000
+	previewCacheTTL  = time.Hour
+	maxPreviewText   = 300 // bytes kept of a title or description
+)
+
+// LinkPreview describes the page behind a link, from its OpenGraph tags or else
+// its title and description
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// cachedPreview is a fetched preview, nil when the link had none
+type cachedPreview struct {
+	preview *LinkPreview
+	fetched time.Time
+}
+
+// previewRequest is a message's link waiting to be fetched
+type previewRequest struct {
+	room *Room
+	id   uint64
+	url  string
+}
+
+// previewService fetches the first link of chat messages and sends the room a
+// link_preview event about it
+type previewService struct {
+	hosts  []string // hosts fetched, with their subdomains; any public host when empty
+	queue  chan previewRequest
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]cachedPreview
+}
+
+// Link previews from LINK_PREVIEWS, nil when off
+var previews *previewService
+
+// Set up link previews when LINK_PREVIEWS is on: LINK_PREVIEW_HOSTS limits the
+// hosts fetched, and LINK_PREVIEW_TIMEOUT bounds each fetch
+func newPreviewsFromEnv() *previewService {
+	if !env.Bool("LINK_PREVIEWS", false) {
+		return nil
+	}
+	p := &previewService{
+		queue: make(chan previewRequest, previewQueueSize),
+		cache: make(map[string]cachedPreview),
+	}
+	for _, host := range strings.Split(os.Getenv("LINK_PREVIEW_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			p.hosts = append(p.hosts, host)
+		}
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if len(p.hosts) == 0 {
+		// Any host may be linked, so don't let links reach the server's own network
+		dialer.Control = refusePrivate
+	}
+	p.client = &http.Client{
+		Timeout:   env.Duration("LINK_PREVIEW_TIMEOUT", 5*time.Second),
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= previewRedirects {
+				return errors.New("too many redirects")
+			}
+			if !p.allows(req.URL) {
+				return errors.New("redirected to a host that isn't allowed")
+			}
+			return nil
+		},
+	}
+	for range previewWorkers {
+		go p.work()
+	}
+	return p
+}
+
+// Refuse connections to loopback, private and other non-public addresses
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if ip = ip.Unmap(); !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("%s is not a public address", ip)
+	}
+	return nil
+}
+
+// Report whether a link may be fetched: http or https, to an allowed host
+func (p *previewService) allows(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return false
+	}
+	if len(p.hosts) == 0 {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range p.hosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue the first link of a chat message for previewing; called from room
+// goroutines, so it never blocks and drops the link when the queue is full
+func (p *previewService) dispatch(r *Room, m *Message) {
+	if p == nil || m.Type != typeChat {
+		return
+	}
+	link := firstLink(m.Body)
+	if link == "" {
+		return
+	}
+	select {
+	case p.queue <- previewRequest{room: r, id: m.ID, url: link}:
+	default:
+		r.logger().Warn("Link preview queue full, dropping link", "id", m.ID)
+	}
+}
+
+// Find the first link of a message body, with https:// added to bare www. links
+func firstLink(body string) string {
+	link := linkPattern.FindString(body)
+	if link == "" {
+		return ""
+	}
+	// Leave out punctuation ending the sentence around the link
+	link = strings.TrimRight(link, ".,;:!?)]}>'\"")
+	if strings.HasPrefix(strings.ToLower(link), "www.") {
+		link = "https://" + link
+	}
+	return link
+}
+
+// Fetch queued links until the process exits, sending each preview to its room
+// as {"type":"link_preview","id":7,"preview":{...}} about message 7
+func (p *previewService) work() {
+	for req := range p.queue {
+		preview := p.lookup(req.url)
+		if preview == nil {
+			continue
+		}
+		event := newMessage(typeLinkPreview, "")
+		event.ID, event.Preview = req.id, preview
+		req.room.do(func() {
+			// The message may have been deleted meanwhile
+			sender, err := req.room.messageSender(req.id)
+			if err != nil {
+				return
+			}
+			event.Sender = sender
+			req.room.deliver(event)
+		})
+	}
+}
+
+// Get a link's preview from the cache, fetching it when missing or stale; nil
+// when the page can't be fetched or says nothing about itself
+func (p *previewService) lookup(link string) *LinkPreview {
+	p.mu.Lock()
+	cached, ok := p.cache[link]
+	p.mu.Unlock()
+	if ok && time.Since(cached.fetched) < previewCacheTTL {
+		return cached.preview
+	}
+	preview, err := p.fetch(link)
+	if err != nil {
+		slog.Debug("Link preview failed", "url", link, "err", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= previewCacheSize {
+		p.evict()
+	}
+	p.cache[link] = cachedPreview{preview: preview, fetched: time.Now()}
+	return preview
+}
+
+// Make room in the cache, dropping stale previews or else an arbitrary half;
+// the caller holds p.mu
+func (p *previewService) evict() {
+	for link, cached := range p.cache {
+		if time.Since(cached.fetched) >= previewCacheTTL {
+			delete(p.cache, link)
+		}
+	}
+	for link := range p.cache {
+		if len(p.cache) < previewCacheSize/2 {
+			return
+		}
+		delete(p.cache, link)
+	}
+}
+
+// Fetch a page and read its metadata
+func (p *previewService) fetch(link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if !p.allows(u) {
+		return nil, errors.New("host not allowed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "chat-app link preview")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("page answered %s", resp.Status)
+	}
+	if typ, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); typ != "text/html" {
+		return nil, fmt.Errorf("not a page but %q", typ)
+	}
+	preview := readPreview(io.LimitReader(resp.Body, previewMaxBody), resp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, nil
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+// Read the OpenGraph tags of a page's head, falling back to its title and
+// description; image links are made absolute against the page's URL
+func readPreview(r io.Reader, page *url.URL) *LinkPreview {
+	preview := &LinkPreview{}
+	var title, description string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return finishPreview(preview, title, description, page)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				return finishPreview(preview, title, description, page)
+			case "title":
+				if z.Next() == html.TextToken && title == "" {
+					title = string(z.Text())
+				}
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = string(v)
+					}
+				}
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:image":
+					preview.Image = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "description":
+					description = content
+				}
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				return finishPreview(preview, title, description, page)
+			}
+		}
+	}
+}
+
+// Fill a preview's gaps from the page's title and description and tidy its text
+func finishPreview(preview *LinkPreview, title, description string, page *url.URL) *LinkPreview {
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	tidy := func(s string) string {
+		return truncate(strings.Join(strings.Fields(cleanText(s)), " "), maxPreviewText)
+	}
+	preview.Title, preview.Description, preview.SiteName = tidy(preview.Title), tidy(preview.Description), tidy(preview.SiteName)
+	if preview.Image != "" {
+		image, err := page.Parse(preview.Image)
+		if err != nil || (image.Scheme != "http" && image.Scheme != "https") {
+			preview.Image = ""
+		} else {
+			preview.Image = image.String()
+		}
+	}
+	return preview
+}
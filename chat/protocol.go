@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"chat-app/internal/msgpack"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Subprotocols a client can request when connecting; clients that don't ask
+// for one are treated as text-only and can't receive binary payloads
+const (
+	protocolText    = "chat.text"
+	protocolBinary  = "chat.binary"
+	protocolJSON    = "chat-json"    // the JSON envelopes of chat.text, asked for by name
+	protocolMsgpack = "chat-msgpack" // envelopes as MessagePack in binary frames, both ways
+)
+
+// Policies for delivering a binary message to a text-only client
+const (
+	binaryNotice      = "notice"      // drop the message and tell the client
+	binaryPlaceholder = "placeholder" // send a text placeholder in its place
+)
+
+// Policy used when a binary message can't be sent to a client, from BINARY_FALLBACK
+var binaryFallback = binaryFallbackFromEnv()
+
+// frame is a single WebSocket message queued for a client
+type frame struct {
+	messageType int
+	data        []byte
+	prepared    *websocket.PreparedMessage // shared by the connections of a broadcast
+	span        trace.SpanContext          // the fanout span of a traced broadcast
+	queued      time.Time                  // when a traced broadcast was queued
+}
+
+// Wrap text in a text frame
+func textFrame(text []byte) frame {
+	return frame{messageType: websocket.TextMessage, data: text}
+}
+
+// frames is a message with its frame in each encoding, each made the first time
+// a client speaking it needs it, so a broadcast is encoded once per encoding in
+// use rather than once per connection; safe for the goroutines of a fanout
+type frames struct {
+	m          *Message
+	recipients int               // connections of a broadcast sharing the frames, 0 for a single send
+	span       trace.SpanContext // the fanout span of a traced broadcast
+	queued     time.Time         // when a traced broadcast was queued
+
+	jsonOnce, packedOnce sync.Once
+	json, packed         frame
+}
+
+// Get the frames of a message sent to a single client
+func framesOf(m *Message) *frames {
+	return &frames{m: m}
+}
+
+// Get the JSON text frame
+func (f *frames) text() frame {
+	f.jsonOnce.Do(func() { f.json = f.share(websocket.TextMessage, f.m.encode()) })
+	return f.json
+}
+
+// Get the MessagePack binary frame
+func (f *frames) msgpack() frame {
+	f.packedOnce.Do(func() { f.packed = f.share(websocket.BinaryMessage, f.m.pack()) })
+	return f.packed
+}
+
+// Frame data for the recipients; a broadcast's frame is prepared so it is framed,
+// and with compression on compressed, once for all of them
+func (f *frames) share(messageType int, data []byte) frame {
+	shared := frame{messageType: messageType, data: data, span: f.span, queued: f.queued}
+	if f.recipients == 0 || f.recipients < 2 && !upgrader.EnableCompression {
+		return shared
+	}
+	if prepared, err := websocket.NewPreparedMessage(messageType, data); err == nil {
+		shared.prepared = prepared
+	}
+	return shared
+}
+
+// Encode a message on its own for a connection that may have negotiated
+// chat-msgpack, as before its client is registered
+func singleFrame(m *Message, packed bool) frame {
+	if packed {
+		return framesOf(m).msgpack()
+	}
+	return textFrame(m.encode())
+}
+
+// Encode a message for a client's protocol; reports false if nothing should be
+// sent, as when the client blocked the sender
+func encodeFor(client *Client, f *frames) (frame, bool) {
+	if client.blocks(f.m) {
+		return frame{}, false
+	}
+	return encodeProtocol(client, f)
+}
+
+// Encode a message for a client's protocol without checking blocks; text-only
+// clients get the fallback for binary payloads
+func encodeProtocol(client *Client, f *frames) (frame, bool) {
+	if client.msgpack {
+		return f.msgpack(), true
+	}
+	m := f.m
+	// Ciphertexts and key material are for the client's encryption, not for display
+	if m.Data == nil || client.binary || m.Type == typeEncrypted || m.Type == typeKeyExchange {
+		return f.text(), true
+	}
+	switch binaryFallback {
+	case binaryPlaceholder:
+		placeholder := *m
+		placeholder.Data = nil
+		placeholder.Body = fmt.Sprintf("[binary message, %d bytes]", len(m.Data))
+		return textFrame(placeholder.encode()), true
+	default:
+		return textFrame(systemMessage(m.Sender + " sent a binary message your client can't display").encode()), true
+	}
+}
+
+// Decode a frame from a client: binary frames are MessagePack envelopes from
+// chat-msgpack clients and chat message payloads from everyone else
+func decodeFrame(messageType int, data []byte, packed bool) (*Message, error) {
+	if messageType != websocket.BinaryMessage {
+		return decodeMessage(data)
+	}
+	if !packed {
+		return &Message{Type: typeChat, Data: data}, nil
+	}
+	var m Message
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Read the binary fallback policy from the environment
+func binaryFallbackFromEnv() string {
+	switch policy := os.Getenv("BINARY_FALLBACK"); policy {
+	case "", binaryNotice:
+		return binaryNotice
+	case binaryPlaceholder:
+		return binaryPlaceholder
+	default:
+		slog.Warn("Unknown BINARY_FALLBACK, using the default", "policy", policy, "default", binaryNotice)
+		return binaryNotice
+	}
+}
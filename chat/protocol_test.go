@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBinaryMessageToTextOnlyClient(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantType string
+		wantBody string
+	}{
+		{binaryNotice, typeSystem, "alice sent a binary message your client can't display"},
+		{binaryPlaceholder, typeChat, "[binary message, 4 bytes]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setFor(t, &binaryFallback, tt.policy)
+			_, srv, _ := newTestServer(t)
+			dialer := websocket.Dialer{Subprotocols: []string{protocolBinary}}
+			conn, _, err := dialer.Dial(wsURL(srv, url.Values{"room": {"binary"}, "username": {"alice"}}), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			alice := &testConn{Conn: conn, t: t}
+			alice.expect(typeMembers)
+			bob := join(t, srv, "binary", "bob")
+
+			if err := alice.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2, 3}); err != nil {
+				t.Fatal(err)
+			}
+			m := bob.expect(tt.wantType)
+			if m.Body != tt.wantBody || m.Data != nil {
+				t.Errorf("text-only client got %+v, want %s %q", m, tt.wantType, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBinaryMessageReplaysPerClientProtocol(t *testing.T) {
+	setFor(t, &binaryFallback, binaryPlaceholder)
+	_, srv, _ := newTestServer(t)
+	dialBinary := func(username string) *testConn {
+		dialer := websocket.Dialer{Subprotocols: []string{protocolBinary}}
+		conn, _, err := dialer.Dial(wsURL(srv, url.Values{"room": {"replayed"}, "username": {username}}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		c := &testConn{Conn: conn, t: t}
+		c.expect(typeMembers)
+		return c
+	}
+	alice := dialBinary("alice")
+	if err := alice.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect(typeAck)
+
+	// A binary client gets the payload back as it was sent
+	carol := dialBinary("carol")
+	if m := carol.expect(typeChat); !m.Replay || !bytes.Equal(m.Data, []byte{0, 1, 2, 3}) || m.Body != "" {
+		t.Errorf("binary client replayed %+v, want the payload in data", m)
+	}
+	// A text-only client gets the fallback, as it would live
+	bob := join(t, srv, "replayed", "bob")
+	if m := bob.expect(typeChat); !m.Replay || m.Body != "[binary message, 4 bytes]" || m.Data != nil {
+		t.Errorf("text-only client replayed %+v, want the placeholder", m)
+	}
+}
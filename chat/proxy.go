@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// addressList matches addresses against IPs and CIDR ranges
+type addressList []netip.Prefix
+
+// Parse a comma separated list of IPs and CIDR ranges such as
+// "10.0.0.0/8,192.168.1.7", exiting on entries that are neither
+func addressListFromEnv(name string) addressList {
+	var list addressList
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parseAddressRange(entry)
+		if err != nil {
+			fatal("Invalid "+name+" entry, expected an IP or CIDR range", "entry", entry)
+		}
+		list = append(list, prefix)
+	}
+	return list
+}
+
+// Parse an IP or CIDR range such as "10.0.0.0/8", an IP being a range of one
+func parseAddressRange(entry string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(entry)
+		if addrErr != nil {
+			return netip.Prefix{}, addrErr
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+// Report whether the address, an IP without a port, is in the list
+func (l addressList) contains(ip string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reverse proxies, from TRUSTED_PROXIES, whose X-Forwarded-For, X-Real-IP,
+// X-Forwarded-Proto and X-Forwarded-Host headers are believed
+var trustedProxies addressList
+
+// Addresses refused a connection, from BANNED_IPS
+var bannedIPs addressList
+
+// Get the address of the peer the request came straight from, without its port
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Report whether the request came straight from a trusted proxy
+func viaTrustedProxy(r *http.Request) bool {
+	return len(trustedProxies) > 0 && trustedProxies.contains(peerIP(r))
+}
+
+// Get the client's address from a trusted proxy's headers: the last address of
+// X-Forwarded-For that isn't another trusted proxy, else X-Real-IP; empty when
+// the proxy sent neither
+func forwardedIP(r *http.Request) string {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// Garbage from the client itself; the hops after it were checked already
+			break
+		}
+		if i == 0 || !trustedProxies.contains(hop) {
+			return hop
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		if _, err := netip.ParseAddr(ip); err == nil {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Get the scheme the client used, https behind a trusted proxy that says so
+// with X-Forwarded-Proto
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if viaTrustedProxy(r) {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// Get the host the client asked for, from X-Forwarded-Host behind a trusted proxy
+func requestHost(r *http.Request) string {
+	if viaTrustedProxy(r) {
+		host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// Report whether the client reached the server over HTTPS, so cookies can be Secure
+func secureRequest(r *http.Request) bool {
+	return requestScheme(r) == "https"
+}
+
+// Make a URL of this server, such as "/attachments/x", absolute as the client
+// sees the server
+func absoluteURL(r *http.Request, path string) string {
+	return requestScheme(r) + "://" + requestHost(r) + path
+}
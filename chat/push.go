@@ -0,0 +1,617 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"chat-app/internal/env"
+)
+
+// Kinds of push subscriptions
+const (
+	pushWebPush = "webpush" // a browser's Web Push subscription
+	pushFCM     = "fcm"     // a Firebase Cloud Messaging registration token
+)
+
+// Push delivery settings
+const (
+	pushQueueSize        = 1024
+	pushWorkers          = 4
+	pushAttempts         = 5
+	pushBackoff          = time.Second // doubled after every failed attempt
+	pushTimeout          = 10 * time.Second
+	pushTTL              = 24 * time.Hour // how long push services keep a notification for an unreachable device
+	maxPushSubscriptions = 10             // per user, the oldest dropped beyond this
+	maxPushBody          = 200            // bytes of a message body shown in a notification
+	pushBatchLines       = 3              // messages shown in a batched notification
+)
+
+var errNoPushSubscription = errors.New("no such push subscription")
+
+// pushSubscription is a device a user gets push notifications on
+type pushSubscription struct {
+	ID       string       `json:"id"`
+	Kind     string       `json:"kind"`
+	Endpoint string       `json:"endpoint,omitempty"` // Web Push endpoint URL
+	Keys     *webPushKeys `json:"keys,omitempty"`
+	Token    string       `json:"fcm_token,omitempty"`
+	Created  time.Time    `json:"created_at"`
+
+	username string
+}
+
+// webPushKeys are the keys a browser encrypts its Web Push messages with
+type webPushKeys struct {
+	P256dh string `json:"p256dh"` // base64url P-256 public key
+	Auth   string `json:"auth"`   // base64url authentication secret
+}
+
+// Check a subscription as a browser's PushSubscription.toJSON() or an app's
+// {"fcm_token":"..."} gives it, setting its kind and an ID that's the same
+// every time the same device registers
+func (s *pushSubscription) validate() error {
+	switch {
+	case s.Token != "" && s.Endpoint == "":
+		s.Kind = pushFCM
+	case s.Endpoint != "" && s.Token == "":
+		s.Kind = pushWebPush
+		u, err := url.Parse(s.Endpoint)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			return errors.New("endpoint must be an https URL")
+		}
+		if s.Keys == nil || s.Keys.P256dh == "" || s.Keys.Auth == "" {
+			return errors.New("a Web Push subscription needs keys.p256dh and keys.auth")
+		}
+		if _, _, err := parseWebPushKeys(s.Keys); err != nil {
+			return err
+		}
+	default:
+		return errors.New("a subscription needs either an endpoint with keys or an fcm_token")
+	}
+	sum := sha256.Sum256([]byte(s.Kind + " " + s.Endpoint + s.Token))
+	s.ID = hex.EncodeToString(sum[:8])
+	return nil
+}
+
+// pushPreferences are what a user wants push notifications for
+type pushPreferences struct {
+	DMs        bool     `json:"dms"`
+	Mentions   bool     `json:"mentions"`
+	WhenAway   bool     `json:"when_away"`   // also while connected but away, not only while offline
+	MutedRooms []string `json:"muted_rooms"` // rooms whose mentions aren't pushed
+}
+
+// Preferences of users who never set theirs
+var defaultPushPreferences = pushPreferences{DMs: true, Mentions: true, WhenAway: true, MutedRooms: []string{}}
+
+// pushUser is what the push service knows about a user
+type pushUser struct {
+	subscriptions []*pushSubscription // oldest first
+	prefs         pushPreferences
+}
+
+// pushNotification is the JSON a service worker or app gets for a direct message
+// or mention, or for a batch of them, to show the user
+type pushNotification struct {
+	Type   string `json:"type"` // dm, mention, or batch for several
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	Room   string `json:"room,omitempty"`
+	Sender string `json:"sender,omitempty"`
+	ID     uint64 `json:"id,omitempty"`    // the mentioning message
+	Count  int    `json:"count,omitempty"` // messages in a batch
+	TS     int64  `json:"ts"`
+}
+
+// pushDelivery is one notification on its way to one device
+type pushDelivery struct {
+	subscription *pushSubscription
+	notification *pushNotification
+	payload      []byte
+}
+
+// pushSender delivers notifications to one kind of subscription
+type pushSender interface {
+	send(ctx context.Context, d pushDelivery) error
+}
+
+// errPushExpired means the device is gone and its subscription should be dropped
+var errPushExpired = errors.New("subscription expired")
+
+// pushService sends push notifications of direct messages and mentions to users
+// who are offline or away, batching those that come close together
+type pushService struct {
+	webPush *webPushSender // nil without PUSH_VAPID_PRIVATE_KEY
+	fcm     *fcmSender     // nil without FCM_CREDENTIALS
+	window  time.Duration  // notifications within this of the first are sent as one
+	queue   chan pushDelivery
+
+	mu      sync.Mutex
+	users   map[string]*pushUser           // loaded from the store the first time they're needed
+	pending map[string][]*pushNotification // by username, waiting for the batch window to end
+}
+
+// Push notifications, nil unless PUSH_VAPID_PRIVATE_KEY or FCM_CREDENTIALS is set
+var pushes *pushService
+
+// Set up push notifications through Web Push with PUSH_VAPID_PRIVATE_KEY and
+// PUSH_VAPID_SUBJECT, and through FCM with FCM_CREDENTIALS; PUSH_BATCH_WINDOW
+// sets how long notifications are gathered into one. Exits if either is invalid.
+func newPushFromEnv() *pushService {
+	p := &pushService{
+		window:  env.Duration("PUSH_BATCH_WINDOW", 10*time.Second),
+		queue:   make(chan pushDelivery, pushQueueSize),
+		users:   make(map[string]*pushUser),
+		pending: make(map[string][]*pushNotification),
+	}
+	if key := os.Getenv("PUSH_VAPID_PRIVATE_KEY"); key != "" {
+		sender, err := newWebPushSender(key, os.Getenv("PUSH_VAPID_SUBJECT"))
+		if err != nil {
+			fatal("Invalid Web Push settings", "err", err)
+		}
+		p.webPush = sender
+	}
+	if path := os.Getenv("FCM_CREDENTIALS"); path != "" {
+		sender, err := newFCMSender(path)
+		if err != nil {
+			fatal("Invalid FCM_CREDENTIALS", "err", err)
+		}
+		p.fcm = sender
+	}
+	if p.webPush == nil && p.fcm == nil {
+		return nil
+	}
+	for range pushWorkers {
+		go p.work()
+	}
+	return p
+}
+
+// Get what the service knows about a user, loading it from the store if needed
+func (p *pushService) user(username string) (*pushUser, error) {
+	p.mu.Lock()
+	u, ok := p.users[username]
+	p.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+	u = &pushUser{prefs: defaultPushPreferences}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		subscriptions, err := store.PushSubscriptions(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		u.subscriptions = subscriptions
+		prefs, err := store.PushPreferences(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if prefs != nil {
+			u.prefs = *prefs
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if loaded, ok := p.users[username]; ok {
+		return loaded, nil
+	}
+	p.users[username] = u
+	return u, nil
+}
+
+// Report whether the service can deliver to a kind of subscription
+func (p *pushService) supports(kind string) bool {
+	return kind == pushWebPush && p.webPush != nil || kind == pushFCM && p.fcm != nil
+}
+
+// Add a device or refresh one already registered, saving it first; beyond
+// maxPushSubscriptions the user's oldest is dropped
+func (p *pushService) subscribe(s *pushSubscription) error {
+	u, err := p.user(s.username)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SavePushSubscription(ctx, s, maxPushSubscriptions); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.subscriptions = slices.DeleteFunc(u.subscriptions, func(old *pushSubscription) bool { return old.ID == s.ID })
+	u.subscriptions = append(u.subscriptions, s)
+	u.subscriptions = u.subscriptions[max(0, len(u.subscriptions)-maxPushSubscriptions):]
+	return nil
+}
+
+// Remove one of a user's devices
+func (p *pushService) unsubscribe(username, id string) error {
+	u, err := p.user(username)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	found := slices.ContainsFunc(u.subscriptions, func(s *pushSubscription) bool { return s.ID == id })
+	p.mu.Unlock()
+	if !found {
+		return errNoPushSubscription
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.DeletePushSubscription(ctx, username, id); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.subscriptions = slices.DeleteFunc(u.subscriptions, func(s *pushSubscription) bool { return s.ID == id })
+	return nil
+}
+
+// List a user's devices, oldest first
+func (p *pushService) subscriptions(username string) ([]*pushSubscription, error) {
+	u, err := p.user(username)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(u.subscriptions), nil
+}
+
+// Get a user's preferences
+func (p *pushService) preferences(username string) (pushPreferences, error) {
+	u, err := p.user(username)
+	if err != nil {
+		return pushPreferences{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefs := u.prefs
+	prefs.MutedRooms = slices.Clone(prefs.MutedRooms)
+	return prefs, nil
+}
+
+// Replace a user's preferences, saving them first
+func (p *pushService) setPreferences(username string, prefs pushPreferences) error {
+	u, err := p.user(username)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SavePushPreferences(ctx, username, prefs); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.prefs = prefs
+	return nil
+}
+
+// Report whether a user should be pushed to right now: nobody is connected as
+// them or, unless their preferences say otherwise, they're away
+func pushWanted(username string, prefs pushPreferences) bool {
+	if len(users.lookup(username)) == 0 {
+		return true
+	}
+	return prefs.WhenAway && statuses.away(username)
+}
+
+// Push a direct message or mention to its recipient if they're offline or away
+// and want it, after the batch window; called from room goroutines, so the
+// store is only read when the user isn't loaded yet
+func (p *pushService) notify(username string, m *Message) {
+	if p == nil || username == m.Sender {
+		return
+	}
+	prefs, err := p.preferences(username)
+	if err != nil {
+		slog.Error("Storage error", "username", username, "err", err)
+		return
+	}
+	switch {
+	case m.Type == typeDM && !prefs.DMs,
+		m.Type == typeMention && (!prefs.Mentions || slices.Contains(prefs.MutedRooms, m.Room)),
+		!pushWanted(username, prefs):
+		return
+	}
+	n := &pushNotification{Type: m.Type, Body: pushExcerpt(m.Body), Room: m.Room, Sender: m.Sender, TS: m.TS}
+	if m.Type == typeMention {
+		n.ID = m.ID
+		n.Title = m.Sender + " mentioned you in " + m.Room
+	} else {
+		n.Title = m.Sender
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	batch, waiting := p.pending[username]
+	p.pending[username] = append(batch, n)
+	if !waiting {
+		time.AfterFunc(p.window, func() { p.flush(username) })
+	}
+}
+
+// Send the notifications gathered for a user once the batch window is over, as
+// one that sums them up when there are several, unless the user came back
+func (p *pushService) flush(username string) {
+	p.mu.Lock()
+	batch := p.pending[username]
+	delete(p.pending, username)
+	_, loaded := p.users[username]
+	p.mu.Unlock()
+	if !loaded || len(batch) == 0 {
+		return
+	}
+	prefs, err := p.preferences(username)
+	if err != nil {
+		return
+	}
+	subscriptions, err := p.subscriptions(username)
+	if err != nil || len(subscriptions) == 0 || !pushWanted(username, prefs) {
+		return
+	}
+	n := batch[0]
+	if len(batch) > 1 {
+		n = summarize(batch)
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("Push encode error", "username", username, "err", err)
+		return
+	}
+	for _, s := range subscriptions {
+		if !p.supports(s.Kind) {
+			continue
+		}
+		select {
+		case p.queue <- pushDelivery{subscription: s, notification: n, payload: payload}:
+		default:
+			slog.Warn("Push queue full, dropping notification", "username", username, "subscription", s.ID)
+		}
+	}
+}
+
+// Sum up several notifications as one, showing the latest few messages
+func summarize(batch []*pushNotification) *pushNotification {
+	last := batch[len(batch)-1]
+	n := &pushNotification{Type: "batch", Title: fmt.Sprintf("%d new messages", len(batch)), Count: len(batch), TS: last.TS}
+	var lines []string
+	for _, note := range batch[max(0, len(batch)-pushBatchLines):] {
+		line := note.Sender + ": " + note.Body
+		if note.Type == typeMention {
+			line = note.Sender + " in " + note.Room + ": " + note.Body
+		}
+		lines = append(lines, line)
+	}
+	n.Body = strings.Join(lines, "\n")
+	if len(batch) > pushBatchLines {
+		n.Body += fmt.Sprintf("\nand %d more", len(batch)-pushBatchLines)
+	}
+	if !slices.ContainsFunc(batch, func(note *pushNotification) bool { return note.Room != last.Room }) {
+		n.Room = last.Room
+	}
+	return n
+}
+
+// Cut a message body to what a notification shows
+func pushExcerpt(body string) string {
+	if len(body) <= maxPushBody {
+		return body
+	}
+	cut := maxPushBody
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return body[:cut] + "…"
+}
+
+// Deliver queued notifications until the process exits
+func (p *pushService) work() {
+	for d := range p.queue {
+		p.deliver(d)
+	}
+}
+
+// Send a notification to its device, retrying with exponential backoff on
+// network errors, 429 and 5xx responses, and dropping the subscription when
+// the push service says the device is gone
+func (p *pushService) deliver(d pushDelivery) {
+	sender := pushSender(p.webPush)
+	if d.subscription.Kind == pushFCM {
+		sender = p.fcm
+	}
+	backoff := pushBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		err := sender.send(ctx, d)
+		cancel()
+		switch {
+		case err == nil:
+			pushNotifications.WithLabelValues("sent").Inc()
+			return
+		case errors.Is(err, errPushExpired):
+			pushNotifications.WithLabelValues("expired").Inc()
+			if err := p.unsubscribe(d.subscription.username, d.subscription.ID); err != nil && !errors.Is(err, errNoPushSubscription) {
+				slog.Error("Storage error", "username", d.subscription.username, "err", err)
+			}
+			return
+		}
+		var retry retryableError
+		if !errors.As(err, &retry) || attempt == pushAttempts {
+			pushNotifications.WithLabelValues("failed").Inc()
+			slog.Warn("Push delivery failed", "username", d.subscription.username, "subscription", d.subscription.ID, "attempts", attempt, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Classify a push service's answer: 404 and 410 mean the device is gone, and
+// 429 and 5xx are worth trying again
+func pushStatusError(status int, detail string) error {
+	err := fmt.Errorf("push service answered %d %s", status, detail)
+	switch {
+	case status < 300:
+		return nil
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return fmt.Errorf("%w: %w", errPushExpired, err)
+	case status == http.StatusTooManyRequests || status >= 500:
+		return retryableError{err}
+	}
+	return err
+}
+
+// Answer 404 for the push API while push notifications are off, reporting
+// whether they're on
+func requirePush(w http.ResponseWriter) bool {
+	if pushes == nil {
+		http.Error(w, "Push notifications are off", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// HTTP handler giving browsers the VAPID public key to subscribe with, as
+// {"vapid_public_key":"..."}
+func servePushKey(w http.ResponseWriter, r *http.Request) {
+	if !requirePush(w) {
+		return
+	}
+	if pushes.webPush == nil {
+		http.Error(w, "Web Push is off", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"vapid_public_key": pushes.webPush.publicKey})
+}
+
+// HTTP handler listing the requesting user's push subscriptions; the user
+// comes from the token with JWT_SECRET, else from ?username=
+func servePushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !requirePush(w) {
+		return
+	}
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	subscriptions, err := pushes.subscriptions(username)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if subscriptions == nil {
+		subscriptions = []*pushSubscription{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// HTTP handler registering a device for the requesting user, from a browser's
+// PushSubscription as {"endpoint":"...","keys":{"p256dh":"...","auth":"..."}}
+// or an app's {"fcm_token":"..."}
+func servePushSubscribe(w http.ResponseWriter, r *http.Request) {
+	if !requirePush(w) {
+		return
+	}
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	var s pushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !pushes.supports(s.Kind) {
+		http.Error(w, "This server doesn't send "+s.Kind+" notifications", http.StatusBadRequest)
+		return
+	}
+	s.username, s.Created = username, time.Now()
+	if err := pushes.subscribe(&s); err != nil {
+		slog.Error("Storage error", "username", username, "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// HTTP handler removing one of the requesting user's push subscriptions
+func servePushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if !requirePush(w) {
+		return
+	}
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	switch err := pushes.unsubscribe(username, r.PathValue("id")); {
+	case errors.Is(err, errNoPushSubscription):
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP handler getting the requesting user's push preferences with GET, or
+// changing them with PUT; fields left out of a PUT keep their value
+func servePushPreferences(w http.ResponseWriter, r *http.Request) {
+	if !requirePush(w) {
+		return
+	}
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := pushes.preferences(username)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if prefs.MutedRooms == nil {
+			prefs.MutedRooms = []string{}
+		}
+		if err := pushes.setPreferences(username, prefs); err != nil {
+			slog.Error("Storage error", "username", username, "err", err)
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// OAuth scope of the FCM HTTP v1 API
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// fcmSender delivers notifications through the FCM HTTP v1 API, authenticated
+// as a Firebase service account
+type fcmSender struct {
+	endpoint string // messages:send URL of the Firebase project
+	client   *http.Client
+}
+
+// serviceAccount is the part of a Google service account key file FCM needs
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// Set up FCM with the service account key file downloaded from the Firebase console
+func newFCMSender(path string) (*fcmSender, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("a service account key needs project_id, client_email and private_key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	config := &jwt.Config{
+		Email:        account.ClientEmail,
+		PrivateKey:   []byte(account.PrivateKey),
+		PrivateKeyID: account.PrivateKeyID,
+		Scopes:       []string{fcmScope},
+		TokenURL:     account.TokenURI,
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: pushTimeout})
+	client := config.Client(ctx)
+	client.Timeout = pushTimeout
+	return &fcmSender{
+		endpoint: "https://fcm.googleapis.com/v1/projects/" + account.ProjectID + "/messages:send",
+		client:   client,
+	}, nil
+}
+
+// fcmMessage is the body of a messages:send request
+type fcmMessage struct {
+	Message struct {
+		Token        string            `json:"token"`
+		Notification map[string]string `json:"notification"`
+		Data         map[string]string `json:"data"`
+		Android      map[string]any    `json:"android"`
+		APNS         map[string]any    `json:"apns"`
+	} `json:"message"`
+}
+
+func (s *fcmSender) send(ctx context.Context, d pushDelivery) error {
+	n := d.notification
+	var m fcmMessage
+	m.Message.Token = d.subscription.Token
+	m.Message.Notification = map[string]string{"title": n.Title, "body": n.Body}
+	// Data values must be strings
+	m.Message.Data = map[string]string{"type": n.Type, "room": n.Room, "sender": n.Sender, "ts": strconv.FormatInt(n.TS, 10)}
+	if n.ID != 0 {
+		m.Message.Data["id"] = strconv.FormatUint(n.ID, 10)
+	}
+	if n.Count != 0 {
+		m.Message.Data["count"] = strconv.Itoa(n.Count)
+	}
+	m.Message.Android = map[string]any{"priority": "high", "ttl": fmt.Sprintf("%ds", int(pushTTL.Seconds()))}
+	m.Message.APNS = map[string]any{"headers": map[string]string{"apns-priority": "10"}}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer resp.Body.Close()
+	// FCM answers 404 UNREGISTERED for tokens of uninstalled apps
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return pushStatusError(resp.StatusCode, string(bytes.TrimSpace(detail)))
+}
@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Record size announced in the header of an encrypted Web Push message, which
+// holds the whole payload in one record
+const webPushRecordSize = 4096
+
+// How long the VAPID token of a request is valid; push services accept at most a day
+const vapidTTL = 12 * time.Hour
+
+// webPushSender delivers Web Push messages (RFC 8030), encrypted for the browser
+// (RFC 8291) and signed with the server's VAPID key (RFC 8292)
+type webPushSender struct {
+	key       *ecdsa.PrivateKey
+	publicKey string // base64url uncompressed P-256 point, given to browsers as applicationServerKey
+	subject   string // mailto: or https: contact for the push services
+	client    *http.Client
+}
+
+// Set up Web Push with a base64url P-256 private key, as web-push
+// generate-vapid-keys prints it, and the contact push services may reach
+func newWebPushSender(privateKey, subject string) (*webPushSender, error) {
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return nil, errors.New("PUSH_VAPID_SUBJECT must be a mailto: or https:// contact")
+	}
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("PUSH_VAPID_PRIVATE_KEY: %w", err)
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("PUSH_VAPID_PRIVATE_KEY: %w", err)
+	}
+	public := ecdhKey.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(public[1:33]), Y: new(big.Int).SetBytes(public[33:])},
+		D:         new(big.Int).SetBytes(d),
+	}
+	// Endpoints come from browsers, so don't let them reach the server's own network
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: refusePrivate}
+	return &webPushSender{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+		subject:   subject,
+		client:    &http.Client{Timeout: pushTimeout, Transport: &http.Transport{DialContext: dialer.DialContext}},
+	}, nil
+}
+
+// Decode a subscription's keys: the browser's P-256 public key and its 16 byte
+// authentication secret
+func parseWebPushKeys(keys *webPushKeys) (*ecdh.PublicKey, []byte, error) {
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	raw, err := decode(keys.P256dh)
+	if err != nil {
+		return nil, nil, errors.New("keys.p256dh must be base64url")
+	}
+	public, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, nil, errors.New("keys.p256dh must be a P-256 public key")
+	}
+	auth, err := decode(keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, nil, errors.New("keys.auth must be 16 bytes of base64url")
+	}
+	return public, auth, nil
+}
+
+// Encrypt a payload for a browser with the aes128gcm content encoding of RFC 8291
+func encryptWebPush(keys *webPushKeys, payload []byte) ([]byte, error) {
+	browserKey, auth, err := parseWebPushKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	local, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := local.ECDH(browserKey)
+	if err != nil {
+		return nil, err
+	}
+	localPublic := local.PublicKey().Bytes()
+	info := append(append([]byte("WebPush: info\x00"), browserKey.Bytes()...), localPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, auth, info), ikm); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, nonce := make([]byte, 16), make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The header is the salt, the record size and the server's public key, and
+	// 0x02 after the payload marks its only record as the last
+	body := make([]byte, 0, 16+4+1+len(localPublic)+len(payload)+1+gcm.Overhead())
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, webPushRecordSize)
+	body = append(body, byte(len(localPublic)))
+	body = append(body, localPublic...)
+	// The payload is shared by every device of the user, so append to a copy
+	return gcm.Seal(body, nonce, append(payload[:len(payload):len(payload)], 0x02), nil), nil
+}
+
+// Sign the VAPID token for the push service behind an endpoint
+func (s *webPushSender) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{u.Scheme + "://" + u.Host},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(vapidTTL)),
+		Subject:   s.subject,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(s.key)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + token + ", k=" + s.publicKey, nil
+}
+
+func (s *webPushSender) send(ctx context.Context, d pushDelivery) error {
+	body, err := encryptWebPush(d.subscription.Keys, d.payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := s.vapid(d.subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return pushStatusError(resp.StatusCode, strings.TrimSpace(string(detail)))
+}
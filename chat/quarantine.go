@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+)
+
+// quarantine limits how often recently joined users may post
+type quarantine struct {
+	window   time.Duration // how long after joining a user stays limited
+	interval time.Duration // minimum time between their messages
+}
+
+// Report whether the sender may post now under the room's quarantine, telling them
+// how long to wait if not; runs on the room goroutine
+func (r *Room) allowQuarantined(client *Client, now time.Time) bool {
+	q := r.quarantine
+	if q.window <= 0 || client == nil || now.Sub(client.joinedAt) >= q.window {
+		return true
+	}
+	if wait := q.interval - now.Sub(client.lastMessage); wait > 0 {
+		r.sendTo(client, errorMessage(fmt.Sprintf("New members can post once every %s, wait %s", q.interval, wait.Round(time.Second))))
+		return false
+	}
+	client.lastMessage = now
+	return true
+}
+
+// Configure quarantine for new members; runs on the room goroutine
+func (r *Room) setQuarantine(c *Client, args []string) {
+	const usage = "Usage: /quarantine <window> <interval> (e.g. /quarantine 10m 30s) or /quarantine off"
+	if c.username != r.owner {
+		r.sendTo(c, errorMessage("Only the room owner can change quarantine"))
+		return
+	}
+	if len(args) == 1 && args[0] == "off" {
+		r.quarantine = quarantine{}
+		r.audit(c.username, auditQuarantine, "", "", "off")
+		r.deliver(systemMessage(c.username + " turned off quarantine for new members"))
+		return
+	}
+	if len(args) != 2 {
+		r.sendTo(c, errorMessage(usage))
+		return
+	}
+	window, err1 := time.ParseDuration(args[0])
+	interval, err2 := time.ParseDuration(args[1])
+	if err1 != nil || err2 != nil || window <= 0 || interval <= 0 {
+		r.sendTo(c, errorMessage(usage))
+		return
+	}
+	r.quarantine = quarantine{window: window, interval: interval}
+	r.audit(c.username, auditQuarantine, "", "", window.String()+" "+interval.String())
+	r.deliver(systemMessage(fmt.Sprintf("%s set quarantine: members who joined in the last %s can post once every %s",
+		c.username, window, interval)))
+}
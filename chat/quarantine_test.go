@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantineLimitsOnlyNewMembers(t *testing.T) {
+	_, srv, _ := newTestServer(t)
+	owner := join(t, srv, "guarded", "owner")
+	owner.say("/quarantine 300ms 1m")
+	owner.expect(typeSystem)
+	time.Sleep(400 * time.Millisecond)
+	newcomer := join(t, srv, "guarded", "newcomer")
+
+	newcomer.say("first")
+	newcomer.expect(typeAck)
+	newcomer.say("second")
+	if m := newcomer.expect(typeError); !strings.HasPrefix(m.Body, "New members can post once every 1m0s") {
+		t.Errorf("newcomer got %q, want the quarantine notice", m.Body)
+	}
+
+	// The owner joined before the window, so isn't limited
+	for _, body := range []string{"one", "two", "three"} {
+		owner.say(body)
+		for m := owner.next(); m.Type != typeAck; m = owner.next() {
+			if m.Type == typeError {
+				t.Fatalf("the older member was limited: %q", m.Body)
+			}
+		}
+	}
+}
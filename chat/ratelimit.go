@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Per-client message rate limits, from MESSAGE_RATE and MESSAGE_BURST
+var (
+	messageRate  = 1.0 // tokens refilled per second
+	messageBurst = 5.0 // maximum tokens a client can save up
+)
+
+// Window used to count sent messages
+const quotaWindow = time.Minute
+
+// tokenBucket limits how fast a single client can send messages
+type tokenBucket struct {
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	windowStart time.Time
+	sent        int
+}
+
+// Create a full token bucket
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{
+		rate:        rate,
+		burst:       burst,
+		tokens:      burst,
+		last:        now,
+		windowStart: now,
+	}
+}
+
+// Refill tokens for the time elapsed since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if now.Sub(b.windowStart) >= quotaWindow {
+		b.windowStart = now
+		b.sent = 0
+	}
+}
+
+// Take a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	b.sent++
+	return true
+}
+
+// quotaStatus is a snapshot of a client's rate limit state
+type quotaStatus struct {
+	remaining int
+	burst     int
+	resetIn   time.Duration
+	sent      int
+}
+
+// Report the current state of the bucket without consuming a token
+func (b *tokenBucket) status() quotaStatus {
+	b.refill(time.Now())
+	missing := b.burst - b.tokens
+	return quotaStatus{
+		remaining: int(b.tokens),
+		burst:     int(b.burst),
+		resetIn:   time.Duration(missing / b.rate * float64(time.Second)).Round(time.Second),
+		sent:      b.sent,
+	}
+}
+
+// Start a new counting window, clearing the messages sent this window. The
+// tokens are left as they are, so clearing doesn't get around the limit.
+func (b *tokenBucket) clear() {
+	b.refill(time.Now())
+	b.windowStart = b.last
+	b.sent = 0
+}
+
+func (s quotaStatus) String() string {
+	return fmt.Sprintf("quota: %d/%d messages available, full in %s, %d sent this window",
+		s.remaining, s.burst, s.resetIn, s.sent)
+}
+
+// Take a token for a message, reporting whether the client is over its limit.
+// The first dropped message of a burst gets a throttle event back.
+func (c *Client) throttled() bool {
+	if c.limiter.allow() {
+		c.throttling = false
+		return false
+	}
+	if !c.throttling {
+		c.throttling = true
+		c.room.do(func() {
+			c.room.sendTo(c, newMessage(typeThrottle, fmt.Sprintf("Rate limit exceeded, slow down: %g messages per second, bursts of %g", c.limiter.rate, c.limiter.burst)))
+		})
+	}
+	return true
+}
+
+// connLimiter caps the concurrent connections from one IP address
+type connLimiter struct {
+	mu     sync.Mutex
+	max    int // unlimited when zero
+	counts map[string]int
+}
+
+// Create a limiter allowing max connections per IP, or any number when max is zero
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, counts: make(map[string]int)}
+}
+
+// Count a new connection from ip, reporting false if it is over the limit
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.counts[ip] >= l.max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Forget a connection from ip once it has closed
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip]--; l.counts[ip] <= 0 {
+		delete(l.counts, ip)
+	}
+}
+
+// Count the open connections from every address
+func (l *connLimiter) total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, count := range l.counts {
+		n += count
+	}
+	return n
+}
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+// Wait for the reply to /quota
+func (c *testConn) expectQuota() string {
+	c.t.Helper()
+	for {
+		if m := c.expect(typeSystem); strings.HasPrefix(m.Body, "quota:") {
+			return m.Body
+		}
+	}
+}
+
+func TestQuotaReflectsConsumedTokens(t *testing.T) {
+	setFor(t, &messageRate, 0.001)
+	setFor(t, &messageBurst, 5.0)
+	_, srv, _ := newTestServer(t)
+	alice := join(t, srv, "quota", "alice")
+
+	alice.say("/quota")
+	if got, want := alice.expectQuota(), "5/5 messages available"; !strings.Contains(got, want) {
+		t.Errorf("before sending: got %q, want %q", got, want)
+	}
+	for range 3 {
+		alice.say("hello")
+		alice.expect(typeAck)
+	}
+	alice.say("/quota")
+	got := alice.expectQuota()
+	for _, want := range []string{"2/5 messages available", "3 sent this window"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("after sending 3: got %q, want %q", got, want)
+		}
+	}
+
+	alice.say("/quota clear")
+	got = alice.expectQuota()
+	for _, want := range []string{"2/5 messages available", "0 sent this window"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("after clearing: got %q, want %q", got, want)
+		}
+	}
+}
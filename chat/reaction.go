@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Longest emoji accepted in a reaction, in bytes; enough for flags and skin tones
+const maxEmojiLen = 32
+
+// Report whether s can be used as a reaction: a short string without spaces or control characters
+func validEmoji(s string) bool {
+	return s != "" && len(s) <= maxEmojiLen && !strings.ContainsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+// Add or remove a client's reaction to one of the room's messages and tell the
+// room the message's new reaction counts; runs on the room goroutine
+func (r *Room) react(c *Client, m *Message) {
+	if r.refuseReadOnly(c) {
+		return
+	}
+	if !validEmoji(m.Emoji) {
+		r.sendTo(c, errorMessage("A reaction needs an emoji"))
+		return
+	}
+	if _, err := r.messageSender(m.ID); err != nil {
+		r.sendTo(c, errorMessage(fmt.Sprintf("Can't react to message %d: %v", m.ID, err)))
+		return
+	}
+	add := m.Type == typeReactionAdd
+	counts, changed := r.applyReaction(m.ID, m.Emoji, c.username, add)
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		stored, err := store.React(ctx, r.name, m.ID, m.Emoji, c.username, add)
+		if err != nil {
+			r.logger().Error("Storage error", "err", err)
+			return
+		}
+		// The store also knows about messages that have left the in-memory history
+		counts, changed = stored, true
+	}
+	if !changed {
+		return
+	}
+	event := newMessage(m.Type, "")
+	event.ID = m.ID
+	event.Sender = c.username
+	event.Emoji = m.Emoji
+	event.Reactions = counts
+	r.deliver(event)
+}
+
+// Record a reaction in the in-memory history, returning the message's reaction
+// counts and whether anything changed
+func (r *Room) applyReaction(id uint64, emoji, username string, add bool) (map[string]int, bool) {
+	i := slices.IndexFunc(r.history, func(e historyEntry) bool { return e.contains(id) })
+	if i < 0 {
+		return nil, false
+	}
+	entry := &r.history[i]
+	users := entry.Reactions[emoji]
+	j := slices.Index(users, username)
+	switch {
+	case add && j < 0:
+		if entry.Reactions == nil {
+			entry.Reactions = make(map[string][]string)
+		}
+		entry.Reactions[emoji] = append(users, username)
+	case !add && j >= 0:
+		if users = slices.Delete(users, j, j+1); len(users) == 0 {
+			delete(entry.Reactions, emoji)
+		} else {
+			entry.Reactions[emoji] = users
+		}
+	default:
+		return entry.reactionCounts(), false
+	}
+	return entry.reactionCounts(), true
+}
+
+// Count the users behind each of the entry's reactions
+func (e *historyEntry) reactionCounts() map[string]int {
+	if len(e.Reactions) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(e.Reactions))
+	for emoji, users := range e.Reactions {
+		counts[emoji] = len(users)
+	}
+	return counts
+}
@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Record that a client's user has read the room up to a message and tell the
+// room; markers only move forward. Runs on the room goroutine.
+func (r *Room) markRead(c *Client, id uint64) {
+	id = min(id, r.seq)
+	if id <= r.reads[c.username] {
+		return
+	}
+	r.reads[c.username] = id
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.MarkRead(ctx, r.name, c.username, id); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	read := newMessage(typeRead, "")
+	read.ID = id
+	read.Sender = c.username
+	r.deliver(read)
+}
+
+// Count a user's unread messages in every room they have read before. Without a
+// store, only open rooms count and IDs stand in for messages, so deleted messages
+// still count as unread.
+func (h *Hub) unread(ctx context.Context, username string) (map[string]int, error) {
+	if store != nil {
+		return store.Unread(ctx, username)
+	}
+	counts := make(map[string]int)
+	for _, room := range h.list() {
+		result := make(chan int, 1)
+		ran := room.do(func() {
+			if last, ok := room.reads[username]; ok {
+				result <- int(room.seq - last)
+			} else {
+				result <- -1
+			}
+		})
+		if ran {
+			if n := <-result; n >= 0 {
+				counts[room.name] = n
+			}
+		}
+	}
+	return counts, nil
+}
+
+// Answer a client's unread query with its user's counts per room
+func (c *Client) sendUnread() {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	counts, err := c.room.hub.unread(ctx, c.username)
+	if err != nil {
+		c.logger().Error("Storage error", "err", err)
+		c.replyError("Couldn't count unread messages")
+		return
+	}
+	reply := newMessage(typeUnread, "")
+	reply.Unread = counts
+	c.deliver(reply)
+}
+
+// Get the user a request acts for: the token's subject when authentication is on,
+// else the username query parameter. Answers 401 and reports false without one.
+func requestUsername(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := r.URL.Query().Get("username")
+	if jwtSecret != nil {
+		verified, err := verifyToken(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return "", false
+		}
+		username = verified
+	}
+	if !validUsername(username) {
+		http.Error(w, usernameError, http.StatusBadRequest)
+		return "", false
+	}
+	return username, true
+}
+
+// HTTP handler returning the user's unread counts per room, as {"room": 3}
+func (h *Hub) serveUnread(w http.ResponseWriter, r *http.Request) {
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	counts, err := h.unread(ctx, username)
+	if err != nil {
+		slog.Error("Storage error", "username", username, "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// report is a user's complaint about a message
+type report struct {
+	Room      string    `json:"room"`
+	MessageID uint64    `json:"message_id"`
+	Sender    string    `json:"sender"`
+	Body      string    `json:"body"`
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"ts"`
+}
+
+// Reports listed by the admin endpoint, the latest ones
+const reportLimit = 1000
+
+// Reports kept when there's no store, the oldest dropped beyond this
+const reportMemoryMax = 1000
+
+// reportStore keeps filed reports for review when there's no store
+type reportStore struct {
+	mu      sync.Mutex
+	reports []report // oldest first
+}
+
+func (s *reportStore) add(r report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append(s.reports, r)
+	if len(s.reports) > reportMemoryMax {
+		s.reports = s.reports[len(s.reports)-reportMemoryMax:]
+	}
+}
+
+func (s *reportStore) list() []report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]report(nil), s.reports[max(len(s.reports)-reportLimit, 0):]...)
+}
+
+// Reports filed by users of every room, when there's no store
+var reports = &reportStore{}
+
+// Keep a report, in the store if there is one
+func saveReport(r report) {
+	if store == nil {
+		reports.add(r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := store.SaveReport(ctx, &r); err != nil {
+		slog.Error("Storage error", "err", err)
+	}
+}
+
+// Get the latest reports, oldest first
+func listReports() ([]report, error) {
+	if store == nil {
+		return reports.list(), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return store.Reports(ctx, reportLimit)
+}
+
+// Find the sender and body of one of the room's messages, looking in the store
+// once the in-memory history no longer holds it; runs on the room goroutine
+func (r *Room) reportedMessage(id uint64) (sender, body string, ok bool) {
+	for i := range r.history {
+		if r.history[i].contains(id) {
+			return r.history[i].Sender, r.history[i].Body, true
+		}
+	}
+	if store == nil {
+		return "", "", false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	m, err := store.Get(ctx, r.name, id)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+	}
+	if m == nil {
+		return "", "", false
+	}
+	return m.Sender, m.Body, true
+}
+
+// File a report about a message in the room's history; runs on the room goroutine
+func (r *Room) fileReport(c *Client, args []string) {
+	if len(args) == 0 {
+		r.sendTo(c, errorMessage("Usage: /report <messageId> [reason]"))
+		return
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		r.sendTo(c, errorMessage("Usage: /report <messageId> [reason]"))
+		return
+	}
+	sender, body, ok := r.reportedMessage(id)
+	if !ok {
+		r.sendTo(c, errorMessage(fmt.Sprintf("Message %d not found", id)))
+		return
+	}
+	reason := strings.Join(args[1:], " ")
+	saveReport(report{
+		Room:      r.name,
+		MessageID: id,
+		Sender:    sender,
+		Body:      body,
+		Reporter:  c.username,
+		Reason:    reason,
+		Time:      time.Now(),
+	})
+	r.sendTo(c, systemMessage(fmt.Sprintf("Reported message %d", id)))
+
+	// Let the room owner know without telling everyone
+	notice := fmt.Sprintf("%s reported message %d from %s: %s", c.username, id, sender, reason)
+	for client := range r.clients {
+		if client.username == r.owner && client != c {
+			r.sendTo(client, systemMessage(notice))
+		}
+	}
+}
+
+// HTTP handler listing the latest filed reports for admins, oldest first
+func serveReports(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	list, err := listReports()
+	if err != nil {
+		slog.Error("Storage error", "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportReachesOwnerAndAdminEndpoint(t *testing.T) {
+	setFor(t, &reports, &reportStore{})
+	setFor(t, &adminToken, "secret")
+	_, srv, mux := newTestServer(t)
+	mux.HandleFunc("GET /admin/reports", serveReports)
+	owner := join(t, srv, "reported", "owner")
+	spammer := join(t, srv, "reported", "spammer")
+	reporter := join(t, srv, "reported", "reporter")
+
+	spammer.say("buy cheap watches")
+	id := spammer.expect(typeAck).ID
+	reporter.say(fmt.Sprintf("/report %d spam", id))
+	if m := reporter.expect(typeSystem); m.Body != fmt.Sprintf("Reported message %d", id) {
+		t.Errorf("reporter got %q", m.Body)
+	}
+	for {
+		if m := owner.expect(typeSystem); strings.Contains(m.Body, "reported message") {
+			if want := fmt.Sprintf("reporter reported message %d from spammer: spam", id); m.Body != want {
+				t.Errorf("owner got %q, want %q", m.Body, want)
+			}
+			break
+		}
+	}
+	for _, m := range spammer.drain(100 * time.Millisecond) {
+		if strings.Contains(m.Body, "reported") {
+			t.Errorf("the report was shown to the reported sender: %q", m.Body)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/reports", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the admin token: %s, want 401", resp.Status)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []report
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("listed %d reports, want 1", len(got))
+	}
+	r := got[0]
+	if r.Room != "reported" || r.MessageID != id || r.Sender != "spammer" || r.Body != "buy cheap watches" || r.Reporter != "reporter" || r.Reason != "spam" {
+		t.Errorf("listed %+v", r)
+	}
+}
+
+func TestReportStoredMessageKeepsReportInStore(t *testing.T) {
+	s := useTestStore(t)
+	setFor(t, &reports, &reportStore{})
+	_, srv, _ := newTestServer(t)
+	// A message from before the room was last open, only the store has
+	old := &Message{Type: typeChat, Room: "stored", ID: 999, Sender: "spammer", Body: "old spam", TS: time.Now().UnixMilli()}
+	if err := s.Save(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+	reporter := join(t, srv, "stored", "reporter")
+	reporter.say("/report 999 spam")
+	if m := reporter.expect(typeSystem); m.Body != "Reported message 999" {
+		t.Fatalf("reporter got %q", m.Body)
+	}
+
+	got, err := s.Reports(context.Background(), reportLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Sender != "spammer" || got[0].Body != "old spam" || got[0].Reporter != "reporter" {
+		t.Errorf("stored %+v, want the report on the stored message", got)
+	}
+	if len(reports.list()) != 0 {
+		t.Error("the report was kept in memory as well as in the store")
+	}
+}
+
+func TestReportMemoryIsCapped(t *testing.T) {
+	s := &reportStore{}
+	for i := range reportMemoryMax + 10 {
+		s.add(report{MessageID: uint64(i)})
+	}
+	got := s.list()
+	if len(got) != reportMemoryMax || got[0].MessageID != 10 {
+		t.Errorf("kept %d reports from message %d, want the latest %d", len(got), got[0].MessageID, reportMemoryMax)
+	}
+}
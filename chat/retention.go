@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Server-wide retention for rooms without their own, from RETENTION_DAYS and
+// RETENTION_MESSAGES; messages are kept forever when both are 0
+var (
+	retainDays        int
+	retainMessages    int
+	retentionInterval = time.Hour // how often the janitor prunes, from RETENTION_INTERVAL
+)
+
+// Time allowed for one round of pruning every room
+const pruneTimeout = time.Minute
+
+// retention is how long a room keeps its messages
+type retention struct {
+	before time.Time // drop messages sent before this, unless zero
+	keep   int       // keep only this many of the latest messages, unless 0
+}
+
+// Work out a room's retention from its metadata and the server defaults
+func retentionOf(meta roomMeta, now time.Time) retention {
+	if meta.Ephemeral {
+		return retention{before: now}
+	}
+	days := cmp.Or(meta.RetainDays, retainDays)
+	p := retention{keep: cmp.Or(meta.RetainMessages, retainMessages)}
+	if days > 0 {
+		p.before = now.AddDate(0, 0, -days)
+	}
+	return p
+}
+
+// Report whether the retention drops anything
+func (p retention) limited() bool {
+	return !p.before.IsZero() || p.keep > 0
+}
+
+// Drop the in-memory history the retention no longer covers, returning how many
+// entries were dropped; runs on the room goroutine
+func (r *Room) pruneHistory(p retention) int {
+	start := 0
+	for start < len(r.history) && !p.before.IsZero() && r.history[start].last.Before(p.before) {
+		start++
+	}
+	if p.keep > 0 {
+		start = max(start, len(r.history)-p.keep)
+	}
+	r.history = r.history[start:]
+	return start
+}
+
+// Tell the room's members that older messages are gone; runs on the room goroutine
+func (r *Room) announceTruncation(removed int64) {
+	r.deliver(newMessage(typeTruncated, fmt.Sprintf("%d older messages were removed from the history", removed)))
+}
+
+// Periodically prune every room's messages past its retention, until the hub stops
+func (h *Hub) janitor() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		closed := h.closed
+		h.mu.Unlock()
+		if closed {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pruneTimeout)
+		h.prune(ctx, time.Now())
+		cancel()
+	}
+}
+
+// Prune the open rooms' history and the stored messages of every room
+func (h *Hub) prune(ctx context.Context, now time.Time) {
+	open := make(map[string]bool)
+	for _, room := range h.list() {
+		open[room.name] = true
+		room.do(func() {
+			p := retentionOf(room.meta, now)
+			if !p.limited() {
+				return
+			}
+			// Ephemeral rooms keep their live history, they only never store it
+			var removed int64
+			if !room.meta.Ephemeral {
+				removed = int64(room.pruneHistory(p))
+			}
+			if store != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+				defer cancel()
+				if stored, err := store.Prune(ctx, room.name, p.before, p.keep); err != nil {
+					room.logger().Error("Storage error", "err", err)
+				} else {
+					removed = max(removed, stored)
+				}
+			}
+			if removed > 0 {
+				room.announceTruncation(removed)
+			}
+		})
+	}
+	if store == nil {
+		return
+	}
+	// Closed rooms still have their messages stored
+	rooms, err := store.Rooms(ctx)
+	if err != nil {
+		slog.Error("Storage error", "err", err)
+		return
+	}
+	for _, name := range rooms {
+		if open[name] {
+			continue
+		}
+		meta, err := store.LoadRoom(ctx, name)
+		if err != nil {
+			slog.Error("Storage error", "room", name, "err", err)
+			continue
+		}
+		if p := retentionOf(meta, now); p.limited() {
+			if _, err := store.Prune(ctx, name, p.before, p.keep); err != nil {
+				slog.Error("Storage error", "room", name, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Limits on inbound frame sizes. The read limit counts bytes on the wire,
+// so compressed frames are also capped on their decompressed size. Frames over
+// the limits close the connection, so the read limit is raised to leave room for
+// any message within maxMessageSize, which is refused with an error instead.
+var readLimit = 64 * 1024
+
+const maxDecompressionRatio = 8
+
+func maxDecompressedSize() int {
+	return min(readLimit*maxDecompressionRatio, max(256*1024, readLimit))
+}
+
+// Number of recent messages each room keeps in memory
+const historySize = 100
+
+// Merge consecutive history messages from one sender sent within this window of
+// each other, from HISTORY_COALESCE; disabled when zero
+var historyCoalesce time.Duration
+
+// Number of latest messages replayed to a joining client, from HISTORY_REPLAY
+var historyReplay int
+
+// Room represents a chat room
+type Room struct {
+	name        string
+	clients     map[*Client]bool
+	targets     []*Client // the clients as a slice for fanout, rebuilt after joins and leaves
+	waiting     []*Client // clients in line for the full room, first come first served
+	broadcast   chan *Message
+	unregister  chan *Client
+	control     chan func()
+	done        chan struct{}  // closed once run has returned
+	remote      chan *Message  // events relayed from other instances
+	unsubscribe func()         // stops relaying events from the backplane
+	connections map[string]int // open connections per chatting username
+	seq         uint64         // ID of the last broadcast message
+	owner       string         // username of the client that created the room
+	stats       *rateCounter
+	access      *roomAccess // who may join; safe to use from any goroutine
+	moderators  map[string]bool
+	muted       map[string]bool   // users whose messages are silently dropped
+	reads       map[string]uint64 // ID of the latest message each user has read
+	history     []historyEntry    // most recent messages, oldest first
+	quarantine  quarantine
+	lastPosted  map[string]time.Time  // when each user last posted, while slow mode is on
+	filters     map[string]roomFilter // message filters turned on, by name
+	meta        roomMeta
+	calls       map[string]*call // the call each user is in, by username
+	pinned      []uint64         // IDs of pinned messages, in the order they were pinned
+	polls       map[uint64]*poll // open polls by ID
+	expiring    []expiring       // disappearing messages, soonest first
+	expiryTimer *time.Timer      // removes the soonest of them when it expires
+	stopped     bool             // set by stop to end run
+	hub         *Hub
+	idleTimer   *time.Timer // asks the hub to close the room while it is empty
+
+	// Optional room-local numbering shown in front of messages
+	numbering  bool
+	displayNum int
+}
+
+// Create a new chat room
+func newRoom(name string) *Room {
+	return &Room{
+		name:        name,
+		clients:     make(map[*Client]bool),
+		connections: make(map[string]int),
+		broadcast:   make(chan *Message),
+		unregister:  make(chan *Client),
+		control:     make(chan func()),
+		done:        make(chan struct{}),
+		stats:       &rateCounter{},
+		access:      &roomAccess{mode: accessPublic},
+		moderators:  make(map[string]bool),
+		muted:       make(map[string]bool),
+		reads:       make(map[string]uint64),
+		filters:     make(map[string]roomFilter),
+		calls:       make(map[string]*call),
+		polls:       make(map[uint64]*poll),
+	}
+}
+
+// Run the room to handle broadcasting and clients joining/leaving, until stopped
+func (r *Room) run() {
+	defer close(r.done)
+	r.armIdleTimer()
+	for !r.stopped {
+		select {
+		case client := <-r.unregister:
+			r.leave(client)
+		case fn := <-r.control:
+			fn()
+		case message := <-r.broadcast:
+			r.publish(message)
+		}
+	}
+}
+
+// Give a chat message its ID, store it and send it to the room, reporting false
+// if the sender may not post right now; runs on the room goroutine
+func (r *Room) publish(message *Message) bool {
+	ctx, span := tracer.Start(messageContext(message), "chat.publish",
+		trace.WithAttributes(attribute.String("chat.room", r.name), attribute.String("chat.username", message.Sender)),
+	)
+	defer span.End()
+	now := time.Now()
+	if r.muted[message.Sender] || !r.allowQuarantined(message.from, now) || !r.filter(message) || !r.allowSlowMode(message.from, now) {
+		span.AddEvent("dropped")
+		return false
+	}
+	if r.refuseReadOnly(message.from) || r.refuseEncryption(message) {
+		span.AddEvent("dropped")
+		return false
+	}
+	if message.ParentID != 0 {
+		thread, err := r.threadOf(message.ParentID)
+		if err != nil {
+			if message.from != nil {
+				r.sendTo(message.from, errorMessage(fmt.Sprintf("Can't reply to message %d: %v", message.ParentID, err)))
+			}
+			span.AddEvent("dropped")
+			return false
+		}
+		message.ParentID = thread
+	}
+	message.Room = r.name
+	message.TS = now.UnixMilli()
+	if !r.runHooks(ctx, message) {
+		span.AddEvent("dropped")
+		return false
+	}
+	message.ID = r.nextID()
+	span.SetAttributes(attribute.Int64("chat.message_id", int64(message.ID)))
+	setTrace(message, span)
+	expires := r.expiryOf(message, now)
+	if !expires.IsZero() {
+		message.ExpiresAt = expires.UnixMilli()
+	}
+	if message.from != nil && message.from.shadowBanned.Load() {
+		r.echoShadowBanned(message)
+		r.ack(message)
+		return true
+	}
+	r.persist(message)
+	r.stats.add(now)
+	messagesBroadcast.Inc()
+	r.remember(historyEntry{ID: r.seq, Sender: message.Sender, Body: message.Body, Data: message.Data, Time: now, ParentID: message.ParentID,
+		expires: expires, encrypted: message.Type == typeEncrypted, keyID: message.KeyID})
+	if !expires.IsZero() {
+		r.scheduleExpiry(r.seq, expires)
+	}
+	if r.numbering {
+		r.displayNum++
+		message.Number = r.displayNum
+	}
+	if message.Type == typeEncrypted {
+		// Nothing else can read the ciphertext
+		r.deliver(message)
+		r.runAfterHooks(ctx, message)
+		r.ack(message)
+		return true
+	}
+	analytics.record(messageID(r.name, r.seq), r.name, message.Sender, message.payload())
+	r.deliver(message)
+	webhooks.dispatch(r.name, hookMessage, message)
+	bridges.relay(r.name, message)
+	previews.dispatch(r, message)
+	r.notifyMentions(message)
+	r.runAfterHooks(ctx, message)
+	r.ack(message)
+	return true
+}
+
+// Tell the sender of a published message its ID
+func (r *Room) ack(message *Message) {
+	if message.from != nil {
+		ack := newMessage(typeAck, "")
+		ack.ID, ack.Ref = message.ID, message.ref
+		r.sendTo(message.from, ack)
+	}
+}
+
+// Run fn on the room goroutine, reporting false if the room has stopped
+func (r *Room) do(fn func()) bool {
+	select {
+	case r.control <- fn:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// Stop the room, closing every client's connection with the given close code,
+// and wait for its goroutine to finish, so nothing it does outlives the stop
+func (r *Room) stop(code int, reason string) {
+	r.do(func() {
+		for client := range r.clients {
+			client.closeCode, client.closeReason = code, reason
+			delete(r.clients, client)
+			r.targets = nil
+			clientsConnected.Dec()
+			close(client.send)
+			if !client.presenceOnly {
+				r.updatePresence(presence.Unregister, client)
+			}
+		}
+		for _, client := range r.waiting {
+			client.closeCode, client.closeReason = code, reason
+			close(client.send)
+		}
+		r.waiting = nil
+		r.stopped = true
+		r.stopPolls()
+		r.stopExpiry()
+	})
+	<-r.done
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
+}
+
+// Deliver an event relayed from another instance; runs on the room goroutine
+func (r *Room) receiveRemote(m *Message) {
+	switch m.Type {
+	case typeChat, typeEncrypted:
+		r.seq = max(r.seq, m.ID)
+		r.stats.add(time.Now())
+		entry := historyEntry{ID: m.ID, Sender: m.Sender, Body: m.Body, Data: m.Data, Time: time.UnixMilli(m.TS), ParentID: m.ParentID,
+			encrypted: m.Type == typeEncrypted, keyID: m.KeyID}
+		if m.ExpiresAt != 0 {
+			entry.expires = time.UnixMilli(m.ExpiresAt)
+		}
+		r.remember(entry)
+	case typeEdit, typeDelete:
+		r.applyChange(m.Type, m.ID, m.Body)
+	case typeMessageExpired:
+		r.applyChange(typeDelete, m.ID, "")
+	case typeReactionAdd, typeReactionRemove:
+		r.applyReaction(m.ID, m.Emoji, m.Sender, m.Type == typeReactionAdd)
+	case typeRead:
+		r.reads[m.Sender] = max(r.reads[m.Sender], m.ID)
+	case typePinned, typeUnpinned:
+		r.pinned = m.Pinned
+	}
+	r.deliverLocal(m)
+}
+
+// Add a client to the room, announcing the user if this is their first connection,
+// and send it the roster and recent history. Reports false if the client's username
+// is taken and it was refused, leaving the reason in closeCode and closeReason.
+func (r *Room) join(client *Client) bool {
+	if !client.presenceOnly && r.connections[client.username] > 0 && !r.claimUsername(client) {
+		return false
+	}
+	if r.full(client) {
+		if r.meta.Queue {
+			r.enqueue(client)
+			return true
+		}
+		r.refuseFull(client)
+		return false
+	}
+	r.enter(client)
+	return true
+}
+
+// Let a client that may join into the room; runs on the room goroutine
+func (r *Room) enter(client *Client) {
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	// Fanout only looks up the blocks of users already loaded
+	if _, err := blocks.of(client.username); err != nil {
+		client.logger().Error("Storage error", "err", err)
+	}
+	r.clients[client] = true
+	r.targets = nil
+	clientsConnected.Inc()
+	client.logger().Debug("Joined", "presence_only", client.presenceOnly)
+	if !client.presenceOnly {
+		r.updatePresence(presence.Register, client)
+		if r.connections[client.username]++; r.connections[client.username] == 1 {
+			joined := r.presenceEvent(typeJoin, client.username)
+			r.deliver(joined)
+			webhooks.dispatch(r.name, hookJoin, joined)
+		}
+	}
+	roster := newMessage(typeMembers, "")
+	roster.Members = r.members()
+	roster.Statuses = statuses.of(roster.Members)
+	if r.meta != (roomMeta{}) {
+		roster.Meta = r.meta.update()
+	}
+	roster.Pinned = r.pins()
+	r.sendTo(client, roster)
+	// Presence-only clients get the roster but none of the room's messages
+	if !client.presenceOnly {
+		r.replay(client)
+		r.sendPolls(client)
+		session := newMessage(typeSession, client.sessionID)
+		session.To = client.username
+		r.sendTo(client, session)
+		r.deliverOffline(client)
+	}
+}
+
+// Remove a client from the room, announcing the user once their last connection is gone
+func (r *Room) leave(client *Client) {
+	if client.waiting.Load() {
+		r.dequeue(client)
+		return
+	}
+	if _, ok := r.clients[client]; !ok {
+		return
+	}
+	delete(r.clients, client)
+	r.targets = nil
+	clientsConnected.Dec()
+	close(client.send)
+	client.logger().Debug("Left", "reason", client.closeReason)
+	if len(r.clients) == 0 {
+		r.armIdleTimer()
+	}
+	if client.presenceOnly {
+		return
+	}
+	r.updatePresence(presence.Unregister, client)
+	if r.connections[client.username]--; r.connections[client.username] <= 0 {
+		delete(r.connections, client.username)
+		r.hangUp(client.username)
+		left := r.presenceEvent(typeLeave, client.username)
+		r.deliver(left)
+		webhooks.dispatch(r.name, hookLeave, left)
+		r.admitWaiting()
+	}
+}
+
+// Start counting down to closing the empty room
+func (r *Room) armIdleTimer() {
+	if r.hub == nil || r.hub.idleTimeout <= 0 || len(r.clients) > 0 {
+		return
+	}
+	// Private rooms stay until deleted, as their invites go when they close, and
+	// without storage their access rules too
+	if r.access.mode != accessPublic {
+		return
+	}
+	r.idleTimer = time.AfterFunc(r.hub.idleTimeout, func() { r.hub.closeIfIdle(r) })
+}
+
+// Build a join or leave event carrying the updated roster
+func (r *Room) presenceEvent(typ, username string) *Message {
+	m := newMessage(typ, "")
+	m.Sender = username
+	m.Members = r.members()
+	m.Statuses = statuses.of(m.Members)
+	return m
+}
+
+// Keep a message in the room's history, dropping the oldest beyond historySize.
+// Consecutive messages from one sender within historyCoalesce share an entry.
+func (r *Room) remember(entry historyEntry) {
+	if n := len(r.history); historyCoalesce > 0 && n > 0 {
+		prev := &r.history[n-1]
+		// Disappearing messages stay apart, as each expires on its own, and
+		// ciphertexts and binary payloads can't be joined
+		if prev.Sender == entry.Sender && prev.ParentID == entry.ParentID && entry.Time.Sub(prev.last) <= historyCoalesce &&
+			prev.expires.IsZero() && entry.expires.IsZero() && prev.Data == nil && entry.Data == nil {
+			prev.Body += "\n" + entry.Body
+			prev.LastID = entry.ID
+			prev.last = entry.Time
+			return
+		}
+	}
+	entry.last = entry.Time
+	r.history = append(r.history, entry)
+	if len(r.history) > historySize {
+		r.history = r.history[len(r.history)-historySize:]
+	}
+}
+
+// Report whether the room's messages go to the store, which isn't the case
+// without persistence or in ephemeral and end-to-end encrypted rooms; runs on
+// the room goroutine
+func (r *Room) stored() bool {
+	return store != nil && !r.meta.Ephemeral && !r.meta.E2E
+}
+
+// Save a message to the store, if the room stores its messages
+func (r *Room) persist(m *Message) {
+	if !r.stored() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := store.Save(ctx, m); err != nil {
+		r.logger().Error("Storage error", "err", err)
+	}
+}
+
+// Send a joining client the room's latest messages, or everything after its
+// last_seen_id when reconnecting, from the store if persistence is on and from
+// the in-memory history otherwise
+func (r *Room) replay(client *Client) {
+	if client.lastSeen > 0 {
+		r.redeliver(client)
+		return
+	}
+	if historyReplay <= 0 {
+		return
+	}
+	var messages []*Message
+	if r.stored() {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		var err error
+		if messages, err = store.Recent(ctx, r.name, historyReplay); err != nil {
+			r.logger().Error("Storage error", "err", err)
+			return
+		}
+	} else {
+		for _, entry := range r.history[max(0, len(r.history)-historyReplay):] {
+			messages = append(messages, entry.message())
+		}
+	}
+	r.sendReplay(client, messages)
+}
+
+// Send a reconnecting client the messages after its last_seen_id, up to historySize
+func (r *Room) redeliver(client *Client) {
+	var messages []*Message
+	var complete bool
+	if r.stored() {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		var err error
+		if messages, err = store.Since(ctx, r.name, client.lastSeen, historySize); err != nil {
+			r.logger().Error("Storage error", "err", err)
+			return
+		}
+		complete = len(messages) < historySize
+	} else {
+		for _, entry := range r.history {
+			if max(entry.ID, entry.LastID) > client.lastSeen {
+				messages = append(messages, entry.message())
+			}
+		}
+		complete = len(r.history) < historySize || r.history[0].ID <= client.lastSeen+1
+	}
+	if !complete {
+		r.sendTo(client, systemMessage("Some messages sent while you were away are no longer available"))
+	}
+	r.sendReplay(client, messages)
+}
+
+// Send messages from history, marked as replayed
+func (r *Room) sendReplay(client *Client, messages []*Message) {
+	for _, m := range messages {
+		m.Replay = true
+		r.sendTo(client, m)
+	}
+}
+
+// Continue a persisted room's message IDs after its latest stored message
+func (r *Room) restoreSeq() {
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	seq, err := store.LastID(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	r.seq = seq
+}
+
+// Build the ID of a room's message from its sequence number
+func messageID(room string, seq uint64) string {
+	return fmt.Sprintf("%s-%d", room, seq)
+}
+
+// Allocate the next message ID, shared with other instances through the backplane
+func (r *Room) nextID() uint64 {
+	if backplane != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		id, err := backplane.NextID(ctx, r.name)
+		if err == nil {
+			r.seq = id
+			return id
+		}
+		r.logger().Error("Backplane error", "err", err)
+	}
+	r.seq++
+	return r.seq
+}
+
+// Deliver a message to every client of the room, on this and other instances
+func (r *Room) deliver(m *Message) {
+	r.deliverLocal(m)
+	if backplane == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := backplane.Publish(ctx, r.name, m); err != nil {
+		r.logger().Error("Backplane error", "err", err)
+	}
+}
+
+// Deliver a message to this instance's clients, skipping all but presence events for presence-only clients
+func (r *Room) deliverLocal(m *Message) {
+	m.Room = r.name
+	_, span := tracer.Start(messageContext(m), "chat.fanout",
+		trace.WithAttributes(attribute.String("chat.room", r.name), attribute.String("chat.type", m.Type), attribute.Int("chat.recipients", len(r.clients))),
+	)
+	defer span.End()
+	full := &frames{m: m, recipients: len(r.clients)}
+	if span.IsRecording() {
+		full.span, full.queued = span.SpanContext(), time.Now()
+	}
+	presence := m.isPresence()
+	typing := m.Type == typeTyping || m.Type == typeStopped
+	var hidden map[string]bool // users who blocked the sender, looked up once for everyone
+	if blockable(m) {
+		hidden = blocks.blockersOf(m.Sender)
+	}
+	r.fanout(presence, func(client *Client) (frame, bool) {
+		if typing && client.username == m.Sender {
+			return frame{}, false // nobody needs to see themselves typing
+		}
+		if hidden[client.username] {
+			return frame{}, false
+		}
+		return encodeProtocol(client, full)
+	})
+}
+
+// Clients each goroutine of a parallel fanout delivers to at least; smaller
+// rooms, and every room with a single CPU, are delivered to by the room goroutine alone
+const fanoutChunk = 256
+
+// Deliver a frame encoded per client, dropping clients whose buffer is full. Big
+// rooms split the clients across goroutines, each queueing on its share of the
+// connections, so encode must be safe to call concurrently.
+func (r *Room) fanout(presence bool, encode func(*Client) (frame, bool)) {
+	if r.targets == nil {
+		r.targets = slices.Collect(maps.Keys(r.clients))
+	}
+	deliver := func(clients []*Client) (slow []*Client) {
+		for _, client := range clients {
+			if client.presenceOnly && !presence {
+				continue
+			}
+			f, ok := encode(client)
+			if !ok {
+				continue
+			}
+			if !r.offer(client, f) {
+				slow = append(slow, client)
+			}
+		}
+		return slow
+	}
+	var slow []*Client
+	if workers := min(runtime.GOMAXPROCS(0), len(r.targets)/fanoutChunk); workers <= 1 {
+		slow = deliver(r.targets)
+	} else {
+		shares := make([][]*Client, workers)
+		var wg sync.WaitGroup
+		for i, chunk := range slices.Collect(slices.Chunk(r.targets, (len(r.targets)+workers-1)/workers)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				shares[i] = deliver(chunk)
+			}()
+		}
+		wg.Wait()
+		slow = slices.Concat(shares...)
+	}
+	for _, client := range slow {
+		r.leave(client)
+	}
+}
+
+// Send a message to a single client if it is still in the room
+func (r *Room) sendTo(client *Client, m *Message) {
+	if _, ok := r.clients[client]; !ok && !client.waiting.Load() {
+		return
+	}
+	if m.Room == "" {
+		m.Room = r.name
+	}
+	f, ok := encodeFor(client, framesOf(m))
+	if ok && !r.offer(client, f) {
+		r.leave(client)
+	}
+}
+
+// Record a client joining or leaving in the presence store
+func (r *Room) updatePresence(update func(ctx context.Context, room, username string) error, client *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+	defer cancel()
+	if err := update(ctx, r.name, client.username); err != nil {
+		r.logger().Error("Presence error", "err", err)
+	}
+}
+
+// List the usernames of the room's chatting members, falling back to local clients
+// if the presence store can't be reached
+func (r *Room) members() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+	defer cancel()
+	names, err := presence.List(ctx, r.name)
+	if err == nil {
+		return names
+	}
+	r.logger().Error("Presence error", "err", err)
+	for client := range r.clients {
+		if !client.presenceOnly {
+			names = append(names, client.username)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Send a chat message and wait for it to come back, returning its display number
+func numberOf(c *testConn, body string) int {
+	c.t.Helper()
+	c.say(body)
+	for {
+		if m := c.expect(typeChat); m.Body == body {
+			return m.Number
+		}
+	}
+}
+
+func TestMessageNumbering(t *testing.T) {
+	setFor(t, &messageBurst, 100.0)
+	_, srv, _ := newTestServer(t)
+	owner := join(t, srv, "numbered", "owner")
+	guest := join(t, srv, "numbered", "guest")
+
+	if n := numberOf(owner, "before"); n != 0 {
+		t.Errorf("number without numbering = %d, want none", n)
+	}
+	owner.say("/numbering on")
+	for i, body := range []string{"one", "two", "three"} {
+		if n := numberOf(owner, body); n != i+1 {
+			t.Errorf("message %q numbered %d, want %d", body, n, i+1)
+		}
+	}
+
+	guest.say("/numbering reset")
+	guest.expect(typeError)
+	if n := numberOf(owner, "four"); n != 4 {
+		t.Errorf("after a guest's reset: numbered %d, want 4", n)
+	}
+
+	owner.say("/numbering reset")
+	if n := numberOf(owner, "again"); n != 1 {
+		t.Errorf("after the owner's reset: numbered %d, want 1", n)
+	}
+}
+
+func TestRecreatedRoomKeepsItsOwner(t *testing.T) {
+	useTestStore(t)
+	hub, srv, _ := newTestServer(t)
+	owner := join(t, srv, "kept", "owner")
+	hub.remove("kept", websocket.CloseGoingAway, "restarting")
+	owner.expectClosed()
+
+	// The first one back into the room doesn't become its owner
+	guest := join(t, srv, "kept", "guest")
+	guest.say("/numbering on")
+	guest.expect(typeError)
+
+	owner = join(t, srv, "kept", "owner")
+	owner.say("/numbering on")
+	if n := numberOf(owner, "one"); n != 1 {
+		t.Errorf("numbered %d after the owner turned numbering on, want 1", n)
+	}
+}
+
+func TestHistoryCoalescesWithinWindow(t *testing.T) {
+	setFor(t, &historyCoalesce, 5*time.Second)
+	r := &Room{}
+	start := time.Now()
+	r.remember(historyEntry{ID: 1, Sender: "alice", Body: "one", Time: start})
+	r.remember(historyEntry{ID: 2, Sender: "alice", Body: "two", Time: start.Add(time.Second)})
+	r.remember(historyEntry{ID: 3, Sender: "alice", Body: "three", Time: start.Add(5 * time.Second)})
+	r.remember(historyEntry{ID: 4, Sender: "alice", Body: "later", Time: start.Add(20 * time.Second)})
+	r.remember(historyEntry{ID: 5, Sender: "bob", Body: "reply", Time: start.Add(21 * time.Second)})
+
+	want := []historyEntry{
+		{ID: 1, LastID: 3, Sender: "alice", Body: "one\ntwo\nthree"},
+		{ID: 4, Sender: "alice", Body: "later"},
+		{ID: 5, Sender: "bob", Body: "reply"},
+	}
+	if len(r.history) != len(want) {
+		t.Fatalf("history has %d entries, want %d: %+v", len(r.history), len(want), r.history)
+	}
+	for i, w := range want {
+		got := r.history[i]
+		if got.ID != w.ID || got.LastID != w.LastID || got.Sender != w.Sender || got.Body != w.Body {
+			t.Errorf("entry %d = %d-%d %s %q, want %d-%d %s %q", i, got.ID, got.LastID, got.Sender, got.Body, w.ID, w.LastID, w.Sender, w.Body)
+		}
+	}
+}
+
+func TestHistoryKeepsEntriesApartWithoutCoalescing(t *testing.T) {
+	setFor(t, &historyCoalesce, 0)
+	r := &Room{}
+	start := time.Now()
+	r.remember(historyEntry{ID: 1, Sender: "alice", Body: "one", Time: start})
+	r.remember(historyEntry{ID: 2, Sender: "alice", Body: "two", Time: start})
+	if len(r.history) != 2 {
+		t.Errorf("history has %d entries, want 2", len(r.history))
+	}
+}
+
+func TestCoalescedMessagesBroadcastSeparately(t *testing.T) {
+	setFor(t, &historyCoalesce, time.Minute)
+	_, srv, _ := newTestServer(t)
+	alice := join(t, srv, "coalesced", "alice")
+	bob := join(t, srv, "coalesced", "bob")
+	alice.say("one")
+	alice.say("two")
+	for _, want := range []string{"one", "two"} {
+		if m := bob.expect(typeChat); m.Body != want {
+			t.Errorf("bob got %q, want %q on its own", m.Body, want)
+		}
+	}
+}
+
+// Deliver chat messages to rooms of growing size, whose clients' frames are
+// taken off their buffers as fast as they come, so big rooms go through the
+// parallel fanout
+func BenchmarkBroadcast(b *testing.B) {
+	for _, size := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", size), func(b *testing.B) {
+			setFor(b, &slowPolicy, slowDropOldest)
+			r := newRoom("bench")
+			for i := 0; i < size; i++ {
+				client := &Client{send: make(chan frame, sendBufferSize), username: fmt.Sprintf("user%d", i)}
+				r.clients[client] = true
+				go func() {
+					for range client.send {
+					}
+				}()
+			}
+			b.Cleanup(func() {
+				for client := range r.clients {
+					close(client.send)
+				}
+			})
+			m := newMessage(typeChat, "hello, room")
+			m.Sender = "user0"
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.deliverLocal(m)
+			}
+		})
+	}
+}
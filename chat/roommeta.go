@@ -0,0 +1,288 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Longest room topic and description in bytes
+const (
+	maxTopicLength       = 200
+	maxDescriptionLength = 2000
+)
+
+// roomMeta is what a room's owner says about it
+type roomMeta struct {
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	Capacity    int    `json:"capacity,omitempty"`  // most members at once, unlimited when 0
+	Queue       bool   `json:"queue,omitempty"`     // users wait in line for a full room instead of being refused
+	SlowMode    int    `json:"slow_mode,omitempty"` // seconds members wait between messages, off when 0
+	// Retention, the server's when 0; ephemeral rooms never store messages
+	RetainDays     int  `json:"retain_days,omitempty"`
+	RetainMessages int  `json:"retain_messages,omitempty"`
+	Ephemeral      bool `json:"ephemeral,omitempty"`
+	// Seconds until each message disappears, never when 0
+	MessageTTL int `json:"message_ttl,omitempty"`
+	// Members encrypt their messages end to end, and the server stores none of them
+	E2E bool `json:"e2e,omitempty"`
+	// Only moderators and the owner may post in announcement rooms
+	Announcement bool `json:"announcement,omitempty"`
+}
+
+// roomUpdate changes the fields of a room's metadata that it sets, e.g.
+// {"topic":"Release day"}; events carry every field
+type roomUpdate struct {
+	Topic       *string `json:"topic,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Capacity    *int    `json:"capacity,omitempty"`
+	Queue       *bool   `json:"queue,omitempty"`
+	SlowMode    *int    `json:"slow_mode,omitempty"`
+
+	RetainDays     *int  `json:"retain_days,omitempty"`
+	RetainMessages *int  `json:"retain_messages,omitempty"`
+	Ephemeral      *bool `json:"ephemeral,omitempty"`
+	MessageTTL     *int  `json:"message_ttl,omitempty"`
+	E2E            *bool `json:"e2e,omitempty"`
+	Announcement   *bool `json:"announcement,omitempty"`
+}
+
+// Describe the metadata as an update setting every field
+func (m roomMeta) update() *roomUpdate {
+	return &roomUpdate{
+		Topic: &m.Topic, Description: &m.Description, Capacity: &m.Capacity, Queue: &m.Queue, SlowMode: &m.SlowMode,
+		RetainDays: &m.RetainDays, RetainMessages: &m.RetainMessages, Ephemeral: &m.Ephemeral,
+		MessageTTL: &m.MessageTTL, E2E: &m.E2E, Announcement: &m.Announcement,
+	}
+}
+
+var errNotOwner = errors.New("only the room owner can change the room's settings")
+
+// Check an update and clean up its text
+func (u *roomUpdate) validate() error {
+	if *u == (roomUpdate{}) {
+		return errors.New("a room update needs a topic, description, capacity, queueing, slow mode, retention, message TTL, encryption or announcement mode")
+	}
+	if u.Topic != nil {
+		if *u.Topic = cleanText(*u.Topic); len(*u.Topic) > maxTopicLength {
+			return fmt.Errorf("topics are limited to %d bytes", maxTopicLength)
+		}
+	}
+	if u.Description != nil {
+		if *u.Description = cleanText(*u.Description); len(*u.Description) > maxDescriptionLength {
+			return fmt.Errorf("descriptions are limited to %d bytes", maxDescriptionLength)
+		}
+	}
+	for _, n := range []*int{u.Capacity, u.SlowMode, u.RetainDays, u.RetainMessages, u.MessageTTL} {
+		if n != nil && *n < 0 {
+			return errors.New("capacity, slow mode, retention and message TTL can't be negative")
+		}
+	}
+	if u.SlowMode != nil && *u.SlowMode > maxSlowMode {
+		return fmt.Errorf("slow mode is at most %s", time.Duration(maxSlowMode)*time.Second)
+	}
+	if u.MessageTTL != nil && *u.MessageTTL > maxMessageTTL {
+		return fmt.Errorf("message TTL is at most %s", time.Duration(maxMessageTTL)*time.Second)
+	}
+	return nil
+}
+
+// Apply an update from the given user, or from an administrator when by is
+// empty, saving it and telling the room; runs on the room goroutine
+func (r *Room) updateMeta(by string, u *roomUpdate) (roomMeta, error) {
+	if by != "" && by != r.owner {
+		return r.meta, errNotOwner
+	}
+	return r.applyMeta(by, u)
+}
+
+// Apply an update whose sender may make it, as updateMeta does; runs on the
+// room goroutine
+func (r *Room) applyMeta(by string, u *roomUpdate) (roomMeta, error) {
+	if err := u.validate(); err != nil {
+		return r.meta, err
+	}
+	before := r.meta
+	if u.Topic != nil {
+		r.meta.Topic = *u.Topic
+	}
+	if u.Description != nil {
+		r.meta.Description = *u.Description
+	}
+	if u.Capacity != nil {
+		r.meta.Capacity = *u.Capacity
+	}
+	if u.Queue != nil {
+		r.meta.Queue = *u.Queue
+	}
+	if u.SlowMode != nil {
+		r.meta.SlowMode = *u.SlowMode
+	}
+	if u.RetainDays != nil {
+		r.meta.RetainDays = *u.RetainDays
+	}
+	if u.RetainMessages != nil {
+		r.meta.RetainMessages = *u.RetainMessages
+	}
+	if u.Ephemeral != nil {
+		r.meta.Ephemeral = *u.Ephemeral
+	}
+	if u.MessageTTL != nil {
+		r.meta.MessageTTL = *u.MessageTTL
+	}
+	if u.E2E != nil {
+		r.meta.E2E = *u.E2E
+	}
+	if u.Announcement != nil {
+		r.meta.Announcement = *u.Announcement
+	}
+	if r.meta == before {
+		return r.meta, nil
+	}
+	if change, err := json.Marshal(u); err == nil {
+		r.audit(by, auditRoomUpdate, "", "", string(change))
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SaveRoom(ctx, r.name, r.meta); err != nil {
+			r.logger().Error("Storage error", "err", err)
+		}
+	}
+	event := newMessage(typeRoomUpdate, "")
+	event.Sender = by
+	event.Meta = r.meta.update()
+	r.deliver(event)
+	if r.meta.Topic != before.Topic {
+		r.deliver(systemMessage(topicNotice(by, r.meta.Topic)))
+	}
+	if r.meta.Announcement != before.Announcement {
+		r.deliver(systemMessage(announcementNotice(by, r.meta.Announcement)))
+	}
+	if r.meta.SlowMode != before.SlowMode {
+		r.lastPosted = nil
+		r.deliver(systemMessage(slowModeNotice(by, r.meta.SlowMode)))
+	}
+	if r.meta.E2E != before.E2E {
+		r.deliver(systemMessage(e2eNotice(by, r.meta.E2E)))
+	}
+	if r.meta.MessageTTL != before.MessageTTL {
+		r.deliver(systemMessage(messageTTLNotice(by, r.meta.MessageTTL)))
+	}
+	// More space, or no more line to wait in
+	r.admitWaiting()
+	return r.meta, nil
+}
+
+// Describe a topic change for the room
+func topicNotice(by, topic string) string {
+	if by == "" {
+		by = "An administrator"
+	}
+	if topic == "" {
+		return by + " cleared the topic"
+	}
+	return fmt.Sprintf("%s set the topic to: %s", by, topic)
+}
+
+// Describe turning announcement mode on or off for the room
+func announcementNotice(by string, on bool) string {
+	if by == "" {
+		by = "An administrator"
+	}
+	if on {
+		return by + " made the room announcement-only: only moderators can post"
+	}
+	return by + " opened the room to everyone's messages"
+}
+
+// Report whether a user may only read the room, as it is an announcement room
+// and they aren't a moderator; runs on the room goroutine
+func (r *Room) readOnly(username string) bool {
+	return r.meta.Announcement && r.role(username) < roleModerator
+}
+
+// Refuse a client's post to an announcement room with a forbidden error,
+// reporting whether it was refused; runs on the room goroutine
+func (r *Room) refuseReadOnly(c *Client) bool {
+	if c == nil || !r.readOnly(c.username) {
+		return false
+	}
+	r.sendTo(c, codedError(errCodeForbidden, "Only moderators can post in this announcement room"))
+	return true
+}
+
+// Load the room's saved metadata, before its goroutine starts
+func (r *Room) restoreMeta() {
+	if store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	meta, err := store.LoadRoom(ctx, r.name)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return
+	}
+	r.meta = meta
+}
+
+// Report whether the room has no space for another member; runs on the room goroutine
+func (r *Room) full(c *Client) bool {
+	return r.meta.Capacity > 0 && !c.presenceOnly && r.connections[c.username] == 0 && len(r.connections) >= r.meta.Capacity
+}
+
+// HTTP handler changing a room's metadata from a room update body such as
+// {"topic": "..."}; for admins, and with JWT_SECRET for the room's owner
+func (h *Hub) servePatchRoom(w http.ResponseWriter, r *http.Request) {
+	room, exists := h.lookup(r.PathValue("name"))
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	editor := ""
+	if !isAdmin(r) {
+		if jwtSecret == nil {
+			requireAdmin(w, r)
+			return
+		}
+		verified, err := verifyToken(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		editor = verified
+	}
+	var update roomUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	type result struct {
+		meta roomMeta
+		err  error
+	}
+	results := make(chan result, 1)
+	if !room.do(func() {
+		meta, err := room.updateMeta(editor, &update)
+		results <- result{meta, err}
+	}) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	res := <-results
+	switch {
+	case errors.Is(res.err, errNotOwner):
+		http.Error(w, res.err.Error(), http.StatusForbidden)
+		return
+	case res.err != nil:
+		http.Error(w, res.err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res.meta)
+}
@@ -0,0 +1,280 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of scheduled messages, sent later at their send_at
+const (
+	maxScheduleAhead    = 30 * 24 * time.Hour
+	maxScheduledPerUser = 100
+	scheduleInterval    = time.Second // how often the scheduler looks for due messages
+	scheduleBatch       = 100         // due messages sent per look
+)
+
+var errTooManyScheduled = fmt.Errorf("you can have at most %d scheduled messages", maxScheduledPerUser)
+
+// memorySchedule keeps scheduled messages in memory when there's no store
+type memorySchedule struct {
+	mu       sync.Mutex
+	lastID   uint64
+	messages map[uint64]*Message
+}
+
+var scheduledMessages = &memorySchedule{messages: make(map[uint64]*Message)}
+
+// Queue a chat message for its SendAt, returning its ID among the scheduled
+// messages; refused once the sender has too many waiting
+func schedule(m *Message) (uint64, error) {
+	pending, err := pendingScheduled(m.Sender)
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) >= maxScheduledPerUser {
+		return 0, errTooManyScheduled
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		return store.Schedule(ctx, m)
+	}
+	q := scheduledMessages
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastID++
+	queued := *m
+	queued.ID = q.lastID
+	q.messages[queued.ID] = &queued
+	return queued.ID, nil
+}
+
+// List a user's scheduled messages, soonest first
+func pendingScheduled(sender string) ([]*Message, error) {
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		return store.Scheduled(ctx, sender)
+	}
+	q := scheduledMessages
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var pending []*Message
+	for _, m := range q.messages {
+		if m.Sender == sender {
+			copied := *m
+			pending = append(pending, &copied)
+		}
+	}
+	slices.SortFunc(pending, func(a, b *Message) int { return cmp.Or(cmp.Compare(a.SendAt, b.SendAt), cmp.Compare(a.ID, b.ID)) })
+	return pending, nil
+}
+
+// Cancel one of a user's scheduled messages, or any user's when sender is
+// empty, reporting whether it was still waiting
+func unschedule(sender string, id uint64) (bool, error) {
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		return store.Unschedule(ctx, id, sender)
+	}
+	q := scheduledMessages
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, ok := q.messages[id]
+	if !ok || (sender != "" && m.Sender != sender) {
+		return false, nil
+	}
+	delete(q.messages, id)
+	return true, nil
+}
+
+// Get scheduled messages whose time has come, soonest first
+func dueScheduled(now time.Time) ([]*Message, error) {
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		return store.DueScheduled(ctx, now.UnixMilli(), scheduleBatch)
+	}
+	q := scheduledMessages
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []*Message
+	for _, m := range q.messages {
+		if m.SendAt <= now.UnixMilli() {
+			copied := *m
+			due = append(due, &copied)
+		}
+	}
+	slices.SortFunc(due, func(a, b *Message) int { return cmp.Or(cmp.Compare(a.SendAt, b.SendAt), cmp.Compare(a.ID, b.ID)) })
+	return due[:min(len(due), scheduleBatch)], nil
+}
+
+// Send scheduled messages as they come due, until the hub stops. With a store
+// shared by several instances, each message is claimed by deleting it first,
+// so only one of them sends it; in a cluster, only the room's node does.
+func (h *Hub) scheduler() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if h.stopped() {
+			return
+		}
+		due, err := dueScheduled(time.Now())
+		if err != nil {
+			slog.Error("Storage error", "err", err)
+			continue
+		}
+		for _, m := range due {
+			if shards != nil && shards.owner(m.Room) != shards.self {
+				continue
+			}
+			claimed, err := unschedule("", m.ID)
+			if err != nil {
+				slog.Error("Storage error", "err", err)
+				continue
+			}
+			if claimed {
+				h.sendScheduled(m)
+			}
+		}
+	}
+}
+
+// Post a scheduled message to its room, opening the room if needed, unless the
+// sender may no longer post there
+func (h *Hub) sendScheduled(m *Message) {
+	room := h.room(m.Room, "")
+	if room == nil {
+		return
+	}
+	message := &Message{
+		Type: typeChat, Sender: m.Sender, Body: m.Body, Data: m.Data, ParentID: m.ParentID,
+		DisplayName: m.DisplayName, Avatar: m.Avatar,
+	}
+	room.do(func() {
+		if room.access.isBanned(m.Sender) || room.readOnly(m.Sender) {
+			room.logger().Info("Dropped a scheduled message", "username", m.Sender, "scheduled_id", m.ID)
+			return
+		}
+		room.publish(message)
+	})
+}
+
+// Queue a chat message from the client for its send_at and tell the client its
+// scheduled ID, as {"type":"scheduled","id":3,"send_at":1700000000000}
+func (c *Client) scheduleChat(m *Message) {
+	if c.throttled() {
+		return
+	}
+	if time.UnixMilli(m.SendAt).After(time.Now().Add(maxScheduleAhead)) {
+		c.replyError(fmt.Sprintf("Messages can be scheduled at most %s ahead", maxScheduleAhead))
+		return
+	}
+	m.Room, m.Sender = c.room.name, c.username
+	m.DisplayName, m.Avatar = c.displayName, c.avatar
+	id, err := schedule(m)
+	switch {
+	case errors.Is(err, errTooManyScheduled):
+		c.replyError(err.Error())
+		return
+	case err != nil:
+		c.logger().Error("Storage error", "err", err)
+		c.replyError("Couldn't schedule the message")
+		return
+	}
+	reply := newMessage(typeScheduled, m.Body)
+	reply.ID, reply.SendAt, reply.Ref = id, m.SendAt, m.ref
+	c.replyWith(reply)
+}
+
+// Run "/scheduled", listing the sender's scheduled messages
+func runScheduled(cmd *Command) {
+	pending, err := pendingScheduled(cmd.Username())
+	if err != nil {
+		slog.Error("Storage error", "username", cmd.Username(), "err", err)
+		cmd.Error("Couldn't load your scheduled messages")
+		return
+	}
+	if len(pending) == 0 {
+		cmd.Reply("You have no scheduled messages")
+		return
+	}
+	lines := make([]string, len(pending))
+	for i, m := range pending {
+		lines[i] = fmt.Sprintf("%d: %s in %s at %s", m.ID, strconv.Quote(m.Body), m.Room, time.UnixMilli(m.SendAt).UTC().Format(time.RFC3339))
+	}
+	cmd.Reply("Scheduled:\n" + strings.Join(lines, "\n"))
+}
+
+// Run "/unschedule <id>", cancelling one of the sender's scheduled messages
+func runUnschedule(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Error("Usage: /unschedule <id>")
+		return
+	}
+	id, err := strconv.ParseUint(cmd.Args[0], 10, 64)
+	if err != nil {
+		cmd.Error("Usage: /unschedule <id>")
+		return
+	}
+	switch cancelled, err := unschedule(cmd.Username(), id); {
+	case err != nil:
+		slog.Error("Storage error", "username", cmd.Username(), "err", err)
+		cmd.Error("Couldn't cancel the message")
+	case !cancelled:
+		cmd.Error(fmt.Sprintf("You have no scheduled message %d", id))
+	default:
+		cmd.Reply(fmt.Sprintf("Cancelled scheduled message %d", id))
+	}
+}
+
+// HTTP handler listing the requesting user's scheduled messages, soonest first;
+// the user comes from the token with JWT_SECRET, else from ?username=
+func serveScheduled(w http.ResponseWriter, r *http.Request) {
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	pending, err := pendingScheduled(username)
+	if err != nil {
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if pending == nil {
+		pending = []*Message{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pending)
+}
+
+// HTTP handler cancelling one of the requesting user's scheduled messages
+func serveUnschedule(w http.ResponseWriter, r *http.Request) {
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	switch cancelled, err := unschedule(username, id); {
+	case err != nil:
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+	case !cancelled:
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,186 @@
+// Package chat is a WebSocket chat server: rooms, their clients and the HTTP
+// API around them. Configure it, create a Hub and register its routes:
+//
+//	chat.ConfigureFromEnv()
+//	hub := chat.NewHub(10 * time.Minute)
+//	hub.Routes(mux)
+//	server := &http.Server{Handler: chat.CheckOrigins(mux)}
+//
+// and call hub.Shutdown from server.RegisterOnShutdown, as event streams only
+// end once the hub closes them.
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"chat-app/internal/env"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ConfigureFromEnv sets up the chat server from environment variables, opening
+// its storage, presence and backplane connections; call it before NewHub
+func ConfigureFromEnv() {
+	configureLogging()
+	configureTracing()
+	sessions = newSessionStore(env.Duration("SESSION_TTL", 5*time.Minute), env.Int("SESSION_MAX", 10000))
+	analytics = newAnalyticsFromEnv()
+	presence = newPresenceFromEnv()
+	strictQuery = env.Bool("STRICT_QUERY", false)
+	origins = originPolicyFromEnv()
+	trustedProxies = addressListFromEnv("TRUSTED_PROXIES")
+	bannedIPs = addressListFromEnv("BANNED_IPS")
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		jwtSecret = []byte(secret)
+	}
+	connAudit = newConnAuditFromEnv()
+	historyCoalesce = env.Duration("HISTORY_COALESCE", 0)
+	challenge = challengeFromEnv()
+	historyReplay = env.Int("HISTORY_REPLAY", 50)
+	store = newStoreFromEnv()
+	serverBans = loadServerBans()
+	backplane = newBackplaneFromEnv()
+	shards = newClusterFromEnv()
+	archiver = newArchiverFromEnv()
+	attachments = newAttachmentsFromEnv()
+	maxAttachmentSize = int64(env.Int("ATTACHMENT_MAX_SIZE", int(maxAttachmentSize)))
+	idleTimeout = env.Duration("IDLE_TIMEOUT", 0)
+	awayAfter = env.Duration("AWAY_AFTER", awayAfter)
+	idleWarning = idleWarningFromEnv(idleTimeout)
+	messageRate = env.Float("MESSAGE_RATE", messageRate)
+	messageBurst = env.Float("MESSAGE_BURST", messageBurst)
+	connLimits = newConnLimiter(env.Int("MAX_CONNECTIONS_PER_IP", 0))
+	sendBufferSize = max(env.Int("SEND_BUFFER", sendBufferSize), 1)
+	writeTimeout = env.Duration("WRITE_TIMEOUT", writeTimeout)
+	slowPolicy = slowPolicyFromEnv(os.Getenv("SLOW_CLIENT_POLICY"))
+	upgrader.EnableCompression = env.Bool("WS_COMPRESSION", true)
+	maxMessageSize = max(env.Int("MAX_MESSAGE_SIZE", maxMessageSize), 1)
+	// JSON can escape a byte as \u0000, so fit six times the largest message
+	readLimit = max(readLimit, 6*maxMessageSize+1024)
+	usernameConflict = usernameConflictFromEnv(os.Getenv("USERNAME_CONFLICT"))
+	multiDevice = env.Bool("MULTI_DEVICE", false)
+	botTokens = botTokensFromEnv(os.Getenv("BOT_TOKENS"))
+	configureFilters()
+	offlineMax = env.Int("OFFLINE_QUEUE_MAX", offlineMax)
+	offlineTTL = env.Duration("OFFLINE_QUEUE_TTL", offlineTTL)
+	retainDays = env.Int("RETENTION_DAYS", 0)
+	retainMessages = env.Int("RETENTION_MESSAGES", 0)
+	retentionInterval = env.Duration("RETENTION_INTERVAL", retentionInterval)
+	maxPins = env.Int("MAX_PINS", maxPins)
+	previews = newPreviewsFromEnv()
+	bridges = newBridgesFromEnv()
+	pushes = newPushFromEnv()
+	configureAccounts()
+	configureOAuth()
+}
+
+// Routes registers the WebSocket endpoint and the HTTP API on mux. Metrics are
+// global, so only one hub per process can register its routes.
+func (h *Hub) Routes(mux *http.ServeMux) {
+	registerHubMetrics(h)
+	// With CLUSTER_NODES, requests about a room are served by the node owning it
+	mux.HandleFunc("/ws", sharded("?room", h.joinRoom))
+	mux.HandleFunc("GET /events", sharded("?room", h.serveEvents))
+	mux.HandleFunc("POST /events", sharded("?room", h.serveEventPost))
+	mux.HandleFunc("GET /rooms/{name}/stats", sharded("name", h.serveRoomStats))
+	mux.HandleFunc("GET /api/rooms", h.serveRooms)
+	mux.HandleFunc("POST /api/rooms", h.serveCreateRoom)
+	mux.HandleFunc("GET /api/rooms/{name}", sharded("name", h.serveRoom))
+	mux.HandleFunc("PATCH /api/rooms/{name}", sharded("name", h.servePatchRoom))
+	mux.HandleFunc("DELETE /api/rooms/{name}", sharded("name", h.serveDeleteRoom))
+	mux.HandleFunc("POST /api/rooms/{name}/invites", sharded("name", h.serveInvite))
+	mux.HandleFunc("GET /api/rooms/{name}/messages", sharded("name", h.serveMessages))
+	mux.HandleFunc("POST /api/rooms/{name}/messages", sharded("name", h.servePost))
+	mux.HandleFunc("GET /api/rooms/{name}/export", sharded("name", h.serveRoomExport))
+	mux.HandleFunc("GET /api/rooms/{name}/messages/{id}/thread", sharded("name", h.serveThread))
+	mux.HandleFunc("GET /api/unread", h.serveUnread)
+	mux.HandleFunc("GET /api/scheduled", serveScheduled)
+	mux.HandleFunc("DELETE /api/scheduled/{id}", serveUnschedule)
+	mux.HandleFunc("POST /api/rooms/{name}/attachments", sharded("name", h.serveUpload))
+	mux.HandleFunc("GET /admin/reports", serveReports)
+	mux.HandleFunc("GET /admin/audit", serveAuditLog)
+	mux.HandleFunc("GET /admin/bans", serveServerBans)
+	mux.HandleFunc("POST /admin/bans", h.serveAddServerBan)
+	mux.HandleFunc("DELETE /admin/bans/{kind}/{value...}", h.serveDeleteServerBan)
+	mux.HandleFunc("GET /admin/connections", h.serveConnections)
+	mux.HandleFunc("DELETE /admin/connections/{id}", h.serveDisconnect)
+	mux.HandleFunc("POST /admin/announce", h.serveAnnounce)
+	mux.HandleFunc("GET /admin/maintenance", serveMaintenance)
+	mux.HandleFunc("PUT /admin/maintenance", serveMaintenance)
+	mux.HandleFunc("GET /admin/debug", h.serveDebug)
+	mux.HandleFunc("GET /admin/debug/{profile}", serveDebugProfile)
+	mux.HandleFunc("GET /api/webhooks", serveWebhooks)
+	mux.HandleFunc("POST /api/webhooks", serveAddWebhook)
+	mux.HandleFunc("DELETE /api/webhooks/{id}", serveDeleteWebhook)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", h.serveHealth)
+	mux.HandleFunc("GET /readyz", h.serveReady)
+	mux.HandleFunc("POST /login", serveLogin)
+	mux.HandleFunc("POST /register", serveRegister)
+	mux.HandleFunc("POST /logout", serveLogout)
+	mux.HandleFunc("GET /api/me", serveMe)
+	mux.HandleFunc("GET /api/me/export", h.serveUserExport)
+	mux.HandleFunc("GET /api/me/blocks", serveBlocks)
+	mux.HandleFunc("PUT /api/me/blocks/{username}", serveBlock)
+	mux.HandleFunc("DELETE /api/me/blocks/{username}", serveBlock)
+	mux.HandleFunc("PATCH /api/me", serveMe)
+	mux.HandleFunc("GET /api/push/key", servePushKey)
+	mux.HandleFunc("GET /api/me/push/subscriptions", servePushSubscriptions)
+	mux.HandleFunc("POST /api/me/push/subscriptions", servePushSubscribe)
+	mux.HandleFunc("DELETE /api/me/push/subscriptions/{id}", servePushUnsubscribe)
+	mux.HandleFunc("GET /api/me/push/preferences", servePushPreferences)
+	mux.HandleFunc("PUT /api/me/push/preferences", servePushPreferences)
+	mux.HandleFunc("GET /api/users/{username}", serveProfile)
+	mux.HandleFunc("GET /auth/providers", serveProviders)
+	mux.HandleFunc("GET /auth/session", serveSession)
+	mux.HandleFunc("GET /auth/{provider}", serveOAuthStart)
+	mux.HandleFunc("GET /auth/{provider}/callback", serveOAuthCallback)
+	if local, ok := attachments.(*localAttachments); ok {
+		mux.Handle("GET /attachments/", local.handler())
+	}
+}
+
+// CheckOrigins wraps a handler to refuse browser requests from origins that
+// ALLOWED_ORIGINS doesn't allow, answering CORS requests from those it does
+func CheckOrigins(next http.Handler) http.Handler {
+	return origins.handler(next)
+}
+
+// Shutdown disconnects the bridges, archives what the rooms still hold, closes
+// every connection and stops every room, then closes the store; ctx bounds how
+// long it waits
+func (h *Hub) Shutdown(ctx context.Context) {
+	bridges.stop()
+	if archiver != nil {
+		archiveRooms(ctx, h)
+	}
+	drain(ctx, h)
+	if store != nil {
+		store.Close()
+	}
+	if tracerProvider != nil {
+		tracerProvider.Shutdown(ctx)
+	}
+}
+
+// Close every connection and stop every room, waiting until pending messages
+// are written or ctx is done
+func drain(ctx context.Context, hub *Hub) {
+	hub.stopAll(websocket.CloseGoingAway, "server shutting down")
+	flushed := make(chan struct{})
+	go func() {
+		pumps.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		slog.Warn("Shutdown timed out before all connections were closed")
+	}
+}
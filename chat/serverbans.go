@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Kinds of server-wide bans
+const (
+	banIP       = "ip"       // an IP address or CIDR range
+	banUsername = "username" // a username
+)
+
+// serverBan keeps a user or address off the whole server, or with Shadow lets
+// them in but shows their messages to nobody but themselves
+type serverBan struct {
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"` // the username, or the IP or CIDR range
+	Shadow  bool      `json:"shadow,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created_at"`
+
+	prefix netip.Prefix // the parsed range of an IP ban
+}
+
+// Check a ban's kind and value, normalizing the value: IP bans are kept as
+// masked ranges, or as the bare address for a single IP
+func (b *serverBan) validate() error {
+	switch b.Kind {
+	case banUsername:
+		if !validUsername(b.Value) {
+			return errors.New(usernameError)
+		}
+	case banIP:
+		prefix, err := parseAddressRange(strings.TrimSpace(b.Value))
+		if err != nil {
+			return errors.New("value must be an IP or CIDR range")
+		}
+		b.prefix, b.Value = prefix, prefix.String()
+		if prefix.IsSingleIP() {
+			b.Value = prefix.Addr().String()
+		}
+	default:
+		return errors.New("kind must be ip or username")
+	}
+	b.Reason = cleanText(b.Reason)
+	return nil
+}
+
+// Report whether the ban covers a user connecting from an IP
+func (b *serverBan) matches(username, ip string) bool {
+	if b.Kind == banUsername {
+		return b.Value == username
+	}
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && b.prefix.Contains(addr.Unmap())
+}
+
+// banList holds the server-wide bans, kept in the store when there is one
+type banList struct {
+	mu   sync.RWMutex
+	bans map[string]*serverBan // by kind and value
+}
+
+// Server-wide bans, loaded from the store on start
+var serverBans = &banList{bans: make(map[string]*serverBan)}
+
+func banKey(kind, value string) string { return kind + " " + value }
+
+// Load the bans kept in the store, exiting if they can't be read
+func loadServerBans() *banList {
+	l := &banList{bans: make(map[string]*serverBan)}
+	if store == nil {
+		return l
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	bans, err := store.ServerBans(ctx)
+	if err != nil {
+		fatal("Storage error", "err", err)
+	}
+	for _, b := range bans {
+		if err := b.validate(); err != nil {
+			slog.Warn("Skipping invalid ban", "kind", b.Kind, "value", b.Value, "err", err)
+			continue
+		}
+		l.bans[banKey(b.Kind, b.Value)] = b
+	}
+	return l
+}
+
+// Find the ban covering a user connecting from an IP, preferring a full ban to
+// a shadow ban
+func (l *banList) match(username, ip string) (*serverBan, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var found *serverBan
+	for _, b := range l.bans {
+		if b.matches(username, ip) && (found == nil || found.Shadow) {
+			found = b
+		}
+	}
+	return found, found != nil
+}
+
+// List the bans, oldest first
+func (l *banList) list() []*serverBan {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	bans := make([]*serverBan, 0, len(l.bans))
+	for _, b := range l.bans {
+		bans = append(bans, b)
+	}
+	slices.SortFunc(bans, func(a, b *serverBan) int { return a.Created.Compare(b.Created) })
+	return bans
+}
+
+// Add or replace a ban, saving it first
+func (l *banList) add(b *serverBan) error {
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.SaveServerBan(ctx, b); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans[banKey(b.Kind, b.Value)] = b
+	return nil
+}
+
+// Lift a ban, returning it if there was one
+func (l *banList) remove(kind, value string) (*serverBan, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[banKey(kind, value)]
+	if !ok {
+		return nil, nil
+	}
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := store.DeleteServerBan(ctx, kind, value); err != nil {
+			return nil, err
+		}
+	}
+	delete(l.bans, banKey(kind, value))
+	return b, nil
+}
+
+// Report whether a username is banned from the server, shadow bans aside
+func serverBanned(username string) bool {
+	b, banned := serverBans.match(username, "")
+	return banned && !b.Shadow
+}
+
+// Apply the server-wide bans to the live connections a ban has just been added
+// or lifted for: shadow bans start or stop hiding their messages, and fully
+// banned users are disconnected
+func (h *Hub) enforceBan(changed *serverBan) {
+	for _, room := range h.list() {
+		room.do(func() {
+			for c := range room.clients {
+				if !changed.matches(c.username, c.ip) {
+					continue
+				}
+				b, banned := serverBans.match(c.username, c.ip)
+				if banned && !b.Shadow {
+					c.closeCode, c.closeReason = websocket.ClosePolicyViolation, "banned from the server"
+					room.leave(c)
+					continue
+				}
+				c.shadowBanned.Store(banned)
+			}
+		})
+	}
+}
+
+// Send a shadow-banned user's message back to their own connections to the room
+// only, as if the room had it; runs on the room goroutine
+func (r *Room) echoShadowBanned(m *Message) {
+	for c := range r.clients {
+		if c.username == m.Sender && !c.presenceOnly {
+			copied := *m
+			r.sendTo(c, &copied)
+		}
+	}
+}
+
+// HTTP handler listing the server-wide bans; admin only
+func serveServerBans(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverBans.list())
+}
+
+// HTTP handler adding a server-wide ban such as {"kind":"ip","value":"10.0.0.0/8",
+// "reason":"..."} or {"kind":"username","value":"bob","shadow":true}; admin only
+func (h *Hub) serveAddServerBan(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var b serverBan
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := b.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.Created = time.Now()
+	if err := serverBans.add(&b); err != nil {
+		slog.Error("Storage error", "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	detail := b.Kind
+	if b.Shadow {
+		detail += " shadow"
+	}
+	audit(auditEntry{Action: auditServerBan, Target: b.Value, Reason: b.Reason, Detail: detail})
+	h.enforceBan(&b)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+// HTTP handler lifting a server-wide ban, as DELETE /admin/bans/ip/10.0.0.0/8
+// or /admin/bans/username/bob; admin only
+func (h *Hub) serveDeleteServerBan(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	lookup := serverBan{Kind: r.PathValue("kind"), Value: r.PathValue("value")}
+	if err := lookup.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := serverBans.remove(lookup.Kind, lookup.Value)
+	if err != nil {
+		slog.Error("Storage error", "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if b == nil {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	audit(auditEntry{Action: auditServerUnban, Target: b.Value, Reason: r.URL.Query().Get("reason"), Detail: b.Kind})
+	h.enforceBan(b)
+	w.WriteHeader(http.StatusNoContent)
+}
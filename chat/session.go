@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// session remembers who a disconnected client was so it can resume
+type session struct {
+	id       string
+	username string
+	room     string
+	saved    time.Time
+}
+
+// sessionStore holds resumable sessions, bounded by a TTL and a maximum size
+type sessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxSize  int
+	order    *list.List // oldest session at the front
+	sessions map[string]*list.Element
+}
+
+// Create a session store and start expiring stale sessions
+func newSessionStore(ttl time.Duration, maxSize int) *sessionStore {
+	s := &sessionStore{
+		ttl:      ttl,
+		maxSize:  maxSize,
+		order:    list.New(),
+		sessions: make(map[string]*list.Element),
+	}
+	go s.expireLoop()
+	return s
+}
+
+// Generate a random session ID
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Save a session, evicting the oldest ones when the store is full
+func (s *sessionStore) put(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.sessions[sess.id]; ok {
+		s.remove(e)
+	}
+	sess.saved = time.Now()
+	s.sessions[sess.id] = s.order.PushBack(sess)
+	for s.maxSize > 0 && s.order.Len() > s.maxSize {
+		s.remove(s.order.Front())
+		sessionsEvicted.WithLabelValues("capacity").Inc()
+	}
+	sessionsActive.Set(float64(s.order.Len()))
+}
+
+// Remove and return a session that hasn't expired yet
+func (s *sessionStore) take(id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	s.remove(e)
+	sessionsActive.Set(float64(s.order.Len()))
+	sess := e.Value.(*session)
+	if time.Since(sess.saved) > s.ttl {
+		sessionsEvicted.WithLabelValues("ttl").Inc()
+		return nil, false
+	}
+	return sess, true
+}
+
+// Drop every session older than the TTL
+func (s *sessionStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if now.Sub(e.Value.(*session).saved) <= s.ttl {
+			break
+		}
+		s.remove(e)
+		sessionsEvicted.WithLabelValues("ttl").Inc()
+	}
+	sessionsActive.Set(float64(s.order.Len()))
+}
+
+// Periodically expire stale sessions
+func (s *sessionStore) expireLoop() {
+	if s.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.ttl / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.expire(now)
+	}
+}
+
+// Unlink a session; the caller must hold the lock
+func (s *sessionStore) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.sessions, e.Value.(*session).id)
+}
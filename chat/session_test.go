@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Read a session eviction counter
+func evictions(reason string) float64 {
+	return testutil.ToFloat64(sessionsEvicted.WithLabelValues(reason))
+}
+
+func TestSessionStoreEvictsOldestWhenFull(t *testing.T) {
+	s := newSessionStore(time.Minute, 2)
+	before := evictions("capacity")
+	for _, id := range []string{"a", "b", "c"} {
+		s.put(&session{id: id, username: "user-" + id, room: "lobby"})
+	}
+	if _, ok := s.take("a"); ok {
+		t.Error("the oldest session survived exceeding the cap")
+	}
+	for _, id := range []string{"b", "c"} {
+		if sess, ok := s.take(id); !ok || sess.username != "user-"+id {
+			t.Errorf("take(%q) = %v, %v, want the session", id, sess, ok)
+		}
+	}
+	if got := evictions("capacity") - before; got != 1 {
+		t.Errorf("capacity evictions = %v, want 1", got)
+	}
+}
+
+func TestSessionStoreExpiresStaleSessions(t *testing.T) {
+	s := newSessionStore(time.Minute, 10)
+	before := evictions("ttl")
+	s.put(&session{id: "stale", username: "alice", room: "lobby"})
+	s.sessions["stale"].Value.(*session).saved = time.Now().Add(-2 * time.Minute)
+	s.put(&session{id: "fresh", username: "bob", room: "lobby"})
+
+	s.expire(time.Now())
+	if _, ok := s.sessions["stale"]; ok {
+		t.Error("the stale session wasn't expired")
+	}
+	if _, ok := s.take("fresh"); !ok {
+		t.Error("the fresh session was expired")
+	}
+	if got := evictions("ttl") - before; got != 1 {
+		t.Errorf("TTL evictions = %v, want 1", got)
+	}
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+)
+
+// Longest slow mode interval, in seconds
+const maxSlowMode = 6 * 60 * 60
+
+// Report whether the sender may post now under the room's slow mode, telling
+// them how long to wait if not; moderators aren't slowed. Runs on the room goroutine.
+func (r *Room) allowSlowMode(client *Client, now time.Time) bool {
+	interval := time.Duration(r.meta.SlowMode) * time.Second
+	if interval <= 0 || client == nil || r.role(client.username) >= roleModerator {
+		return true
+	}
+	// Kept per username, so reconnecting doesn't skip the wait
+	if wait := interval - now.Sub(r.lastPosted[client.username]); wait > 0 {
+		refusal := codedError(errCodeSlowMode, fmt.Sprintf("Slow mode is on: one message every %s, wait %s", interval, wait.Round(time.Second)))
+		refusal.RetryAfter = wait.Milliseconds()
+		r.sendTo(client, refusal)
+		return false
+	}
+	if r.lastPosted == nil {
+		r.lastPosted = make(map[string]time.Time)
+	}
+	r.lastPosted[client.username] = now
+	return true
+}
+
+// Turn slow mode on with an interval such as "30s", or off; for moderators.
+// Runs on the room goroutine.
+func (r *Room) setSlowMode(c *Client, args []string) {
+	const usage = "Usage: /slowmode <interval> (e.g. /slowmode 30s) or /slowmode off"
+	if r.role(c.username) < roleModerator {
+		r.sendTo(c, errorMessage("Only moderators can change slow mode"))
+		return
+	}
+	if len(args) != 1 {
+		r.sendTo(c, errorMessage(usage))
+		return
+	}
+	seconds := 0
+	if args[0] != "off" {
+		interval, err := time.ParseDuration(args[0])
+		if err != nil || interval < time.Second {
+			r.sendTo(c, errorMessage(usage))
+			return
+		}
+		seconds = int(interval / time.Second)
+	}
+	if _, err := r.applyMeta(c.username, &roomUpdate{SlowMode: &seconds}); err != nil {
+		r.sendTo(c, errorMessage("Can't change slow mode: "+err.Error()))
+	}
+}
+
+// Describe turning slow mode on or off for the room
+func slowModeNotice(by string, seconds int) string {
+	if by == "" {
+		by = "An administrator"
+	}
+	if seconds == 0 {
+		return by + " turned off slow mode"
+	}
+	return fmt.Sprintf("%s turned on slow mode: members can post once every %s", by, time.Duration(seconds)*time.Second)
+}
@@ -0,0 +1,375 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Most rooms one WebSocket may be in at once
+const maxJoinedRooms = 32
+
+// socket is a WebSocket connection and the rooms joined over it. Each room has
+// a Client of its own for the connection, whose frames the socket writes; the
+// peer's messages go to the room they name, or the only one joined.
+type socket struct {
+	conn     *websocket.Conn
+	hub      *Hub
+	identity *Client // the client the connection was opened with, whose identity later joins share
+	out      chan frame
+	end      chan struct{} // closed once the last room is left, after its frames were queued
+	done     chan struct{} // closed once writePump has stopped
+
+	mu      sync.Mutex
+	clients map[string]*Client // by room name
+	ended   bool
+	// Close frame of the last room left
+	closeCode   int
+	closeReason string
+}
+
+// Set up a connection opened by client, which it joins rooms as
+func newSocket(h *Hub, conn *websocket.Conn, client *Client) *socket {
+	s := &socket{
+		conn:     conn,
+		hub:      h,
+		identity: client,
+		out:      make(chan frame, sendBufferSize),
+		end:      make(chan struct{}),
+		done:     make(chan struct{}),
+		clients:  make(map[string]*Client),
+	}
+	client.socket = s
+	return s
+}
+
+// Subscribe the connection to a client's room, reporting false once the
+// connection is ending
+func (s *socket) add(c *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return false
+	}
+	s.clients[c.room.name] = c
+	go s.forward(c)
+	return true
+}
+
+// Pass a client's frames on to the connection until its room closes send
+func (s *socket) forward(c *Client) {
+	for f := range c.send {
+		select {
+		case s.out <- f:
+		case <-s.done:
+		}
+	}
+	s.left(c)
+}
+
+// Drop a room the connection is no longer in, telling the peer why, or end the
+// connection with the room's close frame once it was the last
+func (s *socket) left(c *Client) {
+	s.mu.Lock()
+	if s.clients[c.room.name] == c {
+		delete(s.clients, c.room.name)
+	}
+	last := len(s.clients) == 0
+	if last {
+		s.ended = true
+		s.closeCode, s.closeReason = c.closeCode, c.closeReason
+		close(s.end)
+	}
+	s.mu.Unlock()
+	if !last {
+		event := newMessage(typeUnsubscribe, c.closeReason)
+		event.Room = c.room.name
+		s.send(event)
+	}
+}
+
+// Queue a message for the peer that no room sent, such as an answer to a join
+func (s *socket) send(m *Message) {
+	select {
+	case s.out <- singleFrame(m, s.identity.msgpack):
+	case <-s.done:
+	}
+}
+
+// List the clients of the rooms the connection is in
+func (s *socket) joined() []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Find the client of the room a message from the peer is for: the room it
+// names, or the only one joined. Messages about the user rather than a room
+// may go through any.
+func (s *socket) route(m *Message) (*Client, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Room != "" {
+		if c, ok := s.clients[m.Room]; ok {
+			return c, ""
+		}
+		return nil, "You haven't joined " + m.Room
+	}
+	if len(s.clients) == 1 || m.Type == typeDM || m.Type == typeStatus || m.Type == typeActivity || m.Type == typeUnread {
+		for _, c := range s.clients {
+			return c, ""
+		}
+	}
+	return nil, "Messages have to name their room once the connection has joined several"
+}
+
+// ReadPump handles reading messages from the WebSocket
+func (s *socket) readPump() {
+	// The connection itself is closed by writePump once every room closed its client's send
+	defer s.disconnect()
+	touchIdle, stopIdle := s.watchIdle()
+	defer stopIdle()
+	s.identity.active()
+	for {
+		messageType, message, err := s.readMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				s.logger().Info("Disconnecting for inactivity")
+			} else if !isClosedError(err) {
+				s.logger().Warn("Read error", "err", err)
+			}
+			break
+		}
+		touchIdle()
+
+		m, err := decodeFrame(messageType, message, s.identity.msgpack)
+		if err != nil {
+			s.send(codedError(errCodeInvalid, "Invalid message: "+err.Error()))
+			continue
+		}
+		if refusal := sanitize(m); refusal != nil {
+			s.send(refusal)
+			continue
+		}
+		if m.Type == typeSubscribe {
+			s.join(m)
+			continue
+		}
+		c, refusal := s.route(m)
+		if c == nil {
+			s.send(codedError(errCodeInvalid, refusal))
+			continue
+		}
+		c.active()
+		if m.Type == typeUnsubscribe {
+			s.leave(c)
+			continue
+		}
+		c.receive(m)
+	}
+}
+
+// Join another room over the connection, checked as the room's query
+// parameters are when connecting, with m.ID as the last message seen there and
+// m.Body as the session to resume
+func (s *socket) join(m *Message) {
+	first := s.identity
+	joined := s.joined()
+	if len(joined) > 0 && joined[0].throttled() {
+		return
+	}
+	refuse := func(refusal *Message) {
+		refusal.Room = m.Room
+		s.send(refusal)
+	}
+	if m.Room == "" {
+		s.send(codedError(errCodeInvalid, "A join needs the room to join"))
+		return
+	}
+	for _, c := range joined {
+		if c.room.name == m.Room {
+			refuse(errorMessage("You're already in " + m.Room))
+			return
+		}
+	}
+	if len(joined) >= maxJoinedRooms {
+		refuse(errorMessage(fmt.Sprintf("A connection can be in at most %d rooms", maxJoinedRooms)))
+		return
+	}
+	if maintenance.Load() {
+		refuse(errorMessage("The server is down for maintenance"))
+		return
+	}
+	access, err := s.hub.accessOf(context.Background(), m.Room)
+	if err != nil {
+		s.logger().Error("Storage error", "err", err)
+		refuse(errorMessage("Can't join " + m.Room + " right now"))
+		return
+	}
+	if access.isBanned(first.username) {
+		refuse(codedError(errCodeForbidden, "You are banned from this room"))
+		return
+	}
+	if !access.admits(m.Password, m.Invite) {
+		refuse(codedError(errCodeForbidden, "Forbidden"))
+		return
+	}
+	client := &Client{
+		conn:         s.conn,
+		socket:       s,
+		send:         make(chan frame, sendBufferSize),
+		username:     first.username,
+		displayName:  first.displayName,
+		avatar:       first.avatar,
+		email:        first.email,
+		limiter:      first.limiter,
+		ip:           first.ip,
+		connID:       first.connID,
+		presenceOnly: first.presenceOnly,
+		sessionID:    newSessionID(),
+		lastSeen:     m.ID,
+		binary:       first.binary,
+		msgpack:      first.msgpack,
+		joinedAt:     time.Now(),
+	}
+	client.shadowBanned.Store(first.shadowBanned.Load())
+	if m.Body != "" {
+		if sess, ok := sessions.take(m.Body); ok && sess.room == m.Room && sess.username == client.username {
+			client.sessionID = sess.id
+		} else {
+			client.replaces = m.Body
+		}
+	}
+	if !s.hub.register(m.Room, client) {
+		refusal := client.refusal
+		if refusal == nil {
+			refusal = errorMessage("Can't join " + m.Room + ": " + cmp.Or(client.closeReason, "server shutting down"))
+		}
+		refuse(refusal)
+		return
+	}
+	if !s.add(client) {
+		client.leave()
+	}
+}
+
+// Leave one of the rooms the connection is in, as long as it isn't the last
+func (s *socket) leave(c *Client) {
+	if len(s.joined()) == 1 {
+		refusal := errorMessage("You can't leave the last room of a connection, close it instead")
+		refusal.Room = c.room.name
+		s.send(refusal)
+		return
+	}
+	c.leave()
+}
+
+// Leave every room once the connection has ended, keeping their sessions for resuming
+func (s *socket) disconnect() {
+	connLimits.release(s.identity.ip)
+	for _, c := range s.joined() {
+		c.leave()
+		c.keepSession()
+	}
+}
+
+// Start the idle timers: a warning shortly before the idle timeout and a read
+// deadline at it. touch pushes both back after activity, stop cancels the warning.
+func (s *socket) watchIdle() (touch func(), stop func()) {
+	if idleTimeout <= 0 {
+		return func() {}, func() {}
+	}
+	s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	warning := time.AfterFunc(idleTimeout-idleWarning, func() {
+		s.send(systemMessage(fmt.Sprintf("You'll be disconnected for inactivity in %s, send a message to stay connected", idleWarning)))
+	})
+	touch = func() {
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		warning.Reset(idleTimeout - idleWarning)
+	}
+	return touch, func() { warning.Stop() }
+}
+
+// Read the next message, aborting the connection if it decompresses beyond the size limit
+func (s *socket) readMessage() (int, []byte, error) {
+	messageType, r, err := s.conn.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	limit := maxDecompressedSize()
+	message, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(message) > limit {
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message too big")
+		s.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		return 0, nil, errMessageTooBig
+	}
+	return messageType, message, nil
+}
+
+// WritePump handles sending the rooms' messages to the WebSocket
+func (s *socket) writePump() {
+	defer pumps.Done()
+	defer s.conn.Close()
+	defer close(s.done)
+	for {
+		select {
+		case f := <-s.out:
+			if !s.write(f) {
+				return
+			}
+		case <-s.end:
+			// The last room closed its channel: send what it queued, then tell
+			// the peer before closing the connection
+			for len(s.out) > 0 {
+				if !s.write(<-s.out) {
+					return
+				}
+			}
+			code := s.closeCode
+			if code == 0 {
+				code = websocket.CloseNormalClosure
+			}
+			closeMessage := websocket.FormatCloseMessage(code, s.closeReason)
+			s.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+// Write a frame, reporting false once the connection failed
+func (s *socket) write(f frame) bool {
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	span := s.identity.traceWrite(f)
+	var err error
+	if f.prepared != nil {
+		err = s.conn.WritePreparedMessage(f.prepared)
+	} else {
+		err = s.conn.WriteMessage(f.messageType, f.data)
+	}
+	if span != nil {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+	if err != nil && !isClosedError(err) {
+		s.logger().Warn("Write error", "err", err)
+	}
+	return err == nil
+}
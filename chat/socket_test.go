@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCompressionBombDropsConnection(t *testing.T) {
+	setFor(t, &upgrader.EnableCompression, true)
+	_, srv, _ := newTestServer(t)
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(wsURL(srv, url.Values{"room": {"bomb"}, "username": {"alice"}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatal("compression wasn't negotiated")
+	}
+	c := &testConn{Conn: conn, t: t}
+	c.expect(typeMembers)
+
+	// Deflates to a few kilobytes, well within the read limit, but inflates past the cap
+	body := strings.Repeat("a", 4*maxDecompressedSize())
+	c.EnableWriteCompression(true)
+	c.say(body)
+	err = c.expectClosed()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("connection ended with %v, want a message too big close", err)
+	}
+}
+
+// countingConn counts the bytes read from a connection
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// Broadcast chatty messages to a room of peers with and without permessage-deflate,
+// reporting the bytes the peers read off the wire per message
+func BenchmarkBroadcastCompression(b *testing.B) {
+	const peers = 50
+	body := strings.Repeat("The quick brown fox jumps over the lazy dog, again and again. ", 16)
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compression=%t", compress), func(b *testing.B) {
+			setFor(b, &upgrader.EnableCompression, compress)
+			setFor(b, &messageRate, 1e9)
+			setFor(b, &messageBurst, 1e9)
+			_, srv, _ := newTestServer(b)
+			var wire atomic.Int64
+			dialer := websocket.Dialer{
+				EnableCompression: compress,
+				NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+					return countingConn{conn, &wire}, err
+				},
+			}
+			conns := make([]*testConn, peers)
+			for i := range conns {
+				query := url.Values{"room": {"bench"}, "username": {fmt.Sprintf("user%d", i)}}
+				conn, _, err := dialer.Dial(wsURL(srv, query), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() { conn.Close() })
+				conns[i] = &testConn{Conn: conn, t: b}
+				conns[i].expect(typeMembers)
+			}
+			// Once a first message arrived everywhere, the join events are behind it
+			conns[0].say("warm up")
+			for _, c := range conns {
+				c.expect(typeChat)
+			}
+			wire.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conns[0].say(fmt.Sprintf("%d %s", i, body))
+				for _, c := range conns {
+					c.expect(typeChat)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+// Wait for the inactivity warning
+func (c *testConn) expectIdleWarning() {
+	c.t.Helper()
+	for {
+		if m := c.expect(typeSystem); strings.Contains(m.Body, "disconnected for inactivity") {
+			return
+		}
+	}
+}
+
+func TestIdleWarningPrecedesDisconnect(t *testing.T) {
+	setFor(t, &idleTimeout, 400*time.Millisecond)
+	setFor(t, &idleWarning, 200*time.Millisecond)
+	_, srv, _ := newTestServer(t)
+	alice := join(t, srv, "idle", "alice")
+
+	alice.expectIdleWarning()
+	alice.expectClosed()
+}
+
+func TestActivityAfterIdleWarningCancelsDisconnect(t *testing.T) {
+	setFor(t, &idleTimeout, 400*time.Millisecond)
+	setFor(t, &idleWarning, 200*time.Millisecond)
+	_, srv, _ := newTestServer(t)
+	alice := join(t, srv, "idle", "alice")
+
+	alice.expectIdleWarning()
+	alice.send(&Message{Type: typeActivity})
+	// Without the activity the connection would close before the next warning
+	alice.expectIdleWarning()
+	alice.expectClosed()
+}
+
+func TestShortIdleTimeoutWarnsHalfway(t *testing.T) {
+	// The default 30s warning would leave no time before the warning at all
+	setFor(t, &idleTimeout, 400*time.Millisecond)
+	setFor(t, &idleWarning, idleWarningFromEnv(idleTimeout))
+	if idleWarning != 200*time.Millisecond {
+		t.Fatalf("warning %s before a %s timeout, want halfway", idleWarning, idleTimeout)
+	}
+	_, srv, _ := newTestServer(t)
+	alice := join(t, srv, "idle", "alice")
+	joined := time.Now()
+
+	alice.expectIdleWarning()
+	if waited := time.Since(joined); waited < 150*time.Millisecond {
+		t.Errorf("warned %s after joining, want about halfway to the timeout", waited)
+	}
+	alice.expectClosed()
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between comments that keep idle event streams open through proxies
+const sseKeepAlive = 25 * time.Second
+
+// sseClient is a client connected over server-sent events. Its messages arrive
+// as separate POST requests, which mu serializes as readPump does for WebSockets.
+type sseClient struct {
+	mu     sync.Mutex
+	client *Client
+}
+
+// sseRegistry finds event stream clients by session ID for their POSTs
+type sseRegistry struct {
+	mu      sync.Mutex
+	clients map[string]*sseClient
+}
+
+var sseClients = &sseRegistry{clients: make(map[string]*sseClient)}
+
+func (s *sseRegistry) add(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.sessionID] = &sseClient{client: c}
+}
+
+func (s *sseRegistry) remove(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sc, ok := s.clients[c.sessionID]; ok && sc.client == c {
+		delete(s.clients, c.sessionID)
+	}
+}
+
+func (s *sseRegistry) lookup(sessionID string) (*sseClient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.clients[sessionID]
+	return sc, ok
+}
+
+// HTTP handler to join a room over server-sent events, for clients that can't
+// open a WebSocket. It takes the same query parameters as /ws.
+func (h *Hub) serveEvents(w http.ResponseWriter, r *http.Request) {
+	h.admit(w, r, h.serveSSE)
+}
+
+// Stream the room's messages to the client until either side ends it,
+// reporting whether the client was started
+func (h *Hub) serveSSE(roomName string, client *Client, w http.ResponseWriter, r *http.Request) bool {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return false
+	}
+	// The bot challenge is only spoken over WebSockets, so it can't be skipped by streaming
+	if challenge.kind != "" {
+		connAudit.record(r, client.username, connChallengeFailed, "event streams can't answer the challenge")
+		http.Error(w, "This server requires a WebSocket", http.StatusForbidden)
+		return false
+	}
+	client.send = make(chan frame, sendBufferSize)
+	client.joinedAt = time.Now()
+	client.limiter = newTokenBucket(messageRate, messageBurst)
+	if !h.register(roomName, client) {
+		if client.closeReason != "" {
+			http.Error(w, client.closeReason, http.StatusConflict)
+		} else {
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		}
+		return false
+	}
+	sseClients.add(client)
+	connAudit.record(r, client.username, connSuccess, "")
+	pumps.Add(1)
+	defer pumps.Done()
+	defer sseClients.remove(client)
+	defer client.disconnect()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Each event gets its own write deadline, as WebSocket frames do in writePump
+	rc := http.NewResponseController(w)
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case f, ok := <-client.send:
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				// The room closed the stream, like a WebSocket close frame
+				fmt.Fprintf(w, "event: close\ndata: %s\n\n", closeMessage(client).encode())
+				flusher.Flush()
+				return true
+			}
+			fmt.Fprintf(w, "data: %s\n\n", f.data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			io.WriteString(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return true
+		}
+	}
+}
+
+// Describe why the room closed the client's stream
+func closeMessage(c *Client) *Message {
+	reason := c.closeReason
+	if reason == "" {
+		reason = "closed"
+	}
+	return systemMessage(reason)
+}
+
+// HTTP handler for a message from an event stream client, named by the session
+// ID it was sent when joining; the body is a message envelope as sent over /ws
+func (h *Hub) serveEventPost(w http.ResponseWriter, r *http.Request) {
+	sc, ok := sseClients.lookup(r.URL.Query().Get("session"))
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(readLimit)))
+	if err != nil {
+		http.Error(w, "Message too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	m, err := decodeMessage([]byte(strings.TrimSpace(string(body))))
+	if err != nil {
+		http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if refusal := sanitize(m); refusal != nil {
+		status := http.StatusBadRequest
+		if refusal.Code == errCodeTooBig {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, refusal.Body, status)
+		return
+	}
+	sc.mu.Lock()
+	sc.client.active()
+	sc.client.receive(m)
+	sc.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Number of one-second buckets kept, enough for the longest window
+const statsBuckets = 15 * 60
+
+// rateCounter counts events over a sliding window using a fixed ring of per-second buckets
+type rateCounter struct {
+	mu      sync.Mutex
+	buckets [statsBuckets]int
+	seconds [statsBuckets]int64 // unix second each bucket was last used for
+}
+
+// Count one event at the given time
+func (rc *rateCounter) add(now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	sec := now.Unix()
+	i := sec % statsBuckets
+	if rc.seconds[i] != sec {
+		rc.seconds[i] = sec
+		rc.buckets[i] = 0
+	}
+	rc.buckets[i]++
+}
+
+// Count the events in the window ending at now
+func (rc *rateCounter) count(now time.Time, window time.Duration) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	sec := now.Unix()
+	oldest := sec - int64(window/time.Second) + 1
+	total := 0
+	for i, s := range rc.seconds {
+		if s >= oldest && s <= sec {
+			total += rc.buckets[i]
+		}
+	}
+	return total
+}
+
+// roomStats reports how many messages a room saw recently
+type roomStats struct {
+	Room     string `json:"room"`
+	Members  int    `json:"members"`
+	Last1m   int    `json:"last_1m"`
+	Last5m   int    `json:"last_5m"`
+	Last15m  int    `json:"last_15m"`
+	Messages uint64 `json:"messages"`
+}
+
+// HTTP handler reporting a room's message rates
+func (h *Hub) serveRoomStats(w http.ResponseWriter, r *http.Request) {
+	room, exists := h.lookup(r.PathValue("name"))
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	stats := make(chan roomStats, 1)
+	if !room.do(func() { stats <- roomStats{Room: room.name, Members: len(room.members()), Messages: room.seq} }) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	result := <-stats
+	now := time.Now()
+	result.Last1m = room.stats.count(now, time.Minute)
+	result.Last5m = room.stats.count(now, 5*time.Minute)
+	result.Last15m = room.stats.count(now, 15*time.Minute)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
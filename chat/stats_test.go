@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRoomStatsCountSentMessages(t *testing.T) {
+	hub, srv, mux := newTestServer(t)
+	mux.HandleFunc("GET /rooms/{name}/stats", hub.serveRoomStats)
+	alice := join(t, srv, "busy", "alice")
+	for range 3 {
+		alice.say("hello")
+		alice.expect(typeAck)
+	}
+
+	resp, err := http.Get(srv.URL + "/rooms/busy/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats roomStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Last1m != 3 || stats.Last5m != 3 || stats.Last15m != 3 || stats.Members != 1 {
+		t.Errorf("stats = %+v, want 3 messages in every window from 1 member", stats)
+	}
+}
+
+func TestRateCounterDecays(t *testing.T) {
+	var rc rateCounter
+	start := time.Unix(1_700_000_000, 0)
+	for i := range 10 {
+		rc.add(start.Add(time.Duration(i) * 10 * time.Second))
+	}
+	counts := func(now time.Time) [3]int {
+		return [3]int{rc.count(now, time.Minute), rc.count(now, 5*time.Minute), rc.count(now, 15*time.Minute)}
+	}
+	tests := []struct {
+		after time.Duration
+		want  [3]int
+	}{
+		{90 * time.Second, [3]int{6, 10, 10}},
+		{3 * time.Minute, [3]int{0, 10, 10}},
+		{6 * time.Minute, [3]int{0, 3, 10}},
+		{20 * time.Minute, [3]int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		if got := counts(start.Add(tt.after)); got != tt.want {
+			t.Errorf("after %s: 1m/5m/15m = %v, want %v", tt.after, got, tt.want)
+		}
+	}
+}
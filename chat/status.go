@@ -0,0 +1,209 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statuses a user can set; away is also set for them after awayAfter without activity
+const (
+	statusOnline = "online"
+	statusAway   = "away"
+	statusBusy   = "busy"
+)
+
+// Longest custom status text, in bytes
+const maxStatusText = 100
+
+// How long a user may send nothing before they're shown as away, from
+// AWAY_AFTER; never when 0
+var awayAfter = 5 * time.Minute
+
+// userStatus is what a user's status says, e.g. {"status":"busy","text":"in a meeting"}
+type userStatus struct {
+	Status string `json:"status"`
+	Text   string `json:"text,omitempty"`
+}
+
+// statusList maps usernames to their status
+type statusList map[string]userStatus
+
+// userActivity is a connected user's chosen status and when they were last heard from
+type userActivity struct {
+	chosen userStatus
+	idle   bool // shown as away for inactivity rather than by choice
+	active time.Time
+}
+
+// The status others see: away while idle, unless the user chose something else
+// than online
+func (a *userActivity) status() userStatus {
+	if a.idle && a.chosen.Status == statusOnline {
+		return userStatus{Status: statusAway, Text: a.chosen.Text}
+	}
+	return a.chosen
+}
+
+// statusRegistry tracks the status of every chatting user, across all rooms
+type statusRegistry struct {
+	mu    sync.Mutex
+	users map[string]*userActivity
+}
+
+// Statuses of connected users, forgotten when their last connection goes
+var statuses = &statusRegistry{users: make(map[string]*userActivity)}
+
+// Get a user's activity, starting them online; the caller holds s.mu
+func (s *statusRegistry) activity(username string) *userActivity {
+	a, ok := s.users[username]
+	if !ok {
+		a = &userActivity{chosen: userStatus{Status: statusOnline}, active: time.Now()}
+		s.users[username] = a
+	}
+	return a
+}
+
+// Note that a user just sent something, reporting their status when that brings
+// them back from being away for inactivity
+func (s *statusRegistry) touch(username string) (userStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.activity(username)
+	a.active = time.Now()
+	if !a.idle {
+		return userStatus{}, false
+	}
+	a.idle = false
+	return a.status(), a.chosen.Status == statusOnline
+}
+
+// Set the status a user chose, reporting whether others see a change
+func (s *statusRegistry) set(username string, status userStatus) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.activity(username)
+	before := a.status()
+	a.chosen, a.idle, a.active = status, false, time.Now()
+	return a.status() != before
+}
+
+// Mark the users who are online but haven't sent anything for awayAfter as away,
+// returning their new statuses
+func (s *statusRegistry) sweep(now time.Time) statusList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := make(statusList)
+	for username, a := range s.users {
+		if a.idle || now.Sub(a.active) < awayAfter {
+			continue
+		}
+		a.idle = true
+		if a.chosen.Status == statusOnline {
+			changed[username] = a.status()
+		}
+	}
+	return changed
+}
+
+// Drop a user whose last connection is gone
+func (s *statusRegistry) forget(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, username)
+}
+
+// Report whether a connected user is away, by choice or for inactivity
+func (s *statusRegistry) away(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.users[username]
+	return ok && a.status().Status == statusAway
+}
+
+// Get the statuses of those users who are anything but plainly online, for rosters;
+// nil when all of them are
+func (s *statusRegistry) of(usernames []string) statusList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found statusList
+	for _, username := range usernames {
+		a, ok := s.users[username]
+		if !ok {
+			continue
+		}
+		if status := a.status(); status != (userStatus{Status: statusOnline}) {
+			if found == nil {
+				found = make(statusList)
+			}
+			found[username] = status
+		}
+	}
+	return found
+}
+
+// Check a status a client asked for, e.g. {"type":"status_set","status":"busy",
+// "body":"in a meeting"}; an empty status means online
+func parseStatus(m *Message) (userStatus, string) {
+	status := userStatus{Status: strings.ToLower(strings.TrimSpace(m.Status)), Text: strings.TrimSpace(m.Body)}
+	switch status.Status {
+	case "":
+		status.Status = statusOnline
+	case statusOnline, statusAway, statusBusy:
+	default:
+		return status, "A status is online, away or busy"
+	}
+	if len(status.Text) > maxStatusText {
+		return status, "A status text is at most 100 bytes"
+	}
+	return status, ""
+}
+
+// Note activity from the client, telling its user's rooms when they're back
+func (c *Client) active() {
+	if c.presenceOnly || awayAfter <= 0 || c.waiting.Load() {
+		return
+	}
+	if status, back := statuses.touch(c.username); back {
+		broadcastStatus(c.username, status)
+	}
+}
+
+// Set the status the client's user chose and tell every room they're in
+func (c *Client) setStatus(m *Message) {
+	status, refusal := parseStatus(m)
+	if refusal != "" {
+		c.replyWith(codedError(errCodeInvalid, refusal))
+		return
+	}
+	if statuses.set(c.username, status) {
+		broadcastStatus(c.username, status)
+	}
+}
+
+// Send a status_set event about a user to every room they're connected to
+func broadcastStatus(username string, status userStatus) {
+	rooms := make(map[*Room]bool)
+	for _, c := range users.lookup(username) {
+		rooms[c.room] = true
+	}
+	for room := range rooms {
+		event := newMessage(typeStatus, status.Text)
+		event.Sender, event.Status = username, status.Status
+		room.do(func() { room.deliver(event) })
+	}
+}
+
+// Mark idle users as away every little while until the hub stops
+func (h *Hub) awayWatcher() {
+	ticker := time.NewTicker(min(max(awayAfter/4, time.Second), 30*time.Second))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if h.stopped() {
+			return
+		}
+		for username, status := range statuses.sweep(now) {
+			broadcastStatus(username, status)
+		}
+	}
+}
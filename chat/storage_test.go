@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUnreadSkipsExpiredMessages(t *testing.T) {
+	s := useTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	for _, m := range []*Message{
+		{Room: "lobby", ID: 1, Sender: "alice", Body: "read already", TS: now.UnixMilli()},
+		{Room: "lobby", ID: 2, Sender: "alice", Body: "kept", TS: now.UnixMilli()},
+		{Room: "lobby", ID: 3, Sender: "alice", Body: "expired", TS: now.UnixMilli(), ExpiresAt: now.Add(-time.Second).UnixMilli()},
+		{Room: "lobby", ID: 4, Sender: "alice", Body: "expiring later", TS: now.UnixMilli(), ExpiresAt: now.Add(time.Hour).UnixMilli()},
+		{Room: "quiet", ID: 1, Sender: "alice", Body: "read already", TS: now.UnixMilli()},
+		{Room: "quiet", ID: 2, Sender: "alice", Body: "expired", TS: now.UnixMilli(), ExpiresAt: now.Add(-time.Second).UnixMilli()},
+	} {
+		if err := s.Save(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.MarkRead(ctx, "lobby", "bob", 1)
+	s.MarkRead(ctx, "quiet", "bob", 1)
+
+	unread, err := s.Unread(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unread["lobby"] != 2 || unread["quiet"] != 0 || len(unread) != 2 {
+		t.Errorf("unread = %v, want 2 in lobby and 0 in quiet", unread)
+	}
+}
@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Replies sent for a thread over the WebSocket, and the default page of the API
+const threadLimit = 100
+
+// Find the thread a reply to parent goes in: the parent's own, or the one the
+// parent is a reply in, as threads don't nest; runs on the room goroutine
+func (r *Room) threadOf(parent uint64) (uint64, error) {
+	for _, entry := range r.history {
+		if entry.contains(parent) {
+			return cmp.Or(entry.ParentID, parent), nil
+		}
+	}
+	if !r.stored() {
+		return 0, errNoMessage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	m, err := store.Get(ctx, r.name, parent)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		return 0, errNoMessage
+	}
+	if m == nil {
+		return 0, errNoMessage
+	}
+	return cmp.Or(m.ParentID, parent), nil
+}
+
+// Get up to limit of the replies to parent after the given ID, oldest first, from
+// the store if the room keeps its messages there, else from the recent history;
+// runs on the room goroutine
+func (r *Room) thread(parent, after uint64, limit int) ([]*Message, error) {
+	if r.stored() {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		return store.Thread(ctx, r.name, parent, after, limit)
+	}
+	var replies []*Message
+	for _, entry := range r.history {
+		if entry.ParentID == parent && entry.ID > after && len(replies) < limit {
+			reply := entry.message()
+			reply.Room = r.name
+			replies = append(replies, reply)
+		}
+	}
+	return replies, nil
+}
+
+// Answer a client's {"type":"thread","id":7} with the thread's latest replies as
+// {"type":"thread","id":7,"replies":[...]}; runs on the room goroutine
+func (r *Room) sendThread(c *Client, parent uint64) {
+	if _, err := r.threadOf(parent); err != nil {
+		r.sendTo(c, errorMessage(fmt.Sprintf("Can't show the thread of message %d: %v", parent, err)))
+		return
+	}
+	replies, err := r.thread(parent, 0, threadLimit)
+	if err != nil {
+		r.logger().Error("Storage error", "err", err)
+		r.sendTo(c, errorMessage("Couldn't load the thread"))
+		return
+	}
+	reply := newMessage(typeThread, "")
+	reply.ID = parent
+	reply.Replies = replies
+	if reply.Replies == nil {
+		reply.Replies = []*Message{}
+	}
+	r.sendTo(c, reply)
+}
+
+// HTTP handler returning the replies to a message as {"messages":[...],"next_after":7};
+// takes after and limit parameters for paging, and password or invite for private rooms
+func (h *Hub) serveThread(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	query := r.URL.Query()
+	parent, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	after, limit := uint64(0), threadLimit
+	if v := query.Get("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxSearchLimit)
+	}
+	if !h.authorizeRead(w, r, name) {
+		return
+	}
+	room, open := h.lookup(name)
+	var messages []*Message
+	switch {
+	case open:
+		type result struct {
+			messages []*Message
+			err      error
+		}
+		results := make(chan result, 1)
+		if !room.do(func() {
+			messages, err := room.thread(parent, after, limit)
+			results <- result{messages, err}
+		}) {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		res := <-results
+		messages, err = res.messages, res.err
+	case store != nil:
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		defer cancel()
+		messages, err = store.Thread(ctx, name, parent, after, limit)
+	default:
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Storage error", "room", name, "err", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	page := struct {
+		Messages  []*Message `json:"messages"`
+		NextAfter uint64     `json:"next_after,omitempty"` // set when there may be later replies
+	}{Messages: messages}
+	if page.Messages == nil {
+		page.Messages = []*Message{}
+	}
+	if len(messages) == limit {
+		page.NextAfter = messages[len(messages)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
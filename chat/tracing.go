@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"chat-app/internal/env"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer of the message pipeline. Its spans are dropped unless tracing is set
+// up: receive, publish, fanout and one write per recipient, so the time between
+// a client sending a message and another receiving it can be broken down.
+var tracer = otel.Tracer("chat-app/chat")
+
+// Provider exporting the spans, nil when tracing is off; flushed when shutting down
+var tracerProvider *sdktrace.TracerProvider
+
+// Messages carry their trace as a W3C traceparent
+var traceFormat = propagation.TraceContext{}
+
+// Export spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set; the exporter and sampler read the
+// other OTEL_ variables themselves
+func configureTracing() {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		fatal("Invalid tracing configuration", "err", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", env.String("OTEL_SERVICE_NAME", "chat-app")),
+	))
+	if err != nil {
+		fatal("Invalid tracing configuration", "err", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(traceFormat)
+}
+
+// Get the context of the message's trace: the span it was received or published
+// in here, or else the traceparent it came with from a client or another instance
+func messageContext(m *Message) context.Context {
+	if m.span.IsValid() {
+		return trace.ContextWithSpanContext(context.Background(), m.span)
+	}
+	if m.Trace == "" {
+		return context.Background()
+	}
+	return traceFormat.Extract(context.Background(), propagation.MapCarrier{"traceparent": m.Trace})
+}
+
+// Make a span the message's, recording it as the traceparent recipients get
+func setTrace(m *Message, span trace.Span) {
+	if !span.IsRecording() {
+		return
+	}
+	m.span = span.SpanContext()
+	carrier := propagation.MapCarrier{}
+	traceFormat.Inject(trace.ContextWithSpanContext(context.Background(), m.span), carrier)
+	m.Trace = carrier["traceparent"]
+}
+
+// Start the span of writing a frame to a connection, timed from when it was
+// queued so it includes the wait in the send buffer; nil for untraced frames
+func (c *Client) traceWrite(f frame) trace.Span {
+	if !f.span.IsValid() {
+		return nil
+	}
+	_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), f.span), "chat.write",
+		trace.WithTimestamp(f.queued),
+		trace.WithAttributes(attribute.String("chat.username", c.username), attribute.Float64("chat.queued_ms", float64(time.Since(f.queued))/float64(time.Millisecond))),
+	)
+	return span
+}
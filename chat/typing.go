@@ -0,0 +1,35 @@
+package chat
+
+import "time"
+
+// Minimum time between relayed typing_start events from one client
+const typingDebounce = 3 * time.Second
+
+// Relay a typing_start or typing_stop to the rest of the room without
+// persisting it. Repeated starts within typingDebounce are dropped, as are
+// stops without a relayed start.
+func (c *Client) sendTyping(typ string) {
+	if c.presenceOnly {
+		return
+	}
+	now := time.Now()
+	switch typ {
+	case typeTyping:
+		if now.Sub(c.typingAt) < typingDebounce {
+			return
+		}
+		c.typingAt = now
+	case typeStopped:
+		if c.typingAt.IsZero() {
+			return
+		}
+		c.typingAt = time.Time{}
+	}
+	m := newMessage(typ, "")
+	m.Sender = c.username
+	c.room.do(func() {
+		if !c.room.readOnly(c.username) {
+			c.room.deliver(m)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// How a room settles a second connection under a username it already has, from
+// USERNAME_CONFLICT; MULTI_DEVICE lets it through as another device of the same user
+const (
+	conflictReject = "reject" // refuse the new connection
+	conflictSuffix = "suffix" // rename it, e.g. alice-2
+)
+
+var (
+	usernameConflict = conflictReject
+	multiDevice      bool
+)
+
+// Check USERNAME_CONFLICT, falling back to refusing duplicates
+func usernameConflictFromEnv(policy string) string {
+	switch policy {
+	case "":
+		return conflictReject
+	case conflictReject, conflictSuffix:
+		return policy
+	}
+	slog.Warn("Unknown USERNAME_CONFLICT, refusing duplicate usernames", "policy", policy)
+	return conflictReject
+}
+
+// Settle a client joining under a username already connected to the room,
+// reporting false if it has to be refused; runs on the room goroutine
+func (r *Room) claimUsername(c *Client) bool {
+	if multiDevice {
+		return true
+	}
+	// A reconnecting client names the session of its old connection, which is
+	// secret, so it may replace the old connection
+	if c.replaces != "" {
+		for other := range r.clients {
+			if !other.presenceOnly && other.username == c.username && other.sessionID == c.replaces {
+				other.closeCode, other.closeReason = websocket.CloseNormalClosure, "replaced by a new connection"
+				r.leave(other)
+				c.sessionID = other.sessionID
+				return true
+			}
+		}
+	}
+	if usernameConflict == conflictSuffix {
+		c.username = r.freeUsername(c.username)
+		return true
+	}
+	c.closeCode, c.closeReason = websocket.ClosePolicyViolation, "username "+c.username+" is taken"
+	return false
+}
+
+// Find a variant of a username that nobody in the room is using
+func (r *Room) freeUsername(username string) string {
+	for n := 2; ; n++ {
+		suffix := fmt.Sprintf("-%d", n)
+		candidate := username[:min(len(username), maxUsernameLength-len(suffix))] + suffix
+		if r.connections[candidate] == 0 {
+			return candidate
+		}
+	}
+}
+
+// userRegistry tracks every chatting client by username, across all rooms
+type userRegistry struct {
+	mu      sync.RWMutex
+	clients map[string]map[*Client]bool
+}
+
+// Connected users, used to route direct messages
+var users = &userRegistry{clients: make(map[string]map[*Client]bool)}
+
+func (u *userRegistry) add(c *Client) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.clients[c.username] == nil {
+		u.clients[c.username] = make(map[*Client]bool)
+	}
+	u.clients[c.username][c] = true
+}
+
+func (u *userRegistry) remove(c *Client) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.clients[c.username], c)
+	if len(u.clients[c.username]) == 0 {
+		delete(u.clients, c.username)
+		statuses.forget(c.username)
+	}
+}
+
+// List the connections of a user, in any room
+func (u *userRegistry) lookup(username string) []*Client {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	var clients []*Client
+	for c := range u.clients[username] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Keep one client per connection, as a WebSocket in several rooms has a client
+// in each that would otherwise get the same message more than once; a client
+// in room, if any, is kept over the others
+func perConnection(clients []*Client, room *Room) []*Client {
+	kept := make(map[*socket]int)
+	var unique []*Client
+	for _, c := range clients {
+		if c.socket == nil {
+			unique = append(unique, c)
+			continue
+		}
+		if i, ok := kept[c.socket]; ok {
+			if c.room == room {
+				unique[i] = c
+			}
+			continue
+		}
+		kept[c.socket] = len(unique)
+		unique = append(unique, c)
+	}
+	return unique
+}
+
+// Send a copy of a message to one of a user's connections through its room
+func (c *Client) deliver(m *Message) {
+	copied := *m
+	c.room.do(func() { c.room.sendTo(c, &copied) })
+}
+
+// Send a direct message to every connection of the target user, or queue it while
+// they're offline, pushing it to their devices while they're offline or away,
+// and copy it to the sender's connections so all their devices show the conversation
+func (c *Client) sendDirect(m *Message) {
+	if m.To == "" {
+		c.replyError("A direct message needs a recipient")
+		return
+	}
+	targets := perConnection(users.lookup(m.To), nil)
+	if len(targets) == 0 && offlineMax <= 0 {
+		c.replyError(m.To + " is not online")
+		return
+	}
+	if blocks.has(m.To, c.username) {
+		c.replyWith(codedError(errCodeBlocked, m.To+" isn't accepting your direct messages"))
+		return
+	}
+	if c.throttled() {
+		return
+	}
+	dm := newMessage(typeDM, m.Body)
+	dm.Sender = c.username
+	dm.To = m.To
+	if c.shadowBanned.Load() {
+		for _, own := range perConnection(users.lookup(c.username), nil) {
+			own.deliver(dm)
+		}
+		return
+	}
+	if len(targets) == 0 {
+		if !queueOffline(m.To, dm) {
+			c.replyError(m.To + " is not online")
+			return
+		}
+		c.reply(m.To + " is not online and will get your message when they connect")
+	}
+	for _, target := range targets {
+		target.deliver(dm)
+	}
+	pushes.notify(m.To, dm)
+	if m.To != c.username {
+		for _, own := range perConnection(users.lookup(c.username), nil) {
+			own.deliver(dm)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Largest chat message body in bytes, from MAX_MESSAGE_SIZE; binary payloads
+// are only bounded by the frame limit
+var maxMessageSize = 8 * 1024
+
+// Codes of error events about a client's message
+const (
+	errCodeTooBig    = "message_too_big"
+	errCodeInvalid   = "invalid_message"
+	errCodeForbidden = "forbidden"
+	errCodeBlocked   = "blocked"
+	errCodeRoomFull  = "room_full"
+	errCodeSlowMode  = "slow_mode"
+	errCodeE2E       = "e2e_required"
+)
+
+// Create an error event with a code clients can act on
+func codedError(code, body string) *Message {
+	m := errorMessage(body)
+	m.Code = code
+	return m
+}
+
+// Check a message from a client and clean up its text fields, returning the
+// error event to answer with if it has to be dropped
+func sanitize(m *Message) *Message {
+	if len(m.Body) > maxMessageSize {
+		return codedError(errCodeTooBig, fmt.Sprintf("Messages are limited to %d bytes", maxMessageSize))
+	}
+	m.Body = cleanText(m.Body)
+	m.To = cleanText(m.To)
+	m.Emoji = cleanText(m.Emoji)
+	m.Ref = cleanText(m.Ref)
+	m.KeyID = cleanText(m.KeyID)
+	return nil
+}
+
+// Replace invalid UTF-8 and drop control characters other than newlines and
+// tabs, including the invisible ones that reorder text
+func cleanText(s string) string {
+	s = strings.ToValidUTF8(s, "�")
+	if !strings.ContainsFunc(s, unwantedRune) {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if unwantedRune(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func unwantedRune(r rune) bool {
+	if r == '\n' || r == '\t' {
+		return false
+	}
+	return unicode.IsControl(r) || isBidiControl(r)
+}
+
+// Report whether r overrides the direction of the text around it
+func isBidiControl(r rune) bool {
+	return (r >= '‪' && r <= '‮') || (r >= '⁦' && r <= '⁩')
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Turn a client away from the full room, leaving the error event to send it in
+// refusal and the close frame's reason in closeCode and closeReason
+func (r *Room) refuseFull(c *Client) {
+	c.refusal = codedError(errCodeRoomFull, r.name+" is full")
+	c.refusal.Room = r.name
+	c.closeCode, c.closeReason = websocket.CloseTryAgainLater, "room is full"
+	connAudit.recordClient(c, connRoomFull, "")
+}
+
+// Put a client at the end of the line for the full room; it stays connected but
+// only hears from the room once admitted. Runs on the room goroutine.
+func (r *Room) enqueue(c *Client) {
+	c.waiting.Store(true)
+	r.waiting = append(r.waiting, c)
+	r.sendTo(c, systemMessage(fmt.Sprintf("%s is full; you are number %d in line and will join when someone leaves", r.name, len(r.waiting))))
+}
+
+// Take a client out of the line, ending its connection, as when it gave up
+// waiting; runs on the room goroutine
+func (r *Room) dequeue(c *Client) {
+	for i, other := range r.waiting {
+		if other == c {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			c.waiting.Store(false)
+			close(c.send)
+			r.tellPlaces(i)
+			return
+		}
+	}
+}
+
+// Tell the clients in line from the given place on where they now stand
+func (r *Room) tellPlaces(from int) {
+	for i := from; i < len(r.waiting); i++ {
+		r.sendTo(r.waiting[i], systemMessage(fmt.Sprintf("You are now number %d in line for %s", i+1, r.name)))
+	}
+}
+
+// Let waiting clients in, first come first served, while the room has space;
+// once the room stops queueing, those still in line are turned away. Runs on
+// the room goroutine.
+func (r *Room) admitWaiting() {
+	admitted := 0
+	for len(r.waiting) > 0 && !r.full(r.waiting[0]) {
+		next := r.waiting[0]
+		r.waiting = r.waiting[1:]
+		next.waiting.Store(false)
+		// Someone may have taken the username while the client waited
+		if !next.presenceOnly && r.connections[next.username] > 0 && !r.claimUsername(next) {
+			close(next.send)
+			continue
+		}
+		r.enter(next)
+		if !next.presenceOnly {
+			users.add(next)
+		}
+		r.sendTo(next, systemMessage("It's your turn, welcome to "+r.name))
+		admitted++
+	}
+	if !r.meta.Queue {
+		for _, c := range r.waiting {
+			c.waiting.Store(false)
+			r.refuseFull(c)
+			select {
+			case c.send <- singleFrame(c.refusal, c.msgpack):
+			default:
+			}
+			close(c.send)
+		}
+		r.waiting = nil
+		return
+	}
+	if admitted > 0 {
+		r.tellPlaces(0)
+	}
+}
@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Room events webhooks can subscribe to
+const (
+	hookMessage = "message"
+	hookJoin    = "join"
+	hookLeave   = "leave"
+)
+
+// Webhook delivery settings
+const (
+	webhookQueueSize = 1024
+	webhookWorkers   = 4
+	webhookAttempts  = 5
+	webhookBackoff   = time.Second // doubled after every failed attempt
+	webhookTimeout   = 10 * time.Second
+)
+
+// webhook is an admin-registered URL receiving a room's events, or every room's
+// when Room is empty
+type webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Room   string   `json:"room,omitempty"`
+	Events []string `json:"events,omitempty"` // all events when empty
+	Secret string   `json:"secret,omitempty"` // HMAC key, only shown when registering
+}
+
+// Report whether the hook wants an event from a room
+func (h *webhook) wants(room, event string) bool {
+	return (h.Room == "" || h.Room == room) && (len(h.Events) == 0 || slices.Contains(h.Events, event))
+}
+
+// webhookEvent is the JSON body posted to a webhook
+type webhookEvent struct {
+	Event   string   `json:"event"`
+	Room    string   `json:"room"`
+	Message *Message `json:"message"`
+}
+
+// webhookDelivery is one event on its way to one hook
+type webhookDelivery struct {
+	hook  *webhook
+	event string
+	body  []byte
+}
+
+// webhookRegistry holds the registered hooks and the queue their deliveries wait in
+type webhookRegistry struct {
+	mu     sync.RWMutex
+	hooks  map[string]*webhook
+	queue  chan webhookDelivery
+	client *http.Client
+	start  sync.Once
+}
+
+// Webhooks registered through the admin API; kept in memory only
+var webhooks = &webhookRegistry{
+	hooks:  make(map[string]*webhook),
+	queue:  make(chan webhookDelivery, webhookQueueSize),
+	client: &http.Client{Timeout: webhookTimeout},
+}
+
+// Register a hook, giving it an ID and a signing secret
+func (w *webhookRegistry) add(hook *webhook) {
+	hook.ID = newSessionID()[:16]
+	hook.Secret = newSessionID()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks[hook.ID] = hook
+	w.start.Do(func() {
+		for range webhookWorkers {
+			go w.work()
+		}
+	})
+}
+
+func (w *webhookRegistry) remove(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.hooks[id]
+	delete(w.hooks, id)
+	return ok
+}
+
+// List the hooks without their secrets
+func (w *webhookRegistry) list() []webhook {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	hooks := make([]webhook, 0, len(w.hooks))
+	for _, hook := range w.hooks {
+		listed := *hook
+		listed.Secret = ""
+		hooks = append(hooks, listed)
+	}
+	slices.SortFunc(hooks, func(a, b webhook) int { return strings.Compare(a.ID, b.ID) })
+	return hooks
+}
+
+// Queue an event for every hook that wants it, dropping it for hooks whose
+// deliveries can't keep up; called from room goroutines, so it never blocks
+func (w *webhookRegistry) dispatch(room, event string, m *Message) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	var body []byte
+	for _, hook := range w.hooks {
+		if !hook.wants(room, event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(webhookEvent{Event: event, Room: room, Message: m}); err != nil {
+				slog.Error("Webhook encode error", "room", room, "err", err)
+				return
+			}
+		}
+		select {
+		case w.queue <- webhookDelivery{hook: hook, event: event, body: body}:
+		default:
+			slog.Warn("Webhook queue full, dropping event", "webhook", hook.ID, "room", room, "event", event)
+		}
+	}
+}
+
+// Deliver queued events until the process exits
+func (w *webhookRegistry) work() {
+	for d := range w.queue {
+		w.deliver(d)
+	}
+}
+
+// Post an event to its hook, retrying with exponential backoff on network errors,
+// 429 and 5xx responses
+func (w *webhookRegistry) deliver(d webhookDelivery) {
+	mac := hmac.New(sha256.New, []byte(d.hook.Secret))
+	mac.Write(d.body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(d, signature)
+		if err == nil {
+			return
+		}
+		var retry retryableError
+		if !errors.As(err, &retry) || attempt == webhookAttempts {
+			slog.Warn("Webhook delivery failed", "webhook", d.hook.ID, "event", d.event, "attempts", attempt, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryableError marks a delivery failure worth trying again
+type retryableError struct{ error }
+
+func (w *webhookRegistry) post(d webhookDelivery, signature string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Event", d.event)
+	req.Header.Set("X-Chat-Signature", signature)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryableError{fmt.Errorf("webhook answered %s", resp.Status)}
+	default:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
+
+// HTTP handler registering a webhook from {"url": "...", "room": "...", "events": [...]};
+// the response carries the secret its deliveries are signed with. Admin only.
+func serveAddWebhook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var hook webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "The url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	for _, event := range hook.Events {
+		if event != hookMessage && event != hookJoin && event != hookLeave {
+			http.Error(w, "Unknown event "+event, http.StatusBadRequest)
+			return
+		}
+	}
+	webhooks.add(&hook)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// HTTP handler listing the registered webhooks; admin only
+func serveWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks.list())
+}
+
+// HTTP handler removing a webhook; admin only
+func serveDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !webhooks.remove(r.PathValue("id")) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,420 @@
+// Package client connects to a chat server over its WebSocket protocol, for
+// bots and tests. Dial a room and send and receive envelopes:
+//
+//	c, err := client.Dial("ws://localhost:8080/ws?room=general&username=bot", token)
+//	c.Handle(client.TypeChat, func(m *client.Message) { ... })
+//	c.Send(&client.Message{Type: client.TypeChat, Body: "hi"})
+//
+// Dropped connections are dialed again with backoff, resuming the session and
+// asking for the messages missed meanwhile with last_seen_id. Join adds more
+// rooms to the connection, joined again after reconnecting.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"chat-app/internal/msgpack"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reconnection backoff, doubled after every failed attempt
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Subprotocol of MessagePack envelopes, asked for by WithMsgpack
+const protocolMsgpack = "chat-msgpack"
+
+// Envelopes waiting for Receive; the oldest is dropped when nobody reads them
+const receiveQueue = 256
+
+// Time allowed for writing an envelope
+const writeTimeout = 10 * time.Second
+
+var (
+	// ErrClosed is returned once the client was closed
+	ErrClosed = errors.New("client closed")
+	// ErrDisconnected is returned by Send while the client is reconnecting
+	ErrDisconnected = errors.New("not connected")
+)
+
+// HandshakeError is a server refusing the connection, such as for a bad token
+type HandshakeError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("server refused the connection: %d %s", e.StatusCode, e.Body)
+}
+
+// Option changes how a client connects
+type Option func(*Client)
+
+// WithHeader adds headers to every handshake
+func WithHeader(header http.Header) Option {
+	return func(c *Client) {
+		for key, values := range header {
+			c.header[key] = append(c.header[key], values...)
+		}
+	}
+}
+
+// WithHandler handles envelopes of a type from the first one on; see Handle
+func WithHandler(typ string, fn func(*Message)) Option {
+	return func(c *Client) { c.handlers[typ] = append(c.handlers[typ], fn) }
+}
+
+// WithMsgpack asks the server to send and take envelopes as MessagePack, which
+// is smaller and cheaper to decode than JSON; servers that don't speak it keep
+// to JSON
+func WithMsgpack() Option {
+	return func(c *Client) { c.dialer.Subprotocols = []string{protocolMsgpack} }
+}
+
+// WithoutReconnect stops the client when its connection drops instead of dialing again
+func WithoutReconnect() Option {
+	return func(c *Client) { c.reconnect = false }
+}
+
+// OnConnect is called after every successful handshake, reconnections included
+func OnConnect(fn func()) Option {
+	return func(c *Client) { c.onConnect = fn }
+}
+
+// OnDisconnect is called with the error that ended each connection
+func OnDisconnect(fn func(error)) Option {
+	return func(c *Client) { c.onDisconnect = fn }
+}
+
+// Client is a connection to a chat room that dials again when it drops
+type Client struct {
+	url          *url.URL
+	room         string // the room dialed
+	header       http.Header
+	dialer       *websocket.Dialer
+	reconnect    bool
+	onConnect    func()
+	onDisconnect func(error)
+
+	mu       sync.Mutex
+	conn     *websocket.Conn     // nil while reconnecting
+	sessions map[string]string   // session IDs to resume, from the server's session events, by room
+	lastSeen map[string]uint64   // ID of the latest message received, by room
+	joins    map[string]*Message // rooms joined with Join, joined again after reconnecting
+	handlers map[string][]func(*Message)
+
+	incoming  chan *Message
+	done      chan struct{} // closed once the client has stopped
+	closeOnce sync.Once
+	err       error // why the client stopped
+}
+
+// Dial connects to a room at a URL such as ws://host/ws?room=x&username=y,
+// sending token, if any, as a bearer token. It fails if the first handshake
+// does; later disconnections are retried in the background.
+func Dial(rawURL, token string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		url:       u,
+		room:      u.Query().Get("room"),
+		sessions:  make(map[string]string),
+		lastSeen:  make(map[string]uint64),
+		joins:     make(map[string]*Message),
+		header:    http.Header{},
+		dialer:    &websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+		reconnect: true,
+		handlers:  make(map[string][]func(*Message)),
+		incoming:  make(chan *Message, receiveQueue),
+		done:      make(chan struct{}),
+	}
+	if token != "" {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(conn)
+	return c, nil
+}
+
+// Handle calls fn from the client's reading goroutine for every envelope of the
+// type, or of every type when typ is empty, instead of queueing them for Receive
+func (c *Client) Handle(typ string, fn func(*Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[typ] = append(c.handlers[typ], fn)
+}
+
+// Send writes an envelope, failing with ErrDisconnected while reconnecting
+func (c *Client) Send(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if c.conn == nil {
+		return ErrDisconnected
+	}
+	messageType, encode := websocket.TextMessage, json.Marshal
+	if c.conn.Subprotocol() == protocolMsgpack {
+		messageType, encode = websocket.BinaryMessage, msgpack.Marshal
+	}
+	data, err := encode(m)
+	if err != nil {
+		return err
+	}
+	switch m.Type {
+	case TypeSubscribe:
+		join := *m
+		c.joins[m.Room] = &join
+	case TypeUnsubscribe:
+		delete(c.joins, m.Room)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// Say sends a chat message to the room dialed
+func (c *Client) Say(body string) error {
+	return c.Send(&Message{Type: TypeChat, Room: c.room, Body: body})
+}
+
+// Join adds a room to the connection; its messages then carry its name in
+// Room, and messages sent to it have to. Send a TypeSubscribe envelope with
+// Password or Invite for protected rooms.
+func (c *Client) Join(room string) error {
+	return c.Send(&Message{Type: TypeSubscribe, Room: room})
+}
+
+// Leave leaves a room joined with Join
+func (c *Client) Leave(room string) error {
+	return c.Send(&Message{Type: TypeUnsubscribe, Room: room})
+}
+
+// Receive waits for the next envelope no handler took. Once the client has
+// stopped it returns the queued envelopes, then why it stopped.
+func (c *Client) Receive(ctx context.Context) (*Message, error) {
+	select {
+	case m := <-c.incoming:
+		return m, nil
+	default:
+	}
+	select {
+	case m := <-c.incoming:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		select {
+		case m := <-c.incoming:
+			return m, nil
+		default:
+			return nil, c.err
+		}
+	}
+}
+
+// Done is closed once the client has stopped, after Close or a connection it won't retry
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err reports why the client stopped, nil while it runs
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close leaves the room and stops reconnecting
+func (c *Client) Close() error {
+	c.stop(ErrClosed)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
+// Stop the client for good with the reason Receive and Err report
+func (c *Client) stop(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Dial the room, resuming the previous session and its missed messages, and
+// join the rooms joined before again
+func (c *Client) connect() (*websocket.Conn, error) {
+	u := *c.url
+	query := u.Query()
+	c.mu.Lock()
+	if session := c.sessions[c.room]; session != "" {
+		query.Set("session", session)
+	}
+	if lastSeen := c.lastSeen[c.room]; lastSeen > 0 {
+		query.Set("last_seen_id", strconv.FormatUint(lastSeen, 10))
+	}
+	c.mu.Unlock()
+	u.RawQuery = query.Encode()
+	conn, resp, err := c.dialer.Dial(u.String(), c.header)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return nil, &HandshakeError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	var joins []*Message
+	for room, join := range c.joins {
+		rejoin := *join
+		rejoin.Body, rejoin.ID = c.sessions[room], c.lastSeen[room]
+		joins = append(joins, &rejoin)
+	}
+	c.mu.Unlock()
+	for _, join := range joins {
+		c.Send(join)
+	}
+	if c.onConnect != nil {
+		c.onConnect()
+	}
+	return conn, nil
+}
+
+// Read from connection after connection until the client stops
+func (c *Client) run(conn *websocket.Conn) {
+	backoff := minBackoff
+	for {
+		err := c.read(conn)
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if c.onDisconnect != nil {
+			c.onDisconnect(err)
+		}
+		if !c.reconnect || !retryable(err) {
+			c.stop(err)
+			return
+		}
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+			if conn, err = c.connect(); err == nil {
+				backoff = minBackoff
+				break
+			}
+			if !retryable(err) {
+				c.stop(err)
+				return
+			}
+		}
+	}
+}
+
+// Read envelopes until the connection fails
+func (c *Client) read(conn *websocket.Conn) error {
+	packed := conn.Subprotocol() == protocolMsgpack
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var m Message
+		if packed && messageType == websocket.BinaryMessage {
+			err = msgpack.Unmarshal(data, &m)
+		} else {
+			err = json.Unmarshal(data, &m)
+		}
+		if err != nil {
+			continue
+		}
+		c.dispatch(&m)
+	}
+}
+
+// Remember what resuming needs, then hand the envelope to its handlers or queue it
+func (c *Client) dispatch(m *Message) {
+	c.mu.Lock()
+	switch m.Type {
+	case TypeSession:
+		c.sessions[m.Room] = m.Body
+	case TypeChat, TypePollCreate:
+		c.lastSeen[m.Room] = max(c.lastSeen[m.Room], m.ID)
+	case TypeUnsubscribe:
+		delete(c.joins, m.Room)
+	}
+	handlers := slices.Concat(c.handlers[m.Type], c.handlers[""])
+	c.mu.Unlock()
+	if len(handlers) > 0 {
+		for _, fn := range handlers {
+			fn(m)
+		}
+		return
+	}
+	for {
+		select {
+		case c.incoming <- m:
+			return
+		default:
+		}
+		select {
+		case <-c.incoming:
+		default:
+		}
+	}
+}
+
+// Report whether a connection that ended with err is worth dialing again; the
+// server closing normally or for a policy violation, as when kicked, banned or
+// the username is taken, and handshakes refused with 4xx other than 429 are final
+func retryable(err error) bool {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.ClosePolicyViolation) {
+		return false
+	}
+	var handshake *HandshakeError
+	if errors.As(err, &handshake) {
+		return handshake.StatusCode == http.StatusTooManyRequests || handshake.StatusCode >= 500
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package client
+
+import "encoding/json"
+
+// Envelope types, as in the server's protocol
+const (
+	TypeChat           = "chat"
+	TypeDM             = "dm"
+	TypeJoin           = "user_joined"
+	TypeLeave          = "user_left"
+	TypeMembers        = "members"
+	TypeSystem         = "system"
+	TypeError          = "error"
+	TypeSession        = "session"
+	TypeThrottle       = "throttle"
+	TypeTyping         = "typing_start"
+	TypeStopped        = "typing_stop"
+	TypeAck            = "ack"
+	TypeAttachment     = "attachment"
+	TypeMention        = "mention"
+	TypeEdit           = "edit"
+	TypeDelete         = "delete"
+	TypeSlow           = "connection_slow"
+	TypeReactionAdd    = "reaction_add"
+	TypeReactionRemove = "reaction_remove"
+	TypeRead           = "read"
+	TypeUnread         = "unread"
+	TypeWarning        = "warning"
+	TypeRoomUpdate     = "room_update"
+	TypeTruncated      = "history_truncated"
+	TypeThread         = "thread"
+	TypePinned         = "message_pinned"
+	TypeUnpinned       = "message_unpinned"
+	TypeScheduled      = "scheduled"
+	TypePollCreate     = "poll_create"
+	TypePollVote       = "poll_vote"
+	TypePollResults    = "poll_results"
+	TypeLinkPreview    = "link_preview"
+	TypeStatus         = "status_set"
+	TypeActivity       = "activity"
+	TypeSubscribe      = "join"  // joins Room over the same connection
+	TypeUnsubscribe    = "leave" // leaves Room, or tells the client it is no longer in Room
+)
+
+// Message is the JSON envelope of everything sent over the WebSocket, e.g.
+// {"type":"chat","room":"x","sender":"bob","body":"hi","ts":1700000000000}
+type Message struct {
+	Type        string          `json:"type"`
+	ID          uint64          `json:"id,omitempty"`
+	Room        string          `json:"room,omitempty"`
+	Sender      string          `json:"sender,omitempty"`
+	To          string          `json:"to,omitempty"` // recipient of a direct message
+	Body        string          `json:"body,omitempty"`
+	Data        []byte          `json:"data,omitempty"`   // binary payload, base64 in JSON
+	Number      int             `json:"number,omitempty"` // room-local display number
+	Members     []string        `json:"members,omitempty"`
+	TS          int64           `json:"ts,omitempty"`     // unix milliseconds
+	Replay      bool            `json:"replay,omitempty"` // sent again from history on joining
+	Ref         string          `json:"ref,omitempty"`    // client-chosen reference, echoed in the ack
+	Attachment  *Attachment     `json:"attachment,omitempty"`
+	Emoji       string          `json:"emoji,omitempty"`
+	Reactions   map[string]int  `json:"reactions,omitempty"`
+	Unread      map[string]int  `json:"unread,omitempty"`
+	Bot         bool            `json:"bot,omitempty"`
+	Action      bool            `json:"action,omitempty"`
+	Code        string          `json:"code,omitempty"` // machine-readable reason of an error
+	Meta        json.RawMessage `json:"meta,omitempty"` // the room's topic, description and settings
+	Offline     bool            `json:"offline,omitempty"`
+	Signal      json.RawMessage `json:"signal,omitempty"` // WebRTC session description or ICE candidate
+	Trace       string          `json:"trace,omitempty"`
+	DisplayName string          `json:"display_name,omitempty"`
+	Avatar      string          `json:"avatar,omitempty"`
+	ParentID    uint64          `json:"parent_id,omitempty"`
+	Replies     []*Message      `json:"replies,omitempty"`
+	Pinned      []uint64        `json:"pinned,omitempty"`
+	SendAt      int64           `json:"send_at,omitempty"`
+	Poll        *Poll           `json:"poll,omitempty"`
+	Option      *int            `json:"option,omitempty"`
+	Preview     *LinkPreview    `json:"preview,omitempty"`
+	Status      string          `json:"status,omitempty"`      // online, away or busy
+	Statuses    StatusList      `json:"statuses,omitempty"`    // members who aren't plainly online
+	RetryAfter  int64           `json:"retry_after,omitempty"` // milliseconds until a slowed sender may post again
+	Password    string          `json:"password,omitempty"`    // of a protected room to join
+	Invite      string          `json:"invite,omitempty"`      // of an invite-only room to join
+}
+
+// Attachment describes an uploaded file
+type Attachment struct {
+	URL         string `json:"url"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// Poll is a question the room votes on, with its tally in events
+type Poll struct {
+	Question  string     `json:"question"`
+	Options   []string   `json:"options"`
+	Anonymous bool       `json:"anonymous,omitempty"`
+	ClosesAt  int64      `json:"closes_at,omitempty"` // unix milliseconds
+	Closed    bool       `json:"closed,omitempty"`
+	Counts    []int      `json:"counts,omitempty"`
+	Voters    [][]string `json:"voters,omitempty"`
+}
+
+// LinkPreview describes the page behind the first link of a chat message
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// UserStatus is a member's status in a roster
+type UserStatus struct {
+	Status string `json:"status"`
+	Text   string `json:"text,omitempty"`
+}
+
+// StatusList maps usernames to their status
+type StatusList map[string]UserStatus
@@ -0,0 +1,203 @@
+// Command chat-cli is a terminal client for the chat server: it joins a room
+// and reads lines to send from the terminal, printing what the room says.
+//
+//	chat-cli -server ws://localhost:8080 -username alice -room general
+//
+// Lines are sent to the room as chat messages, so server commands such as
+// /nick work as in the browser. The client itself handles /join <room> to
+// switch rooms, /dm <user> <text> for direct messages, /help and /quit.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-app/client"
+	"chat-app/internal/env"
+)
+
+// Prompt shown while waiting for a line
+const prompt = "> "
+
+// session is the connection to the current room, replaced when switching rooms
+type session struct {
+	server, username, token string
+
+	mu   sync.Mutex // serializes output and room switches
+	room string
+	conn *client.Client
+}
+
+func main() {
+	server := flag.String("server", env.String("CHAT_SERVER", "ws://localhost:8080"), "server URL, ws:// or wss://")
+	username := flag.String("username", os.Getenv("USER"), "username to chat as")
+	room := flag.String("room", "general", "room to join first")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "login token, when the server needs one")
+	flag.Parse()
+
+	s := &session{server: strings.TrimSuffix(*server, "/"), username: *username, token: *token}
+	if err := s.join(*room); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not join:", err)
+		os.Exit(1)
+	}
+	s.printf("Joined %s as %s; /help lists the commands", *room, *username)
+
+	lines := bufio.NewScanner(os.Stdin)
+	for fmt.Print(prompt); lines.Scan(); fmt.Print(prompt) {
+		if !s.run(strings.TrimSpace(lines.Text())) {
+			break
+		}
+	}
+	s.current().Close()
+}
+
+// Connect to a room, leaving the current one once the new one answered
+func (s *session) join(room string) error {
+	query := url.Values{"room": {room}, "username": {s.username}}
+	conn, err := client.Dial(s.server+"/ws?"+query.Encode(), s.token,
+		client.WithHandler("", func(m *client.Message) { s.show(m) }),
+		client.OnDisconnect(func(err error) { s.printf("Disconnected: %v", err) }),
+	)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	previous := s.conn
+	s.room, s.conn = room, conn
+	s.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	go func() {
+		<-conn.Done()
+		if err := conn.Err(); err != client.ErrClosed {
+			s.printf("Left %s: %v", room, err)
+		}
+	}()
+	return nil
+}
+
+// Handle a line typed by the user, reporting false to quit
+func (s *session) run(line string) bool {
+	command, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	var err error
+	switch {
+	case line == "":
+	case command == "/quit":
+		return false
+	case command == "/help":
+		// The server lists its own commands after these
+		s.printf("/join <room> switches rooms, /dm <user> <text> sends a direct message and /quit leaves")
+		err = s.send(&client.Message{Type: client.TypeChat, Body: "/help"})
+	case command == "/join":
+		if rest == "" {
+			s.printf("Usage: /join <room>")
+			break
+		}
+		if err = s.join(rest); err == nil {
+			s.printf("Joined %s", rest)
+		}
+	case command == "/dm":
+		to, body, _ := strings.Cut(rest, " ")
+		if to == "" || strings.TrimSpace(body) == "" {
+			s.printf("Usage: /dm <user> <text>")
+			break
+		}
+		err = s.send(&client.Message{Type: client.TypeDM, To: to, Body: strings.TrimSpace(body)})
+	default:
+		err = s.send(&client.Message{Type: client.TypeChat, Body: line})
+	}
+	if err != nil {
+		s.printf("Error: %v", err)
+	}
+	return true
+}
+
+// Send an envelope to the current room
+func (s *session) send(m *client.Message) error {
+	return s.current().Send(m)
+}
+
+// Get the connection to the current room
+func (s *session) current() *client.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Print an envelope from the server, skipping those only other clients need
+func (s *session) show(m *client.Message) {
+	var line string
+	at := time.UnixMilli(m.TS).Format("15:04")
+	switch m.Type {
+	case client.TypeChat:
+		line = fmt.Sprintf("%s %s: %s", at, m.Sender, m.Body)
+		if m.Action {
+			line = fmt.Sprintf("%s * %s %s", at, m.Sender, m.Body)
+		}
+	case client.TypeAttachment:
+		line = fmt.Sprintf("%s %s shared %s: %s", at, m.Sender, m.Attachment.Name, m.Attachment.URL)
+	case client.TypeDM:
+		line = fmt.Sprintf("%s [dm] %s → %s: %s", at, m.Sender, m.To, m.Body)
+	case client.TypeMention:
+		if m.Room == s.currentRoom() {
+			return // shown as the chat message itself
+		}
+		line = fmt.Sprintf("%s [%s] %s mentioned you: %s", at, m.Room, m.Sender, m.Body)
+	case client.TypeJoin:
+		line = m.Sender + " joined"
+	case client.TypeLeave:
+		line = m.Sender + " left"
+	case client.TypeMembers:
+		members := make([]string, len(m.Members))
+		for i, name := range m.Members {
+			members[i] = name
+			if status, ok := m.Statuses[name]; ok {
+				members[i] += " (" + status.Status + ")"
+			}
+		}
+		line = "In the room: " + strings.Join(members, ", ")
+	case client.TypeStatus:
+		line = m.Sender + " is now " + m.Status
+		if m.Body != "" {
+			line += ": " + m.Body
+		}
+	case client.TypeSystem, client.TypeWarning, client.TypeTruncated:
+		line = m.Body
+	case client.TypeError:
+		line = "Error: " + m.Body
+	case client.TypeEdit:
+		line = fmt.Sprintf("%s %s edited [%d]: %s", at, m.Sender, m.ID, m.Body)
+	case client.TypeDelete:
+		line = fmt.Sprintf("%s %s deleted [%d]", at, m.Sender, m.ID)
+	case client.TypeLinkPreview:
+		line = fmt.Sprintf("  ↳ %s", m.Preview.Title)
+	default:
+		return
+	}
+	if m.Replay {
+		line = "(earlier) " + line
+	}
+	s.printf("%s", line)
+}
+
+// Name the room currently joined
+func (s *session) currentRoom() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.room
+}
+
+// Print a line above the prompt, clearing whatever was typed so far from view
+func (s *session) printf(format string, args ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Printf("\r\033[K"+format+"\n"+prompt, args...)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Latency buckets, each 10% wider than the one before, from 10µs to about a minute
+const (
+	minLatency  = 10 * time.Microsecond
+	growth      = 1.1
+	bucketCount = 165
+)
+
+// histogram counts latencies in logarithmic buckets, so percentiles come within
+// 10% without keeping every sample; safe for concurrent use
+type histogram struct {
+	counts [bucketCount]atomic.Uint64
+	max    atomic.Int64
+}
+
+// Bucket a latency falls in
+func bucketOf(d time.Duration) int {
+	if d <= minLatency {
+		return 0
+	}
+	return min(int(math.Log(float64(d)/float64(minLatency))/math.Log(growth))+1, bucketCount-1)
+}
+
+// Upper bound of a bucket
+func bucketBound(i int) time.Duration {
+	return time.Duration(float64(minLatency) * math.Pow(growth, float64(i)))
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.counts[bucketOf(d)].Add(1)
+	for {
+		max := h.max.Load()
+		if int64(d) <= max || h.max.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Count the latencies recorded
+func (h *histogram) count() uint64 {
+	var total uint64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+	}
+	return total
+}
+
+// Estimate the latency under which a fraction p of those recorded fell, zero without any
+func (h *histogram) percentile(p float64) time.Duration {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p * float64(total)))
+	var seen uint64
+	for i := range h.counts {
+		if seen += h.counts[i].Load(); seen >= target {
+			return min(bucketBound(i), time.Duration(h.max.Load()))
+		}
+	}
+	return time.Duration(h.max.Load())
+}
+
+// Forget what was recorded, to start the next report's interval
+func (h *histogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+	h.max.Store(0)
+}
@@ -0,0 +1,381 @@
+// Command loadgen puts a chat server under load with simulated clients, to
+// check its capacity before a launch. It connects the clients across rooms,
+// has each send chat messages at a steady rate, and reports how long acks and
+// deliveries took and how many messages were lost.
+//
+//	loadgen -server ws://localhost:8080 -clients 2000 -rooms 100 -rate 0.2 -duration 2m
+//
+// With -soak it runs until interrupted, reporting every -interval, so slow
+// leaks and latency creep show over hours. With -admin-token each report adds
+// the server's goroutines and heap from /admin/debug. The server's rate limits
+// and MAX_CONNECTIONS_PER_IP apply to the simulated clients as to any other, so
+// raise them on the server under test.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chat-app/client"
+	"chat-app/internal/env"
+)
+
+// config is what the flags ask for
+type config struct {
+	server     string
+	clients    int
+	rooms      int
+	rate       float64 // chat messages per second per client
+	size       int     // bytes of each message's body
+	ramp       time.Duration
+	duration   time.Duration
+	soak       bool
+	interval   time.Duration
+	timeout    time.Duration // how long a message may wait for its ack before it counts as lost
+	prefix     string
+	adminToken string
+}
+
+// counters are the running totals of a load test
+type counters struct {
+	connected    atomic.Int64
+	dialFailures atomic.Int64
+	disconnects  atomic.Int64
+	sent         atomic.Int64
+	sendFailures atomic.Int64
+	acked        atomic.Int64
+	lost         atomic.Int64 // sent but not acked within the timeout
+	delivered    atomic.Int64
+	expected     atomic.Int64 // deliveries the acked messages should have made to the other simulated clients
+	throttled    atomic.Int64
+	errors       atomic.Int64
+	slow         atomic.Int64
+}
+
+// test is a running load test
+type test struct {
+	config
+	counters
+	ack, delivery           histogram // since the last report
+	totalAck, totalDelivery histogram // since the start
+	members                 map[string]*atomic.Int64
+	mu                      sync.Mutex
+	sims                    []*simClient // those connected
+}
+
+// simClient is one simulated user, chatting in one room
+type simClient struct {
+	t       *test
+	name    string
+	room    string
+	conn    *client.Client
+	mu      sync.Mutex
+	seq     int
+	pending map[string]time.Time // refs of the messages sent waiting for their ack
+}
+
+func main() {
+	var c config
+	flag.StringVar(&c.server, "server", env.String("CHAT_SERVER", "ws://localhost:8080"), "server URL, ws:// or wss://")
+	flag.IntVar(&c.clients, "clients", 100, "simulated clients")
+	flag.IntVar(&c.rooms, "rooms", 10, "rooms to spread the clients across")
+	flag.Float64Var(&c.rate, "rate", 1, "chat messages per second each client sends")
+	flag.IntVar(&c.size, "size", 64, "bytes of each message's body")
+	flag.DurationVar(&c.ramp, "ramp", 10*time.Second, "time taken to connect every client")
+	flag.DurationVar(&c.duration, "duration", time.Minute, "how long to keep sending after the ramp")
+	flag.BoolVar(&c.soak, "soak", false, "send until interrupted, ignoring -duration")
+	flag.DurationVar(&c.interval, "interval", 10*time.Second, "time between reports")
+	flag.DurationVar(&c.timeout, "timeout", 5*time.Second, "time a message may wait for its ack before it counts as lost")
+	flag.StringVar(&c.prefix, "prefix", "loadgen", "prefix of the simulated usernames and rooms")
+	flag.StringVar(&c.adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "admin token to report the server's runtime stats with")
+	flag.Parse()
+	if c.clients < 1 || c.rooms < 1 || c.rate <= 0 || c.size < 24 {
+		fmt.Fprintln(os.Stderr, "loadgen needs at least one client and room, a positive rate and a size of 24 bytes or more")
+		os.Exit(2)
+	}
+	c.server = strings.TrimSuffix(c.server, "/")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	t := &test{config: c, members: make(map[string]*atomic.Int64)}
+	for i := range c.rooms {
+		t.members[t.roomName(i)] = new(atomic.Int64)
+	}
+	fmt.Printf("Connecting %d clients to %d rooms over %s, each sending %g messages/s\n", c.clients, c.rooms, c.ramp, c.rate)
+	t.run(ctx)
+}
+
+// Name the room of the given number
+func (t *test) roomName(i int) string {
+	return fmt.Sprintf("%s-%d", t.prefix, i)
+}
+
+// Connect the clients, let them chat until the test is over, then wait for the
+// last acks and print the totals
+func (t *test) run(ctx context.Context) {
+	if !t.soak {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.ramp+t.duration)
+		defer cancel()
+	}
+	start := time.Now()
+	var senders sync.WaitGroup
+	go t.report(ctx, start)
+ramp:
+	for i := range t.clients {
+		select {
+		case <-ctx.Done():
+			break ramp
+		case <-time.After(t.ramp / time.Duration(t.clients)):
+		}
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			t.simulate(ctx, i)
+		}()
+	}
+	<-ctx.Done()
+	senders.Wait()
+	// Messages still in flight get the timeout to be acked
+	time.Sleep(t.timeout)
+	t.expirePending(time.Now())
+	t.summarize(time.Since(start))
+	for _, c := range t.simulated() {
+		c.conn.Close()
+	}
+}
+
+// Connect a client and send messages until the test is over
+func (t *test) simulate(ctx context.Context, i int) {
+	c := &simClient{t: t, name: fmt.Sprintf("%s-%d", t.prefix, i), room: t.roomName(i % t.rooms), pending: make(map[string]time.Time)}
+	query := url.Values{"room": {c.room}, "username": {c.name}}
+	members := t.members[c.room]
+	conn, err := client.Dial(t.server+"/ws?"+query.Encode(), "",
+		client.WithHandler("", c.handle),
+		client.OnConnect(func() { t.connected.Add(1); members.Add(1) }),
+		client.OnDisconnect(func(error) { t.connected.Add(-1); members.Add(-1); t.disconnects.Add(1) }),
+	)
+	if err != nil {
+		if t.dialFailures.Add(1) == 1 {
+			fmt.Fprintln(os.Stderr, "Could not connect:", err)
+		}
+		return
+	}
+	c.conn = conn
+	t.mu.Lock()
+	t.sims = append(t.sims, c)
+	t.mu.Unlock()
+
+	// Spread the clients' messages over the period rather than sending in step
+	period := time.Duration(float64(time.Second) / t.rate)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(rand.N(period)):
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		c.send()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send a chat message whose body starts with when it was sent, for receivers
+// to time its delivery
+func (c *simClient) send() {
+	now := time.Now()
+	body := strconv.FormatInt(now.UnixNano(), 10) + " "
+	body += strings.Repeat("x", max(c.t.size-len(body), 0))
+	c.mu.Lock()
+	c.seq++
+	ref := strconv.Itoa(c.seq)
+	c.pending[ref] = now
+	c.mu.Unlock()
+	if err := c.conn.Send(&client.Message{Type: client.TypeChat, Body: body, Ref: ref}); err != nil {
+		c.mu.Lock()
+		delete(c.pending, ref)
+		c.mu.Unlock()
+		c.t.sendFailures.Add(1)
+		return
+	}
+	c.t.sent.Add(1)
+}
+
+// Time acks and deliveries and count what the server refused
+func (c *simClient) handle(m *client.Message) {
+	t := c.t
+	switch m.Type {
+	case client.TypeAck:
+		c.mu.Lock()
+		sent, ok := c.pending[m.Ref]
+		delete(c.pending, m.Ref)
+		c.mu.Unlock()
+		if !ok {
+			return // lost already, or not ours
+		}
+		latency := time.Since(sent)
+		t.ack.record(latency)
+		t.totalAck.record(latency)
+		t.acked.Add(1)
+		t.expected.Add(max(t.members[c.room].Load()-1, 0))
+	case client.TypeChat:
+		if m.Replay || m.Sender == c.name {
+			return
+		}
+		stamp, _, _ := strings.Cut(m.Body, " ")
+		sent, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			return
+		}
+		latency := time.Since(time.Unix(0, sent))
+		t.delivery.record(latency)
+		t.totalDelivery.record(latency)
+		t.delivered.Add(1)
+	case client.TypeThrottle:
+		t.throttled.Add(1)
+	case client.TypeError:
+		t.errors.Add(1)
+	case client.TypeSlow:
+		t.slow.Add(1)
+	}
+}
+
+// List the clients that connected
+func (t *test) simulated() []*simClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*simClient(nil), t.sims...)
+}
+
+// Count the messages still waiting for their ack since before the timeout as lost
+func (t *test) expirePending(now time.Time) {
+	for _, c := range t.simulated() {
+		c.mu.Lock()
+		for ref, sent := range c.pending {
+			if now.Sub(sent) > t.timeout {
+				delete(c.pending, ref)
+				t.lost.Add(1)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Print a report every interval until the test is over
+func (t *test) report(ctx context.Context, start time.Time) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var lastSent, lastDelivered int64
+	last := start
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.expirePending(now)
+			sent, delivered := t.sent.Load(), t.delivered.Load()
+			elapsed := now.Sub(last).Seconds()
+			fmt.Printf("[%s] clients %d/%d  sent %d (%.0f/s)  delivered %d (%.0f/s)  lost %d  throttled %d  errors %d  disconnects %d\n",
+				now.Sub(start).Round(time.Second), t.connected.Load(), t.clients,
+				sent, float64(sent-lastSent)/elapsed, delivered, float64(delivered-lastDelivered)/elapsed,
+				t.lost.Load(), t.throttled.Load(), t.errors.Load(), t.disconnects.Load())
+			fmt.Printf("  ack %s  delivery %s\n", latencies(&t.ack), latencies(&t.delivery))
+			t.ack.reset()
+			t.delivery.reset()
+			if t.adminToken != "" {
+				t.reportServer(ctx)
+			}
+			lastSent, lastDelivered, last = sent, delivered, now
+		}
+	}
+}
+
+// Describe the percentiles of a histogram
+func latencies(h *histogram) string {
+	if h.count() == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("p50 %s p90 %s p99 %s max %s", round(h.percentile(0.5)), round(h.percentile(0.9)), round(h.percentile(0.99)), round(time.Duration(h.max.Load())))
+}
+
+// Round a latency to what its size makes worth showing
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// serverStats is the part of GET /admin/debug a report shows
+type serverStats struct {
+	Goroutines  int     `json:"goroutines"`
+	HeapAlloc   uint64  `json:"heap_alloc_bytes"`
+	Sys         uint64  `json:"sys_bytes"`
+	GCCycles    uint32  `json:"gc_cycles"`
+	LastGCPause float64 `json:"last_gc_pause_ms"`
+	Rooms       int     `json:"rooms"`
+	Connections int     `json:"connections"`
+}
+
+// Print the server's runtime stats
+func (t *test) reportServer(ctx context.Context) {
+	endpoint := strings.Replace(t.server, "ws", "http", 1) + "/admin/debug"
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		fmt.Println("  server:", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+t.adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("  server:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("  server:", resp.Status)
+		return
+	}
+	var s serverStats
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		fmt.Println("  server:", err)
+		return
+	}
+	fmt.Printf("  server goroutines %d  heap %.1f MiB  sys %.1f MiB  gc %d (last pause %.2fms)  rooms %d  connections %d\n",
+		s.Goroutines, float64(s.HeapAlloc)/(1<<20), float64(s.Sys)/(1<<20), s.GCCycles, s.LastGCPause, s.Rooms, s.Connections)
+}
+
+// Print the totals of the whole test
+func (t *test) summarize(elapsed time.Duration) {
+	sent, acked, delivered, expected := t.sent.Load(), t.acked.Load(), t.delivered.Load(), t.expected.Load()
+	fmt.Printf("\nRan %s with %d of %d clients connected (%d failed to connect, %d disconnections)\n",
+		elapsed.Round(time.Second), t.connected.Load(), t.clients, t.dialFailures.Load(), t.disconnects.Load())
+	fmt.Printf("Sent %d messages (%.0f/s), %d failed to send, %d acked, %d lost\n",
+		sent, float64(sent)/elapsed.Seconds(), t.sendFailures.Load(), acked, t.lost.Load())
+	fmt.Printf("Delivered %d of the %d expected (%d missing)\n", delivered, expected, max(expected-delivered, 0))
+	fmt.Printf("Throttled %d, errors %d, slow connection warnings %d\n", t.throttled.Load(), t.errors.Load(), t.slow.Load())
+	fmt.Printf("Ack latency      %s\n", latencies(&t.totalAck))
+	fmt.Printf("Delivery latency %s\n", latencies(&t.totalDelivery))
+}
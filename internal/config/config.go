@@ -0,0 +1,275 @@
+// Package config loads settings from a YAML file, the environment and command
+// line flags, in increasing order of precedence. Every setting ends up in its
+// environment variable, where the rest of the server reads it.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of setting values, checked at startup
+const (
+	kindString = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindDuration
+	kindList // a YAML list or a comma separated string
+	kindPort
+)
+
+// setting maps a key of the config file to its environment variable and flag
+type setting struct {
+	key     string // dotted path in the config file
+	env     string
+	flag    string // derived from env when empty, e.g. SEND_BUFFER -> send-buffer
+	kind    int
+	min     float64  // smallest accepted number
+	options []string // accepted values, any when empty
+	prefix  []string // accepted value prefixes, any when empty
+	usage   string
+}
+
+func (s setting) flagName() string {
+	if s.flag != "" {
+		return s.flag
+	}
+	return strings.ReplaceAll(strings.ToLower(s.env), "_", "-")
+}
+
+// The configurable settings; anything else can still be set in the environment
+var settings = []setting{
+	{key: "listen.host", env: "HOST", usage: "address to listen on, all interfaces when empty"},
+	{key: "listen.port", env: "PORT", kind: kindPort, usage: "port to listen on (default 8080, or 443 with -autocert)"},
+	{key: "listen.tls_cert", env: "TLS_CERT", flag: "cert", usage: "TLS certificate file; serve HTTPS with -key"},
+	{key: "listen.tls_key", env: "TLS_KEY", flag: "key", usage: "TLS private key file"},
+	{key: "listen.autocert", env: "AUTOCERT", kind: kindBool, usage: "get certificates from Let's Encrypt for -domains"},
+	{key: "listen.autocert_domains", env: "AUTOCERT_DOMAINS", flag: "domains", kind: kindList, usage: "comma separated host names to get certificates for"},
+	{key: "listen.autocert_cache", env: "AUTOCERT_CACHE", usage: "directory keeping Let's Encrypt certificates (default certs)"},
+	{key: "listen.http_port", env: "HTTP_PORT", kind: kindPort, usage: "port answering ACME challenges and redirecting to HTTPS with -autocert (default 80)"},
+	{key: "listen.grpc_port", env: "GRPC_PORT", kind: kindPort, usage: "port serving the gRPC API, off when empty"},
+	{key: "listen.shutdown_timeout", env: "SHUTDOWN_TIMEOUT", kind: kindDuration, usage: "how long shutting down waits for connections (default 10s)"},
+
+	{key: "limits.max_message_size", env: "MAX_MESSAGE_SIZE", kind: kindInt, min: 1, usage: "largest chat message in bytes (default 8KB)"},
+	{key: "buffers.send", env: "SEND_BUFFER", kind: kindInt, min: 1, usage: "outgoing messages queued per connection (default 256)"},
+	{key: "buffers.write_timeout", env: "WRITE_TIMEOUT", kind: kindDuration, usage: "how long a single write may take (default 10s)"},
+	{key: "buffers.compression", env: "WS_COMPRESSION", kind: kindBool, usage: "compress WebSocket messages for clients that offer permessage-deflate (default true)"},
+	{key: "buffers.slow_client_policy", env: "SLOW_CLIENT_POLICY", options: []string{"disconnect", "drop-oldest"}, usage: "what to do when a connection's queue is full"},
+
+	{key: "limits.message_rate", env: "MESSAGE_RATE", kind: kindFloat, usage: "messages per second each client may send (default 1)"},
+	{key: "limits.message_burst", env: "MESSAGE_BURST", kind: kindFloat, min: 1, usage: "messages a client may send in a burst (default 5)"},
+	{key: "limits.max_connections_per_ip", env: "MAX_CONNECTIONS_PER_IP", kind: kindInt, usage: "concurrent connections from one address, unlimited when 0"},
+	{key: "limits.idle_timeout", env: "IDLE_TIMEOUT", kind: kindDuration, usage: "disconnect clients silent for this long, never when 0"},
+	{key: "limits.attachment_max_size", env: "ATTACHMENT_MAX_SIZE", kind: kindInt, min: 1, usage: "largest attachment in bytes (default 10MB)"},
+
+	{key: "security.allowed_origins", env: "ALLOWED_ORIGINS", kind: kindList, usage: `origins allowed to connect, or "*"; same origin only by default`},
+	{key: "security.trusted_proxies", env: "TRUSTED_PROXIES", kind: kindList, usage: "IPs and CIDR ranges of reverse proxies whose X-Forwarded-* headers are believed"},
+	{key: "security.banned_ips", env: "BANNED_IPS", kind: kindList, usage: "IPs and CIDR ranges refused a connection"},
+	{key: "security.accounts", env: "ACCOUNTS", kind: kindBool, usage: "require registered accounts with passwords; needs STORAGE_DSN and JWT_SECRET"},
+	{key: "security.oauth_redirect_url", env: "OAUTH_REDIRECT_URL", usage: "public URL of the server, where identity providers send users back"},
+	{key: "security.oauth_github_client_id", env: "OAUTH_GITHUB_CLIENT_ID", usage: "GitHub OAuth app client ID, with OAUTH_GITHUB_CLIENT_SECRET"},
+	{key: "security.oauth_google_client_id", env: "OAUTH_GOOGLE_CLIENT_ID", usage: "Google OAuth client ID, with OAUTH_GOOGLE_CLIENT_SECRET"},
+	{key: "security.oidc_issuer", env: "OIDC_ISSUER", usage: "issuer URL of another OpenID Connect provider, with OIDC_CLIENT_ID and OIDC_CLIENT_SECRET"},
+	{key: "security.oidc_client_id", env: "OIDC_CLIENT_ID", usage: "client ID at OIDC_ISSUER"},
+	{key: "security.strict_query", env: "STRICT_QUERY", kind: kindBool, usage: "refuse joins with unknown query parameters"},
+
+	{key: "storage.dsn", env: "STORAGE_DSN", prefix: []string{"sqlite://", "postgres://", "postgresql://"}, usage: "message store such as sqlite://chat.db, none when empty"},
+	{key: "storage.retention_days", env: "RETENTION_DAYS", kind: kindInt, usage: "days stored messages are kept, forever when 0"},
+	{key: "storage.retention_messages", env: "RETENTION_MESSAGES", kind: kindInt, usage: "latest messages kept per room, all when 0"},
+	{key: "storage.retention_interval", env: "RETENTION_INTERVAL", kind: kindDuration, usage: "how often messages past their retention are pruned (default 1h)"},
+	{key: "storage.attachment_dir", env: "ATTACHMENT_DIR", usage: "directory keeping uploaded attachments"},
+
+	{key: "rooms.idle_timeout", env: "ROOM_IDLE_TIMEOUT", kind: kindDuration, usage: "close public rooms empty for this long (default 10m)"},
+	{key: "rooms.history_replay", env: "HISTORY_REPLAY", kind: kindInt, usage: "latest messages replayed to joining clients (default 50)"},
+	{key: "rooms.history_coalesce", env: "HISTORY_COALESCE", kind: kindDuration, usage: "merge a sender's consecutive messages this close in the history"},
+	{key: "rooms.username_conflict", env: "USERNAME_CONFLICT", options: []string{"reject", "suffix"}, usage: "what to do when a username is already in the room"},
+	{key: "rooms.filters", env: "FILTERS", kind: kindList, usage: "message filters turned on in new rooms: profanity, spam, links"},
+	{key: "rooms.profanity_wordlist", env: "PROFANITY_WORDLIST", usage: "file of words the profanity filter masks, one per line"},
+	{key: "rooms.spam_window", env: "SPAM_WINDOW", kind: kindDuration, usage: "how long the spam filter drops a sender's repeated message (default 30s)"},
+	{key: "rooms.max_links", env: "MAX_LINKS", kind: kindInt, usage: "links the links filter allows in a message (default 3)"},
+	{key: "rooms.offline_queue_max", env: "OFFLINE_QUEUE_MAX", kind: kindInt, usage: "direct messages and mentions queued per offline user, none when 0 (default 100)"},
+	{key: "rooms.offline_queue_ttl", env: "OFFLINE_QUEUE_TTL", kind: kindDuration, usage: "how long queued messages wait for their user (default 168h)"},
+	{key: "rooms.max_pins", env: "MAX_PINS", kind: kindInt, usage: "messages a room may have pinned at once (default 25)"},
+	{key: "rooms.away_after", env: "AWAY_AFTER", kind: kindDuration, usage: "show users who sent nothing for this long as away, never when 0 (default 5m)"},
+	{key: "rooms.link_previews", env: "LINK_PREVIEWS", kind: kindBool, usage: "fetch the first link of chat messages and send the room a link_preview"},
+	{key: "rooms.link_preview_hosts", env: "LINK_PREVIEW_HOSTS", kind: kindList, usage: "hosts link previews may fetch, with their subdomains; any public host when empty"},
+	{key: "rooms.link_preview_timeout", env: "LINK_PREVIEW_TIMEOUT", kind: kindDuration, usage: "how long fetching a link preview may take (default 5s)"},
+	{key: "rooms.multi_device", env: "MULTI_DEVICE", kind: kindBool, usage: "let a user connect several devices at once"},
+
+	{key: "cluster.nodes", env: "CLUSTER_NODES", kind: kindList, usage: "base URLs of every node sharing rooms by consistent hashing"},
+	{key: "cluster.self", env: "CLUSTER_SELF", usage: "this node's URL in -cluster-nodes"},
+
+	{key: "push.vapid_subject", env: "PUSH_VAPID_SUBJECT", usage: "mailto: or https:// contact sent to Web Push services, with PUSH_VAPID_PRIVATE_KEY"},
+	{key: "push.fcm_credentials", env: "FCM_CREDENTIALS", usage: "Firebase service account key file for pushing to apps through FCM"},
+	{key: "push.batch_window", env: "PUSH_BATCH_WINDOW", kind: kindDuration, usage: "how long push notifications are gathered into one (default 10s)"},
+
+	{key: "bridges.rooms", env: "BRIDGES", kind: kindList, usage: "room=URL pairs mirroring rooms to irc://, ircs://, matrix:// or matrix+http:// channels; Matrix needs MATRIX_TOKEN"},
+
+	{key: "logging.level", env: "LOG_LEVEL", options: []string{"debug", "info", "warn", "error"}, usage: "lowest level logged (default info)"},
+	{key: "logging.format", env: "LOG_FORMAT", options: []string{"text", "json"}, usage: "log line format (default text)"},
+	{key: "logging.trace_endpoint", env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP/HTTP collector to send traces to, such as http://localhost:4318; no tracing when empty"},
+}
+
+// flagValue collects a setting given on the command line
+type flagValue struct {
+	setting *setting
+	value   string
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.setting != nil && v.setting.kind == kindBool }
+
+// Load parses the command line flags, reads the config file named by -config or
+// CONFIG_FILE, and sets the environment variable of every setting given in either
+// unless the environment already has it (flags win over the environment). It
+// then checks every setting, joining the errors of all invalid ones.
+func Load(args []string) error {
+	fs := flag.NewFlagSet("chat-app", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	values := make([]*flagValue, len(settings))
+	for i := range settings {
+		values[i] = &flagValue{setting: &settings[i]}
+		fs.Var(values[i], settings[i].flagName(), settings[i].usage+" ($"+settings[i].env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *configFile != "" {
+		file, err := readFile(*configFile)
+		if err != nil {
+			return err
+		}
+		for env, value := range file {
+			if _, set := os.LookupEnv(env); !set {
+				os.Setenv(env, value)
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := f.Value.(*flagValue); ok {
+			os.Setenv(v.setting.env, v.value)
+		}
+	})
+
+	var errs []error
+	for _, s := range settings {
+		if err := s.check(os.Getenv(s.env)); err != nil {
+			errs = append(errs, fmt.Errorf("%s ($%s, -%s): %w", s.key, s.env, s.flagName(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Read a config file into environment variable values, rejecting unknown keys
+func readFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+	var tree map[string]any
+	if err := yaml.NewDecoder(f).Decode(&tree); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	values := make(map[string]string)
+	var errs []error
+	flatten("", tree, func(key string, value any) {
+		i := slices.IndexFunc(settings, func(s setting) bool { return s.key == key })
+		if i < 0 {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %s", path, key))
+			return
+		}
+		values[settings[i].env] = scalar(value)
+	})
+	return values, errors.Join(errs...)
+}
+
+// Walk a decoded YAML tree, calling fn with the dotted key of every leaf
+func flatten(prefix string, tree map[string]any, fn func(key string, value any)) {
+	for name, value := range tree {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		if section, ok := value.(map[string]any); ok {
+			flatten(key, section, fn)
+		} else {
+			fn(key, value)
+		}
+	}
+}
+
+// Turn a YAML value into the string its environment variable holds
+func scalar(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = scalar(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Check a setting's value, which may be empty for the default
+func (s setting) check(value string) error {
+	if value == "" {
+		return nil
+	}
+	var n float64
+	switch s.kind {
+	case kindInt:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		n = float64(i)
+	case kindFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		n = f
+	case kindBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+	case kindDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 30s or 5m", value)
+		}
+		n = d.Seconds()
+	case kindPort:
+		p, err := strconv.Atoi(value)
+		if err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("%q is not a port number", value)
+		}
+	}
+	if n < s.min {
+		return fmt.Errorf("%s is less than %g", value, s.min)
+	}
+	if len(s.options) > 0 && !slices.ContainsFunc(s.options, func(o string) bool { return strings.EqualFold(o, value) }) {
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(s.options, ", "))
+	}
+	if len(s.prefix) > 0 && !slices.ContainsFunc(s.prefix, func(p string) bool { return strings.HasPrefix(value, p) }) {
+		return fmt.Errorf("%q doesn't start with %s", value, strings.Join(s.prefix, " or "))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Package env reads configuration from environment variables.
+package env
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Read a string from the environment, falling back when unset or empty
+func String(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Read an integer from the environment, falling back when unset or invalid
+func Int(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using the default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+// Read a duration such as "90s" from the environment, falling back when unset or invalid
+func Duration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using the default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return d
+}
+
+// Read a float from the environment, falling back when unset or invalid
+func Float(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using the default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return f
+}
+
+// Read a boolean such as "true" or "1" from the environment, falling back when unset or invalid
+func Bool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using the default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return b
+}
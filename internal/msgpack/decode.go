@@ -0,0 +1,526 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+type decoder struct {
+	data      []byte
+	pos       int
+	allocated int // bytes of the slices and maps made so far, up to maxAlloc
+}
+
+// Account for making n elements of size bytes each, failing once the
+// document's allocations would go past maxAlloc
+func (d *decoder) allocate(n int, size uintptr) error {
+	if size > 0 && n > (maxAlloc-d.allocated)/int(size) {
+		return errTooBig
+	}
+	d.allocated += n * int(size)
+	return nil
+}
+
+// Decode the next value into v, as encoding/json would decode its JSON: nil
+// clears pointers, maps, slices and interfaces, unknown fields are skipped and
+// types with their own JSON decoding are handed the JSON of the value
+func (d *decoder) into(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errors.New("msgpack: nested too deeply")
+	}
+	b, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if b == 0xc0 {
+		d.pos++
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.into(v.Elem(), depth)
+	}
+	t := v.Type()
+	if pt := reflect.PointerTo(t); pt.Implements(jsonUnmarshaler) || pt.Implements(textUnmarshaler) {
+		return d.viaJSON(v, depth)
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return d.viaJSON(v, depth)
+		}
+		tree, err := d.value(depth)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(asJSON(tree)))
+	case reflect.String:
+		s, ok, err := d.text()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.mismatch(b, t)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		if b != 0xc2 && b != 0xc3 {
+			return d.mismatch(b, t)
+		}
+		d.pos++
+		v.SetBool(b == 0xc3)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return d.number(v, b)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return d.bytesInto(v, b)
+		}
+		n, ok, err := d.length(b, 0x90, 0x0f, 0xdc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.mismatch(b, t)
+		}
+		// Every element takes a byte at least, so a bogus length can't allocate much
+		if n > len(d.data)-d.pos {
+			return errTruncated
+		}
+		if err := d.allocate(n, t.Elem().Size()); err != nil {
+			return err
+		}
+		items := reflect.MakeSlice(t, n, n)
+		for i := range n {
+			if err := d.into(items.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		v.Set(items)
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return d.viaJSON(v, depth)
+		}
+		n, ok, err := d.length(b, 0x80, 0x0f, 0xde)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.mismatch(b, t)
+		}
+		if n > (len(d.data)-d.pos)/2 {
+			return errTruncated
+		}
+		if v.IsNil() {
+			if err := d.allocate(n, t.Key().Size()+t.Elem().Size()); err != nil {
+				return err
+			}
+			v.Set(reflect.MakeMapWithSize(t, n))
+		}
+		for range n {
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			item := reflect.New(t.Elem()).Elem()
+			if err := d.into(item, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), item)
+		}
+	case reflect.Struct:
+		l := layoutOf(t)
+		if !l.ok {
+			return d.viaJSON(v, depth)
+		}
+		n, ok, err := d.length(b, 0x80, 0x0f, 0xde)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.mismatch(b, t)
+		}
+		for range n {
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			f, known := l.field(key)
+			if !known {
+				if _, err := d.value(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.into(v.Field(f.index), depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return d.viaJSON(v, depth)
+	}
+	return nil
+}
+
+// Decode the next value through its JSON, for the types that choose their own
+// decoding or that into can't lay out; v must be addressable
+func (d *decoder) viaJSON(v reflect.Value, depth int) error {
+	tree, err := d.value(depth)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, v.Addr().Interface())
+}
+
+func (d *decoder) mismatch(b byte, t reflect.Type) error {
+	return fmt.Errorf("msgpack: can't decode format 0x%02x into %s", b, t)
+}
+
+func (d *decoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errTruncated
+	}
+	return d.data[d.pos], nil
+}
+
+// Read the element count of an array or map whose fix format is fix with up to
+// fixMax elements and whose 16-bit format is long, reporting false for other
+// formats without consuming them
+func (d *decoder) length(b, fix, fixMax, long byte) (int, bool, error) {
+	switch {
+	case b&^fixMax == fix:
+		d.pos++
+		return int(b & fixMax), true, nil
+	case b == long || b == long+1:
+		d.pos++
+		n, err := d.size(b - long + 1)
+		return n, true, err
+	}
+	return 0, false, nil
+}
+
+// Read a string, reporting false for other formats without consuming them
+func (d *decoder) text() (string, bool, error) {
+	b, err := d.peek()
+	if err != nil {
+		return "", false, err
+	}
+	n := 0
+	switch {
+	case b&0xe0 == 0xa0:
+		d.pos++
+		n = int(b & 0x1f)
+	case b >= 0xd9 && b <= 0xdb:
+		d.pos++
+		if n, err = d.size(b - 0xd9); err != nil {
+			return "", true, err
+		}
+	default:
+		return "", false, nil
+	}
+	s, err := d.string(n)
+	return s, true, err
+}
+
+// Read the string key of a map entry
+func (d *decoder) key() (string, error) {
+	key, ok, err := d.text()
+	if err == nil && !ok {
+		err = errors.New("msgpack: map keys must be strings")
+	}
+	return key, err
+}
+
+// Decode a number into v, failing if it doesn't fit
+func (d *decoder) number(v reflect.Value, b byte) error {
+	isNumber := b <= 0x7f || b >= 0xe0 || b >= 0xca && b <= 0xd3
+	if !isNumber {
+		return d.mismatch(b, v.Type())
+	}
+	n, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	var f float64
+	switch n := n.(type) {
+	case int64:
+		f = float64(n)
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if !v.OverflowInt(n) {
+				v.SetInt(n)
+				return nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if n >= 0 && !v.OverflowUint(uint64(n)) {
+				v.SetUint(uint64(n))
+				return nil
+			}
+		}
+	case uint64:
+		f = float64(n)
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if n <= math.MaxInt64 && !v.OverflowInt(int64(n)) {
+				v.SetInt(int64(n))
+				return nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if !v.OverflowUint(n) {
+				v.SetUint(n)
+				return nil
+			}
+		}
+	case float64:
+		f = n
+	}
+	if kind := v.Kind(); kind == reflect.Float32 || kind == reflect.Float64 {
+		if !v.OverflowFloat(f) {
+			v.SetFloat(f)
+			return nil
+		}
+	}
+	return fmt.Errorf("msgpack: can't decode number %v into %s", n, v.Type())
+}
+
+// Decode binary data into a byte slice; a string is taken as base64, as JSON has it
+func (d *decoder) bytesInto(v reflect.Value, b byte) error {
+	if b >= 0xc4 && b <= 0xc6 {
+		d.pos++
+		n, err := d.size(b - 0xc4)
+		if err != nil {
+			return err
+		}
+		raw, err := d.take(n)
+		if err != nil {
+			return err
+		}
+		v.SetBytes(bytes.Clone(raw))
+		return nil
+	}
+	s, ok, err := d.text()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return d.mismatch(b, v.Type())
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	v.SetBytes(raw)
+	return nil
+}
+
+// Convert a decoded value to what encoding/json decodes into an interface:
+// numbers become float64 and binary data a base64 string
+func asJSON(tree any) any {
+	switch t := tree.(type) {
+	case int64:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(t)
+	case []any:
+		for i, item := range t {
+			t[i] = asJSON(item)
+		}
+	case map[string]any:
+		for key, item := range t {
+			t[key] = asJSON(item)
+		}
+	}
+	return tree
+}
+
+// Decode the next value, whatever it is: nil, bool, int64, uint64, float64,
+// string, []byte, []any or map[string]any
+func (d *decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return d.string(int(b & 0x1f))
+	case b&0xf0 == 0x90:
+		return d.array(int(b&0x0f), depth)
+	case b&0xf0 == 0x80:
+		return d.object(int(b&0x0f), depth)
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.size(b - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(n)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Clone(raw), nil
+	case 0xca:
+		raw, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+	case 0xcb:
+		raw, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		raw, err := d.take(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return bigEndian(raw), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		raw, err := d.take(1 << (b - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		n := bigEndian(raw)
+		shift := 64 - 8*len(raw)
+		return int64(n<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.size(b - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.string(n)
+	case 0xdc, 0xdd:
+		n, err := d.size(b - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.size(b - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n, depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", b)
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	raw := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return raw, nil
+}
+
+// Read a length of 8 bits with size 0, 16 bits with 1 or 32 bits with 2
+func (d *decoder) size(size byte) (int, error) {
+	raw, err := d.take(1 << size)
+	if err != nil {
+		return 0, err
+	}
+	return int(bigEndian(raw)), nil
+}
+
+func (d *decoder) string(n int) (string, error) {
+	raw, err := d.take(n)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func (d *decoder) array(n, depth int) (any, error) {
+	// Every element takes a byte at least, so a bogus length can't allocate much
+	if n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	if err := d.allocate(n, reflect.TypeFor[any]().Size()); err != nil {
+		return nil, err
+	}
+	items := make([]any, n)
+	for i := range items {
+		item, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (d *decoder) object(n, depth int) (any, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errTruncated
+	}
+	if err := d.allocate(n, reflect.TypeFor[string]().Size()+reflect.TypeFor[any]().Size()); err != nil {
+		return nil, err
+	}
+	object := make(map[string]any, n)
+	for range n {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		if object[name], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return object, nil
+}
+
+func bigEndian(raw []byte) uint64 {
+	var n uint64
+	for _, b := range raw {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
@@ -0,0 +1,277 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) value(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	t := v.Type()
+	if t.Implements(jsonMarshaler) || t.Implements(textMarshaler) {
+		return e.viaJSON(v)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.uint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.float(v.Float())
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.value(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.bytes(v.Bytes())
+			return nil
+		}
+		return e.array(v)
+	case reflect.Array:
+		return e.array(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if t.Key().Kind() != reflect.String {
+			return e.viaJSON(v)
+		}
+		return e.object(v)
+	case reflect.Struct:
+		l := layoutOf(t)
+		if !l.ok {
+			return e.viaJSON(v)
+		}
+		return e.structure(v, l.fields)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", t)
+	}
+	return nil
+}
+
+// Encode what the value's JSON encoding decodes to, for the types that choose
+// their own encoding or that layoutOf can't lay out
+func (e *encoder) viaJSON(v reflect.Value) error {
+	encoded, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(encoded))
+	d.UseNumber()
+	var tree any
+	if err := d.Decode(&tree); err != nil {
+		return err
+	}
+	return e.tree(tree)
+}
+
+// Encode a value decoded from JSON
+func (e *encoder) tree(tree any) error {
+	switch t := tree.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if t {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case string:
+		e.string(t)
+	case json.Number:
+		if n, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+			e.int(n)
+		} else if n, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			e.uint(n)
+		} else if f, err := t.Float64(); err == nil {
+			e.float(f)
+		} else {
+			return err
+		}
+	case []any:
+		e.header(len(t), 0x90, 15, 0xdc)
+		for _, item := range t {
+			if err := e.tree(item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		keys := slices.Sorted(maps.Keys(t))
+		e.header(len(keys), 0x80, 15, 0xde)
+		for _, key := range keys {
+			e.string(key)
+			if err := e.tree(t[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *encoder) int(n int64) {
+	switch {
+	case n >= 0:
+		e.uint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(n))
+	}
+}
+
+func (e *encoder) uint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), n)
+	}
+}
+
+func (e *encoder) float(f float64) {
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(f))
+}
+
+func (e *encoder) string(s string) {
+	if len(s) <= math.MaxUint8 && len(s) > 31 {
+		e.buf = append(e.buf, 0xd9, byte(len(s)))
+	} else {
+		e.header(len(s), 0xa0, 31, 0xda)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xc5), uint16(len(b)))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xc6), uint32(len(b)))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+// Write the header of a string, array or map of n elements: the fix format
+// holding up to fixMax, else the 16-bit one, else the 32-bit one after it
+func (e *encoder) header(n int, fix byte, fixMax int, long byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, long), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, long+1), uint32(n))
+	}
+}
+
+func (e *encoder) array(v reflect.Value) error {
+	e.header(v.Len(), 0x90, 15, 0xdc)
+	for i := range v.Len() {
+		if err := e.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode a map with string keys, sorted as encoding/json sorts them
+func (e *encoder) object(v reflect.Value) error {
+	keys := v.MapKeys()
+	slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+	e.header(len(keys), 0x80, 15, 0xde)
+	for _, key := range keys {
+		e.string(key.String())
+		if err := e.value(v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) structure(v reflect.Value, fields []field) error {
+	present := 0
+	for _, f := range fields {
+		if !f.omitEmpty || !isEmpty(v.Field(f.index)) {
+			present++
+		}
+	}
+	e.header(present, 0x80, 15, 0xde)
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+		e.string(f.name)
+		if err := e.value(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report whether omitempty leaves a value out, as in encoding/json
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+// Package msgpack encodes values as MessagePack, the binary wire format of the
+// chat-msgpack subprotocol. Values are laid out as encoding/json would lay them
+// out, with the same field names and omitempty rules, so a MessagePack envelope
+// is a JSON envelope with smaller numbers and raw bytes instead of base64.
+package msgpack
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Deepest nesting of arrays and maps Unmarshal accepts
+const maxDepth = 1000
+
+// Most memory Unmarshal allocates for the slices and maps of one document. A
+// length can't exceed the bytes left, but an element type bigger than the byte
+// a nil takes would otherwise turn a small document into a huge allocation.
+const maxAlloc = 16 << 20
+
+var (
+	errTruncated = errors.New("msgpack: unexpected end of data")
+	errTooBig    = errors.New("msgpack: document decodes too big")
+)
+
+// Marshal encodes a value as MessagePack. Types with their own JSON encoding,
+// such as json.RawMessage, are encoded as their JSON would decode.
+func Marshal(v any) ([]byte, error) {
+	e := &encoder{buf: make([]byte, 0, 256)}
+	if err := e.value(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Unmarshal decodes MessagePack into the value v points to, as encoding/json
+// would decode the same document; binary data goes into []byte fields as it is
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+	d := &decoder{data: data}
+	if err := d.into(rv.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("msgpack: data after the top-level value")
+	}
+	return nil
+}
+
+// Interfaces of the types that choose their own JSON encoding
+var (
+	jsonMarshaler   = reflect.TypeFor[json.Marshaler]()
+	textMarshaler   = reflect.TypeFor[encoding.TextMarshaler]()
+	jsonUnmarshaler = reflect.TypeFor[json.Unmarshaler]()
+	textUnmarshaler = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// field is a struct field as encoding/json names it
+type field struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+// layout is how a struct type is encoded
+type layout struct {
+	fields []field
+	byName map[string]int // indexes into fields
+	ok     bool           // false for structs left to encoding/json
+}
+
+// Laid out struct types, by reflect.Type
+var layouts sync.Map
+
+// Get the layout of a struct type; not ok for structs with embedded fields or
+// ",string" options, which are left to encoding/json
+func layoutOf(t reflect.Type) *layout {
+	if cached, ok := layouts.Load(t); ok {
+		return cached.(*layout)
+	}
+	l := &layout{byName: make(map[string]int), ok: true}
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		name, options, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		flags := strings.Split(options, ",")
+		if sf.Anonymous || slices.Contains(flags, "string") {
+			l = &layout{}
+			break
+		}
+		if !sf.IsExported() || name == "-" && options == "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		l.byName[name] = len(l.fields)
+		l.fields = append(l.fields, field{index: i, name: name, omitEmpty: slices.Contains(flags, "omitempty")})
+	}
+	layouts.Store(t, l)
+	return l
+}
+
+// Find the field a key decodes into, matching names case-insensitively when
+// none matches exactly, as encoding/json does
+func (l *layout) field(key string) (field, bool) {
+	if i, ok := l.byName[key]; ok {
+		return l.fields[i], true
+	}
+	for _, f := range l.fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
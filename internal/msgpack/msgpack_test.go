@@ -0,0 +1,122 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// envelope is laid out like the chat envelope, with the kinds of field it has
+type envelope struct {
+	Type      string          `json:"type"`
+	ID        uint64          `json:"id,omitempty"`
+	Body      string          `json:"body,omitempty"`
+	Data      []byte          `json:"data,omitempty"`
+	Number    int             `json:"number,omitempty"`
+	Members   []string        `json:"members,omitempty"`
+	Reactions map[string]int  `json:"reactions,omitempty"`
+	Signal    json.RawMessage `json:"signal,omitempty"`
+	Option    *int            `json:"option,omitempty"`
+	Replies   []*envelope     `json:"replies,omitempty"`
+	Score     float64         `json:"score,omitempty"`
+	Offline   bool            `json:"offline,omitempty"`
+	internal  string
+}
+
+func envelopes() []envelope {
+	zero := 0
+	return []envelope{
+		{Type: "chat"},
+		{Type: "chat", ID: 1 << 40, Body: "héllo", Number: -3, Score: 0.25, Offline: true},
+		{Type: "chat", Data: []byte{0, 1, 0xff}, Option: &zero},
+		{Type: "members", Members: []string{"alice", "bob"}, Reactions: map[string]int{"👍": 2, "🎉": 1}},
+		{Type: "call_offer", Signal: json.RawMessage(`{"candidates":[1,2.5,null,true],"sdp":"v=0"}`)},
+		{Type: "thread", Replies: []*envelope{{Type: "chat", Body: "first"}, {Type: "chat", Body: "second", ID: 7}}},
+	}
+}
+
+func TestRoundTripMatchesJSON(t *testing.T) {
+	for _, in := range envelopes() {
+		packed, err := Marshal(in)
+		if err != nil {
+			t.Fatalf("marshal %+v: %v", in, err)
+		}
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromPack, fromJSON envelope
+		if err := Unmarshal(packed, &fromPack); err != nil {
+			t.Fatalf("unmarshal %+v: %v", in, err)
+		}
+		if err := json.Unmarshal(encoded, &fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromPack, fromJSON) {
+			t.Errorf("MessagePack decoded %+v, JSON %+v", fromPack, fromJSON)
+		}
+
+		// Decoded into an interface, the document is the JSON one
+		var treePack, treeJSON any
+		if err := Unmarshal(packed, &treePack); err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(encoded, &treeJSON)
+		if !reflect.DeepEqual(treePack, treeJSON) {
+			t.Errorf("MessagePack decoded %v, JSON %v", treePack, treeJSON)
+		}
+		if len(packed) > len(encoded) {
+			t.Errorf("%+v packs to %d bytes, more than its %d of JSON", in, len(packed), len(encoded))
+		}
+	}
+}
+
+func TestUnmarshalCapsAllocation(t *testing.T) {
+	// A million nils, each decoding into a kilobyte struct
+	type big struct{ Pad [1024]byte }
+	data := []byte{0xdd, 0x00, 0x10, 0x00, 0x00}
+	data = append(data, bytes.Repeat([]byte{0xc0}, 1<<20)...)
+	var v []big
+	if err := Unmarshal(data, &v); err != errTooBig {
+		t.Errorf("decoding a gigabyte of elements returned %v, want %v", err, errTooBig)
+	}
+
+	// The same count of small elements fits
+	var small []bool
+	if err := Unmarshal(data, &small); err != nil || len(small) != 1<<20 {
+		t.Errorf("decoded %d elements with %v, want %d", len(small), err, 1<<20)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, in := range envelopes() {
+		packed, err := Marshal(in)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packed)
+	}
+	f.Add([]byte{0xdc, 0xff, 0xff})
+	f.Add([]byte{0xdf, 0x7f, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var e envelope
+		if err := Unmarshal(data, &e); err == nil {
+			if _, err := Marshal(e); err != nil {
+				t.Errorf("decoded %+v but can't encode it: %v", e, err)
+			}
+		}
+		var tree any
+		if err := Unmarshal(data, &tree); err != nil {
+			return
+		}
+		packed, err := Marshal(tree)
+		if err != nil {
+			t.Fatalf("decoded %v but can't encode it: %v", tree, err)
+		}
+		var again any
+		if err := Unmarshal(packed, &again); err != nil {
+			t.Fatalf("can't decode %v encoded again: %v", tree, err)
+		}
+	})
+}
@@ -1,155 +1,78 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"chat-app/chat"
+	"chat-app/internal/config"
+	"chat-app/internal/env"
 )
 
-// WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true }, // Allow all connections
-}
-
-// Client represents a single chatting user
-type Client struct {
-	conn     *websocket.Conn
-	room     *Room
-	send     chan []byte
-	username string
-}
-
-// Room represents a chat room
-type Room struct {
-	name       string
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
-}
-
-// Create a new chat room
-func newRoom(name string) *Room {
-	return &Room{
-		name:       name,
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-	}
-}
-
-// Run the room to handle broadcasting and clients joining/leaving
-func (r *Room) run() {
-	for {
-		select {
-		case client := <-r.register:
-			r.clients[client] = true
-		case client := <-r.unregister:
-			if _, ok := r.clients[client]; ok {
-				delete(r.clients, client)
-				close(client.send)
-			}
-		case message := <-r.broadcast:
-			for client := range r.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(r.clients, client)
-				}
-			}
-		}
-	}
-}
-
-// ReadPump handles reading messages from the WebSocket
-func (c *Client) readPump() {
-	defer func() {
-		c.room.unregister <- c
-		c.conn.Close()
-	}()
-	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
-			log.Println("Read error:", err)
-			break
-		}
-		// Prepend the username to the message
-		broadcastMessage := []byte(fmt.Sprintf("%s: %s", c.username, message))
-		c.room.broadcast <- broadcastMessage
-	}
-}
-
-// WritePump handles sending messages to the WebSocket
-func (c *Client) writePump() {
-	defer c.conn.Close()
-	for message := range c.send {
-		err := c.conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			log.Println("Write error:", err)
-			break
+func main() {
+	if err := config.Load(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "Configuration error:\n"+err.Error())
 		}
+		os.Exit(2)
 	}
-}
-
-// WebSocket handler
-func serveWs(room *Room, username string, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade error:", err)
-		return
-	}
-	client := &Client{conn: conn, room: room, send: make(chan []byte, 256), username: username}
-	client.room.register <- client
-
-	go client.writePump()
-	go client.readPump()
-}
-
-// Map to store rooms
-var rooms = make(map[string]*Room)
-
-// HTTP handler to join a room
-func joinRoom(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "index.html")
-	roomName := r.URL.Query().Get("room")
-	username := r.URL.Query().Get("username") // Get the username from the query parameters
-	// if roomName == "" || username == "" {
-	// 	http.Error(w, "Room name and username are required", http.StatusBadRequest)
-	// 	return
-	// }
-
-	// If the room doesn't exist, create it
-	room, exists := rooms[roomName]
-	if !exists {
-		room = newRoom(roomName)
-		rooms[roomName] = room
-		go room.run()
-	}
+	chat.ConfigureFromEnv()
+	hub := chat.NewHub(env.Duration("ROOM_IDLE_TIMEOUT", 10*time.Minute))
 
-	// Serve the WebSocket connection with the username
-	serveWs(room, username, w, r)
-}
-
-func main() {
 	// fs := http.FileServer(http.Dir("./static")) // Assuming your CSS is in a "static" directory
 	// http.Handle("/static/", http.StripPrefix("/static/", fs))
-	http.HandleFunc("/", joinRoom)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "index.html")
+	})
+	hub.Routes(http.DefaultServeMux)
 
 	port := os.Getenv("PORT")
 	if port == "" {
-		port = "8080" // Fallback port for local testing
+		port = defaultPort()
 	}
 
-	fmt.Println("Server started on port " + port)
-	err := http.ListenAndServe(":"+port, nil)
+	server := &http.Server{Addr: net.JoinHostPort(os.Getenv("HOST"), port), Handler: chat.CheckOrigins(http.DefaultServeMux)}
+	go func() {
+		slog.Info("Server started", "port", port)
+		err := listen(server)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	grpcServer, err := listenGRPC(hub)
 	if err != nil {
-		log.Fatal("ListenAndServe error:", err)
+		slog.Error("gRPC server failed", "err", err)
+		os.Exit(1)
+	}
+
+	// Wait for a termination signal, then archive what the rooms still hold
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.Duration("SHUTDOWN_TIMEOUT", 10*time.Second))
+	defer cancel()
+	// Event streams last until the hub closes them, so stop it while the server waits for them
+	hubStopped := make(chan struct{})
+	server.RegisterOnShutdown(func() {
+		hub.Shutdown(shutdownCtx)
+		close(hubStopped)
+	})
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown error", "err", err)
+	}
+	<-hubStopped
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
 	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"chat-app/chat"
+	"chat-app/internal/env"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Default port for the chosen mode, used when PORT isn't set
+func defaultPort() string {
+	if env.Bool("AUTOCERT", false) {
+		return "443"
+	}
+	return "8080" // Fallback port for local testing
+}
+
+// Serve plain HTTP, HTTPS from TLS_CERT and TLS_KEY, or with AUTOCERT HTTPS with
+// certificates from Let's Encrypt, until the server is shut down
+func listen(server *http.Server) error {
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	switch {
+	case env.Bool("AUTOCERT", false):
+		hosts := os.Getenv("AUTOCERT_DOMAINS")
+		if hosts == "" {
+			return errors.New("-autocert needs -domains or AUTOCERT_DOMAINS")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(hosts, ",")...),
+			Cache:      autocert.DirCache(env.String("AUTOCERT_CACHE", "certs")),
+		}
+		// Let's Encrypt checks the HTTP-01 challenge on port 80; everything else there goes to HTTPS
+		go func() {
+			err := http.ListenAndServe(":"+env.String("HTTP_PORT", "80"), manager.HTTPHandler(nil))
+			slog.Error("ACME challenge listener stopped", "err", err)
+		}()
+		server.TLSConfig = manager.TLSConfig()
+		return server.ListenAndServeTLS("", "")
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return errors.New("TLS needs both -cert and -key")
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// Serve the hub over gRPC on GRPC_PORT, with TLS from TLS_CERT and TLS_KEY
+// when they are set; no server is started without a port
+func listenGRPC(hub *chat.Hub) (*grpc.Server, error) {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		return nil, nil
+	}
+	var opts []grpc.ServerOption
+	if certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"); certFile != "" && keyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(os.Getenv("HOST"), port))
+	if err != nil {
+		return nil, err
+	}
+	server := hub.NewGRPCServer(opts...)
+	go func() {
+		slog.Info("gRPC server started", "port", port)
+		if err := server.Serve(listener); err != nil {
+			slog.Error("gRPC server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+	return server, nil
+}